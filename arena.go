@@ -0,0 +1,176 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Alignment of the items carved from an arena
+const arenaAlign = 8
+
+// Arena is a caller-provided region of memory from which a writer carves the
+// copies of inserted items, e.g., for burst ingestion. Carving an item only
+// bumps an offset and freeing it only decrements a count, the arena is
+// reclaimed as a whole when it is detached from its writer and all its items
+// have been freed.
+type Arena struct {
+	buf  []byte
+	base uintptr
+	off  int
+
+	// Items which have not been freed, plus one while attached to a writer
+	live int64
+
+	onReclaim func(buf []byte)
+}
+
+// NewArena creates an arena carving items from buf. onReclaim is called with
+// buf, by a free worker or by Close, once no item of the arena is in use
+// anymore.
+func NewArena(buf []byte, onReclaim func(buf []byte)) *Arena {
+	a := &Arena{buf: buf, onReclaim: onReclaim}
+	if len(buf) > 0 {
+		a.base = uintptr(unsafe.Pointer(&buf[0]))
+	}
+	return a
+}
+
+// Used returns the number of bytes carved from the arena
+func (a *Arena) Used() int {
+	return a.off
+}
+
+func (a *Arena) contains(p uintptr) bool {
+	return p >= a.base && p < a.base+uintptr(len(a.buf))
+}
+
+// alloc carves an item of l bytes, it returns nil if the arena is full
+func (a *Arena) alloc(l int) *Item {
+	sz := int(itemHeaderSize) + l
+	off := (a.off + arenaAlign - 1) &^ (arenaAlign - 1)
+	if off+sz > len(a.buf) {
+		return nil
+	}
+
+	a.off = off + sz
+	atomic.AddInt64(&a.live, 1)
+	itm := (*Item)(unsafe.Pointer(&a.buf[off]))
+	itm.bornSn = 0
+	itm.deadSn = 0
+	itm.dataLen = uint32(l)
+	return itm
+}
+
+// arenaRegistry holds the arenas of an instance with items in use, ordered
+// by address, so that freed items can be returned to their arena
+type arenaRegistry struct {
+	sync.RWMutex
+	count  int32
+	arenas []*Arena
+}
+
+func (r *arenaRegistry) add(a *Arena) {
+	r.Lock()
+	defer r.Unlock()
+
+	i := sort.Search(len(r.arenas), func(i int) bool {
+		return r.arenas[i].base >= a.base
+	})
+	r.arenas = append(r.arenas, nil)
+	copy(r.arenas[i+1:], r.arenas[i:])
+	r.arenas[i] = a
+	atomic.AddInt32(&r.count, 1)
+}
+
+func (r *arenaRegistry) lookup(p uintptr) *Arena {
+	r.RLock()
+	defer r.RUnlock()
+
+	i := sort.Search(len(r.arenas), func(i int) bool {
+		return r.arenas[i].base > p
+	})
+	if i > 0 && r.arenas[i-1].contains(p) {
+		return r.arenas[i-1]
+	}
+	return nil
+}
+
+// release drops a reference to the arena and reclaims it with the last one
+func (r *arenaRegistry) release(a *Arena) {
+	if atomic.AddInt64(&a.live, -1) != 0 {
+		return
+	}
+
+	r.Lock()
+	for i, x := range r.arenas {
+		if x == a {
+			r.arenas = append(r.arenas[:i], r.arenas[i+1:]...)
+			atomic.AddInt32(&r.count, -1)
+			break
+		}
+	}
+	r.Unlock()
+
+	if a.onReclaim != nil {
+		a.onReclaim(a.buf)
+	}
+}
+
+// freeArenaItem returns an item to its arena, it returns false if the item
+// was not carved from an arena
+func (m *Nitro) freeArenaItem(itm unsafe.Pointer) bool {
+	if atomic.LoadInt32(&m.arenas.count) == 0 {
+		return false
+	}
+
+	if a := m.arenas.lookup(uintptr(itm)); a != nil {
+		m.arenas.release(a)
+		return true
+	}
+	return false
+}
+
+// SetArena makes the writer carve the items it inserts from the arena,
+// falling back to the allocator of the instance once the arena is full. The
+// previous arena of the writer is detached, a nil arena only detaches it. An
+// arena may only be attached once. Arenas require UseMemoryMgmt, since items
+// are otherwise left to the Go garbage collector, and are ignored without it.
+func (w *Writer) SetArena(a *Arena) {
+	if !w.useMemoryMgmt {
+		return
+	}
+
+	if w.arena != nil {
+		w.arenas.release(w.arena)
+	}
+
+	w.arena = a
+	if a != nil {
+		atomic.AddInt64(&a.live, 1)
+		w.arenas.add(a)
+	}
+}
+
+// newWriterItem copies an item into the arena of the writer, if it has room
+func (w *Writer) newWriterItem(bs []byte) *Item {
+	if w.arena != nil {
+		if itm := w.arena.alloc(len(bs) + w.itemMetaSize); itm != nil {
+			itm.dataLen = uint32(len(bs))
+			copy(itm.Bytes(), bs)
+			w.zeroMetadata(itm)
+			return itm
+		}
+	}
+	return w.newItem(bs, w.useMemoryMgmt)
+}
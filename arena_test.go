@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestArena(t *testing.T) {
+	var reclaimed int32
+	onReclaim := func([]byte) {
+		atomic.AddInt32(&reclaimed, 1)
+	}
+
+	db := NewWithConfig(testConf)
+	w := db.NewWriter()
+	a := NewArena(make([]byte, 16<<10), onReclaim)
+	w.SetArena(a)
+
+	// Items beyond the arena come from the allocator
+	n := 1000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	w.Put([]byte(fmt.Sprintf("%010d", 0)))
+	if a.Used() == 0 || a.Used() > 16<<10 {
+		t.Errorf("Unexpected arena usage %d", a.Used())
+	}
+
+	snap, _ := db.NewSnapshot()
+	if got := CountItems(snap); got != n {
+		t.Errorf("Expected %d items, got %d", n, got)
+	}
+	snap.Close()
+
+	for i := 0; i < n; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	w.SetArena(NewArena(make([]byte, 16<<10), onReclaim))
+	w.Put([]byte("item"))
+
+	// The arena is reclaimed once the deleted items are freed
+	for i := 0; i < 2; i++ {
+		snap, _ = db.NewSnapshot()
+		snap.Close()
+	}
+	db.GC()
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&reclaimed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&reclaimed); got != 1 {
+		t.Errorf("Expected the first arena to be reclaimed, got %d", got)
+	}
+
+	db.Close()
+	if got := atomic.LoadInt32(&reclaimed); got != 2 {
+		t.Errorf("Expected Close to reclaim the second arena, got %d", got)
+	}
+}
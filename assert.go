@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// Assertions validate the usage of the API, e.g., that writers are not
+// shared by goroutines and snapshots are not released more often than they
+// are opened. They are compiled in with the nitro_debug build tag and checked
+// in debug mode, see Debug.
+
+// assertionsOn reports whether assertions are checked
+func assertionsOn() bool {
+	return assertionsEnabled && debugMode
+}
+
+// assertFail panics with a message describing the misuse
+func assertFail(format string, args ...interface{}) {
+	panic("nitro: assertion failed: " + fmt.Sprintf(format, args...))
+}
+
+// goid returns the id of the calling goroutine
+func goid() int64 {
+	var buf [64]byte
+	bs := buf[:runtime.Stack(buf[:], false)]
+	bs = bytes.TrimPrefix(bs, []byte("goroutine "))
+	if i := bytes.IndexByte(bs, ' '); i > 0 {
+		bs = bs[:i]
+	}
+
+	id, _ := strconv.ParseInt(string(bs), 10, 64)
+	return id
+}
+
+// enter marks the writer as used by the calling goroutine. It returns
+// whether the matching exit releases the writer, nested calls do not.
+func (w *Writer) enter() bool {
+	if !assertionsOn() {
+		return false
+	}
+
+	id := goid()
+	if atomic.CompareAndSwapInt64(&w.owner, 0, id) {
+		return true
+	}
+
+	if owner := atomic.LoadInt64(&w.owner); owner != id {
+		assertFail("Writer used by goroutine %d while goroutine %d uses it, "+
+			"writers are not thread-safe, create a writer per goroutine", id, owner)
+	}
+
+	return false
+}
+
+func (w *Writer) exit(release bool) {
+	if release {
+		atomic.StoreInt64(&w.owner, 0)
+	}
+}
+
+// assertNoActiveWriters panics if a writer is used while a snapshot is created
+func (m *Nitro) assertNoActiveWriters() {
+	for w := m.wlist; w != nil; w = w.next {
+		if owner := atomic.LoadInt64(&w.owner); owner != 0 {
+			assertFail("NewSnapshot called while goroutine %d uses a writer, "+
+				"snapshots have to be created while no writer is in use", owner)
+		}
+	}
+}
+
+// assertRefCount panics if a snapshot is released more often than opened
+func (s *Snapshot) assertRefCount(refCount int32) {
+	if refCount >= 0 {
+		return
+	}
+
+	var stack []byte
+	if ci := (*closeInfo)(atomic.LoadPointer(&s.closed)); ci != nil {
+		stack = ci.stack
+	}
+
+	assertFail("Snapshot %d closed %d more times than it was opened, every "+
+		"NewSnapshot and successful Open needs exactly one Close, last reference "+
+		"released at:\n%s", s.sn, -refCount, stack)
+}
@@ -0,0 +1,55 @@
+// +build nitro_debug
+
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"strings"
+	"testing"
+)
+
+func expectAssertion(t *testing.T, msg string, fn func()) {
+	defer func() {
+		r := recover()
+		if s, ok := r.(string); !ok || !strings.Contains(s, msg) {
+			t.Errorf("Expected assertion %q, got %v", msg, r)
+		}
+	}()
+
+	fn()
+}
+
+func TestAssertions(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("item"))
+
+	// A writer used by another goroutine
+	w.owner = goid() + 1
+	expectAssertion(t, "writers are not thread-safe", func() {
+		w.Put([]byte("item2"))
+	})
+	expectAssertion(t, "no writer is in use", func() {
+		db.NewSnapshot()
+	})
+	w.owner = 0
+
+	snap1, _ := db.NewSnapshot()
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	snap1.Close()
+	expectAssertion(t, "closed 1 more times than it was opened", func() {
+		snap1.Close()
+	})
+}
@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/elliotcourant/nitro/skiplist"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
-const blockSize = 4096
-
 type itemOp int
 
 const (
@@ -20,6 +20,7 @@ type diskWriter struct {
 	shard      int
 	w          *Writer
 	rbuf, wbuf []byte
+	obuf       []byte
 
 	stats BatchOpStats
 }
@@ -53,10 +54,13 @@ func (r *BatchOpStats) ApplyDiff(a, b BatchOpStats) {
 }
 
 func (m *Nitro) newDiskWriter(shard int) *diskWriter {
+	w := m.NewWriter()
+	w.isInternal = true
 	return &diskWriter{
-		rbuf:  make([]byte, blockSize),
-		wbuf:  make([]byte, blockSize),
-		w:     m.NewWriter(),
+		rbuf:  make([]byte, m.blockDataSize),
+		wbuf:  make([]byte, m.blockDataSize),
+		obuf:  make([]byte, m.blockDataSize),
+		w:     w,
 		shard: shard,
 	}
 }
@@ -112,14 +116,14 @@ func (dw *diskWriter) batchModifyCallback(n *skiplist.Node, cmp skiplist.Compare
 	if n.Item() != skiplist.MinItem {
 		dw.w.DeleteNode(n)
 		dw.stats.BlocksRemoved++
-		err := dw.w.bm.ReadBlock(blockPtr(n.DataPtr), dw.rbuf)
+		err := dw.w.bm.ReadBlock(nodeBlockPtr(n), dw.rbuf)
 		if err != nil {
 			return err
 		}
-		db = newDataBlock(dw.rbuf)
+		db = newDataBlock(dw.rbuf, dw.w.bm)
 	}
 
-	wblock := newDataBlock(dw.wbuf)
+	wblock := newDataBlock(dw.wbuf, dw.w.bm)
 
 	flushBlock := func() error {
 		bptr, err := dw.w.bm.WriteBlock(wblock.Bytes(), dw.shard)
@@ -128,7 +132,7 @@ func (dw *diskWriter) batchModifyCallback(n *skiplist.Node, cmp skiplist.Compare
 			if indexNode == nil {
 				panic("index node creation should not fail")
 			}
-			indexNode.DataPtr = uint64(bptr)
+			setNodeBlockPtr(indexNode, bptr)
 			wblock.Reset()
 			dw.stats.BlocksWritten++
 		}
@@ -137,18 +141,35 @@ func (dw *diskWriter) batchModifyCallback(n *skiplist.Node, cmp skiplist.Compare
 	}
 
 	doWriteItem := func(itm []byte) error {
+		if len(itm) > dw.w.MaxItemSize() {
+			return ErrItemTooLarge
+		}
+
+		// Items which do not fit into a block are stored in overflow
+		// blocks and referenced by a stub
+		entry, write := itm, wblock.Write
+		if len(itm) > wblock.maxInlineItemSize() {
+			stub, err := writeOverflow(dw.w.bm, itm, dw.shard, dw.obuf)
+			if err != nil {
+				return err
+			}
+
+			atomic.StoreInt32(&dw.w.hasOverflowItems, 1)
+			entry, write = stub, wblock.WriteOverflow
+		}
+
 		if indexItem == nil {
 			indexItem = itm
 		}
 
 		dw.stats.ItemsWritten++
-		if err := wblock.Write(itm); err == errBlockFull {
+		if err := write(entry); err == errBlockFull {
 			if err := flushBlock(); err != nil {
 				return err
 			}
 
 			indexItem = itm
-			return wblock.Write(itm)
+			return write(entry)
 		}
 
 		return nil
@@ -175,11 +196,12 @@ func (dw *diskWriter) batchModifyCallback(n *skiplist.Node, cmp skiplist.Compare
 			nItm = db.Get()
 			break
 		default:
+			// Deletes of missing items are ignored
 			if opItr.Op() == itemInsertop {
 				err = doWriteItem(opItm)
 				dw.stats.ItemsInserted++
-				opItr.Next()
 			}
+			opItr.Next()
 		}
 	}
 
@@ -197,6 +219,11 @@ func (dw *diskWriter) batchModifyCallback(n *skiplist.Node, cmp skiplist.Compare
 		err = doWriteItem(nItm)
 	}
 
+	// The rest of the items of a block which cannot be read would be lost
+	if err == nil && db != nil {
+		err = db.err
+	}
+
 	if err != nil {
 		return err
 	}
@@ -257,9 +284,70 @@ func (m *Nitro) newBatchOpIterator(it *Iterator) BatchOpIterator {
 	return bItr
 }
 
+// modify passes functions which insert or replace and delete items of the
+// instance to fn. Instances with a block store are only modified through
+// ApplyOps, so the operations are collected in a temporary instance first
+// and applied by concurr workers. The changes are visible in the next
+// snapshot.
+func (m *Nitro) modify(concurr int, fn func(put, del func([]byte)) error) error {
+	if !m.HasBlockStore() {
+		w := m.NewWriter()
+		return fn(func(bs []byte) { w.Upsert(bs) },
+			func(bs []byte) { w.Delete(bs) })
+	}
+
+	conf := DefaultConfig()
+	conf.SetKeyComparator(m.keyCmp)
+	ops := NewWithConfig(conf)
+	defer ops.Close()
+
+	w := ops.NewWriter()
+	if err := fn(func(bs []byte) { w.Upsert(bs) },
+		func(bs []byte) { w.DeleteNonExist(bs) }); err != nil {
+		return err
+	}
+
+	snap, err := ops.NewSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	_, err = m.ApplyOps(snap, concurr)
+	return err
+}
+
+// ApplyOps applies a batch of operations to an instance with a block store.
+// The items of snap replace the items with the same key and the delete
+// markers created in its instance with DeleteNonExist remove them.
 func (m *Nitro) ApplyOps(snap *Snapshot, concurr int) (BatchOpStats, error) {
-	var err error
-	var stats BatchOpStats
+	return m.applyOps(concurr, func(start, end *Item) (BatchOpIterator, error) {
+		itr := snap.NewIterator()
+		itr.withMarkers = true
+		itr.Seek(start.Bytes())
+		itr.SetEnd(end.Bytes())
+		return m.newBatchOpIterator(itr), nil
+	})
+}
+
+// applyOps applies the operations returned by the iterators of newOpItr to
+// the key ranges [start, end) of the partitions of the store. A nil start or
+// end item denotes an unbounded range.
+func (m *Nitro) applyOps(concurr int,
+	newOpItr func(start, end *Item) (BatchOpIterator, error)) (stats BatchOpStats, err error) {
+
+	began := time.Now()
+	defer func() {
+		m.recordOperation(OpApplyOps, began, stats.ItemsInserted+stats.ItemsRemoved, err)
+	}()
+
+	if err := m.enterWrite(true); err != nil {
+		return stats, err
+	}
+	defer m.exitWrite()
+
+	m.compactor.Lock()
+	defer m.compactor.Unlock()
 
 	w := m.NewWriter()
 	currSnap := &Snapshot{db: m, sn: m.getCurrSn(), refCount: 1}
@@ -267,16 +355,21 @@ func (m *Nitro) ApplyOps(snap *Snapshot, concurr int) (BatchOpStats, error) {
 
 	beforeStats := make([]BatchOpStats, len(pivots)-1)
 	errors := make([]chan error, len(pivots)-1)
+	opItrs := make([]BatchOpIterator, len(pivots)-1)
 
-	for i := 0; i < len(pivots)-1; i++ {
+	for i := range opItrs {
+		opItr, err := newOpItr(pivots[i], pivots[i+1])
+		if err != nil {
+			return stats, err
+		}
+		defer opItr.Close()
+		opItrs[i] = opItr
+	}
+
+	for i, opItr := range opItrs {
 		errors[i] = make(chan error, 1)
 		beforeStats[i] = m.shardWrs[i].stats
 
-		itr := snap.NewIterator()
-		itr.Seek(pivots[i].Bytes())
-		itr.SetEnd(pivots[i+1].Bytes())
-		opItr := m.newBatchOpIterator(itr)
-		defer opItr.Close()
 		head := w.GetNode(pivots[i].Bytes())
 		tail := w.GetNode(pivots[i+1].Bytes())
 
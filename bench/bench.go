@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package bench provides reproducible workloads for benchmarking Nitro.
+//
+// The benchmarks in this package are parameterized by key size, number of
+// concurrent writers or readers and the memory allocator. Run them with
+//
+//	go test -bench . github.com/elliotcourant/nitro/bench
+package bench
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/elliotcourant/nitro"
+	"github.com/elliotcourant/nitro/mm"
+)
+
+// Options describes benchmark parameters
+type Options struct {
+	// KeySize is the size of generated items in bytes (minimum 8)
+	KeySize int
+	// Concurrency is the number of concurrent writers or readers
+	Concurrency int
+	// UseMemoryMgmt enables the mm allocator for items and nodes
+	UseMemoryMgmt bool
+	// Seed is used for deterministic random key generation
+	Seed int64
+}
+
+// DefaultOptions returns the default benchmark parameters
+func DefaultOptions() Options {
+	return Options{
+		KeySize:     16,
+		Concurrency: 1,
+		Seed:        1,
+	}
+}
+
+func (o Options) String() string {
+	alloc := "go"
+	if o.UseMemoryMgmt {
+		alloc = "mm"
+	}
+	return fmt.Sprintf("keysize=%d/concurrency=%d/alloc=%s", o.KeySize, o.Concurrency, alloc)
+}
+
+// Config returns the Nitro configuration for the options
+func (o Options) Config() nitro.Config {
+	cfg := nitro.DefaultConfig()
+	if o.UseMemoryMgmt {
+		cfg.UseMemoryMgmt(mm.Malloc, mm.Free)
+	}
+	return cfg
+}
+
+// Matrix returns the default set of options benchmarks are run with
+func Matrix() []Options {
+	var opts []Options
+	for _, keySize := range []int{16, 128} {
+		for _, concurrency := range []int{1, 4} {
+			for _, useMM := range []bool{false, true} {
+				o := DefaultOptions()
+				o.KeySize = keySize
+				o.Concurrency = concurrency
+				o.UseMemoryMgmt = useMM
+				opts = append(opts, o)
+			}
+		}
+	}
+	return opts
+}
+
+// Key fills buf with the key for the item number i. Keys sort in the order
+// of i and buf should be at least 8 bytes long.
+func Key(buf []byte, i uint64) []byte {
+	binary.BigEndian.PutUint64(buf[:8], i)
+	for x := 8; x < len(buf); x++ {
+		buf[x] = byte(i >> uint(x%8*8))
+	}
+	return buf
+}
+
+// NewKeyBuf returns a key buffer for the options
+func (o Options) NewKeyBuf() []byte {
+	sz := o.KeySize
+	if sz < 8 {
+		sz = 8
+	}
+	return make([]byte, sz)
+}
+
+// Load inserts items [0, n) into db using opts.Concurrency writers
+func Load(db *nitro.Nitro, n int, opts Options) {
+	var wg sync.WaitGroup
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	per := n / concurrency
+	for i := 0; i < concurrency; i++ {
+		start, end := i*per, (i+1)*per
+		if i == concurrency-1 {
+			end = n
+		}
+
+		w := db.NewWriter()
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			buf := opts.NewKeyBuf()
+			for x := start; x < end; x++ {
+				w.Put(Key(buf, uint64(x)))
+			}
+		}(start, end)
+	}
+
+	wg.Wait()
+}
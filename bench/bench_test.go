@@ -0,0 +1,282 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bench
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/elliotcourant/nitro"
+)
+
+const preloadItems = 100000
+
+// runParallel splits b.N operations between opts.Concurrency goroutines
+func runParallel(b *testing.B, opts Options, fn func(id, start, end int)) {
+	var wg sync.WaitGroup
+	per := b.N / opts.Concurrency
+	for i := 0; i < opts.Concurrency; i++ {
+		start, end := i*per, (i+1)*per
+		if i == opts.Concurrency-1 {
+			end = b.N
+		}
+
+		wg.Add(1)
+		go func(id, start, end int) {
+			defer wg.Done()
+			fn(id, start, end)
+		}(i, start, end)
+	}
+	wg.Wait()
+}
+
+func forEachOption(b *testing.B, fn func(b *testing.B, opts Options)) {
+	for _, opts := range Matrix() {
+		opts := opts
+		b.Run(opts.String(), func(b *testing.B) {
+			fn(b, opts)
+		})
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	forEachOption(b, func(b *testing.B, opts Options) {
+		db := nitro.NewWithConfig(opts.Config())
+		defer db.Close()
+
+		writers := make([]*nitro.Writer, opts.Concurrency)
+		for i := range writers {
+			writers[i] = db.NewWriter()
+		}
+
+		b.ResetTimer()
+		runParallel(b, opts, func(id, start, end int) {
+			buf := opts.NewKeyBuf()
+			for i := start; i < end; i++ {
+				writers[id].Put(Key(buf, uint64(i)))
+			}
+		})
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	forEachOption(b, func(b *testing.B, opts Options) {
+		db := nitro.NewWithConfig(opts.Config())
+		defer db.Close()
+		Load(db, preloadItems, opts)
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+
+		b.ResetTimer()
+		runParallel(b, opts, func(id, start, end int) {
+			rnd := rand.New(rand.NewSource(opts.Seed + int64(id)))
+			buf := opts.NewKeyBuf()
+			itr := snap.NewIterator()
+			defer itr.Close()
+			for i := start; i < end; i++ {
+				itr.Seek(Key(buf, uint64(rnd.Intn(preloadItems))))
+				if !itr.Valid() {
+					b.Errorf("Expected to find item")
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkScan(b *testing.B) {
+	forEachOption(b, func(b *testing.B, opts Options) {
+		db := nitro.NewWithConfig(opts.Config())
+		defer db.Close()
+		Load(db, preloadItems, opts)
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+
+		b.ResetTimer()
+		runParallel(b, opts, func(id, start, end int) {
+			itr := snap.NewIterator()
+			defer itr.Close()
+			itr.SeekFirst()
+			for i := start; i < end; i++ {
+				if !itr.Valid() {
+					itr.SeekFirst()
+				}
+				itr.Get()
+				itr.Next()
+			}
+		})
+	})
+}
+
+func BenchmarkMixed(b *testing.B) {
+	forEachOption(b, func(b *testing.B, opts Options) {
+		db := nitro.NewWithConfig(opts.Config())
+		defer db.Close()
+		Load(db, preloadItems, opts)
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+
+		writers := make([]*nitro.Writer, opts.Concurrency)
+		for i := range writers {
+			writers[i] = db.NewWriter()
+		}
+
+		b.ResetTimer()
+		runParallel(b, opts, func(id, start, end int) {
+			rnd := rand.New(rand.NewSource(opts.Seed + int64(id)))
+			buf := opts.NewKeyBuf()
+			itr := snap.NewIterator()
+			defer itr.Close()
+			for i := start; i < end; i++ {
+				if i%2 == 0 {
+					itr.Seek(Key(buf, uint64(rnd.Intn(preloadItems))))
+				} else {
+					writers[id].Put(Key(buf, uint64(preloadItems+i)))
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkGCHeavy replaces items and creates snapshots so that garbage
+// collection of dead items runs concurrently with the writers.
+func BenchmarkGCHeavy(b *testing.B) {
+	forEachOption(b, func(b *testing.B, opts Options) {
+		db := nitro.NewWithConfig(opts.Config())
+		defer db.Close()
+		Load(db, preloadItems, opts)
+
+		writers := make([]*nitro.Writer, opts.Concurrency)
+		for i := range writers {
+			writers[i] = db.NewWriter()
+		}
+
+		const batch = 10000
+		b.ResetTimer()
+		for done := 0; done < b.N; done += batch {
+			n := batch
+			if b.N-done < n {
+				n = b.N - done
+			}
+
+			var wg sync.WaitGroup
+			per := n/opts.Concurrency + 1
+			for id := 0; id < opts.Concurrency; id++ {
+				wg.Add(1)
+				go func(id int) {
+					defer wg.Done()
+					buf := opts.NewKeyBuf()
+					for i := id * per; i < (id+1)*per && i < n; i++ {
+						key := Key(buf, uint64((done+i)%preloadItems))
+						writers[id].Delete(key)
+						writers[id].Put(key)
+					}
+				}(id)
+			}
+			wg.Wait()
+
+			snap, _ := db.NewSnapshot()
+			snap.Close()
+		}
+	})
+}
+
+// BenchmarkApplyOps measures batch application of a snapshot into a block
+// store backed instance.
+func BenchmarkApplyOps(b *testing.B) {
+	opts := DefaultOptions()
+	opts.UseMemoryMgmt = true
+
+	dir, err := ioutil.TempDir("", "nitro-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := opts.Config()
+	cfg.SetBlockStoreDir(dir)
+	db := nitro.NewWithConfig(cfg)
+	defer db.Close()
+
+	tdb := nitro.NewWithConfig(opts.Config())
+	defer tdb.Close()
+	Load(tdb, b.N, opts)
+	snap, _ := tdb.NewSnapshot()
+	defer snap.Close()
+
+	b.ResetTimer()
+	if _, err := db.ApplyOps(snap, 8); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestGeneratorMix(t *testing.T) {
+	w := WorkloadB
+	w.RecordCount = 1000
+	records := uint64(w.RecordCount)
+	g := NewGenerator(w, 1, &records)
+
+	var counts [numOpTypes]int
+	const n = 100000
+	for i := 0; i < n; i++ {
+		op := g.Next()
+		if op.Key >= records {
+			t.Fatalf("key %d out of range %d", op.Key, records)
+		}
+		counts[op.Type]++
+	}
+
+	if r := float64(counts[OpRead]) / n; r < 0.93 || r > 0.97 {
+		t.Errorf("unexpected read proportion %f", r)
+	}
+}
+
+func TestGeneratorZipfianSkew(t *testing.T) {
+	w := WorkloadC
+	w.RecordCount = 10000
+	records := uint64(w.RecordCount)
+	g := NewGenerator(w, 1, &records)
+
+	freq := make(map[uint64]int)
+	const n = 100000
+	for i := 0; i < n; i++ {
+		freq[g.Next().Key]++
+	}
+
+	max := 0
+	for _, c := range freq {
+		if c > max {
+			max = c
+		}
+	}
+
+	// A uniform distribution would yield ~10 hits per key
+	if max < 1000 {
+		t.Errorf("expected skewed distribution, hottest key hit %d times", max)
+	}
+}
+
+func BenchmarkWorkloads(b *testing.B) {
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		w := Workloads()[name]
+		b.Run(name, func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.Concurrency = 4
+			db := nitro.NewWithConfig(opts.Config())
+			defer db.Close()
+
+			Load(db, w.RecordCount, opts)
+			b.ResetTimer()
+			Run(db, w, opts, b.N, false)
+		})
+	}
+}
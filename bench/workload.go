@@ -0,0 +1,316 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bench
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elliotcourant/nitro"
+)
+
+// OpType is a workload operation type
+type OpType int
+
+const (
+	// OpRead looks up an item
+	OpRead OpType = iota
+	// OpUpdate replaces an existing item
+	OpUpdate
+	// OpInsert inserts a new item
+	OpInsert
+	// OpScan reads a range of items
+	OpScan
+	numOpTypes
+)
+
+var opNames = [numOpTypes]string{"read", "update", "insert", "scan"}
+
+func (t OpType) String() string {
+	return opNames[t]
+}
+
+// Key distributions
+const (
+	Uniform = "uniform"
+	Zipfian = "zipfian"
+	Latest  = "latest"
+)
+
+// DefaultRecordCount is the number of records loaded by the standard workloads
+const DefaultRecordCount = 100000
+
+// Workload describes a YCSB style operation mix. The proportions should add
+// up to 1 and Distribution selects how keys for reads, updates and scans are
+// chosen.
+type Workload struct {
+	Name             string
+	ReadProportion   float64
+	UpdateProportion float64
+	InsertProportion float64
+	ScanProportion   float64
+	Distribution     string
+	RecordCount      int
+	MaxScanLength    int
+}
+
+// Standard YCSB core workloads
+var (
+	WorkloadA = Workload{Name: "a", ReadProportion: 0.5, UpdateProportion: 0.5, Distribution: Zipfian, RecordCount: DefaultRecordCount}
+	WorkloadB = Workload{Name: "b", ReadProportion: 0.95, UpdateProportion: 0.05, Distribution: Zipfian, RecordCount: DefaultRecordCount}
+	WorkloadC = Workload{Name: "c", ReadProportion: 1, Distribution: Zipfian, RecordCount: DefaultRecordCount}
+	WorkloadD = Workload{Name: "d", ReadProportion: 0.95, InsertProportion: 0.05, Distribution: Latest, RecordCount: DefaultRecordCount}
+	WorkloadE = Workload{Name: "e", ScanProportion: 0.95, InsertProportion: 0.05, Distribution: Zipfian, MaxScanLength: 100, RecordCount: DefaultRecordCount}
+)
+
+// Workloads returns the standard workloads by name
+func Workloads() map[string]Workload {
+	return map[string]Workload{
+		"a": WorkloadA,
+		"b": WorkloadB,
+		"c": WorkloadC,
+		"d": WorkloadD,
+		"e": WorkloadE,
+	}
+}
+
+// Op is a generated workload operation
+type Op struct {
+	Type       OpType
+	Key        uint64
+	ScanLength int
+}
+
+const zipfianTheta = 0.99
+
+// zipfian generates items in [0, n) following a zipfian distribution using
+// the algorithm from Gray et al, "Quickly generating billion-record synthetic
+// databases", as used by YCSB.
+type zipfian struct {
+	n                 uint64
+	theta, alpha, eta float64
+	zetan, zeta2theta float64
+	countForZeta      uint64
+	halfPowTheta      float64
+}
+
+func zeta(start, n uint64, theta, initial float64) float64 {
+	sum := initial
+	for i := start; i < n; i++ {
+		sum += 1 / math.Pow(float64(i+1), theta)
+	}
+	return sum
+}
+
+func newZipfian(n uint64) *zipfian {
+	z := &zipfian{n: n, theta: zipfianTheta}
+	z.zeta2theta = zeta(0, 2, z.theta, 0)
+	z.alpha = 1 / (1 - z.theta)
+	z.zetan = zeta(0, n, z.theta, 0)
+	z.countForZeta = n
+	z.halfPowTheta = 1 + math.Pow(0.5, z.theta)
+	z.eta = (1 - math.Pow(2/float64(n), 1-z.theta)) / (1 - z.zeta2theta/z.zetan)
+	return z
+}
+
+// grow incrementally extends the item space to n items
+func (z *zipfian) grow(n uint64) {
+	if n > z.countForZeta {
+		z.zetan = zeta(z.countForZeta, n, z.theta, z.zetan)
+		z.countForZeta = n
+		z.n = n
+		z.eta = (1 - math.Pow(2/float64(n), 1-z.theta)) / (1 - z.zeta2theta/z.zetan)
+	}
+}
+
+func (z *zipfian) next(rnd *rand.Rand) uint64 {
+	u := rnd.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+
+	if uz < z.halfPowTheta {
+		return 1
+	}
+
+	return uint64(float64(z.n) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+}
+
+// Generator produces workload operations. A generator is not thread-safe
+// and every concurrent client should use its own generator.
+type Generator struct {
+	w       Workload
+	rnd     *rand.Rand
+	zipf    *zipfian
+	records *uint64
+}
+
+// NewGenerator creates an operation generator. The records counter holds the
+// number of loaded records and is shared between generators so that inserted
+// keys are unique.
+func NewGenerator(w Workload, seed int64, records *uint64) *Generator {
+	g := &Generator{
+		w:       w,
+		rnd:     rand.New(rand.NewSource(seed)),
+		records: records,
+	}
+
+	if w.Distribution == Zipfian || w.Distribution == Latest {
+		g.zipf = newZipfian(atomic.LoadUint64(records))
+	}
+
+	return g
+}
+
+func (g *Generator) nextKey() uint64 {
+	n := atomic.LoadUint64(g.records)
+	if n == 0 {
+		return 0
+	}
+
+	switch g.w.Distribution {
+	case Zipfian:
+		g.zipf.grow(n)
+		// Scatter popular items across the key space
+		return fnvHash64(g.zipf.next(g.rnd)) % n
+	case Latest:
+		g.zipf.grow(n)
+		return n - 1 - g.zipf.next(g.rnd)%n
+	default:
+		return uint64(g.rnd.Int63n(int64(n)))
+	}
+}
+
+// Next returns the next operation
+func (g *Generator) Next() Op {
+	w := g.w
+	r := g.rnd.Float64()
+	switch {
+	case r < w.ReadProportion:
+		return Op{Type: OpRead, Key: g.nextKey()}
+	case r < w.ReadProportion+w.UpdateProportion:
+		return Op{Type: OpUpdate, Key: g.nextKey()}
+	case r < w.ReadProportion+w.UpdateProportion+w.InsertProportion:
+		return Op{Type: OpInsert, Key: atomic.AddUint64(g.records, 1) - 1}
+	default:
+		l := w.MaxScanLength
+		if l < 1 {
+			l = 1
+		}
+		return Op{Type: OpScan, Key: g.nextKey(), ScanLength: 1 + g.rnd.Intn(l)}
+	}
+}
+
+func fnvHash64(v uint64) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		h ^= v & 0xff
+		h *= 1099511628211
+		v >>= 8
+	}
+	return h
+}
+
+// Result holds the outcome of a workload run
+type Result struct {
+	Ops      [numOpTypes]int64
+	Duration time.Duration
+}
+
+// Total returns the total number of operations executed
+func (r Result) Total() int64 {
+	var total int64
+	for _, c := range r.Ops {
+		total += c
+	}
+	return total
+}
+
+func (r Result) String() string {
+	str := fmt.Sprintf("duration = %v\nthroughput = %.0f ops/s\n",
+		r.Duration, float64(r.Total())/r.Duration.Seconds())
+	for i, c := range r.Ops {
+		str += fmt.Sprintf("%-6s = %d\n", OpType(i), c)
+	}
+	return str
+}
+
+// Run loads w.RecordCount records into db unless they are already present and
+// executes ops operations using opts.Concurrency clients.
+func Run(db *nitro.Nitro, w Workload, opts Options, ops int, load bool) Result {
+	var wg sync.WaitGroup
+	var res Result
+
+	if load {
+		Load(db, w.RecordCount, opts)
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	records := uint64(w.RecordCount)
+	snap, _ := db.NewSnapshot()
+	t0 := time.Now()
+	per := ops / concurrency
+	for id := 0; id < concurrency; id++ {
+		n := per
+		if id == concurrency-1 {
+			n = ops - per*(concurrency-1)
+		}
+
+		wr := db.NewWriter()
+		g := NewGenerator(w, opts.Seed+int64(id), &records)
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var counts [numOpTypes]int64
+
+			buf := opts.NewKeyBuf()
+			itr := snap.NewIterator()
+			defer itr.Close()
+			for i := 0; i < n; i++ {
+				op := g.Next()
+				key := Key(buf, op.Key)
+				switch op.Type {
+				case OpRead:
+					itr.Seek(key)
+				case OpUpdate:
+					wr.Upsert(key)
+				case OpInsert:
+					wr.Put(key)
+				case OpScan:
+					itr.Seek(key)
+					for x := 0; x < op.ScanLength && itr.Valid(); x++ {
+						itr.Get()
+						itr.Next()
+					}
+				}
+				counts[op.Type]++
+			}
+
+			for i, c := range counts {
+				atomic.AddInt64(&res.Ops[i], c)
+			}
+		}(n)
+	}
+
+	wg.Wait()
+	res.Duration = time.Since(t0)
+	snap.Close()
+
+	return res
+}
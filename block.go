@@ -3,23 +3,77 @@ package nitro
 import (
 	"encoding/binary"
 	"errors"
+	"sync/atomic"
 )
 
 var (
 	errBlockFull = errors.New("Block full")
+
+	// ErrBlockCorrupt means a data block or an overflow block chain of the
+	// block store could not be decoded
+	ErrBlockCorrupt = errors.New("Block is corrupt")
 )
 
 type blockPtr uint64
 
+const (
+	defaultBlockSize = 4096
+	minBlockSize     = 512
+	// Entry lengths are stored in 15 bits
+	maxBlockSize = 32768
+
+	// overflowFlag marks a block entry as the stub of an item which is
+	// stored in a chain of overflow blocks. The stub is laid out as
+	// [4 byte item len][8 byte first overflow block ptr] and every overflow
+	// block as [8 byte next overflow block ptr][item data].
+	overflowFlag       = 0x8000
+	overflowStubSize   = 12
+	overflowHeaderSize = 8
+
+	noBlock = ^blockPtr(0)
+)
+
 type dataBlock struct {
 	buf    []byte
 	offset int
+	bm     BlockManager
+
+	// Error decoding the block or reading an overflow item, which ends the
+	// entries of the block
+	err error
 }
 
-func newDataBlock(bs []byte) *dataBlock {
+func newDataBlock(bs []byte, bm BlockManager) *dataBlock {
 	return &dataBlock{
 		buf: bs[:cap(bs)],
+		bm:  bm,
+	}
+}
+
+// next returns the next raw block entry and whether it is an overflow stub
+func (db *dataBlock) next() (entry []byte, overflow bool) {
+	if db.offset+2 < len(db.buf) {
+		l := int(binary.BigEndian.Uint16(db.buf[db.offset : db.offset+2]))
+		if l == 0 {
+			db.offset = len(db.buf)
+			return nil, false
+		}
+
+		overflow = l&overflowFlag != 0
+		l &^= overflowFlag
+		if db.offset+2+l > len(db.buf) || (overflow && l != overflowStubSize) {
+			db.offset = len(db.buf)
+			db.err = ErrBlockCorrupt
+			return nil, false
+		}
+
+		db.offset += 2
+		offset := db.offset
+		db.offset += l
+		return db.buf[offset : offset+l], overflow
 	}
+
+	return nil, false
 }
 
 func (db *dataBlock) Get() []byte {
@@ -27,51 +81,62 @@ func (db *dataBlock) Get() []byte {
 		return nil
 	}
 
-	if db.offset+2 < blockSize {
-		l := int(binary.BigEndian.Uint16(db.buf[db.offset : db.offset+2]))
-		if l == 0 {
-			db.offset = blockSize
+	entry, overflow := db.next()
+	if overflow {
+		itm, err := readOverflow(db.bm, entry, len(db.buf))
+		if err != nil {
+			db.offset = len(db.buf)
+			db.err = err
 			return nil
 		}
-		db.offset += 2
-		offset := db.offset
-		db.offset += l
-		return db.buf[offset : offset+l]
+		return itm
 	}
 
-	return nil
+	return entry
 }
 
 func (db *dataBlock) GetItems() [][]byte {
 	var itms [][]byte
 
-	for offset := 0; offset+2 < blockSize; {
-		l := int(binary.BigEndian.Uint16(db.buf[offset : offset+2]))
-		if l == 0 {
-			break
-		}
-		offset += 2
-		itms = append(itms, db.buf[offset:offset+l])
-		offset += l
+	saved := db.offset
+	db.offset = 0
+	for itm := db.Get(); itm != nil; itm = db.Get() {
+		itms = append(itms, itm)
 	}
+	db.offset = saved
 
 	return itms
 }
 
-func (db *dataBlock) Write(itm []byte) error {
-	newLen := db.offset + 2 + len(itm)
+// maxInlineItemSize is the largest item stored within the block, leaving
+// space for its length and the block terminator
+func (db *dataBlock) maxInlineItemSize() int {
+	return len(db.buf) - 4
+}
+
+func (db *dataBlock) writeEntry(bs []byte, flag uint16) error {
+	newLen := db.offset + 2 + len(bs)
 	if newLen > len(db.buf) {
 		return errBlockFull
 	}
 
-	binary.BigEndian.PutUint16(db.buf[db.offset:db.offset+2], uint16(len(itm)))
+	binary.BigEndian.PutUint16(db.buf[db.offset:db.offset+2], uint16(len(bs))|flag)
 	db.offset += 2
-	copy(db.buf[db.offset:db.offset+len(itm)], itm)
-	db.offset += len(itm)
+	copy(db.buf[db.offset:db.offset+len(bs)], bs)
+	db.offset += len(bs)
 
 	return nil
 }
 
+func (db *dataBlock) Write(itm []byte) error {
+	return db.writeEntry(itm, 0)
+}
+
+// WriteOverflow writes the stub of an item stored in overflow blocks
+func (db *dataBlock) WriteOverflow(stub []byte) error {
+	return db.writeEntry(stub, overflowFlag)
+}
+
 func (db *dataBlock) IsEmpty() bool {
 	return db.offset == 0
 }
@@ -91,3 +156,103 @@ func (db *dataBlock) Bytes() []byte {
 
 	return db.buf[:offset]
 }
+
+// writeOverflow stores an item in a chain of overflow blocks and returns its
+// stub. The chain is written back to front, so that every block can refer to
+// its successor. buf has to be of the block size.
+func writeOverflow(bm BlockManager, itm []byte, shard int, buf []byte) ([]byte, error) {
+	next := noBlock
+	chunkSize := len(buf) - overflowHeaderSize
+	nchunks := (len(itm) + chunkSize - 1) / chunkSize
+	for i := nchunks - 1; i >= 0; i-- {
+		chunk := itm[i*chunkSize:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+
+		binary.BigEndian.PutUint64(buf[:overflowHeaderSize], uint64(next))
+		n := copy(buf[overflowHeaderSize:], chunk)
+		bptr, err := bm.WriteBlock(buf[:overflowHeaderSize+n], shard)
+		if err != nil {
+			return nil, err
+		}
+		next = bptr
+	}
+
+	stub := make([]byte, overflowStubSize)
+	binary.BigEndian.PutUint32(stub[0:4], uint32(len(itm)))
+	binary.BigEndian.PutUint64(stub[4:12], uint64(next))
+	return stub, nil
+}
+
+// readOverflow assembles an item from the overflow blocks of its stub
+func readOverflow(bm BlockManager, stub []byte, blockSize int) ([]byte, error) {
+	l := int(binary.BigEndian.Uint32(stub[0:4]))
+	bptr := blockPtr(binary.BigEndian.Uint64(stub[4:12]))
+	chunkSize := blockSize - overflowHeaderSize
+
+	itm := make([]byte, 0, l)
+	buf := make([]byte, blockSize)
+	for len(itm) < l {
+		if bptr == noBlock {
+			return nil, ErrBlockCorrupt
+		}
+
+		if err := bm.ReadBlock(bptr, buf); err != nil {
+			return nil, err
+		}
+
+		n := l - len(itm)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		itm = append(itm, buf[overflowHeaderSize:overflowHeaderSize+n]...)
+		bptr = blockPtr(binary.BigEndian.Uint64(buf[:overflowHeaderSize]))
+	}
+
+	return itm, nil
+}
+
+// deleteOverflow deletes the overflow blocks of a stub. buf has to be of the
+// block size.
+func deleteOverflow(bm BlockManager, stub []byte, buf []byte) error {
+	l := int(binary.BigEndian.Uint32(stub[0:4]))
+	bptr := blockPtr(binary.BigEndian.Uint64(stub[4:12]))
+
+	for ; l > 0 && bptr != noBlock; l -= len(buf) - overflowHeaderSize {
+		if err := bm.ReadBlock(bptr, buf); err != nil {
+			return err
+		}
+
+		if err := bm.DeleteBlock(bptr); err != nil {
+			return err
+		}
+		bptr = blockPtr(binary.BigEndian.Uint64(buf[:overflowHeaderSize]))
+	}
+
+	return nil
+}
+
+// deleteBlock deletes a data block along with the overflow blocks of its items
+func (m *Nitro) deleteBlock(bptr blockPtr, buf, obuf []byte) error {
+	if atomic.LoadInt32(&m.hasOverflowItems) != 0 {
+		if err := m.bm.ReadBlock(bptr, buf); err != nil {
+			return err
+		}
+
+		db := newDataBlock(buf, m.bm)
+		for entry, overflow := db.next(); entry != nil; entry, overflow = db.next() {
+			if overflow {
+				if err := deleteOverflow(m.bm, entry, obuf); err != nil {
+					return err
+				}
+			}
+		}
+
+		if db.err != nil {
+			return db.err
+		}
+	}
+
+	return m.bm.DeleteBlock(bptr)
+}
@@ -0,0 +1,459 @@
+package nitro
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var errUndecryptableBlock = errors.New("Block cannot be decrypted")
+
+// KeyProvider supplies the master keys which wrap the data keys of an
+// encrypted block store. Keys have to be 16, 24 or 32 bytes long (AES-128,
+// AES-192 or AES-256).
+type KeyProvider interface {
+	// MasterKey returns the current master key and its id
+	MasterKey() (id string, key []byte, err error)
+	// Key returns the master key with the given id. Keys which wrapped
+	// data keys before a rotation have to remain available until the next
+	// rotation completes.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider backed by a map of master keys
+type StaticKeyProvider struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (kp *StaticKeyProvider) MasterKey() (string, []byte, error) {
+	key, err := kp.Key(kp.Current)
+	return kp.Current, key, err
+}
+
+func (kp *StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := kp.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown master key %s", id)
+	}
+
+	return key, nil
+}
+
+const (
+	dataKeySize = 32
+	// An encrypted block is laid out as
+	// [4 byte data key id][12 byte nonce][encrypted data][16 byte tag]
+	blockKeyIdSize    = 4
+	blockNonceSize    = 12
+	blockCipherHeader = blockKeyIdSize + blockNonceSize
+	blockCipherTag    = 16
+	blockCipherSize   = blockCipherHeader + blockCipherTag
+)
+
+// wrappedKey is a data key encrypted by a master key
+type wrappedKey struct {
+	Id          uint32 `json:"id"`
+	MasterKeyId string `json:"master_key_id"`
+	Key         []byte `json:"key"`
+}
+
+// fileKeysMeta is stored in the key file of a block store data file
+type fileKeysMeta struct {
+	Active uint32       `json:"active"`
+	Keys   []wrappedKey `json:"keys"`
+}
+
+// fileKeys holds the data keys of a block store data file. Blocks are
+// encrypted with the active key, blocks written before a key rotation remain
+// readable with the retired keys. A retired key is dropped once no block of
+// the file uses it.
+type fileKeys struct {
+	sync.RWMutex
+	path   string
+	active uint32
+	aeads  map[uint32]cipher.AEAD
+	meta   fileKeysMeta
+
+	// Number of blocks encrypted with each data key and the data key of
+	// every block by block number, 0 for unused blocks. Blocks written
+	// before the store was opened are not referenced by any index node.
+	used      map[uint32]int64
+	blockKeys []uint32
+}
+
+// blockCipher encrypts the blocks of a block store with AES-GCM. Every data
+// file has its own data keys, which are stored wrapped by the master key in
+// a key file next to the data file.
+type blockCipher struct {
+	kp        KeyProvider
+	files     []*fileKeys
+	blockSize int
+	bufPool   sync.Pool
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func wrapKey(masterKey, key []byte) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func unwrapKey(masterKey, wrapped []byte) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errUndecryptableBlock
+	}
+
+	nonce := wrapped[:aead.NonceSize()]
+	return aead.Open(nil, nonce, wrapped[aead.NonceSize():], nil)
+}
+
+func newBlockCipher(kp KeyProvider, path string, nfiles, blockSize int) (*blockCipher, error) {
+	bc := &blockCipher{
+		kp:        kp,
+		blockSize: blockSize,
+	}
+
+	bc.bufPool.New = func() interface{} {
+		return make([]byte, blockSize)
+	}
+
+	for i := 0; i < nfiles; i++ {
+		fk := &fileKeys{
+			path:  filepath.Join(path, fmt.Sprintf("blockstore-%d.keys", i)),
+			aeads: make(map[uint32]cipher.AEAD),
+			used:  make(map[uint32]int64),
+		}
+
+		bs, err := ioutil.ReadFile(fk.path)
+		if err == nil {
+			err = json.Unmarshal(bs, &fk.meta)
+		}
+
+		if os.IsNotExist(err) {
+			err = bc.rotateFile(fk)
+		} else if err == nil {
+			err = bc.loadFile(fk)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		bc.files = append(bc.files, fk)
+	}
+
+	return bc, nil
+}
+
+// loadFile unwraps the data keys of a key file
+func (bc *blockCipher) loadFile(fk *fileKeys) error {
+	for _, wk := range fk.meta.Keys {
+		masterKey, err := bc.kp.Key(wk.MasterKeyId)
+		if err != nil {
+			return err
+		}
+
+		key, err := unwrapKey(masterKey, wk.Key)
+		if err != nil {
+			return fmt.Errorf("Unable to unwrap data key %d of %s: %v", wk.Id, fk.path, err)
+		}
+
+		if fk.aeads[wk.Id], err = newAEAD(key); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := fk.aeads[fk.meta.Active]; !ok {
+		return fmt.Errorf("Active data key of %s is missing", fk.path)
+	}
+
+	fk.active = fk.meta.Active
+	return nil
+}
+
+// rotateFile adds a new active data key to a key file and rewraps all data
+// keys with the current master key
+func (bc *blockCipher) rotateFile(fk *fileKeys) error {
+	masterId, masterKey, err := bc.kp.MasterKey()
+	if err != nil {
+		return err
+	}
+
+	fk.Lock()
+	defer fk.Unlock()
+
+	meta := fileKeysMeta{Active: fk.meta.Active + 1}
+	aeads := make(map[uint32]cipher.AEAD, len(fk.aeads)+1)
+	for _, wk := range fk.meta.Keys {
+		// Keys without blocks are not needed anymore
+		if fk.used[wk.Id] == 0 {
+			continue
+		}
+
+		oldMasterKey, err := bc.kp.Key(wk.MasterKeyId)
+		if err != nil {
+			return err
+		}
+
+		key, err := unwrapKey(oldMasterKey, wk.Key)
+		if err != nil {
+			return err
+		}
+
+		if wk.Key, err = wrapKey(masterKey, key); err != nil {
+			return err
+		}
+		wk.MasterKeyId = masterId
+		meta.Keys = append(meta.Keys, wk)
+		aeads[wk.Id] = fk.aeads[wk.Id]
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	wrapped, err := wrapKey(masterKey, key)
+	if err != nil {
+		return err
+	}
+
+	meta.Keys = append(meta.Keys, wrappedKey{Id: meta.Active, MasterKeyId: masterId, Key: wrapped})
+	if aeads[meta.Active], err = newAEAD(key); err != nil {
+		return err
+	}
+
+	// Blocks are encrypted with the new key only once it is durable
+	if err := fk.save(meta); err != nil {
+		return err
+	}
+
+	for id := range fk.used {
+		if _, ok := aeads[id]; !ok {
+			delete(fk.used, id)
+		}
+	}
+
+	fk.meta = meta
+	fk.aeads = aeads
+	fk.active = meta.Active
+	return nil
+}
+
+// save replaces the key file with meta
+func (fk *fileKeys) save(meta fileKeysMeta) error {
+	bs, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	tmpfile := fk.path + ".tmp"
+	if err := writeFileSync(tmpfile, bs); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile, fk.path)
+}
+
+// setBlockKey records the data key of a block, 0 if the block is deleted.
+// fk has to be locked.
+func (fk *fileKeys) setBlockKey(blockNum int64, id uint32) {
+	for int64(len(fk.blockKeys)) <= blockNum {
+		fk.blockKeys = append(fk.blockKeys, 0)
+	}
+
+	if old := fk.blockKeys[blockNum]; old != 0 {
+		fk.used[old]--
+	}
+
+	fk.blockKeys[blockNum] = id
+	if id != 0 {
+		fk.used[id]++
+	}
+}
+
+func writeFileSync(path string, bs []byte) error {
+	f, err := openFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(bs); err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Rotate generates new data keys for all data files and rewraps the existing
+// data keys with the current master key. Blocks written before the rotation
+// keep their data key until they are rewritten.
+func (bc *blockCipher) Rotate() error {
+	for _, fk := range bc.files {
+		if err := bc.rotateFile(fk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasRetiredKeys reports whether a data file holds blocks encrypted with a
+// data key other than the active one
+func (bc *blockCipher) hasRetiredKeys(shard int) bool {
+	fk := bc.files[shard]
+	fk.RLock()
+	defer fk.RUnlock()
+
+	for id, n := range fk.used {
+		if id != fk.active && n > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Release records that a block has been deleted. A retired data key is
+// removed from the key file once its last block is deleted.
+func (bc *blockCipher) Release(shard int, pos int64) error {
+	fk := bc.files[shard]
+	fk.Lock()
+	defer fk.Unlock()
+
+	blockNum := pos / int64(bc.blockSize)
+	if blockNum >= int64(len(fk.blockKeys)) || fk.blockKeys[blockNum] == 0 {
+		return nil
+	}
+
+	id := fk.blockKeys[blockNum]
+	fk.setBlockKey(blockNum, 0)
+	if id == fk.active || fk.used[id] > 0 {
+		return nil
+	}
+
+	meta := fileKeysMeta{Active: fk.meta.Active}
+	for _, wk := range fk.meta.Keys {
+		if wk.Id != id {
+			meta.Keys = append(meta.Keys, wk)
+		}
+	}
+
+	if err := fk.save(meta); err != nil {
+		return err
+	}
+
+	delete(fk.used, id)
+	delete(fk.aeads, id)
+	fk.meta = meta
+	return nil
+}
+
+// isRetired reports whether an encrypted block header refers to a retired
+// data key
+func (bc *blockCipher) isRetired(shard int, hdr []byte) bool {
+	fk := bc.files[shard]
+	fk.RLock()
+	defer fk.RUnlock()
+	return binary.BigEndian.Uint32(hdr[:blockKeyIdSize]) != fk.active
+}
+
+// dataSize is the number of plaintext bytes stored in a block
+func (bc *blockCipher) dataSize() int {
+	return bc.blockSize - blockCipherSize
+}
+
+func (bc *blockCipher) getBuf() []byte {
+	return bc.bufPool.Get().([]byte)
+}
+
+func (bc *blockCipher) putBuf(buf []byte) {
+	bc.bufPool.Put(buf[:cap(buf)])
+}
+
+// Seal encrypts a block into dst, binding it to its location in the store.
+// Short blocks are padded to the block data size.
+func (bc *blockCipher) Seal(dst, bs []byte, shard int, pos int64) []byte {
+	fk := bc.files[shard]
+	fk.Lock()
+	id := fk.active
+	aead := fk.aeads[id]
+	fk.setBlockKey(pos/int64(bc.blockSize), id)
+	fk.Unlock()
+
+	dst = dst[:bc.blockSize]
+	binary.BigEndian.PutUint32(dst[:blockKeyIdSize], id)
+	nonce := dst[blockKeyIdSize:blockCipherHeader]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	plain := dst[blockCipherHeader : blockCipherHeader+bc.dataSize()]
+	n := copy(plain, bs)
+	for ; n < len(plain); n++ {
+		plain[n] = 0
+	}
+
+	var ad [8]byte
+	binary.BigEndian.PutUint64(ad[:], uint64(newBlockPtr(shard, pos)))
+	aead.Seal(plain[:0], nonce, plain, ad[:])
+	return dst
+}
+
+// Open decrypts a block read from the store into buf
+func (bc *blockCipher) Open(buf, bs []byte, shard int, pos int64) error {
+	fk := bc.files[shard]
+	id := binary.BigEndian.Uint32(bs[:blockKeyIdSize])
+	fk.RLock()
+	aead, ok := fk.aeads[id]
+	fk.RUnlock()
+	if !ok {
+		return errUndecryptableBlock
+	}
+
+	var ad [8]byte
+	binary.BigEndian.PutUint64(ad[:], uint64(newBlockPtr(shard, pos)))
+	nonce := bs[blockKeyIdSize:blockCipherHeader]
+	plain, err := aead.Open(bs[blockCipherHeader:blockCipherHeader], nonce,
+		bs[blockCipherHeader:bc.blockSize], ad[:])
+	if err != nil {
+		return errUndecryptableBlock
+	}
+
+	copy(buf, plain)
+	return nil
+}
@@ -1,13 +1,16 @@
 package nitro
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
-	"syscall"
 )
 
 var useLinuxHolePunch = false
@@ -34,6 +37,60 @@ func (ptr blockPtr) Shard() int {
 	return shard
 }
 
+const blockStoreMetaFile = "blockstore.json"
+
+// blockStoreMeta is stored in the block store directory and describes the
+// layout of its data files
+type blockStoreMeta struct {
+	BlockSize int  `json:"block_size"`
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// checkBlockStoreMeta records the layout of a new block store or validates
+// it against the recorded one. Block stores created before the layout was
+// recorded use the default block size and no encryption.
+func checkBlockStoreMeta(path string, blockSize int, encrypted bool) error {
+	metafile := filepath.Join(path, blockStoreMetaFile)
+	bs, err := ioutil.ReadFile(metafile)
+	if os.IsNotExist(err) {
+		fi, err := os.Stat(filepath.Join(path, "blockstore-0.data"))
+		if err == nil && fi.Size() > 0 {
+			if blockSize != defaultBlockSize {
+				return fmt.Errorf("Block store %s has block size %d, configured %d",
+					path, defaultBlockSize, blockSize)
+			}
+
+			if encrypted {
+				return fmt.Errorf("Block store %s is not encrypted", path)
+			}
+		}
+
+		bs, _ = json.Marshal(blockStoreMeta{BlockSize: blockSize, Encrypted: encrypted})
+		return ioutil.WriteFile(metafile, bs, 0660)
+	} else if err != nil {
+		return err
+	}
+
+	var meta blockStoreMeta
+	if err := json.Unmarshal(bs, &meta); err != nil {
+		return err
+	}
+
+	if meta.BlockSize != blockSize {
+		return fmt.Errorf("Block store %s has block size %d, configured %d",
+			path, meta.BlockSize, blockSize)
+	}
+
+	if meta.Encrypted != encrypted {
+		if meta.Encrypted {
+			return fmt.Errorf("Block store %s is encrypted, no key provider configured", path)
+		}
+		return fmt.Errorf("Block store %s is not encrypted", path)
+	}
+
+	return nil
+}
+
 type fileBlockManager struct {
 	wlocks []sync.Mutex
 	wfds   []*os.File
@@ -41,14 +98,31 @@ type fileBlockManager struct {
 
 	wpos []int64
 
+	// Deleted blocks. With hole punching, they are only reused while the
+	// file is compacted.
 	freeBlocks [][]int64
+	compacting []bool
+	blockSize  int64
+
+	// Encrypts blocks if the block store is encrypted
+	cipher *blockCipher
 }
 
-func newFileBlockManager(nfiles int, path string) (*fileBlockManager, error) {
+func newFileBlockManager(nfiles int, path string, blockSize int, kp KeyProvider) (*fileBlockManager, error) {
 	var fd *os.File
 	var err error
 
-	fbm := &fileBlockManager{}
+	if err = checkBlockStoreMeta(path, blockSize, kp != nil); err != nil {
+		return nil, err
+	}
+
+	fbm := &fileBlockManager{blockSize: int64(blockSize)}
+	if kp != nil {
+		if fbm.cipher, err = newBlockCipher(kp, path, nfiles, blockSize); err != nil {
+			return nil, err
+		}
+	}
+
 	defer func() {
 		if err != nil {
 			for _, wfd := range fbm.wfds {
@@ -63,10 +137,11 @@ func newFileBlockManager(nfiles int, path string) (*fileBlockManager, error) {
 	fbm.wlocks = make([]sync.Mutex, nfiles)
 	fbm.wpos = make([]int64, nfiles)
 	fbm.freeBlocks = make([][]int64, nfiles)
+	fbm.compacting = make([]bool, nfiles)
 
 	for i := 0; i < nfiles; i++ {
 		fpath := filepath.Join(path, fmt.Sprintf("blockstore-%d.data", i))
-		fd, err = os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, 0755)
+		fd, err = openFile(fpath, os.O_WRONLY|os.O_CREATE, 0755)
 		if err != nil {
 			return nil, err
 		}
@@ -77,8 +152,8 @@ func newFileBlockManager(nfiles int, path string) (*fileBlockManager, error) {
 			return nil, err
 		}
 
-		fbm.wpos[i] += fbm.wpos[i] % blockSize
-		fd, err = os.Open(fpath)
+		fbm.wpos[i] += fbm.wpos[i] % fbm.blockSize
+		fd, err = openFile(fpath, os.O_RDONLY, 0)
 		if err != nil {
 			return nil, err
 		}
@@ -91,32 +166,141 @@ func newFileBlockManager(nfiles int, path string) (*fileBlockManager, error) {
 
 func (fbm *fileBlockManager) DeleteBlock(bptr blockPtr) error {
 	shard := bptr.Shard()
+	if fbm.cipher != nil {
+		if err := fbm.cipher.Release(shard, bptr.Offset()); err != nil {
+			return err
+		}
+	}
+
 	if useLinuxHolePunch {
-		return punchHole(fbm.wfds[shard], bptr.Offset(), blockSize)
+		if err := punchHole(fbm.wfds[shard], bptr.Offset(), fbm.blockSize); err != nil {
+			return err
+		}
 	}
 
 	fbm.wlocks[shard].Lock()
 	defer fbm.wlocks[shard].Unlock()
-	fbm.freeBlocks[shard] = append(fbm.freeBlocks[shard], bptr.Offset())
+
+	off := bptr.Offset()
+	flist := fbm.freeBlocks[shard]
+	if fbm.compacting[shard] {
+		// Keep the free list in descending order
+		i := sort.Search(len(flist), func(i int) bool { return flist[i] < off })
+		flist = append(flist, 0)
+		copy(flist[i+1:], flist[i:])
+		flist[i] = off
+	} else {
+		flist = append(flist, off)
+	}
+	fbm.freeBlocks[shard] = flist
+
+	if off == fbm.wpos[shard]-fbm.blockSize {
+		return fbm.trim(shard)
+	}
 
 	return nil
 }
 
-func (fbm *fileBlockManager) WriteBlock(bs []byte, shard int) (blockPtr, error) {
-	shard = shard % len(fbm.wpos)
+// trim returns the free blocks at the end of a file to the file system
+func (fbm *fileBlockManager) trim(shard int) error {
+	flist := fbm.freeBlocks[shard]
+	if !fbm.compacting[shard] {
+		sort.Slice(flist, func(i, j int) bool { return flist[i] > flist[j] })
+	}
+
+	end := fbm.wpos[shard]
+	i := 0
+	for ; i < len(flist) && flist[i] == end-fbm.blockSize; i++ {
+		end -= fbm.blockSize
+	}
+
+	fbm.freeBlocks[shard] = flist[i:]
+	fbm.wpos[shard] = end
+	return fbm.wfds[shard].Truncate(end)
+}
+
+// beginCompaction makes allocations of a file reuse the free blocks with the
+// lowest offsets, so that live blocks can be moved towards the start of the
+// file
+func (fbm *fileBlockManager) beginCompaction(shard int) {
 	fbm.wlocks[shard].Lock()
-	var pos int64
+	defer fbm.wlocks[shard].Unlock()
+
+	flist := fbm.freeBlocks[shard]
+	sort.Slice(flist, func(i, j int) bool { return flist[i] > flist[j] })
+	fbm.compacting[shard] = true
+}
+
+func (fbm *fileBlockManager) endCompaction(shard int) {
+	fbm.wlocks[shard].Lock()
+	defer fbm.wlocks[shard].Unlock()
+	fbm.compacting[shard] = false
+}
+
+// hasFreeBlockBelow reports whether a compacted file has a free block with a
+// lower offset than off
+func (fbm *fileBlockManager) hasFreeBlockBelow(shard int, off int64) bool {
+	fbm.wlocks[shard].Lock()
+	defer fbm.wlocks[shard].Unlock()
 
 	flist := fbm.freeBlocks[shard]
-	if !useLinuxHolePunch && len(flist) > 0 {
+	return len(flist) > 0 && flist[len(flist)-1] < off
+}
+
+// BlockFileStats describes the space usage of a block store data file
+type BlockFileStats struct {
+	Blocks     int64
+	FreeBlocks int64
+}
+
+// LiveRatio returns the fraction of the blocks of the file which are in use
+func (s BlockFileStats) LiveRatio() float64 {
+	if s.Blocks == 0 {
+		return 1
+	}
+
+	return float64(s.Blocks-s.FreeBlocks) / float64(s.Blocks)
+}
+
+func (fbm *fileBlockManager) fileStats(shard int) BlockFileStats {
+	fbm.wlocks[shard].Lock()
+	defer fbm.wlocks[shard].Unlock()
+
+	return BlockFileStats{
+		Blocks:     fbm.wpos[shard] / fbm.blockSize,
+		FreeBlocks: int64(len(fbm.freeBlocks[shard])),
+	}
+}
+
+// allocBlock reserves a block in the shard file, reusing a deleted block if
+// there is one
+func (fbm *fileBlockManager) allocBlock(shard int) int64 {
+	fbm.wlocks[shard].Lock()
+	defer fbm.wlocks[shard].Unlock()
+
+	var pos int64
+	flist := fbm.freeBlocks[shard]
+	if (!useLinuxHolePunch || fbm.compacting[shard]) && len(flist) > 0 {
 		pos = flist[len(flist)-1]
 		flist = flist[0 : len(flist)-1]
 		fbm.freeBlocks[shard] = flist
 	} else {
 		pos = fbm.wpos[shard]
-		fbm.wpos[shard] += blockSize
+		fbm.wpos[shard] += fbm.blockSize
+	}
+
+	return pos
+}
+
+func (fbm *fileBlockManager) WriteBlock(bs []byte, shard int) (blockPtr, error) {
+	shard = shard % len(fbm.wpos)
+	pos := fbm.allocBlock(shard)
+
+	if fbm.cipher != nil {
+		buf := fbm.cipher.getBuf()
+		defer fbm.cipher.putBuf(buf)
+		bs = fbm.cipher.Seal(buf, bs, shard, pos)
 	}
-	fbm.wlocks[shard].Unlock()
 
 	_, err := fbm.wfds[shard].WriteAt(bs, pos)
 	if err != nil {
@@ -127,8 +311,29 @@ func (fbm *fileBlockManager) WriteBlock(bs []byte, shard int) (blockPtr, error)
 	return bptr, nil
 }
 
+// Sync commits the written blocks to stable storage
+func (fbm *fileBlockManager) Sync() error {
+	for _, fd := range fbm.wfds {
+		if err := fd.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (fbm *fileBlockManager) ReadBlock(bptr blockPtr, buf []byte) error {
 	shard := bptr.Shard()
+	if fbm.cipher != nil {
+		cbuf := fbm.cipher.getBuf()
+		defer fbm.cipher.putBuf(cbuf)
+		if _, err := fbm.rfds[shard].ReadAt(cbuf, bptr.Offset()); err != nil {
+			return err
+		}
+
+		return fbm.cipher.Open(buf, cbuf, shard, bptr.Offset())
+	}
+
 	n, err := fbm.rfds[shard].ReadAt(buf, bptr.Offset())
 	if err == io.EOF {
 		for ; n < len(buf); n++ {
@@ -139,41 +344,59 @@ func (fbm *fileBlockManager) ReadBlock(bptr blockPtr, buf []byte) error {
 	return err
 }
 
+// dataSize is the number of item bytes stored in a block
+func (fbm *fileBlockManager) dataSize() int {
+	if fbm.cipher != nil {
+		return fbm.cipher.dataSize()
+	}
+
+	return int(fbm.blockSize)
+}
+
 type mmapBlockManager struct {
-	file   *os.File
-	offset int64
-	data   []byte
+	offset    int64
+	blockSize int64
+	file      *os.File
+	data      []byte
 }
 
 const maxFileOffset = 16000000000000 // 16TB
-func newMmapBlockManager(dir string) (*mmapBlockManager, error) {
+
+// maxMmapSize is the size of the block store mapping. 32-bit platforms cannot
+// address more than a fraction of maxFileOffset.
+var maxMmapSize int64 = maxFileOffset
+
+func init() {
+	if strconv.IntSize == 32 {
+		maxMmapSize = 1 << 30
+	}
+}
+
+func newMmapBlockManager(dir string, blockSize int) (*mmapBlockManager, error) {
 	// TODO: Ability to reuse file and update offset
 	file := filepath.Join(dir, "blockstore-mmap.data")
-	mbm := new(mmapBlockManager)
-	if f, err := os.Create(file); err == nil {
-		if _, err := f.WriteAt([]byte("EOF"), maxFileOffset); err != nil {
-			return nil, err
-		}
-		f.Close()
+	mbm := &mmapBlockManager{blockSize: int64(blockSize)}
+	if err := createSparseFile(file, maxMmapSize); err != nil {
+		return nil, err
 	}
 
-	if f, err := os.OpenFile(file, os.O_RDWR, 0755); err != nil {
+	f, err := openFile(file, os.O_RDWR, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	mbm.file = f
+	if mbm.data, err = mmapFile(f, int(maxMmapSize)); err != nil {
+		f.Close()
 		return nil, err
-	} else {
-		mbm.file = f
-		mbm.data, err = syscall.Mmap(int(f.Fd()), 0,
-			maxFileOffset, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-		if err != nil {
-			return nil, err
-		}
 	}
 
 	return mbm, nil
 }
 
 func (mbm *mmapBlockManager) WriteBlock(bs []byte, shard int) (blockPtr, error) {
-	pos := atomic.AddInt64(&mbm.offset, blockSize)
-	pos -= blockSize
+	pos := atomic.AddInt64(&mbm.offset, mbm.blockSize)
+	pos -= mbm.blockSize
 
 	copy(mbm.data[pos:], bs)
 
@@ -183,11 +406,11 @@ func (mbm *mmapBlockManager) WriteBlock(bs []byte, shard int) (blockPtr, error)
 
 func (mbm *mmapBlockManager) DeleteBlock(bptr blockPtr) error {
 	pos := bptr.Offset()
-	return mmapPunchHole(mbm.data[pos : pos+blockSize])
+	return mmapPunchHole(mbm.data[pos : pos+mbm.blockSize])
 }
 
 func (mbm mmapBlockManager) ReadBlock(bptr blockPtr, buf []byte) error {
 	pos := bptr.Offset()
-	copy(buf[:blockSize], mbm.data[pos:pos+blockSize])
+	copy(buf[:mbm.blockSize], mbm.data[pos:pos+mbm.blockSize])
 	return nil
 }
@@ -0,0 +1,120 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// ErrConditionFailed means the item visible to a conditional write did not
+// match the expected item
+var ErrConditionFailed = fmt.Errorf("Item does not match the expected item")
+
+// Number of locks serializing the conditional writes of the keys
+const keyLockStripes = 256
+
+// KeyHash hashes the key of the item data. Items which compare equal by the
+// key comparator must have the same hash.
+type KeyHash func(itm []byte) uint64
+
+// SetKeyHash sets the hash of the keys compared by the key comparator, which
+// spreads the conditional writes of different keys, e.g., PutIf, over
+// several locks. SetKeyComparator resets it, without a key hash all
+// conditional writes are serialized. The default comparator hashes the item
+// data.
+func (cfg *Config) SetKeyHash(fn KeyHash) {
+	cfg.keyHash = fn
+}
+
+// hashBytes is the FNV-1a hash of the data
+func hashBytes(bs []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, b := range bs {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// keyLocks serializes the conditional writes of items with the same key
+type keyLocks [keyLockStripes]sync.Mutex
+
+func (m *Nitro) lockKey(bs []byte) *sync.Mutex {
+	var h uint64
+	if m.keyHash != nil {
+		h = m.keyHash(bs)
+	}
+
+	mu := &m.keyLocks[h%keyLockStripes]
+	mu.Lock()
+	return mu
+}
+
+// PutIf inserts an item if the item visible with the same key has the data
+// expectedOld, which it replaces, or if no such item exists when expectedOld
+// is nil. It returns ErrConditionFailed otherwise.
+//
+// Like Upsert, the expected item is deleted before the item is inserted, so
+// that lookups of the key may briefly find no item. PutIf has two limits:
+//
+// Only conditional writes, i.e., PutIf and Increment, lock the key. They are
+// not atomic against a concurrent Put, Delete or Upsert of the key, which may
+// make PutIf fail after it deleted the expected item, which then remains
+// deleted.
+//
+// The writes are spread over the locks by the key hash, see SetKeyHash. With
+// a custom key comparator and no key hash, all conditional writes of the
+// instance share a single lock.
+//
+// PutIf is not supported in block store mode and returns
+// ErrBlockStoreUnsupported.
+func (w *Writer) PutIf(bs []byte, expectedOld []byte) error {
+	return w.replaceKey(bs, func(old []byte) ([]byte, error) {
+		if expectedOld == nil && old != nil ||
+			expectedOld != nil && (old == nil || !bytes.Equal(old, expectedOld)) {
+			return nil, ErrConditionFailed
+		}
+		return bs, nil
+	})
+}
+
+// replaceKey replaces the item visible with the key of bs, or nil if there
+// is none, by the item returned by fn, which has to have the same key. The
+// data passed to fn is only valid during the call.
+func (w *Writer) replaceKey(bs []byte, fn func(old []byte) ([]byte, error)) error {
+	if w.HasBlockStore() {
+		return ErrBlockStoreUnsupported
+	}
+
+	mu := w.lockKey(bs)
+	defer mu.Unlock()
+
+	var old []byte
+	n := w.GetNode(bs)
+	if n != nil {
+		old = (*Item)(n.Item()).Bytes()
+	}
+
+	bs, err := fn(old)
+	if err != nil {
+		return err
+	}
+
+	if n != nil && !w.DeleteNode(n) {
+		return ErrConditionFailed
+	}
+
+	if n, err = w.tryInsert(bs, true, true); err == nil && n == nil {
+		err = ErrConditionFailed
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestPutIf(t *testing.T) {
+	conf := DefaultConfig()
+	conf.UseKeyValueItems()
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	k := []byte("counter")
+	if err := w.PutIf(EncodeKV(k, []byte("0")), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.PutIf(EncodeKV(k, []byte("1")), nil); err != ErrConditionFailed {
+		t.Errorf("Expected ErrConditionFailed for an existing item, got %v", err)
+	}
+	if err := w.PutIf(EncodeKV(k, []byte("1")), EncodeKV(k, []byte("5"))); err != ErrConditionFailed {
+		t.Errorf("Expected ErrConditionFailed for a different item, got %v", err)
+	}
+	if err := w.PutIf(EncodeKV([]byte("other"), nil), EncodeKV([]byte("other"), nil)); err != ErrConditionFailed {
+		t.Errorf("Expected ErrConditionFailed for a missing item, got %v", err)
+	}
+
+	// Increments of several writers are not lost. The item is briefly
+	// missing while it is replaced.
+	var wg sync.WaitGroup
+	writers, incrs := 8, 500
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := db.NewWriter()
+			for j := 0; j < incrs; j++ {
+				for {
+					n := w.GetNode(EncodeKV(k, nil))
+					if n == nil {
+						continue
+					}
+					old := append([]byte(nil), (*Item)(n.Item()).Bytes()...)
+					_, v := DecodeKV(old)
+					c, _ := strconv.Atoi(string(v))
+					if w.PutIf(EncodeKV(k, []byte(strconv.Itoa(c+1))), old) == nil {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	itm, _ := snap.Get(EncodeKV(k, nil))
+	if _, v := DecodeKV(itm); string(v) != strconv.Itoa(writers*incrs) {
+		t.Errorf("Expected %d, got %s", writers*incrs, v)
+	}
+	if snap.Count() != 1 {
+		t.Errorf("Expected 1 item, got %d", snap.Count())
+	}
+}
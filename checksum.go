@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/binary"
+	"runtime"
+
+	"github.com/elliotcourant/nitro/xxhash"
+)
+
+// itemsDigest accumulates the hashes of a set of items. Hashes are added up,
+// so that the digest does not depend on the order in which the items are
+// visited and partial digests can be combined.
+type itemsDigest struct {
+	count uint64
+	sum   uint64
+}
+
+func (d *itemsDigest) add(itm []byte) {
+	d.count++
+	d.sum += xxhash.Sum64(itm)
+}
+
+func (d *itemsDigest) merge(o itemsDigest) {
+	d.count += o.count
+	d.sum += o.sum
+}
+
+func (d *itemsDigest) Sum64() uint64 {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[0:8], d.count)
+	binary.BigEndian.PutUint64(buf[8:16], d.sum)
+	return xxhash.Sum64(buf[:])
+}
+
+// visitItems invokes fn concurrently for all items of the snapshot, along
+// with the id of the visitor. The items are split at up to shards pivots, so
+// visitor ids are below shards+1. It returns the error reading the items of
+// the block store, in which case not all items were visited.
+func (s *Snapshot) visitItems(shards int, fn func(itm []byte, visitor int)) error {
+	db := s.db
+	if db.HasBlockStore() {
+		// The visitor returns index items with a block store
+		return s.ParallelRange(nil, nil, shards, func(itm []byte, partition int) bool {
+			fn(itm, partition)
+			return true
+		})
+	}
+
+	return db.Visitor(s, func(itm *Item, shard int) error {
+		fn(itm.Bytes(), shard)
+		return nil
+	}, shards, shards)
+}
+
+// Checksum returns a digest of the items of the snapshot. Snapshots with the
+// same items have the same checksum, irrespective of the instance, the
+// machine or the order in which the items were inserted. The items are hashed
+// with xxhash by concurrent visitors over the key range. It returns the
+// error reading the items of the block store, e.g., ErrBlockCorrupt.
+func (s *Snapshot) Checksum() (uint64, error) {
+	s.checkOpen()
+	shards := runtime.GOMAXPROCS(0)
+	digests := make([]itemsDigest, shards+1)
+	if err := s.visitItems(shards, func(itm []byte, visitor int) {
+		digests[visitor].add(itm)
+	}); err != nil {
+		return 0, err
+	}
+
+	var d itemsDigest
+	for _, pd := range digests {
+		d.merge(pd)
+	}
+
+	return d.Sum64(), nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSnapshotChecksum(t *testing.T) {
+	n := 10000
+	checksum := func(conf Config, keys func(i int) int, extra []byte) uint64 {
+		db := NewWithConfig(conf)
+		defer db.Close()
+
+		w := db.NewWriter()
+		for i := 0; i < n; i++ {
+			w.Put([]byte(fmt.Sprintf("key-%010d", keys(i))))
+		}
+		w.Put([]byte("deleted"))
+		if extra != nil {
+			w.Put(extra)
+		}
+		snap0, _ := w.NewSnapshot()
+		defer snap0.Close()
+
+		w.Delete([]byte("deleted"))
+		snap, _ := w.NewSnapshot()
+		defer snap.Close()
+		return snapChecksum(t, snap)
+	}
+
+	forward := func(i int) int { return i }
+	backward := func(i int) int { return n - 1 - i }
+
+	cs := checksum(testConf, forward, nil)
+	if c := checksum(testConf, backward, nil); c != cs {
+		t.Errorf("Expected equal checksums, got %x and %x", cs, c)
+	}
+
+	if c := checksum(testConf, forward, []byte("extra")); c == cs {
+		t.Errorf("Expected checksums to differ")
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		return
+	}
+
+	// Block store instances are populated by ApplyOps
+	tdb := NewWithConfig(DefaultConfig())
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%010d", backward(i))))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	if _, err := db.ApplyOps(tsnap, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	if c := snapChecksum(t, snap); c != cs {
+		t.Errorf("Expected equal checksums with a block store, got %x and %x", cs, c)
+	}
+}
+
+// snapChecksum returns the checksum of a snapshot, failing the test on errors
+func snapChecksum(t *testing.T, snap *Snapshot) uint64 {
+	t.Helper()
+	cs, err := snap.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Command nitrobench runs YCSB style workloads against an in-process Nitro
+// instance so that tuning options can be compared on realistic traffic.
+//
+// Usage:
+//
+//	nitrobench -workload a -records 1000000 -ops 1000000 -concurrency 8 -mm
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/elliotcourant/nitro"
+	"github.com/elliotcourant/nitro/bench"
+)
+
+func main() {
+	var opts = bench.DefaultOptions()
+
+	workload := flag.String("workload", "a", "standard workload (a-e), overridden by explicit proportions")
+	read := flag.Float64("read", -1, "read proportion")
+	update := flag.Float64("update", -1, "update proportion")
+	insert := flag.Float64("insert", -1, "insert proportion")
+	scan := flag.Float64("scan", -1, "scan proportion")
+	dist := flag.String("distribution", "", "key distribution (uniform, zipfian, latest)")
+	records := flag.Int("records", bench.DefaultRecordCount, "number of records to load")
+	ops := flag.Int("ops", 1000000, "number of operations to run")
+	maxScan := flag.Int("maxscan", 100, "maximum scan length")
+	flag.IntVar(&opts.KeySize, "keysize", opts.KeySize, "item size in bytes")
+	flag.IntVar(&opts.Concurrency, "concurrency", opts.Concurrency, "number of concurrent clients")
+	flag.BoolVar(&opts.UseMemoryMgmt, "mm", false, "use the mm allocator")
+	flag.Int64Var(&opts.Seed, "seed", opts.Seed, "random seed")
+	flag.Parse()
+
+	w, ok := bench.Workloads()[*workload]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown workload %q\n", *workload)
+		os.Exit(2)
+	}
+
+	if *read >= 0 || *update >= 0 || *insert >= 0 || *scan >= 0 {
+		w = bench.Workload{Name: "custom", Distribution: w.Distribution}
+		for _, p := range []struct {
+			v   float64
+			dst *float64
+		}{
+			{*read, &w.ReadProportion},
+			{*update, &w.UpdateProportion},
+			{*insert, &w.InsertProportion},
+			{*scan, &w.ScanProportion},
+		} {
+			if p.v > 0 {
+				*p.dst = p.v
+			}
+		}
+	}
+
+	if *dist != "" {
+		switch *dist {
+		case bench.Uniform, bench.Zipfian, bench.Latest:
+			w.Distribution = *dist
+		default:
+			fmt.Fprintf(os.Stderr, "unknown distribution %q\n", *dist)
+			os.Exit(2)
+		}
+	}
+
+	w.RecordCount = *records
+	w.MaxScanLength = *maxScan
+
+	db := nitro.NewWithConfig(opts.Config())
+	defer db.Close()
+
+	fmt.Printf("workload = %s\ndistribution = %s\noptions = %s\n", w.Name, w.Distribution, opts)
+	res := bench.Run(db, w, opts, *ops, true)
+	fmt.Print(res)
+}
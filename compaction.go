@@ -0,0 +1,304 @@
+package nitro
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elliotcourant/nitro/skiplist"
+)
+
+// Files with fewer blocks are not compacted automatically
+const minAutoCompactBlocks = 64
+
+// BlockStoreStats describes the space usage of the block store files
+type BlockStoreStats struct {
+	BlockSize       int64
+	Files           []BlockFileStats
+	Compactions     int64
+	BlocksRelocated int64
+}
+
+// Blocks returns the number of allocated blocks of all files
+func (s BlockStoreStats) Blocks() (n int64) {
+	for _, f := range s.Files {
+		n += f.Blocks
+	}
+	return
+}
+
+// FreeBlocks returns the number of deleted blocks of all files, which are
+// not returned to the file system
+func (s BlockStoreStats) FreeBlocks() (n int64) {
+	for _, f := range s.Files {
+		n += f.FreeBlocks
+	}
+	return
+}
+
+// Fragmentation returns the percentage of the block store files occupied by
+// deleted blocks
+func (s BlockStoreStats) Fragmentation() float64 {
+	if blocks := s.Blocks(); blocks > 0 {
+		return 100 * float64(s.FreeBlocks()) / float64(blocks)
+	}
+
+	return 0
+}
+
+func (s BlockStoreStats) String() string {
+	return fmt.Sprintf(
+		"block_store_live_bytes = %d\n"+
+			"block_store_dead_bytes = %d\n"+
+			"block_store_fragmentation = %.2f\n"+
+			"block_store_compactions = %d\n"+
+			"block_store_blocks_relocated = %d",
+		(s.Blocks()-s.FreeBlocks())*s.BlockSize, s.FreeBlocks()*s.BlockSize,
+		s.Fragmentation(), s.Compactions, s.BlocksRelocated)
+}
+
+// compactor moves the live blocks of fragmented block store files towards
+// the start of the files. Compactions, ApplyOps and NewSnapshot are mutually
+// exclusive, as NewSnapshot collects the gc lists of the internal writers.
+type compactor struct {
+	compactions     int64
+	blocksRelocated int64
+
+	sync.Mutex
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (m *Nitro) fileBlockManager() *fileBlockManager {
+	switch bm := m.bm.(type) {
+	case *fileBlockManager:
+		return bm
+	case *writeBuffer:
+		return bm.fbm
+	}
+
+	return nil
+}
+
+// BlockStoreStats returns the space usage of the block store files
+func (m *Nitro) BlockStoreStats() BlockStoreStats {
+	sts := BlockStoreStats{
+		Compactions:     atomic.LoadInt64(&m.compactor.compactions),
+		BlocksRelocated: atomic.LoadInt64(&m.compactor.blocksRelocated),
+	}
+
+	if fbm := m.fileBlockManager(); fbm != nil {
+		sts.BlockSize = fbm.blockSize
+		for i := range fbm.wfds {
+			sts.Files = append(sts.Files, fbm.fileStats(i))
+		}
+	}
+
+	return sts
+}
+
+// CompactBlockStore compacts the block store files with a ratio of live
+// blocks below minLiveRatio, as well as the files holding blocks encrypted
+// with retired data keys. Live blocks are moved into deleted blocks at lower
+// offsets. The space at the end of a file is released once the moved blocks
+// are garbage collected.
+func (m *Nitro) CompactBlockStore(minLiveRatio float64) error {
+	return m.compactBlockStore(minLiveRatio, 0)
+}
+
+func (m *Nitro) compactBlockStore(minLiveRatio float64, minBlocks int64) error {
+	fbm := m.fileBlockManager()
+	if fbm == nil {
+		return nil
+	}
+
+	if err := m.enterWrite(true); err != nil {
+		return err
+	}
+	defer m.exitWrite()
+
+	for shard := range fbm.wfds {
+		sts := fbm.fileStats(shard)
+		reencrypt := fbm.cipher != nil && fbm.cipher.hasRetiredKeys(shard)
+		if reencrypt || (sts.Blocks >= minBlocks && sts.LiveRatio() < minLiveRatio) {
+			if err := m.compactFile(shard, reencrypt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Nitro) compactFile(shard int, reencrypt bool) error {
+	m.compactor.Lock()
+	defer m.compactor.Unlock()
+
+	// Blocks are checked in the file
+	if wb, ok := m.bm.(*writeBuffer); ok {
+		if err := wb.flushShard(shard); err != nil {
+			return err
+		}
+	}
+
+	fbm := m.fileBlockManager()
+	fbm.beginCompaction(shard)
+	defer fbm.endCompaction(shard)
+
+	// Live nodes are only deleted by ApplyOps and compactions, they can be
+	// used after the iterator is closed
+	var nodes []*skiplist.Node
+	buf := m.store.MakeBuf()
+	iter := m.store.NewIterator(m.iterCmp, buf)
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		n := iter.GetNode()
+		if isValidNode(n) && nodeBlockPtr(n).Shard() == shard {
+			nodes = append(nodes, n)
+		}
+	}
+	iter.Close()
+	m.store.FreeBuf(buf)
+
+	// Blocks at the end of the file are moved first
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodeBlockPtr(nodes[i]).Offset() > nodeBlockPtr(nodes[j]).Offset()
+	})
+
+	dw := m.shardWrs[shard]
+	for _, n := range nodes {
+		bptr := nodeBlockPtr(n)
+		relocate := fbm.hasFreeBlockBelow(shard, bptr.Offset())
+		if !relocate && reencrypt {
+			var err error
+			if relocate, err = m.hasRetiredBlocks(dw, bptr); err != nil {
+				return err
+			}
+		}
+
+		if relocate {
+			if err := m.relocateBlock(dw, n); err != nil {
+				return err
+			}
+		}
+	}
+
+	atomic.AddInt64(&m.compactor.compactions, 1)
+	return nil
+}
+
+// hasRetiredBlocks reports whether a data block or one of the overflow
+// blocks of its items is encrypted with a retired data key. The overflow
+// blocks of an item may be flushed by the write buffer before a key rotation
+// and its data block after it.
+func (m *Nitro) hasRetiredBlocks(dw *diskWriter, bptr blockPtr) (bool, error) {
+	fbm := m.fileBlockManager()
+	var hdr [blockKeyIdSize]byte
+	isRetired := func(bptr blockPtr) (bool, error) {
+		if _, err := fbm.rfds[bptr.Shard()].ReadAt(hdr[:], bptr.Offset()); err != nil {
+			return false, err
+		}
+		return fbm.cipher.isRetired(bptr.Shard(), hdr[:]), nil
+	}
+
+	if retired, err := isRetired(bptr); err != nil || retired {
+		return retired, err
+	}
+
+	if atomic.LoadInt32(&m.hasOverflowItems) == 0 {
+		return false, nil
+	}
+
+	if err := m.bm.ReadBlock(bptr, dw.rbuf); err != nil {
+		return false, err
+	}
+
+	db := newDataBlock(dw.rbuf, m.bm)
+	for entry, overflow := db.next(); entry != nil; entry, overflow = db.next() {
+		if !overflow {
+			continue
+		}
+
+		l := int(binary.BigEndian.Uint32(entry[0:4]))
+		optr := blockPtr(binary.BigEndian.Uint64(entry[4:12]))
+		for ; l > 0 && optr != noBlock; l -= len(dw.obuf) - overflowHeaderSize {
+			if retired, err := isRetired(optr); err != nil || retired {
+				return retired, err
+			}
+
+			if err := m.bm.ReadBlock(optr, dw.obuf); err != nil {
+				return false, err
+			}
+			optr = blockPtr(binary.BigEndian.Uint64(dw.obuf[:overflowHeaderSize]))
+		}
+	}
+
+	return false, db.err
+}
+
+// relocateBlock rewrites the block of an index node, including the overflow
+// blocks of its items, and replaces the node. The old blocks are deleted once
+// the node is garbage collected.
+func (m *Nitro) relocateBlock(dw *diskWriter, n *skiplist.Node) error {
+	if err := m.bm.ReadBlock(nodeBlockPtr(n), dw.rbuf); err != nil {
+		return err
+	}
+
+	db := newDataBlock(dw.rbuf, m.bm)
+	wblock := newDataBlock(dw.wbuf, m.bm)
+	for entry, overflow := db.next(); entry != nil; entry, overflow = db.next() {
+		if !overflow {
+			wblock.Write(entry)
+			continue
+		}
+
+		itm, err := readOverflow(m.bm, entry, len(dw.rbuf))
+		if err != nil {
+			return err
+		}
+
+		stub, err := writeOverflow(m.bm, itm, dw.shard, dw.obuf)
+		if err != nil {
+			return err
+		}
+		wblock.WriteOverflow(stub)
+	}
+
+	if db.err != nil {
+		return db.err
+	}
+
+	bptr, err := m.bm.WriteBlock(wblock.Bytes(), dw.shard)
+	if err != nil {
+		return err
+	}
+
+	// The deleted item may be freed right away
+	itm := append([]byte(nil), (*Item)(n.Item()).Bytes()...)
+	dw.w.DeleteNode(n)
+	indexNode := dw.w.Put2(itm)
+	if indexNode == nil {
+		panic("index node creation should not fail")
+	}
+	setNodeBlockPtr(indexNode, bptr)
+	atomic.AddInt64(&m.compactor.blocksRelocated, 1)
+
+	return nil
+}
+
+func (m *Nitro) compactionWorker() {
+	defer m.compactor.wg.Done()
+	ticker := time.NewTicker(m.compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.compactBlockStore(m.compactLiveRatio, minAutoCompactBlocks)
+		case <-m.compactor.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EffectiveConfig returns the configuration of the instance with the
+// defaults resolved and the changes made at runtime applied, i.e., delta
+// interleaving and the intervals of the stats sampler and watermark jobs. A
+// disabled job has a zero interval. Passing it to NewWithConfig creates an
+// instance which behaves the same, using the same block store directory.
+func (m *Nitro) EffectiveConfig() Config {
+	cfg := m.Config
+	if cfg.useKeyspaces || cfg.useKeyValue {
+		cfg.SetKeyComparator(m.userKeyCmp)
+		cfg.keyHash = m.userKeyHash
+	}
+
+	cfg.useDeltaFiles = m.DeltaInterleaving()
+	if cfg.HasBlockStore() {
+		// Set by the instance
+		cfg.nodeDataCodec = nil
+	}
+
+	for _, j := range m.Jobs() {
+		interval := j.Interval
+		if !j.Enabled {
+			interval = 0
+		}
+
+		switch j.Name {
+		case StatsSamplerJob:
+			cfg.statsInterval = interval
+		case MemoryWatermarkJob:
+			cfg.memoryWatermarkInterval = interval
+		}
+	}
+
+	return cfg
+}
+
+// Describe lists the settings of the configuration, one per line in a fixed
+// order, so that the configurations of instances can be compared. Functions
+// and other callbacks are only reported as set or not.
+func (cfg *Config) Describe() string {
+	set := func(v bool) string {
+		if v {
+			return "set"
+		}
+		return "-"
+	}
+
+	var b strings.Builder
+	add := func(name string, v interface{}) {
+		fmt.Fprintf(&b, "%s=%v\n", name, v)
+	}
+
+	add("refreshRate", cfg.refreshRate)
+	add("fileType", cfg.fileType)
+	add("useMemoryMgmt", cfg.useMemoryMgmt)
+	add("useDeltaFiles", cfg.useDeltaFiles)
+	add("freeBatchSize", cfg.freeBatchSize)
+	add("blockStoreDir", cfg.blockStoreDir)
+	add("storageShards", cfg.storageShards)
+	add("blockSize", cfg.blockSize)
+	add("writeBufSize", cfg.writeBufSize)
+	add("poolBlockBufs", cfg.poolBlockBufs)
+	add("encryption", set(cfg.keyProvider != nil))
+	add("compactLiveRatio", cfg.compactLiveRatio)
+	add("compactInterval", cfg.compactInterval)
+	add("nodeDataCodec", set(cfg.nodeDataCodec != nil))
+	add("maxItemSize", cfg.maxItemSize)
+	add("failFrozenWrites", cfg.failFrozenWrites)
+	add("itemCodec", set(cfg.encodeItemFn != nil || cfg.decodeItemFn != nil))
+	add("dumpEncoders", cfg.dumpEncoders)
+	add("dumpFormat", cfg.dumpFormat)
+	add("useKeyspaces", cfg.useKeyspaces)
+	add("useKeyValue", cfg.useKeyValue)
+	add("itemMetaSize", cfg.itemMetaSize)
+	add("mergeOperator", set(cfg.mergeOperator != nil))
+	add("watchdogTimeout", cfg.watchdogTimeout)
+	add("idleGCPeriod", cfg.idleGCPeriod)
+	add("statsInterval", cfg.statsInterval)
+	add("statsHistorySize", cfg.statsHistorySize)
+	add("memoryLowWatermark", cfg.memoryLowWatermark)
+	add("memoryHighWatermark", cfg.memoryHighWatermark)
+	add("memoryWatermarkInterval", cfg.memoryWatermarkInterval)
+	add("freeListSize", cfg.freeListSize)
+	add("freeListMaxAge", cfg.freeListMaxAge)
+	add("contentionThreshold", cfg.contentionThreshold)
+
+	add("onItemFree", set(cfg.onItemFree != nil))
+	add("onItemInsert", set(cfg.onItemInsert != nil))
+	add("onItemDelete", set(cfg.onItemDelete != nil))
+	add("onMemoryPressure", set(cfg.onMemoryPressure != nil))
+	add("onMemoryHigh", set(cfg.onMemoryHigh != nil))
+	add("onMemoryLow", set(cfg.onMemoryLow != nil))
+	add("onLeak", set(cfg.onLeak != nil))
+	add("onNodeFree", set(cfg.onNodeFree != nil))
+	add("onStaleSession", set(cfg.onStaleSession != nil))
+	add("onContention", set(cfg.onContention != nil))
+	add("onLoadConflict", set(cfg.onLoadConflict != nil))
+	return b.String()
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	conf := testConf
+	conf.blockSize = 0
+	// Shorter keys first
+	conf.SetKeyComparator(func(a, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return bytes.Compare(a, b)
+	})
+	conf.UseKeyspaces()
+	conf.SetStatsSampling(time.Second, 10)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	db.SetDeltaInterleaving(false)
+	db.SetJobInterval(StatsSamplerJob, time.Minute)
+
+	cfg := db.EffectiveConfig()
+	if cfg.blockSize != defaultBlockSize || cfg.useDeltaFiles || cfg.statsInterval != time.Minute {
+		t.Errorf("Unexpected effective config\n%s", cfg.Describe())
+	}
+	if !strings.Contains(cfg.Describe(), "statsInterval=1m0s\n") {
+		t.Errorf("Unexpected description\n%s", cfg.Describe())
+	}
+
+	// The clone uses the same keyspace comparator
+	db2 := NewWithConfig(cfg)
+	defer db2.Close()
+	ks, err := db2.Keyspace("ks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := ks.NewWriter()
+	kw.Put([]byte("aa"))
+	kw.Put([]byte("b"))
+	snap, _ := db2.NewSnapshot()
+	itr := ks.NewIterator(snap)
+	itr.SeekFirst()
+	if !itr.Valid() || string(itr.Get()) != "b" {
+		t.Errorf("Expected the items in the order of the key comparator")
+	}
+	itr.Close()
+	snap.Close()
+
+	db.SetJobEnabled(StatsSamplerJob, false)
+	if cfg := db.EffectiveConfig(); cfg.statsInterval != 0 {
+		t.Errorf("Expected the disabled sampler to have no interval")
+	}
+}
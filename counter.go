@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Size of the value of a counter item
+const counterSize = 8
+
+var (
+	// ErrNotKeyValue means an operation on the values of items was called on
+	// an instance without UseKeyValueItems
+	ErrNotKeyValue = fmt.Errorf("Instance does not use key-value items")
+	// ErrInvalidCounter means the value of the item incremented by Increment
+	// is not a counter
+	ErrInvalidCounter = fmt.Errorf("Item value is not a counter")
+)
+
+// EncodeCounter returns the value of a counter item, see Increment
+func EncodeCounter(v int64) []byte {
+	var buf [counterSize]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	return buf[:]
+}
+
+// DecodeCounter returns the counter of the value of an item, see Increment
+func DecodeCounter(value []byte) (int64, error) {
+	if len(value) != counterSize {
+		return 0, ErrInvalidCounter
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+// Increment adds delta to the counter stored as the value of the item with
+// key and returns the new counter. A missing item is created with the
+// counter delta. The counter is encoded by EncodeCounter, ErrInvalidCounter
+// is returned for items with other values. Increment requires
+// UseKeyValueItems and returns ErrNotKeyValue otherwise.
+//
+// The item is replaced by a delete and an insert which are serialized with
+// the other conditional writes of the key, see PutIf, so that concurrent
+// increments are not lost. Increment is not supported in block store mode
+// and returns ErrBlockStoreUnsupported.
+func (w *Writer) Increment(key []byte, delta int64) (int64, error) {
+	if !w.useKeyValue {
+		return 0, ErrNotKeyValue
+	}
+
+	var v int64
+	err := w.replaceKey(EncodeKV(key, nil), func(old []byte) ([]byte, error) {
+		v = 0
+		if old != nil {
+			_, value := DecodeKV(old)
+			c, err := DecodeCounter(value)
+			if err != nil {
+				return nil, err
+			}
+			v = c
+		}
+
+		v += delta
+		return EncodeKV(key, EncodeCounter(v)), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v, nil
+}
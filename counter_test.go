@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestIncrement(t *testing.T) {
+	plain := New()
+	defer plain.Close()
+	if _, err := plain.NewWriter().Increment([]byte("k"), 1); err != ErrNotKeyValue {
+		t.Errorf("Expected ErrNotKeyValue, got %v", err)
+	}
+
+	conf := testConf
+	conf.UseKeyValueItems()
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	if v, err := w.Increment([]byte("k"), 5); err != nil || v != 5 {
+		t.Errorf("Expected 5, got %d, %v", v, err)
+	}
+	if v, err := w.Increment([]byte("k"), -7); err != nil || v != -2 {
+		t.Errorf("Expected -2, got %d, %v", v, err)
+	}
+
+	w.PutKV([]byte("text"), []byte("abc"))
+	if _, err := w.Increment([]byte("text"), 1); err != ErrInvalidCounter {
+		t.Errorf("Expected ErrInvalidCounter, got %v", err)
+	}
+
+	// Increments of several writers on the same and on different keys are
+	// not lost
+	var wg sync.WaitGroup
+	writers, incrs := 8, 500
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := db.NewWriter()
+			own := []byte(fmt.Sprintf("w%d", i))
+			for j := 0; j < incrs; j++ {
+				if _, err := w.Increment([]byte("shared"), 1); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := w.Increment(own, 2); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	check := func(key string, expected int64) {
+		itm, _ := snap.Get(EncodeKV([]byte(key), nil))
+		_, value := DecodeKV(itm)
+		if v, err := DecodeCounter(value); err != nil || v != expected {
+			t.Errorf("Expected %s = %d, got %d, %v", key, expected, v, err)
+		}
+	}
+
+	check("k", -2)
+	check("shared", int64(writers*incrs))
+	for i := 0; i < writers; i++ {
+		check(fmt.Sprintf("w%d", i), int64(2*incrs))
+	}
+}
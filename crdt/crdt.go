@@ -0,0 +1,359 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package crdt provides a multi-master key/value mode on top of Nitro.
+//
+// Every item carries a (timestamp, actor) version. Writes from different
+// instances are merged deterministically, either by last-writer-wins on the
+// version or by a user supplied merge function, so that two instances can
+// exchange their records in both directions and converge without a leader.
+// Deletes are recorded as tombstones so that they win over older writes.
+// Tombstones older than a horizon which all replicas have synced past can be
+// purged with PurgeTombstones.
+//
+// Items are laid out as
+//
+//	[uvarint key len][key][8 byte timestamp][8 byte actor][1 byte flags][value]
+package crdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/elliotcourant/nitro"
+)
+
+const (
+	flagTombstone = 1
+	metaSize      = 8 + 8 + 1
+)
+
+var errBadItem = errors.New("crdt: malformed item")
+
+// Version orders concurrent writes
+type Version struct {
+	Timestamp uint64
+	Actor     uint64
+}
+
+// Less reports whether v is older than o
+func (v Version) Less(o Version) bool {
+	if v.Timestamp != o.Timestamp {
+		return v.Timestamp < o.Timestamp
+	}
+	return v.Actor < o.Actor
+}
+
+// Record is a versioned key/value pair
+type Record struct {
+	Key       []byte
+	Value     []byte
+	Version   Version
+	Tombstone bool
+}
+
+// MergeFn resolves two conflicting live records for the same key. It must be
+// a join: deterministic, commutative and idempotent (e.g., set union or max),
+// as a record may be merged with an older state of itself. The returned value
+// is stored with the newer of both versions.
+type MergeFn func(local, remote Record) []byte
+
+// Store is a Nitro instance holding versioned records
+type Store struct {
+	db    *nitro.Nitro
+	actor uint64
+	merge MergeFn
+
+	mu      sync.Mutex
+	w       *nitro.Writer
+	clock   uint64
+	horizon uint64
+	buf     []byte
+}
+
+// New creates a Store for the given actor id, which must be unique among the
+// replicas. A nil merge function selects last-writer-wins.
+func New(actor uint64, merge MergeFn) *Store {
+	cfg := nitro.DefaultConfig()
+	cfg.SetKeyComparator(compareItems)
+
+	s := &Store{
+		db:    nitro.NewWithConfig(cfg),
+		actor: actor,
+		merge: merge,
+	}
+	s.w = s.db.NewWriter()
+	return s
+}
+
+// DB returns the underlying Nitro instance
+func (s *Store) DB() *nitro.Nitro {
+	return s.db
+}
+
+// Close shuts down the store
+func (s *Store) Close() {
+	s.db.Close()
+}
+
+func itemKey(itm []byte) []byte {
+	l, n := binary.Uvarint(itm)
+	return itm[n : n+int(l)]
+}
+
+func compareItems(a, b []byte) int {
+	return bytes.Compare(itemKey(a), itemKey(b))
+}
+
+func encodeRecord(buf []byte, r Record) []byte {
+	var meta [metaSize]byte
+
+	binary.BigEndian.PutUint64(meta[0:8], r.Version.Timestamp)
+	binary.BigEndian.PutUint64(meta[8:16], r.Version.Actor)
+	if r.Tombstone {
+		meta[16] = flagTombstone
+	}
+
+	buf = binary.AppendUvarint(buf[:0], uint64(len(r.Key)))
+	buf = append(buf, r.Key...)
+	buf = append(buf, meta[:]...)
+	return append(buf, r.Value...)
+}
+
+// DecodeRecord decodes an item of the store. The returned record aliases itm.
+func DecodeRecord(itm []byte) (Record, error) {
+	var r Record
+	l, n := binary.Uvarint(itm)
+	if n <= 0 || len(itm) < n+metaSize || l > uint64(len(itm)-n-metaSize) {
+		return r, errBadItem
+	}
+
+	meta := itm[n+int(l):]
+	r.Key = itm[n : n+int(l)]
+	r.Version.Timestamp = binary.BigEndian.Uint64(meta[0:8])
+	r.Version.Actor = binary.BigEndian.Uint64(meta[8:16])
+	r.Tombstone = meta[16]&flagTombstone != 0
+	r.Value = meta[metaSize:]
+	return r, nil
+}
+
+// tick returns the next timestamp of the hybrid logical clock, which follows
+// wall clock time but never goes backwards or behind observed timestamps
+func (s *Store) tick() uint64 {
+	now := uint64(time.Now().UnixNano())
+	if now <= s.clock {
+		now = s.clock + 1
+	}
+	s.clock = now
+	return now
+}
+
+func (s *Store) observe(ts uint64) {
+	if ts > s.clock {
+		s.clock = ts
+	}
+}
+
+// Put stores a value under key with a new local version
+func (s *Store) Put(key, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.write(Record{Key: key, Value: value, Version: Version{s.tick(), s.actor}})
+}
+
+// Delete records a tombstone for key
+func (s *Store) Delete(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.write(Record{Key: key, Version: Version{s.tick(), s.actor}, Tombstone: true})
+}
+
+func (s *Store) write(r Record) {
+	s.buf = encodeRecord(s.buf, r)
+	s.w.Upsert(s.buf)
+}
+
+// lookup returns the current record for key
+func (s *Store) lookup(key []byte) (Record, bool) {
+	s.buf = encodeRecord(s.buf, Record{Key: key})
+	n := s.w.GetNode(s.buf)
+	if n == nil {
+		return Record{}, false
+	}
+
+	itm := (*nitro.Item)(n.Item()).Bytes()
+	r, err := DecodeRecord(append([]byte(nil), itm...))
+	return r, err == nil
+}
+
+// Get returns the live value of key
+func (s *Store) Get(key []byte) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.lookup(key)
+	if !ok || r.Tombstone {
+		return nil, false
+	}
+	return r.Value, true
+}
+
+// Merge applies a record received from another replica and reports whether
+// the local state changed
+func (s *Store) Merge(remote Record) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.observe(remote.Version.Timestamp)
+	local, ok := s.lookup(remote.Key)
+	if !ok {
+		// Records below the horizon are known to every replica, a missing
+		// local record has been superseded by a purged tombstone
+		if remote.Version.Timestamp < s.horizon {
+			return false
+		}
+
+		s.write(remote)
+		return true
+	}
+
+	if local.Version == remote.Version {
+		return false
+	}
+
+	if s.merge != nil && !local.Tombstone && !remote.Tombstone {
+		merged := remote
+		if remote.Version.Less(local.Version) {
+			merged.Version = local.Version
+		}
+		merged.Value = s.merge(local, remote)
+		if !merged.Tombstone && bytes.Equal(merged.Value, local.Value) &&
+			merged.Version == local.Version {
+			return false
+		}
+		s.write(merged)
+		return true
+	}
+
+	if local.Version.Less(remote.Version) {
+		s.write(remote)
+		return true
+	}
+
+	return false
+}
+
+// Records invokes fn for every record, including tombstones, in key order.
+// The record is only valid during the callback.
+func (s *Store) Records(fn func(Record) bool) error {
+	// NewSnapshot must not run concurrently with the writer
+	s.mu.Lock()
+	snap, err := s.db.NewSnapshot()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		r, err := DecodeRecord(itr.Get())
+		if err != nil {
+			return err
+		}
+		if !fn(r) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// PurgeTombstones removes the tombstones with a timestamp below horizon and
+// returns the number of removed tombstones. The horizon must not exceed the
+// timestamp up to which all replicas have synced their records, so that no
+// replica still holds a write older than a purged delete. Records below the
+// horizon received by Merge afterwards are ignored unless they update an
+// existing record.
+func (s *Store) PurgeTombstones(horizon uint64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if horizon > s.horizon {
+		s.horizon = horizon
+	}
+
+	snap, err := s.db.NewSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Close()
+
+	var count int
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		r, err := DecodeRecord(itr.Get())
+		if err != nil {
+			return count, err
+		}
+
+		if r.Tombstone && r.Version.Timestamp < s.horizon && s.w.Delete(itr.Get()) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Sync merges the records of a into b and of b into a, after which both
+// stores hold the same records. Returns the number of records changed in a
+// and b.
+func Sync(a, b *Store) (changedA, changedB int, err error) {
+	copyRecord := func(r Record) Record {
+		r.Key = append([]byte(nil), r.Key...)
+		r.Value = append([]byte(nil), r.Value...)
+		return r
+	}
+
+	var fromA, fromB []Record
+	if err = a.Records(func(r Record) bool {
+		fromA = append(fromA, copyRecord(r))
+		return true
+	}); err != nil {
+		return
+	}
+
+	if err = b.Records(func(r Record) bool {
+		fromB = append(fromB, copyRecord(r))
+		return true
+	}); err != nil {
+		return
+	}
+
+	for _, r := range fromA {
+		if b.Merge(r) {
+			changedB++
+		}
+	}
+
+	for _, r := range fromB {
+		if a.Merge(r) {
+			changedA++
+		}
+	}
+
+	return
+}
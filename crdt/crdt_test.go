@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package crdt
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+func TestLastWriterWins(t *testing.T) {
+	a := New(1, nil)
+	defer a.Close()
+	b := New(2, nil)
+	defer b.Close()
+
+	a.Put([]byte("k1"), []byte("a"))
+	b.Put([]byte("k1"), []byte("b"))
+	a.Put([]byte("k2"), []byte("a"))
+	b.Put([]byte("k3"), []byte("b"))
+	b.Delete([]byte("k2"))
+
+	if _, _, err := Sync(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*Store{a, b} {
+		if v, _ := s.Get([]byte("k1")); string(v) != "b" {
+			t.Errorf("expected latest write to win, got %s", v)
+		}
+		if v, ok := s.Get([]byte("k2")); ok {
+			t.Errorf("expected k2 to be deleted, got %s", v)
+		}
+		if v, _ := s.Get([]byte("k3")); string(v) != "b" {
+			t.Errorf("expected k3 to be replicated, got %s", v)
+		}
+	}
+
+	if ca, cb, _ := Sync(a, b); ca != 0 || cb != 0 {
+		t.Errorf("expected converged stores, got %d, %d changes", ca, cb)
+	}
+}
+
+func TestMergeFn(t *testing.T) {
+	union := func(local, remote Record) []byte {
+		set := map[string]bool{}
+		for _, v := range [][]byte{local.Value, remote.Value} {
+			for _, e := range bytes.Split(v, []byte(",")) {
+				set[string(e)] = true
+			}
+		}
+
+		var elems []string
+		for e := range set {
+			elems = append(elems, e)
+		}
+		sort.Strings(elems)
+
+		var out [][]byte
+		for _, e := range elems {
+			out = append(out, []byte(e))
+		}
+		return bytes.Join(out, []byte(","))
+	}
+
+	a := New(1, union)
+	defer a.Close()
+	b := New(2, union)
+	defer b.Close()
+
+	a.Put([]byte("set"), []byte("x,y"))
+	b.Put([]byte("set"), []byte("y,z"))
+	Sync(a, b)
+
+	for _, s := range []*Store{a, b} {
+		if v, _ := s.Get([]byte("set")); string(v) != "x,y,z" {
+			t.Errorf("expected merged set, got %s", v)
+		}
+	}
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	a := New(1, nil)
+	defer a.Close()
+	b := New(2, nil)
+	defer b.Close()
+
+	a.Put([]byte("k1"), []byte("a"))
+	Sync(a, b)
+	b.Delete([]byte("k1"))
+	Sync(a, b)
+
+	horizon := a.clock + 1
+	for _, s := range []*Store{a, b} {
+		if n, err := s.PurgeTombstones(horizon); err != nil || n != 1 {
+			t.Errorf("expected 1 purged tombstone, got %d (%v)", n, err)
+		}
+	}
+
+	// The old write must not be resurrected by a replica below the horizon
+	if a.Merge(Record{Key: []byte("k1"), Value: []byte("a"), Version: Version{horizon - 1, 1}}) {
+		t.Errorf("expected record below the horizon to be ignored")
+	}
+
+	long := bytes.Repeat([]byte("k"), 70000)
+	a.Put(long, []byte("v"))
+	if v, ok := a.Get(long); !ok || string(v) != "v" {
+		t.Errorf("expected long key to be stored, got %s", v)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ErrInvalidCursor means a cursor which was not returned by Iterator.Cursor
+var ErrInvalidCursor = fmt.Errorf("Invalid iterator cursor")
+
+// Version of the cursor encoding
+const cursorVersion = 1
+
+// Cursor returns a token of the position of the iterator, i.e., its current
+// item, and of its end set by SetEnd or SeekPrefix, which NewIteratorAt
+// resumes the scan from. The token does not refer to the snapshot or the
+// iterator, which can be closed. It returns nil if the iterator is not
+// valid, the scan is complete. The limit of SetLimit is ignored, so that the
+// cursor of an iterator which returned a page of items points to the first
+// item of the next page.
+//
+// The token is encoded as [version][item][end][prefix], where the fields
+// are prefixed by their length plus one as a uvarint, 0 denoting nil.
+func (it *Iterator) Cursor() []byte {
+	limit := it.limit
+	it.limit = 0
+	valid := it.Valid()
+	it.limit = limit
+	if !valid {
+		return nil
+	}
+
+	itm := it.Get()
+	if it.err != nil {
+		return nil
+	}
+
+	var end []byte
+	if it.endItm != nil {
+		end = it.endItm.Bytes()
+	}
+
+	token := []byte{cursorVersion}
+	for _, f := range [][]byte{itm, end, it.prefix} {
+		token = appendCursorField(token, f)
+	}
+	return token
+}
+
+func appendCursorField(token, f []byte) []byte {
+	if f == nil {
+		return binary.AppendUvarint(token, 0)
+	}
+
+	token = binary.AppendUvarint(token, uint64(len(f))+1)
+	return append(token, f...)
+}
+
+// decodeCursor returns the fields of a cursor token
+func decodeCursor(token []byte) (fields [3][]byte, err error) {
+	if len(token) == 0 || token[0] != cursorVersion {
+		return fields, ErrInvalidCursor
+	}
+
+	token = token[1:]
+	for i := range fields {
+		l, n := binary.Uvarint(token)
+		if n <= 0 || l > uint64(len(token)-n)+1 {
+			return fields, ErrInvalidCursor
+		}
+
+		token = token[n:]
+		if l > 0 {
+			// An empty field is kept apart from nil, e.g., an empty item
+			fields[i] = make([]byte, l-1)
+			copy(fields[i], token)
+			token = token[l-1:]
+		}
+	}
+
+	if len(token) > 0 || fields[0] == nil {
+		return fields, ErrInvalidCursor
+	}
+	return fields, nil
+}
+
+// NewIteratorAt creates an iterator positioned at the item of a cursor
+// returned by Iterator.Cursor, or at the next bigger item if it does not
+// exist in the snapshot, with the end of the iterator which returned the
+// cursor. The snapshot can be the snapshot of that iterator or a newer one,
+// so that a scan can be paused and resumed without holding its iterator
+// open. It returns ErrInvalidCursor if the cursor is malformed and
+// ErrSnapshotClosed if the snapshot has been closed.
+func (s *Snapshot) NewIteratorAt(cursor []byte) (*Iterator, error) {
+	fields, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	itr, err := s.OpenIterator()
+	if err != nil {
+		return nil, err
+	}
+
+	itm, end, prefix := fields[0], fields[1], fields[2]
+	itr.SetEnd(end)
+	itr.prefix = prefix
+	itr.Seek(itm)
+	return itr, nil
+}
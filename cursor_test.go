@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIteratorCursor(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n := 1000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	itr := snap.NewIterator()
+	itr.SetEnd([]byte(fmt.Sprintf("%010d", 500)))
+	itr.SetLimit(100)
+	count := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		count++
+	}
+	cursor := itr.Cursor()
+	itr.Close()
+	snap.Close()
+	if count != 100 || cursor == nil {
+		t.Fatalf("Expected a page of 100 items and a cursor, got %d", count)
+	}
+
+	// The scan is resumed from a newer snapshot, which misses the deleted
+	// item of the cursor, until the end of the first iterator
+	w.Delete([]byte(fmt.Sprintf("%010d", 100)))
+	snap, _ = db.NewSnapshot()
+	defer snap.Close()
+	for page := 1; cursor != nil; page++ {
+		itr, err := snap.NewIteratorAt(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		itr.SetLimit(100)
+		for ; itr.Valid(); itr.Next() {
+			if expected := fmt.Sprintf("%010d", count+1); string(itr.Get()) != expected {
+				t.Fatalf("Expected %s, got %s", expected, itr.Get())
+			}
+			count++
+		}
+		cursor = itr.Cursor()
+		itr.Close()
+	}
+
+	if count != 499 {
+		t.Errorf("Expected to resume up to the end, got %d items", count)
+	}
+
+	if _, err := snap.NewIteratorAt([]byte{cursorVersion, 5, 'a'}); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestIteratorCursorEmptyItem(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for _, k := range []string{"", "a", "b"} {
+		w.Put([]byte(k))
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	itr := snap.NewIterator()
+	itr.SeekFirst()
+	cursor := itr.Cursor()
+	itr.Close()
+
+	fields, err := decodeCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields[0] == nil || len(fields[0]) != 0 {
+		t.Errorf("Expected an empty item, got %q", fields[0])
+	}
+
+	itr, err = snap.NewIteratorAt(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+
+	var items []string
+	for ; itr.Valid(); itr.Next() {
+		items = append(items, string(itr.Get()))
+	}
+	if fmt.Sprint(items) != fmt.Sprint([]string{"", "a", "b"}) {
+		t.Errorf("Expected to resume from the empty item, got %q", items)
+	}
+
+	if _, err := snap.NewIteratorAt([]byte{cursorVersion, 0, 0, 0}); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package nitro
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/elliotcourant/nitro/mm"
+	"github.com/elliotcourant/nitro/skiplist"
+)
+
+// debugMode is set by Debug
+var debugMode bool
+
+// Debug enables debug mode
+// Additional details will be logged in the statistics. Closed snapshots and
+// iterators are poisoned, using them panics with the stack of the Close call.
+func Debug(flag bool) {
+	skiplist.Debug = flag
+	mm.Debug = flag
+	debugMode = flag
+}
+
+// closeInfo records where an object was closed
+type closeInfo struct {
+	stack []byte
+}
+
+func newCloseInfo() *closeInfo {
+	return &closeInfo{stack: debug.Stack()}
+}
+
+func (ci *closeInfo) panicUsed(what string) {
+	panic(fmt.Sprintf("nitro: %s used after Close, closed at:\n%s", what, ci.stack))
+}
+
+// markClosed poisons a snapshot whose last reference is released
+func (s *Snapshot) markClosed() {
+	if debugMode {
+		atomic.StorePointer(&s.closed, unsafe.Pointer(newCloseInfo()))
+		s.db.leaks.remove(s)
+	}
+}
+
+// checkOpen panics if the snapshot has been closed in debug mode
+func (s *Snapshot) checkOpen() {
+	if ci := (*closeInfo)(atomic.LoadPointer(&s.closed)); ci != nil {
+		ci.panicUsed("Snapshot")
+	}
+}
+
+// checkOpen panics if the iterator has been closed in debug mode
+func (it *Iterator) checkOpen() {
+	if it.closed != nil {
+		it.closed.panicUsed("Iterator")
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"unsafe"
+)
+
+// dumpSource describes the files of a backup read by ApplyFromDump
+type dumpSource struct {
+	dir    string
+	format DumpFormat
+	shards []DumpShardInfo
+	// Items of the delta shards in key order
+	deltas [][]byte
+}
+
+// openDumpSource reads the file list and the delta shards of a backup. Data
+// shards are described by the manifest, backups without a manifest list the
+// data shards without key ranges.
+func (m *Nitro) openDumpSource(dir string) (*dumpSource, error) {
+	hdr, err := readDumpHeader(dir)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Keyspace != "" {
+		return nil, ErrKeyspaceBackup
+	}
+	if hdr.MetadataSize != m.itemMetaSize {
+		return nil, ErrMetadataSizeMismatch
+	}
+
+	src := &dumpSource{dir: dir}
+	if src.format, err = readDumpFormat(dir, m.dumpFormat); err != nil {
+		return nil, err
+	}
+
+	var deltaFiles []string
+	if dm, err := DumpInfo(dir); err == nil {
+		src.shards = dm.Shards
+		for _, s := range dm.DeltaShards {
+			deltaFiles = append(deltaFiles, s.File)
+		}
+	} else if err != ErrNoDumpManifest {
+		return nil, err
+	} else {
+		var files []string
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "data", "files.json"))
+		if err == nil {
+			err = json.Unmarshal(bs, &files)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			src.shards = append(src.shards, DumpShardInfo{File: file, Items: -1})
+		}
+
+		if bs, err := ioutil.ReadFile(filepath.Join(dir, "delta", "files.json")); err == nil {
+			json.Unmarshal(bs, &deltaFiles)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	// Delta shards are not sorted, they are small compared to the data shards
+	for _, file := range deltaFiles {
+		r := m.newDeltaFileReader(m.fileType, src.format, hdr.FramedDeltas)
+		if err := r.Open(filepath.Join(dir, "delta", file)); err != nil {
+			return nil, err
+		}
+
+		for {
+			itm, err := r.ReadItem()
+			if err != nil {
+				r.Close()
+				return nil, err
+			} else if itm == nil {
+				break
+			}
+
+			src.deltas = append(src.deltas, append([]byte(nil), itm.Bytes()...))
+			m.freeItem(itm)
+		}
+		r.Close()
+	}
+
+	sort.Slice(src.deltas, func(i, j int) bool {
+		return m.keyCmp(src.deltas[i], src.deltas[j]) < 0
+	})
+
+	return src, nil
+}
+
+// dumpOpIterator is a BatchOpIterator which inserts the items of a backup in
+// the key range [start, end). The sorted data shards and delta items are
+// merged in key order.
+type dumpOpIterator struct {
+	m          *Nitro
+	start, end []byte
+
+	readers []FileReader
+	heads   []*Item
+	deltas  [][]byte
+
+	itm unsafe.Pointer
+	err error
+}
+
+func (m *Nitro) newDumpOpIterator(src *dumpSource, start, end []byte) (*dumpOpIterator, error) {
+	it := &dumpOpIterator{m: m, start: start, end: end}
+	inRange := func(minKey, maxKey []byte) bool {
+		return (start == nil || m.keyCmp(maxKey, start) >= 0) &&
+			(end == nil || m.keyCmp(minKey, end) < 0)
+	}
+
+	for _, s := range src.shards {
+		if s.Items == 0 || (s.Items > 0 && !inRange(s.MinKey, s.MaxKey)) {
+			continue
+		}
+
+		r := m.newFileReader(m.fileType, src.format)
+		if err := r.Open(filepath.Join(src.dir, "data", s.File)); err != nil {
+			it.Close()
+			return nil, err
+		}
+
+		it.readers = append(it.readers, r)
+		it.heads = append(it.heads, nil)
+		if err := it.seek(len(it.readers) - 1); err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+
+	lo := 0
+	if start != nil {
+		lo = sort.Search(len(src.deltas), func(i int) bool {
+			return m.keyCmp(src.deltas[i], start) >= 0
+		})
+	}
+	it.deltas = src.deltas[lo:]
+
+	it.Next()
+	return it, nil
+}
+
+// seek positions a data shard reader at its first item in the key range
+func (it *dumpOpIterator) seek(shard int) error {
+	for {
+		itm, err := it.readers[shard].ReadItem()
+		if err != nil || itm == nil {
+			return err
+		}
+
+		if it.start == nil || it.m.keyCmp(itm.Bytes(), it.start) >= 0 {
+			it.heads[shard] = itm
+			return nil
+		}
+		it.m.freeItem(itm)
+	}
+}
+
+// advance reads the next item of a data shard
+func (it *dumpOpIterator) advance(shard int) {
+	it.m.freeItem(it.heads[shard])
+	itm, err := it.readers[shard].ReadItem()
+	if err != nil && it.err == nil {
+		// ExecBatchOps has no error path for iterators, the error is
+		// returned once the operations are applied
+		it.err = err
+	}
+	it.heads[shard] = itm
+}
+
+func (it *dumpOpIterator) Next() {
+	// Smallest head of the data shards and delta items
+	var key []byte
+	for _, itm := range it.heads {
+		if itm != nil && (key == nil || it.m.keyCmp(itm.Bytes(), key) < 0) {
+			key = itm.Bytes()
+		}
+	}
+	if len(it.deltas) > 0 && (key == nil || it.m.keyCmp(it.deltas[0], key) < 0) {
+		key = it.deltas[0]
+	}
+
+	if key == nil || (it.end != nil && it.m.keyCmp(key, it.end) >= 0) {
+		it.itm = nil
+		return
+	}
+
+	dst := it.m.allocItem(len(key), false)
+	copy(dst.Bytes(), key)
+	dst.bornSn = it.m.getCurrSn()
+	it.itm = unsafe.Pointer(dst)
+
+	// Items may be stored in a data shard and a delta shard
+	for shard, itm := range it.heads {
+		for itm != nil && it.m.keyCmp(itm.Bytes(), dst.Bytes()) == 0 {
+			it.advance(shard)
+			itm = it.heads[shard]
+		}
+	}
+	for len(it.deltas) > 0 && it.m.keyCmp(it.deltas[0], dst.Bytes()) == 0 {
+		it.deltas = it.deltas[1:]
+	}
+}
+
+func (it *dumpOpIterator) Valid() bool {
+	return it.itm != nil
+}
+
+func (it *dumpOpIterator) Item() unsafe.Pointer {
+	return it.itm
+}
+
+func (it *dumpOpIterator) Op() itemOp {
+	return itemInsertop
+}
+
+func (it *dumpOpIterator) Close() {
+	for i, r := range it.readers {
+		if it.heads[i] != nil {
+			it.m.freeItem(it.heads[i])
+			it.heads[i] = nil
+		}
+		r.Close()
+	}
+	it.readers = nil
+}
+
+// ApplyFromDump inserts the items of a backup written by StoreToDisk into an
+// instance with a block store, replacing the items with the same key. Unlike
+// loading the backup into a temporary instance and calling ApplyOps, the
+// items are streamed from the backup files, so that bulk ingestion does not
+// hold the backup in memory. The data shards are read by concurr workers,
+// each of them applies the items of a key range of the block store. The
+// items of the delta shards are sorted in memory.
+//
+// Instances without a block store insert the items through a writer and
+// return empty stats. Keyspace backups are not supported.
+func (m *Nitro) ApplyFromDump(dir string, concurr int) (BatchOpStats, error) {
+	src, err := m.openDumpSource(dir)
+	if err != nil {
+		return BatchOpStats{}, err
+	}
+
+	if !m.HasBlockStore() {
+		it, err := m.newDumpOpIterator(src, nil, nil)
+		if err != nil {
+			return BatchOpStats{}, err
+		}
+		defer it.Close()
+
+		w := m.NewWriter()
+		for ; it.Valid(); it.Next() {
+			w.Upsert((*Item)(it.Item()).Bytes())
+		}
+		return BatchOpStats{}, it.err
+	}
+
+	var itrs []*dumpOpIterator
+	sts, err := m.applyOps(concurr, func(start, end *Item) (BatchOpIterator, error) {
+		it, err := m.newDumpOpIterator(src, start.Bytes(), end.Bytes())
+		if err == nil {
+			itrs = append(itrs, it)
+		}
+		return it, err
+	})
+
+	for _, it := range itrs {
+		if err == nil {
+			err = it.err
+		}
+	}
+
+	return sts, err
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApplyFromDump(t *testing.T) {
+	n := 20000
+	src := NewWithConfig(testConf)
+	defer src.Close()
+
+	w := src.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+	cs := snapChecksum(t, snap)
+
+	// StoreToDisk closes the snapshot
+	snap.Open()
+	dir := t.TempDir()
+	if err := src.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		conf = testConf
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	// The items of the second round exist
+	for round := 0; round < 2; round++ {
+		if _, err := db.ApplyFromDump(dir, 4); err != nil {
+			t.Fatal(err)
+		}
+
+		snap2, _ := db.NewSnapshot()
+		if snapChecksum(t, snap2) != cs {
+			t.Errorf("Expected items matching the backup in round %d", round)
+		}
+		snap2.Close()
+	}
+
+	if _, err := src.ApplyFromDump(t.TempDir(), 4); err == nil {
+		t.Errorf("Expected an error for a missing backup")
+	}
+}
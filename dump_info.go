@@ -0,0 +1,127 @@
+package nitro
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrNoDumpManifest means the backup directory has no manifest, e.g.,
+// because it was written by upstream nitro or an older version of this
+// package
+var ErrNoDumpManifest = fmt.Errorf("Backup has no manifest")
+
+const dumpManifestFile = "manifest.json"
+
+var dumpCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// DumpShardInfo describes a shard file of a backup. Keys are stored as they
+// are written to the file, i.e., without the keyspace prefix in keyspace
+// backups. The checksum is the CRC-32C of the file contents.
+type DumpShardInfo struct {
+	File     string `json:"file"`
+	Items    int64  `json:"items"`
+	MinKey   []byte `json:"min_key,omitempty"`
+	MaxKey   []byte `json:"max_key,omitempty"`
+	Bytes    int64  `json:"bytes"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// DumpManifest describes the contents of a backup written by StoreToDisk
+type DumpManifest struct {
+	Format      string          `json:"format"`
+	Keyspace    string          `json:"keyspace,omitempty"`
+	Shards      []DumpShardInfo `json:"shards"`
+	DeltaShards []DumpShardInfo `json:"delta_shards,omitempty"`
+}
+
+// Items returns the number of items of the data shards. Items of the delta
+// shards are not included, they may be duplicates of items stored in the
+// data shards.
+func (dm *DumpManifest) Items() (n int64) {
+	for _, s := range dm.Shards {
+		n += s.Items
+	}
+	return
+}
+
+// Bytes returns the size of all shard files
+func (dm *DumpManifest) Bytes() (n int64) {
+	for _, s := range dm.Shards {
+		n += s.Bytes
+	}
+	for _, s := range dm.DeltaShards {
+		n += s.Bytes
+	}
+	return
+}
+
+// DumpInfo reads the manifest of a backup directory without loading the
+// backup
+func DumpInfo(dir string) (*DumpManifest, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(dir, dumpManifestFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNoDumpManifest
+	} else if err != nil {
+		return nil, err
+	}
+
+	dm := new(DumpManifest)
+	if err := json.Unmarshal(bs, dm); err != nil {
+		return nil, err
+	}
+
+	return dm, nil
+}
+
+func writeDumpManifest(dir string, dm *DumpManifest) error {
+	bs, err := json.Marshal(dm)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, dumpManifestFile), bs, 0660)
+}
+
+// shardInfoWriter is implemented by backup file writers which collect the
+// statistics of the written file
+type shardInfoWriter interface {
+	shardInfo() DumpShardInfo
+}
+
+// closeDumpWriters closes the writers of a backup and returns the
+// statistics of their files
+func closeDumpWriters(writers []FileWriter, files []string) ([]DumpShardInfo, error) {
+	infos := make([]DumpShardInfo, len(writers))
+	for i, w := range writers {
+		writers[i] = nil
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		if sw, ok := w.(shardInfoWriter); ok {
+			infos[i] = sw.shardInfo()
+		}
+		infos[i].File = files[i]
+	}
+
+	return infos, nil
+}
+
+// checksumWriter counts and checksums the bytes written to a backup file
+type checksumWriter struct {
+	w   io.Writer
+	n   int64
+	crc uint32
+}
+
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.crc = crc32.Update(cw.crc, dumpCrcTable, p[:n])
+	return n, err
+}
@@ -12,6 +12,17 @@ package nitro
 import "os"
 import "bufio"
 import "errors"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "path/filepath"
+import "sync/atomic"
+import "io"
+import "hash/crc32"
+import "encoding/binary"
+
+// deltaFrameHeaderSize is the size of the header of a framed delta record
+const deltaFrameHeaderSize = 16
 
 var (
 	// DiskBlockSize - backup file reader and writer
@@ -29,6 +40,88 @@ const (
 	RawdbFile FileType = iota
 )
 
+// DumpFormat describes the encoding of items in backup files
+type DumpFormat int
+
+const (
+	// NativeDumpFormat encodes items in [2 byte len][item_bytes] format
+	NativeDumpFormat DumpFormat = iota
+	// CouchbaseDumpFormat encodes items in [4 byte len][item_bytes] format
+	// as done by upstream couchbase/nitro
+	CouchbaseDumpFormat
+)
+
+var dumpFormatNames = map[DumpFormat]string{
+	NativeDumpFormat:    "native",
+	CouchbaseDumpFormat: "couchbase",
+}
+
+func (f DumpFormat) String() string {
+	return dumpFormatNames[f]
+}
+
+func (f DumpFormat) lenSize() int {
+	if f == CouchbaseDumpFormat {
+		return 4
+	}
+	return 2
+}
+
+const dumpHeaderFile = "header.json"
+
+// dumpHeader is stored at the top level of a backup directory and describes
+// its format. Upstream couchbase/nitro neither writes nor reads it.
+type dumpHeader struct {
+	Format   string `json:"format"`
+	Version  int    `json:"version"`
+	Keyspace string `json:"keyspace,omitempty"`
+	// Delta shards are written as framed records, see newDeltaFileWriter
+	FramedDeltas bool `json:"framed_deltas,omitempty"`
+	// Records end with the item metadata, see SetItemMetadataSize
+	MetadataSize int `json:"metadata_size,omitempty"`
+}
+
+func writeDumpHeader(dir string, hdr dumpHeader) error {
+	hdr.Version = 1
+	bs, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, dumpHeaderFile), bs, 0660)
+}
+
+// readDumpFormat returns the format recorded in the header of a backup
+// directory. Backups without a header were written by upstream nitro or an
+// older version of this package and are assumed to be in format def.
+func readDumpFormat(dir string, def DumpFormat) (DumpFormat, error) {
+	hdr, err := readDumpHeader(dir)
+	if err != nil || hdr.Format == "" {
+		return def, err
+	}
+
+	for f, name := range dumpFormatNames {
+		if name == hdr.Format {
+			return f, nil
+		}
+	}
+
+	return def, fmt.Errorf("unknown dump format %q", hdr.Format)
+}
+
+// readDumpHeader returns the header of a backup directory, or an empty header
+// if the backup has none.
+func readDumpHeader(dir string) (hdr dumpHeader, err error) {
+	bs, err := ioutil.ReadFile(filepath.Join(dir, dumpHeaderFile))
+	if os.IsNotExist(err) {
+		return hdr, nil
+	} else if err != nil {
+		return hdr, err
+	}
+
+	err = json.Unmarshal(bs, &hdr)
+	return
+}
+
 // FileWriter represents backup file writer
 type FileWriter interface {
 	Open(path string) error
@@ -43,42 +136,171 @@ type FileReader interface {
 	Close() error
 }
 
-func (m *Nitro) newFileWriter(t FileType) FileWriter {
+// newFileWriter creates a backup file writer. The first stripLen bytes of
+// every item are not written.
+func (m *Nitro) newFileWriter(t FileType, stripLen int) FileWriter {
+	return m.newFormatFileWriter(t, m.dumpFormat, stripLen)
+}
+
+// newFormatFileWriter creates a backup file writer for format f, e.g., to
+// add files to an existing backup
+func (m *Nitro) newFormatFileWriter(t FileType, f DumpFormat, stripLen int) FileWriter {
 	var w FileWriter
 	if t == RawdbFile {
-		w = &rawFileWriter{db: m}
+		w = &rawFileWriter{db: m, format: f, stripLen: stripLen}
 	}
 	return w
 }
 
-func (m *Nitro) newFileReader(t FileType) FileReader {
+func (m *Nitro) newFileReader(t FileType, f DumpFormat) FileReader {
 	var r FileReader
 	if t == RawdbFile {
-		r = &rawFileReader{db: m}
+		r = &rawFileReader{db: m, format: f}
+	}
+	return r
+}
+
+// newDeltaFileWriter creates a delta shard writer. Every record is framed as
+// [4 byte len][4 byte checksum][8 byte seqno][item_bytes], the checksum is the
+// CRC-32C of the seqno and item bytes. Seqnos of a file are consecutive, so a
+// torn write at the tail of a file is detected on restore.
+func (m *Nitro) newDeltaFileWriter(t FileType, f DumpFormat) FileWriter {
+	var w FileWriter
+	if t == RawdbFile {
+		w = &rawFileWriter{db: m, format: f, framed: true}
+	}
+	return w
+}
+
+// newDeltaFileReader creates a delta shard reader. With framed records, the
+// file ends at the first torn or corrupt record.
+func (m *Nitro) newDeltaFileReader(t FileType, f DumpFormat, framed bool) FileReader {
+	var r FileReader
+	if t == RawdbFile {
+		r = &rawFileReader{db: m, format: f, framed: framed}
 	}
 	return r
 }
 
 type rawFileWriter struct {
-	db   *Nitro
-	fd   *os.File
-	w    *bufio.Writer
-	buf  []byte
-	path string
+	db       *Nitro
+	fd       *os.File
+	cw       *checksumWriter
+	w        *bufio.Writer
+	buf      []byte
+	path     string
+	format   DumpFormat
+	stripLen int
+	framed   bool
+	seqno    uint64
+	metaBuf  []byte
+
+	items          int64
+	minKey, maxKey []byte
 }
 
 func (f *rawFileWriter) Open(path string) error {
 	var err error
-	f.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0755)
+	f.fd, err = openFile(path, os.O_WRONLY|os.O_CREATE, 0755)
 	if err == nil {
-		f.buf = make([]byte, encodeBufSize)
-		f.w = bufio.NewWriterSize(f.fd, DiskBlockSize)
+		f.buf = make([]byte, deltaFrameHeaderSize)
+		f.cw = &checksumWriter{w: f.fd}
+		f.w = bufio.NewWriterSize(f.cw, DiskBlockSize)
 	}
 	return err
 }
 
 func (f *rawFileWriter) WriteItem(itm *Item) error {
-	return f.db.EncodeItem(itm, f.buf, f.w)
+	key := itm.Bytes()
+	data, ok, err := f.encode(key)
+	if err != nil || !ok {
+		return err
+	}
+
+	data = withMetadata(data, itm.metadata(f.db.itemMetaSize), &f.metaBuf)
+
+	if f.framed {
+		err = f.writeFrame(data)
+	} else {
+		err = encodeItemBytes(data, f.buf, f.w, f.format)
+	}
+
+	if err != nil || len(key) == 0 {
+		return err
+	}
+
+	f.track(key)
+	return nil
+}
+
+// withMetadata returns the record of the item data followed by its metadata,
+// which is built in buf
+func withMetadata(data, meta []byte, buf *[]byte) []byte {
+	if len(meta) == 0 || len(data) == 0 {
+		return data
+	}
+
+	*buf = append(append((*buf)[:0], data...), meta...)
+	return *buf
+}
+
+// encode returns the data written to the file for an item. Items dropped by
+// the item codec are not written.
+func (f *rawFileWriter) encode(key []byte) (data []byte, ok bool, err error) {
+	data = key
+	if len(data) > 0 {
+		data = data[f.stripLen:]
+	}
+
+	if f.db.encodeItemFn != nil && len(data) > 0 {
+		if data, err = f.db.encodeItemFn(data); err != nil || len(data) == 0 {
+			return nil, false, err
+		}
+	}
+
+	return data, true, nil
+}
+
+// writeFrame writes the data of an item as a framed delta record
+func (f *rawFileWriter) writeFrame(data []byte) error {
+	f.seqno++
+	binary.BigEndian.PutUint32(f.buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(f.buf[8:16], f.seqno)
+	crc := crc32.Update(crc32.Checksum(f.buf[8:16], dumpCrcTable), dumpCrcTable, data)
+	binary.BigEndian.PutUint32(f.buf[4:8], crc)
+
+	if _, err := f.w.Write(f.buf[:deltaFrameHeaderSize]); err != nil {
+		return err
+	}
+	_, err := f.w.Write(data)
+	return err
+}
+
+// track updates the statistics of the file for a written item
+func (f *rawFileWriter) track(key []byte) {
+	f.items++
+	if f.minKey == nil || f.db.keyCmp(key, f.minKey) < 0 {
+		f.minKey = append(f.minKey[:0], key...)
+	}
+	if f.maxKey == nil || f.db.keyCmp(key, f.maxKey) > 0 {
+		f.maxKey = append(f.maxKey[:0], key...)
+	}
+}
+
+// shardInfo returns the statistics of the file, the file has to be closed
+func (f *rawFileWriter) shardInfo() DumpShardInfo {
+	info := DumpShardInfo{
+		Items:    f.items,
+		Bytes:    f.cw.n,
+		Checksum: f.cw.crc,
+	}
+
+	if f.items > 0 {
+		info.MinKey = f.minKey[f.stripLen:]
+		info.MaxKey = f.maxKey[f.stripLen:]
+	}
+
+	return info
 }
 
 func (f *rawFileWriter) Close() error {
@@ -88,30 +310,164 @@ func (f *rawFileWriter) Close() error {
 		return err
 	}
 
-	f.w.Flush()
+	if err := f.w.Flush(); err != nil {
+		f.fd.Close()
+		return err
+	}
 	return f.fd.Close()
 }
 
 type rawFileReader struct {
-	db   *Nitro
-	fd   *os.File
-	r    *bufio.Reader
-	buf  []byte
-	path string
+	db     *Nitro
+	fd     *os.File
+	cr     *countingReader
+	r      *bufio.Reader
+	buf    []byte
+	path   string
+	format DumpFormat
+
+	framed    bool
+	seqno     uint64
+	size      int64
+	truncated bool
 }
 
 func (f *rawFileReader) Open(path string) error {
 	var err error
-	f.fd, err = os.Open(path)
+	f.fd, err = openFile(path, os.O_RDONLY, 0)
 	if err == nil {
-		f.buf = make([]byte, encodeBufSize)
-		f.r = bufio.NewReaderSize(f.fd, DiskBlockSize)
+		f.buf = make([]byte, deltaFrameHeaderSize)
+		f.cr = &countingReader{r: f.fd}
+		f.r = bufio.NewReaderSize(f.cr, DiskBlockSize)
+	}
+
+	if err == nil && f.framed {
+		var fi os.FileInfo
+		if fi, err = f.fd.Stat(); err == nil {
+			f.size = fi.Size()
+		} else {
+			f.fd.Close()
+		}
 	}
 	return err
 }
 
+// readFrame reads a framed delta record. A torn or corrupt record ends the
+// file, it was not completely written when the backup was taken.
+func (f *rawFileReader) readFrame() (*Item, error) {
+	if _, err := io.ReadFull(f.r, f.buf[:deltaFrameHeaderSize]); err != nil {
+		return f.truncate(err)
+	}
+
+	l := int64(binary.BigEndian.Uint32(f.buf[0:4]))
+	crc := binary.BigEndian.Uint32(f.buf[4:8])
+	seqno := binary.BigEndian.Uint64(f.buf[8:16])
+	if seqno != f.seqno+1 || l > f.size {
+		return f.truncate(nil)
+	}
+
+	sum := crc32.Checksum(f.buf[8:16], dumpCrcTable)
+	if l == 0 {
+		if sum != crc {
+			return f.truncate(nil)
+		}
+		return nil, nil
+	}
+
+	itm := f.db.allocItem(int(l), f.db.useMemoryMgmt)
+	data := itm.Bytes()
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		f.db.freeItem(itm)
+		return f.truncate(err)
+	}
+
+	if crc32.Update(sum, dumpCrcTable, data) != crc {
+		f.db.freeItem(itm)
+		return f.truncate(nil)
+	}
+
+	f.seqno = seqno
+	return itm, nil
+}
+
+// truncate ends the file at a torn or corrupt record
+func (f *rawFileReader) truncate(err error) (*Item, error) {
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	f.truncated = true
+	return nil, nil
+}
+
+// truncatedTail reports whether the file ended at a torn or corrupt record
+func (f *rawFileReader) truncatedTail() bool {
+	return f.truncated
+}
+
+func (f *rawFileReader) trackIO(depth *int32) {
+	f.cr.depth = depth
+}
+
+// BytesRead returns the number of bytes read from the file
+func (f *rawFileReader) BytesRead() int64 {
+	return atomic.LoadInt64(&f.cr.n)
+}
+
 func (f *rawFileReader) ReadItem() (*Item, error) {
-	return f.db.DecodeItem(f.buf, f.r)
+	for {
+		var itm *Item
+		var err error
+		if f.framed {
+			itm, err = f.readFrame()
+		} else {
+			itm, err = f.db.decodeItem(f.buf, f.r, f.format)
+		}
+
+		if err != nil || itm == nil {
+			return itm, err
+		}
+
+		if err := f.splitMetadata(itm); err != nil {
+			f.db.freeItem(itm)
+			return nil, err
+		}
+
+		if f.db.decodeItemFn == nil {
+			return itm, nil
+		}
+
+		data, err := f.db.decodeItemFn(itm.Bytes())
+		if err != nil {
+			f.db.freeItem(itm)
+			return nil, err
+		}
+
+		if len(data) > 0 {
+			newItm := f.db.newItem(data, f.db.useMemoryMgmt)
+			copy(newItm.metadata(f.db.itemMetaSize), itm.metadata(f.db.itemMetaSize))
+			f.db.freeItem(itm)
+			return newItm, nil
+		}
+
+		f.db.freeItem(itm)
+	}
+}
+
+// splitMetadata moves the metadata at the end of the record read into an
+// item out of its data. The item was allocated with room for the metadata
+// after the record, which is left unused.
+func (f *rawFileReader) splitMetadata(itm *Item) error {
+	sz := uint32(f.db.itemMetaSize)
+	if sz == 0 {
+		return nil
+	}
+
+	if itm.dataLen < sz {
+		return ErrMetadataSizeMismatch
+	}
+	itm.dataLen -= sz
+	return nil
 }
 
 func (f *rawFileReader) Close() error {
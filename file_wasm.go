@@ -0,0 +1,37 @@
+// +build js wasip1
+
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"errors"
+	"os"
+)
+
+// The block store relies on positional I/O on many concurrently open files
+// and on mmap, which WebAssembly hosts do not reliably provide. Nitro runs
+// purely in memory on these platforms, StoreToDisk and LoadFromDisk remain
+// available where the host exposes a filesystem.
+const blockStoreSupported = false
+
+var errMmapNotSupported = errors.New("mmap is not supported on this platform")
+
+func openFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, flag, perm)
+}
+
+func createSparseFile(path string, size int64) error {
+	return errMmapNotSupported
+}
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapNotSupported
+}
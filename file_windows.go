@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"unsafe"
+)
+
+const fsctlSetSparse = 0x000900c4
+
+const blockStoreSupported = true
+
+// openFile opens a file with FILE_SHARE_DELETE in addition to the share modes
+// used by os.OpenFile, so that dump and block store files can be renamed or
+// removed while other handles (e.g., block store readers) are still open, as
+// is possible on POSIX systems.
+func openFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	var access uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		access = syscall.GENERIC_READ
+	case os.O_WRONLY:
+		access = syscall.GENERIC_WRITE
+	case os.O_RDWR:
+		access = syscall.GENERIC_READ | syscall.GENERIC_WRITE
+	}
+
+	var mode uint32
+	switch {
+	case flag&(os.O_CREATE|os.O_EXCL) == (os.O_CREATE | os.O_EXCL):
+		mode = syscall.CREATE_NEW
+	case flag&(os.O_CREATE|os.O_TRUNC) == (os.O_CREATE | os.O_TRUNC):
+		mode = syscall.CREATE_ALWAYS
+	case flag&os.O_CREATE == os.O_CREATE:
+		mode = syscall.OPEN_ALWAYS
+	case flag&os.O_TRUNC == os.O_TRUNC:
+		mode = syscall.TRUNCATE_EXISTING
+	default:
+		mode = syscall.OPEN_EXISTING
+	}
+
+	share := uint32(syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE | syscall.FILE_SHARE_DELETE)
+	h, err := syscall.CreateFile(p, access, share, nil, mode, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// createSparseFile creates a file of the given size without allocating its
+// blocks. NTFS files have to be marked sparse explicitly, otherwise extending
+// the file zero fills it.
+func createSparseFile(path string, size int64) error {
+	f, err := openFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var n uint32
+	if err := syscall.DeviceIoControl(syscall.Handle(f.Fd()), fsctlSetSparse,
+		nil, 0, nil, 0, &n, nil); err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt([]byte("EOF"), size)
+	return err
+}
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	sz := uint64(size)
+	h, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil,
+		syscall.PAGE_READWRITE, uint32(sz>>32), uint32(sz), nil)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	defer syscall.CloseHandle(h)
+
+	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+
+	var b []byte
+	sh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	sh.Data = addr
+	sh.Len = size
+	sh.Cap = size
+	return b, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWritesFrozen means a mutation was rejected while the writes of an
+// instance are frozen, see FreezeWrites
+var ErrWritesFrozen = fmt.Errorf("Writes are frozen")
+
+// writeGate holds back the mutations of an instance while it is frozen and
+// counts the mutations in progress
+type writeGate struct {
+	frozen int32
+	active int64
+
+	mu     sync.Mutex
+	resume chan struct{}
+}
+
+// SetFailFrozenWrites makes the mutations which return an error, i.e.,
+// TryPut, DeletePrefix, DeleteRange, ApplyOps and CompactBlockStore, fail
+// with ErrWritesFrozen while the writes are frozen instead of waiting for
+// ResumeWrites. Other mutations always wait.
+func (cfg *Config) SetFailFrozenWrites(fail bool) {
+	cfg.failFrozenWrites = fail
+}
+
+// enterWrite waits until the writes are not frozen and registers a mutation
+// in progress, which has to be ended by exitWrite. With canFail, it returns
+// ErrWritesFrozen instead of waiting if configured.
+func (m *Nitro) enterWrite(canFail bool) error {
+	g := &m.writeGate
+	for {
+		atomic.AddInt64(&g.active, 1)
+		if atomic.LoadInt32(&g.frozen) == 0 {
+			return nil
+		}
+		atomic.AddInt64(&g.active, -1)
+
+		if canFail && m.failFrozenWrites {
+			return ErrWritesFrozen
+		}
+
+		g.mu.Lock()
+		resume := g.resume
+		g.mu.Unlock()
+		if resume != nil {
+			<-resume
+		}
+	}
+}
+
+func (m *Nitro) exitWrite() {
+	atomic.AddInt64(&m.writeGate.active, -1)
+}
+
+// FreezeWrites holds back new mutations of the instance until ResumeWrites,
+// e.g., to take a file system or VM level copy of the block store. Reads of
+// existing snapshots continue. It returns once the mutations in progress,
+// including ApplyOps, block store compaction and the deletion of garbage
+// collected blocks, have finished and the buffered blocks have been written,
+// see Sync. StoreToDisk is not held back, backups in progress have to be
+// waited for before copying their directories.
+func (m *Nitro) FreezeWrites() error {
+	g := &m.writeGate
+	g.mu.Lock()
+	if g.resume == nil {
+		g.resume = make(chan struct{})
+		atomic.StoreInt32(&g.frozen, 1)
+	}
+	g.mu.Unlock()
+
+	for atomic.LoadInt64(&g.active) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	return m.Sync()
+}
+
+// ResumeWrites releases the mutations held back by FreezeWrites
+func (m *Nitro) ResumeWrites() {
+	g := &m.writeGate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.resume != nil {
+		atomic.StoreInt32(&g.frozen, 0)
+		close(g.resume)
+		g.resume = nil
+	}
+}
+
+// WritesFrozen returns whether the writes of the instance are frozen
+func (m *Nitro) WritesFrozen() bool {
+	return atomic.LoadInt32(&m.writeGate.frozen) == 1
+}
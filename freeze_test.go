@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFreezeWrites(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	if err := db.FreezeWrites(); err != nil || !db.WritesFrozen() {
+		t.Fatalf("Expected writes to be frozen (%v)", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.Put([]byte("frozen"))
+		w.Delete([]byte("key-0"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Expected the writes to wait while frozen")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Reads continue
+	if CountItems(snap) != 100 {
+		t.Errorf("Expected the snapshot to be readable")
+	}
+
+	db.ResumeWrites()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the writes to resume")
+	}
+
+	snap2, _ := db.NewSnapshot()
+	if CountItems(snap2) != 100 || db.WritesFrozen() {
+		t.Errorf("Expected the writes to be applied")
+	}
+	snap2.Close()
+}
+
+func TestFreezeWritesFail(t *testing.T) {
+	conf := testConf
+	conf.SetFailFrozenWrites(true)
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	tw := tdb.NewWriter()
+	for i := 0; i < 1000; i++ {
+		tw.Put([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+
+	db.FreezeWrites()
+	if _, err := db.ApplyOps(tsnap, 2); err != ErrWritesFrozen {
+		t.Errorf("Expected ErrWritesFrozen, got %v", err)
+	}
+	if err := db.CompactBlockStore(1); err != ErrWritesFrozen {
+		t.Errorf("Expected ErrWritesFrozen, got %v", err)
+	}
+	db.ResumeWrites()
+
+	if _, err := db.ApplyOps(tsnap, 2); err != nil {
+		t.Fatal(err)
+	}
+	snap, _ := db.NewSnapshot()
+	if snapChecksum(t, snap) != snapChecksum(t, tsnap) {
+		t.Errorf("Expected the operations to be applied after resuming")
+	}
+	snap.Close()
+}
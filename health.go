@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// Dead snapshots waiting for garbage collection above which GC is
+	// considered to fall behind
+	healthMaxGCBacklog = 64
+
+	// Ratio of the memory quota above which it is close to exhaustion
+	healthMaxQuotaRatio = 0.9
+)
+
+// HealthReport summarizes the state of an instance for readiness probes
+type HealthReport struct {
+	// Healthy is false if any problem was found
+	Healthy  bool
+	Problems []string
+
+	// Dead snapshots waiting for garbage collection
+	GCBacklog int64
+
+	// Memory usage and quota of the Manager of the instance, 0 without a
+	// quota
+	MemoryInUse int64
+	MemoryQuota int64
+
+	// Whether the block store directory accepts writes, true without a
+	// block store
+	BlockStoreWritable bool
+
+	// Names of the maintenance jobs whose last run failed
+	FailingJobs []string
+}
+
+func (r *HealthReport) problem(format string, args ...interface{}) {
+	r.Healthy = false
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Health checks whether garbage collection keeps up with the dead snapshots,
+// whether the memory quota of the Manager of the instance is close to
+// exhaustion, whether the block store directory is writable and whether a
+// maintenance job is failing. The block store is probed by writing a
+// temporary file.
+func (m *Nitro) Health() HealthReport {
+	r := HealthReport{
+		Healthy:            true,
+		GCBacklog:          int64(m.gcsnapshots.GetStats().NodeCount),
+		MemoryInUse:        m.MemoryInUse(),
+		BlockStoreWritable: true,
+	}
+
+	if m.hasShutdown {
+		r.problem("instance has been shutdown")
+	}
+
+	if r.GCBacklog > healthMaxGCBacklog {
+		r.problem("%d dead snapshots wait for garbage collection", r.GCBacklog)
+	}
+
+	if m.mgr != nil && m.mgr.cfg.MemoryQuota > 0 {
+		r.MemoryInUse = m.mgr.MemoryInUse()
+		r.MemoryQuota = m.mgr.cfg.MemoryQuota
+		if float64(r.MemoryInUse) > healthMaxQuotaRatio*float64(r.MemoryQuota) {
+			r.problem("memory usage %d is close to the quota %d", r.MemoryInUse, r.MemoryQuota)
+		}
+	}
+
+	if m.HasBlockStore() {
+		if err := probeWritable(m.blockStoreDir); err != nil {
+			r.BlockStoreWritable = false
+			r.problem("block store is not writable: %v", err)
+		}
+	}
+
+	for _, st := range m.Jobs() {
+		if st.LastError != nil {
+			r.FailingJobs = append(r.FailingJobs, st.Name)
+			r.problem("job %s failed: %v", st.Name, st.LastError)
+		}
+	}
+
+	return r
+}
+
+// probeWritable writes and removes a temporary file in dir
+func probeWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write([]byte{0})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	if r := db.Health(); !r.Healthy || len(r.Problems) != 0 || !r.BlockStoreWritable {
+		t.Errorf("Expected a healthy instance, got %+v", r)
+	}
+
+	db.AddJob("sweep", time.Hour, func(*Nitro) error { return fmt.Errorf("sweep failed") })
+	db.RunJob("sweep")
+	if r := db.Health(); r.Healthy || len(r.FailingJobs) != 1 || r.FailingJobs[0] != "sweep" {
+		t.Errorf("Expected a failing job, got %+v", r)
+	}
+
+	cfg := DefaultManagerConfig()
+	cfg.MemoryQuota = 1
+	mgr := NewManager(cfg)
+	defer mgr.Close()
+
+	mdb, _ := mgr.Create("a", DefaultConfig())
+	if r := mdb.Health(); !r.Healthy || r.MemoryQuota != cfg.MemoryQuota {
+		t.Errorf("Expected a healthy instance, got %+v", r)
+	}
+	mdb.NewWriter().Put([]byte("item"))
+	if r := mdb.Health(); r.Healthy || r.MemoryInUse == 0 {
+		t.Errorf("Expected the quota to be close to exhaustion, got %+v", r)
+	}
+
+	conf := testConf
+	dir := t.TempDir()
+	conf.SetBlockStoreDir(dir)
+	if conf.HasBlockStore() {
+		bs := NewWithConfig(conf)
+		defer bs.Close()
+
+		if r := bs.Health(); !r.Healthy || !r.BlockStoreWritable {
+			t.Errorf("Expected a writable block store, got %+v", r)
+		}
+		os.RemoveAll(dir)
+		if r := bs.Health(); r.Healthy || r.BlockStoreWritable {
+			t.Errorf("Expected the block store not to be writable, got %+v", r)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+)
+
+const histogramBuckets = 33
+
+// SizeHistogram is a streaming histogram of sizes using power of two buckets.
+// Bucket i counts sizes in the range [2^(i-1), 2^i), bucket 0 counts zero sizes.
+type SizeHistogram struct {
+	Count   int64
+	Sum     int64
+	Max     int64
+	Buckets [histogramBuckets]int64
+}
+
+func sizeBucket(sz int) int {
+	return bits.Len32(uint32(sz))
+}
+
+// Add records a size into the histogram
+func (h *SizeHistogram) Add(sz int) {
+	h.Count++
+	h.Sum += int64(sz)
+	if int64(sz) > h.Max {
+		h.Max = int64(sz)
+	}
+	h.Buckets[sizeBucket(sz)]++
+}
+
+// Remove removes a previously recorded size from the histogram. Max keeps
+// the largest size ever recorded.
+func (h *SizeHistogram) Remove(sz int) {
+	h.Count--
+	h.Sum -= int64(sz)
+	h.Buckets[sizeBucket(sz)]--
+}
+
+// Apply adds the counts of another histogram
+func (h *SizeHistogram) Apply(o *SizeHistogram) {
+	h.Count += o.Count
+	h.Sum += o.Sum
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+
+	for i, c := range o.Buckets {
+		h.Buckets[i] += c
+	}
+}
+
+// Merge atomically moves the counts of a partial histogram into h and
+// resets the partial histogram
+func (h *SizeHistogram) Merge(o *SizeHistogram) {
+	atomic.AddInt64(&h.Count, o.Count)
+	atomic.AddInt64(&h.Sum, o.Sum)
+	for max := atomic.LoadInt64(&h.Max); o.Max > max; max = atomic.LoadInt64(&h.Max) {
+		if atomic.CompareAndSwapInt64(&h.Max, max, o.Max) {
+			break
+		}
+	}
+
+	for i, c := range o.Buckets {
+		if c != 0 {
+			atomic.AddInt64(&h.Buckets[i], c)
+		}
+	}
+
+	*o = SizeHistogram{}
+}
+
+func (h *SizeHistogram) load() SizeHistogram {
+	var r SizeHistogram
+	r.Count = atomic.LoadInt64(&h.Count)
+	r.Sum = atomic.LoadInt64(&h.Sum)
+	r.Max = atomic.LoadInt64(&h.Max)
+	for i := range h.Buckets {
+		r.Buckets[i] = atomic.LoadInt64(&h.Buckets[i])
+	}
+	return r
+}
+
+// Mean returns the average size
+func (h SizeHistogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return float64(h.Sum) / float64(h.Count)
+}
+
+// Percentile returns the upper bound of the bucket holding the given
+// percentile (0-100) of sizes
+func (h SizeHistogram) Percentile(p float64) int64 {
+	target := int64(float64(h.Count)*p/100 + 0.5)
+	var sum int64
+	for i, c := range h.Buckets {
+		sum += c
+		if c > 0 && sum >= target {
+			if i == 0 {
+				return 0
+			}
+
+			upper := int64(1)<<uint(i) - 1
+			if upper > h.Max {
+				upper = h.Max
+			}
+			return upper
+		}
+	}
+
+	return h.Max
+}
+
+func (h SizeHistogram) String() string {
+	str := fmt.Sprintf(
+		"count = %d\n"+
+			"mean  = %.2f\n"+
+			"p50   = %d\n"+
+			"p99   = %d\n"+
+			"max   = %d\n",
+		h.Count, h.Mean(), h.Percentile(50), h.Percentile(99), h.Max)
+
+	for i, c := range h.Buckets {
+		if c > 0 {
+			lo := 0
+			if i > 0 {
+				lo = 1 << uint(i-1)
+			}
+			str += fmt.Sprintf("[%d, %d) => %d\n", lo, 1<<uint(i), c)
+		}
+	}
+
+	return str
+}
+
+// ItemSizeStats returns the histogram of data sizes of the live items. The
+// writer-local counts are merged when a snapshot is created, so items written
+// or deleted after the latest snapshot are not reflected yet.
+func (m *Nitro) ItemSizeStats() SizeHistogram {
+	return m.itemSizes.load()
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestItemSizeStats(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 1; i <= 100; i++ {
+		w.Put(bytes.Repeat([]byte{byte(i)}, i))
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	h := db.ItemSizeStats()
+	if h.Count != 100 || h.Sum != 5050 || h.Max != 100 {
+		t.Errorf("Unexpected histogram\n%s", h)
+	}
+
+	if p := h.Percentile(50); p != 63 {
+		t.Errorf("Expected p50 bucket bound 63, got %d", p)
+	}
+
+	for i := 51; i <= 100; i++ {
+		w.Delete(bytes.Repeat([]byte{byte(i)}, i))
+	}
+
+	if h2 := db.ItemSizeStats(); h2 != h {
+		t.Errorf("Expected histogram to be unchanged until the next snapshot\n%s", h2)
+	}
+
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	if h = db.ItemSizeStats(); h.Count != 50 || h.Sum != 1275 {
+		t.Errorf("Expected deleted items to be removed\n%s", h)
+	}
+}
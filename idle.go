@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SetIdleGC schedules a garbage collection pass once no writer has mutated
+// the instance for the idle period. It collects the dead snapshots which
+// were skipped while another collection was running, and with
+// SetAutoCompaction also compacts the block store, so that reclamation
+// after heavy delete phases happens while the instance is not busy. Every
+// idle period gets one pass.
+func (cfg *Config) SetIdleGC(idle time.Duration) {
+	cfg.idleGCPeriod = idle
+}
+
+type idleScheduler struct {
+	passes int64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (m *Nitro) startIdleScheduler() {
+	m.idleGC.stop = make(chan struct{})
+	m.idleGC.wg.Add(1)
+	go m.idleWorker()
+}
+
+func (m *Nitro) stopIdleScheduler() {
+	if m.idleGC.stop != nil {
+		close(m.idleGC.stop)
+		m.idleGC.wg.Wait()
+	}
+}
+
+// IdleGCPasses returns the number of passes run by SetIdleGC
+func (m *Nitro) IdleGCPasses() int64 {
+	return atomic.LoadInt64(&m.idleGC.passes)
+}
+
+func (m *Nitro) mutations() (n int64) {
+	for w := m.wlist; w != nil; w = w.next {
+		n += atomic.LoadInt64(&w.mutations)
+	}
+
+	return
+}
+
+func (m *Nitro) idleWorker() {
+	defer m.idleGC.wg.Done()
+	ticker := time.NewTicker(m.idleGCPeriod / 4)
+	defer ticker.Stop()
+
+	last := m.mutations()
+	lastChange := time.Now()
+	done := false
+	for {
+		select {
+		case <-ticker.C:
+			if n := m.mutations(); n != last {
+				last = n
+				lastChange = time.Now()
+				done = false
+			} else if !done && time.Since(lastChange) >= m.idleGCPeriod {
+				m.idleCollect()
+				done = true
+			}
+		case <-m.idleGC.stop:
+			return
+		}
+	}
+}
+
+func (m *Nitro) idleCollect() {
+	m.GC()
+	if m.HasBlockStore() && m.compactLiveRatio > 0 {
+		m.compactBlockStore(m.compactLiveRatio, 0)
+	}
+	atomic.AddInt64(&m.idleGC.passes, 1)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package importer streams key/value data from external stores into Nitro.
+//
+// The package does not read ForestDB or Plasma files itself. Both formats are
+// only accessible through their client libraries
+// (github.com/couchbase/goforestdb requires cgo and libforestdb, Plasma is not
+// go gettable), which Nitro does not depend on. Stores are read through the
+// Source interface instead and adapters live in the application. A ForestDB
+// adapter only has to wrap a forestdb.Iterator:
+//
+//	type fdbSource struct{ it *forestdb.Iterator }
+//
+//	func (s *fdbSource) Next() ([]byte, []byte, error) {
+//		doc, err := s.it.Get()
+//		if err == forestdb.FDB_RESULT_ITERATOR_FAIL {
+//			return nil, nil, io.EOF
+//		} else if err != nil {
+//			return nil, nil, err
+//		}
+//		s.it.Next()
+//		return doc.Key(), doc.Body(), nil
+//	}
+package importer
+
+import (
+	"io"
+	"sync"
+
+	"github.com/elliotcourant/nitro"
+)
+
+// ErrKeyTooLong means a key which does not fit the 2 byte length of
+// EncodeKeyValue
+var ErrKeyTooLong = nitro.ErrKeyTooLong
+
+// Source produces key/value records. Next returns io.EOF once all records
+// have been returned. The returned slices are only valid until the next call.
+type Source interface {
+	Next() (key, value []byte, err error)
+}
+
+// SourceFunc adapts a function to the Source interface
+type SourceFunc func() (key, value []byte, err error)
+
+// Next calls fn
+func (fn SourceFunc) Next() ([]byte, []byte, error) {
+	return fn()
+}
+
+// EncodeFn builds the Nitro item for a record, appending it to buf. An
+// error stops the import.
+type EncodeFn func(buf, key, value []byte) ([]byte, error)
+
+// EncodeKeyValue encodes records as [2 byte key len][key][value], the item
+// encoding of nitro.UseKeyValueItems, see nitro.EncodeKV. Keys longer than
+// 65535 bytes are rejected with ErrKeyTooLong.
+func EncodeKeyValue(buf, key, value []byte) ([]byte, error) {
+	return nitro.AppendKV(buf[:0], key, value)
+}
+
+// Stats describes the outcome of an import
+type Stats struct {
+	Records int64
+	Bytes   int64
+}
+
+const batchSize = 1024
+
+type batch struct {
+	items [][]byte
+	size  int64
+}
+
+// Import reads all records from src and inserts them into db using
+// concurrency writers. The source is read by a single goroutine and records
+// are handed to the writers in batches. Existing items with the same key are
+// kept.
+func Import(db *nitro.Nitro, src Source, encode EncodeFn, concurrency int) (Stats, error) {
+	var wg sync.WaitGroup
+	var stats Stats
+
+	if encode == nil {
+		encode = EncodeKeyValue
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	batches := make(chan *batch, concurrency)
+	free := sync.Pool{New: func() interface{} {
+		return &batch{items: make([][]byte, 0, batchSize)}
+	}}
+
+	for i := 0; i < concurrency; i++ {
+		w := db.NewWriter()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				for _, itm := range b.items {
+					w.Put(itm)
+				}
+				b.items = b.items[:0]
+				b.size = 0
+				free.Put(b)
+			}
+		}()
+	}
+
+	var err error
+	var buf []byte
+	b := free.Get().(*batch)
+	for {
+		var key, value []byte
+		if key, value, err = src.Next(); err != nil {
+			break
+		}
+
+		if buf, err = encode(buf, key, value); err != nil {
+			break
+		}
+		b.items = append(b.items, append([]byte(nil), buf...))
+		b.size += int64(len(buf))
+		if len(b.items) == batchSize {
+			stats.Records += int64(len(b.items))
+			stats.Bytes += b.size
+			batches <- b
+			b = free.Get().(*batch)
+		}
+	}
+
+	stats.Records += int64(len(b.items))
+	stats.Bytes += b.size
+	batches <- b
+	close(batches)
+	wg.Wait()
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	return stats, err
+}
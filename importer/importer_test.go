@@ -0,0 +1,66 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package importer
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/elliotcourant/nitro"
+)
+
+func TestImport(t *testing.T) {
+	db := nitro.New()
+	defer db.Close()
+
+	n := 10000
+	i := 0
+	src := SourceFunc(func() ([]byte, []byte, error) {
+		if i == n {
+			return nil, nil, io.EOF
+		}
+		i++
+		return []byte(fmt.Sprintf("key-%05d", i)), []byte("value"), nil
+	})
+
+	stats, err := Import(db, src, nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Records != int64(n) {
+		t.Errorf("Expected %d records, got %d", n, stats.Records)
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	if c := snap.Count(); c != int64(n) {
+		t.Errorf("Expected %d items, got %d", n, c)
+	}
+}
+
+func TestImportLongKey(t *testing.T) {
+	db := nitro.New()
+	defer db.Close()
+
+	done := false
+	src := SourceFunc(func() ([]byte, []byte, error) {
+		if done {
+			return nil, nil, io.EOF
+		}
+		done = true
+		return make([]byte, 70000), []byte("value"), nil
+	})
+
+	if _, err := Import(db, src, nil, 1); err != ErrKeyTooLong {
+		t.Errorf("Expected ErrKeyTooLong, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	deltaDumpPutsFile    = "puts"
+	deltaDumpDeletesFile = "deletes"
+)
+
+// StoreDeltaToDisk writes an incremental backup holding the changes between
+// two snapshots of the instance, base and snap. Items which are new or
+// changed in snap and items of base which are missing from snap are written
+// in key order. The backup is applied with ApplyDeltaDump onto an instance
+// holding the items of base, e.g., one loaded from a full backup of base.
+//
+// Incremental backups are unrelated to the delta files of StoreToDisk, which
+// hold the items written while a full backup is taken.
+func (m *Nitro) StoreDeltaToDisk(dir string, base, snap *Snapshot) (err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	puts := m.newFileWriter(m.fileType, 0)
+	if err := puts.Open(filepath.Join(dir, deltaDumpPutsFile)); err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := puts.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	dels := m.newFileWriter(m.fileType, 0)
+	if err := dels.Open(filepath.Join(dir, deltaDumpDeletesFile)); err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dels.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	write := func(w FileWriter, bs []byte) error {
+		return w.WriteItem(m.newItem(bs, false))
+	}
+
+	ita := base.NewIterator()
+	if ita == nil {
+		base.checkOpen()
+	}
+	defer ita.Close()
+
+	itb := snap.NewIterator()
+	if itb == nil {
+		snap.checkOpen()
+	}
+	defer itb.Close()
+
+	ita.SeekFirst()
+	itb.SeekFirst()
+	for ita.Valid() || itb.Valid() {
+		var c int
+		switch {
+		case !ita.Valid():
+			c = 1
+		case !itb.Valid():
+			c = -1
+		default:
+			c = m.keyCmp(ita.Get(), itb.Get())
+		}
+
+		switch {
+		case c < 0:
+			err = write(dels, ita.Get())
+		case c > 0:
+			err = write(puts, itb.Get())
+		case !bytes.Equal(ita.Get(), itb.Get()):
+			err = write(puts, itb.Get())
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if c <= 0 {
+			ita.Next()
+		}
+		if c >= 0 {
+			itb.Next()
+		}
+	}
+
+	if err := ita.Err(); err != nil {
+		return err
+	}
+	if err := itb.Err(); err != nil {
+		return err
+	}
+
+	return writeDumpHeader(dir, dumpHeader{Format: m.dumpFormat.String(),
+		MetadataSize: m.itemMetaSize})
+}
+
+// ApplyDeltaDump replays an incremental backup written by StoreDeltaToDisk
+// onto the current items of the instance and returns a snapshot of the
+// result. The deletes are applied before the puts.
+func (m *Nitro) ApplyDeltaDump(dir string) (*Snapshot, error) {
+	format, err := readDumpFormat(dir, m.dumpFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	replay := func(file string, fn func([]byte)) error {
+		r := m.newFileReader(m.fileType, format)
+		if err := r.Open(filepath.Join(dir, file)); err != nil {
+			return err
+		}
+		defer r.Close()
+
+		for {
+			itm, err := r.ReadItem()
+			if err != nil {
+				return err
+			} else if itm == nil {
+				return nil
+			}
+
+			fn(itm.Bytes())
+			m.freeItem(itm)
+		}
+	}
+
+	err = m.modify(runtime.GOMAXPROCS(0), func(put, del func([]byte)) error {
+		if err := replay(deltaDumpDeletesFile, del); err != nil {
+			return err
+		}
+		return replay(deltaDumpPutsFile, put)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m.NewSnapshot()
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApplyDeltaDump(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+	base, _ := w.NewSnapshot()
+	defer base.Close()
+
+	// StoreToDisk closes the snapshot
+	base.Open()
+	fulldir := t.TempDir()
+	if err := db.StoreToDisk(fulldir, base, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		w.Delete([]byte(fmt.Sprintf("key-%010d", i*7)))
+	}
+	for i := 10000; i < 10500; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	deltadir := t.TempDir()
+	if err := db.StoreDeltaToDisk(deltadir, base, snap); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk(fulldir, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap2.Close()
+
+	snap2, err = db2.ApplyDeltaDump(deltadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap2.Close()
+
+	if snap2.Count() != 10400 || snapChecksum(t, snap2) != snapChecksum(t, snap) {
+		t.Errorf("Expected %d items matching the snapshot, got %d", 10400, snap2.Count())
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/elliotcourant/nitro/skiplist"
+)
+
+// ingestChunkSize is the number of items handed to an ingest worker at once
+const ingestChunkSize = 4096
+
+// ErrUnsortedSource means the items of a SortedSource were not in strictly
+// increasing key order
+var ErrUnsortedSource = fmt.Errorf("Items of the source are not in key order")
+
+// SortedSource provides items in strictly increasing key order, e.g., the
+// output of an ETL pipeline
+type SortedSource interface {
+	// Next returns the next item or nil at the end of the source. The item
+	// data is only valid until the next call.
+	Next() ([]byte, error)
+}
+
+// sortedReader validates the order of the items of a SortedSource
+type sortedReader struct {
+	m     *Nitro
+	src   SortedSource
+	last  []byte
+	count int64
+}
+
+func (r *sortedReader) next() ([]byte, error) {
+	bs, err := r.src.Next()
+	if err != nil || bs == nil {
+		return nil, err
+	}
+
+	if r.count > 0 && r.m.keyCmp(r.last, bs) >= 0 {
+		return nil, ErrUnsortedSource
+	}
+
+	r.last = append(r.last[:0], bs...)
+	r.count++
+	return bs, nil
+}
+
+// IngestSorted inserts the items of a pre-sorted source and returns the
+// number of ingested items. The order of the items is validated, ingestion
+// stops with ErrUnsortedSource at the first item which is out of order and
+// the items before it remain inserted.
+//
+// Items are ingested into an empty instance by concurr skiplist builders
+// without going through the writers, like LoadFromDisk, and there may not be
+// concurrent writers. Items are inserted into instances with a block store
+// through the batch operation path, other instances insert the items through
+// concurr writers, replacing the items with the same key. The items are
+// visible in the next snapshot.
+func (m *Nitro) IngestSorted(src SortedSource, concurr int) (int64, error) {
+	r := &sortedReader{m: m, src: src}
+	if concurr < 1 {
+		concurr = 1
+	}
+
+	if m.HasBlockStore() {
+		err := m.ingestSortedOps(r, concurr)
+		return r.count, err
+	}
+
+	empty := m.isEmpty()
+	var b *skiplist.Builder
+	if empty {
+		b = skiplist.NewBuilderWithConfig(m.newStoreConfig())
+		b.SetItemSizeFunc(m.itemSize)
+	}
+
+	type chunk struct {
+		seg   *skiplist.Segment
+		items []*Item
+	}
+
+	var wg sync.WaitGroup
+	var segments []*skiplist.Segment
+	chunks := make(chan chunk, concurr)
+	for i := 0; i < concurr; i++ {
+		var w *Writer
+		if !empty {
+			w = m.NewWriter()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				for _, itm := range c.items {
+					if empty {
+						c.seg.Add(unsafe.Pointer(itm))
+					} else {
+						w.Upsert(itm.Bytes())
+						m.freeItem(itm)
+					}
+				}
+			}
+		}()
+	}
+
+	var c chunk
+	var err error
+	for {
+		var bs []byte
+		if bs, err = r.next(); err != nil || bs == nil {
+			break
+		}
+
+		if c.items == nil {
+			c.items = make([]*Item, 0, ingestChunkSize)
+			if empty {
+				c.seg = b.NewSegment()
+				segments = append(segments, c.seg)
+			}
+		}
+
+		// Items are born in the current snapshot, so that they may be
+		// replaced like the items inserted by writers
+		itm := m.newItem(bs, m.useMemoryMgmt)
+		itm.bornSn = m.getCurrSn()
+		if c.items = append(c.items, itm); len(c.items) == ingestChunkSize {
+			chunks <- c
+			c = chunk{}
+		}
+	}
+
+	if c.items != nil {
+		chunks <- c
+	}
+	close(chunks)
+	wg.Wait()
+
+	if empty {
+		m.store = b.Assemble(segments...)
+		m.itemsCount = int64(m.store.GetStats().NodeCount)
+	}
+
+	return r.count, err
+}
+
+// chanOpIterator is a BatchOpIterator which inserts the items received from
+// a channel
+type chanOpIterator struct {
+	m       *Nitro
+	ch      chan []byte
+	itm     unsafe.Pointer
+	started bool
+}
+
+func (it *chanOpIterator) start() {
+	if !it.started {
+		it.started = true
+		it.Next()
+	}
+}
+
+func (it *chanOpIterator) Next() {
+	it.itm = nil
+	if bs, ok := <-it.ch; ok {
+		itm := it.m.allocItem(len(bs), false)
+		copy(itm.Bytes(), bs)
+		itm.bornSn = it.m.getCurrSn()
+		it.itm = unsafe.Pointer(itm)
+	}
+}
+
+func (it *chanOpIterator) Valid() bool {
+	it.start()
+	return it.itm != nil
+}
+
+func (it *chanOpIterator) Item() unsafe.Pointer {
+	it.start()
+	return it.itm
+}
+
+func (it *chanOpIterator) Op() itemOp {
+	return itemInsertop
+}
+
+func (it *chanOpIterator) Close() {
+	// Unblock the reader if the operations were not applied
+	for range it.ch {
+	}
+}
+
+// ingestSortedOps inserts the items of a sorted source into a block store.
+// The items are routed in order to the iterators of the partitions of the
+// store, which are applied concurrently.
+func (m *Nitro) ingestSortedOps(r *sortedReader, concurr int) error {
+	type partition struct {
+		end []byte
+		ch  chan []byte
+	}
+
+	var parts []partition
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := m.applyOps(concurr, func(start, end *Item) (BatchOpIterator, error) {
+			p := partition{end: end.Bytes(), ch: make(chan []byte, ingestChunkSize)}
+			if parts = append(parts, p); end == nil {
+				close(ready)
+			}
+			return &chanOpIterator{m: m, ch: p.ch}, nil
+		})
+		done <- err
+	}()
+
+	<-ready
+	var err error
+	p := 0
+	for {
+		var bs []byte
+		if bs, err = r.next(); err != nil || bs == nil {
+			break
+		}
+
+		for parts[p].end != nil && m.keyCmp(bs, parts[p].end) >= 0 {
+			close(parts[p].ch)
+			p++
+		}
+		parts[p].ch <- append([]byte(nil), bs...)
+	}
+
+	for ; p < len(parts); p++ {
+		close(parts[p].ch)
+	}
+
+	if e := <-done; err == nil {
+		err = e
+	}
+	return err
+}
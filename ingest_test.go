@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+type sliceSource struct {
+	items [][]byte
+}
+
+func (s *sliceSource) Next() ([]byte, error) {
+	if len(s.items) == 0 {
+		return nil, nil
+	}
+
+	itm := s.items[0]
+	s.items = s.items[1:]
+	return itm, nil
+}
+
+func TestIngestSorted(t *testing.T) {
+	n := 20000
+	source := func(step int) *sliceSource {
+		s := &sliceSource{}
+		for i := 0; i < n; i += step {
+			s.items = append(s.items, []byte(fmt.Sprintf("key-%010d", i)))
+		}
+		return s
+	}
+
+	ref := NewWithConfig(testConf)
+	defer ref.Close()
+	if _, err := ref.IngestSorted(source(1), 4); err != nil {
+		t.Fatal(err)
+	}
+	rsnap, _ := ref.NewSnapshot()
+	defer rsnap.Close()
+
+	if rsnap.Count() != int64(n) || CountItems(rsnap) != n {
+		t.Errorf("Expected %d items, got %d", n, rsnap.Count())
+	}
+
+	w := ref.NewWriter()
+	for i := 0; i < 10; i++ {
+		w.Delete([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+	snap, _ := ref.NewSnapshot()
+	if CountItems(snap) != n-10 {
+		t.Errorf("Expected ingested items to be deleted")
+	}
+	snap.Close()
+
+	// Ingestion into non-empty instances and block stores
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	for _, c := range []Config{testConf, conf} {
+		db := NewWithConfig(c)
+		for _, step := range []int{2, 1} {
+			if count, err := db.IngestSorted(source(step), 4); err != nil || count != int64(n/step) {
+				t.Fatalf("Expected %d items, got %d (%v)", n/step, count, err)
+			}
+		}
+
+		snap, _ := db.NewSnapshot()
+		if snapChecksum(t, snap) != snapChecksum(t, rsnap) {
+			t.Errorf("Expected ingested items to match (block store %v)", db.HasBlockStore())
+		}
+		snap.Close()
+		db.Close()
+	}
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	s := source(1)
+	s.items[100], s.items[101] = s.items[101], s.items[100]
+	if count, err := db.IngestSorted(s, 4); err != ErrUnsortedSource || count != 101 {
+		t.Errorf("Expected ErrUnsortedSource after 101 items, got %d (%v)", count, err)
+	}
+}
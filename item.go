@@ -12,6 +12,7 @@ package nitro
 import (
 	"encoding/binary"
 	"io"
+	"math"
 	"reflect"
 	"unsafe"
 )
@@ -30,44 +31,61 @@ type Item struct {
 
 func (m *Nitro) newItem(data []byte, useMM bool) (itm *Item) {
 	l := len(data)
-	itm = m.allocItem(l, useMM)
-	copy(itm.Bytes(), data)
+	if itm = m.allocItem(l, useMM); itm != nil {
+		copy(itm.Bytes(), data)
+	}
 	return itm
 }
 
 func (m *Nitro) freeItem(itm *Item) {
-	if m.useMemoryMgmt {
+	if m.useMemoryMgmt && !m.freeArenaItem(unsafe.Pointer(itm)) {
 		m.freeFun(unsafe.Pointer(itm))
 	}
 }
 
+// allocItem returns nil if the memory allocator fails
 func (m *Nitro) allocItem(l int, useMM bool) (itm *Item) {
-	blockSize := itemHeaderSize + uintptr(l)
+	blockSize := itemHeaderSize + uintptr(l+m.itemMetaSize)
 	if useMM {
-		itm = (*Item)(m.mallocFun(int(blockSize)))
+		if itm = (*Item)(m.mallocFun(int(blockSize))); itm == nil {
+			return nil
+		}
 		itm.deadSn = 0
 		itm.bornSn = 0
+		itm.dataLen = uint32(l)
+		m.zeroMetadata(itm)
 	} else {
 		block := make([]byte, blockSize)
 		itm = (*Item)(unsafe.Pointer(&block[0]))
+		itm.dataLen = uint32(l)
 	}
-
-	itm.dataLen = uint32(l)
 	return
 }
 
 // EncodeItem encodes in [2 byte len][item_bytes] format.
 func (m *Nitro) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
-	l := 2
+	return encodeItemBytes(itm.Bytes(), buf, w, NativeDumpFormat)
+}
+
+func encodeItemBytes(data []byte, buf []byte, w io.Writer, f DumpFormat) error {
+	l := f.lenSize()
 	if len(buf) < l {
 		return errNotEnoughSpace
 	}
 
-	binary.BigEndian.PutUint16(buf[0:2], uint16(itm.dataLen))
-	if _, err := w.Write(buf[0:2]); err != nil {
+	if l == 2 {
+		if len(data) > math.MaxUint16 {
+			return ErrItemTooLarge
+		}
+		binary.BigEndian.PutUint16(buf[0:2], uint16(len(data)))
+	} else {
+		binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	}
+
+	if _, err := w.Write(buf[0:l]); err != nil {
 		return err
 	}
-	if _, err := w.Write(itm.Bytes()); err != nil {
+	if _, err := w.Write(data); err != nil {
 		return err
 	}
 
@@ -76,13 +94,24 @@ func (m *Nitro) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
 
 // DecodeItem decodes encoded [2 byte len][item_bytes] format.
 func (m *Nitro) DecodeItem(buf []byte, r io.Reader) (*Item, error) {
-	if _, err := io.ReadFull(r, buf[0:2]); err != nil {
+	return m.decodeItem(buf, r, NativeDumpFormat)
+}
+
+func (m *Nitro) decodeItem(buf []byte, r io.Reader, f DumpFormat) (*Item, error) {
+	l := f.lenSize()
+	if _, err := io.ReadFull(r, buf[0:l]); err != nil {
 		return nil, err
 	}
 
-	l := binary.BigEndian.Uint16(buf[0:2])
-	if l > 0 {
-		itm := m.allocItem(int(l), m.useMemoryMgmt)
+	var dataLen int
+	if l == 2 {
+		dataLen = int(binary.BigEndian.Uint16(buf[0:2]))
+	} else {
+		dataLen = int(binary.BigEndian.Uint32(buf[0:4]))
+	}
+
+	if dataLen > 0 {
+		itm := m.allocItem(dataLen, m.useMemoryMgmt)
 		data := itm.Bytes()
 		_, err := io.ReadFull(r, data)
 		return itm, err
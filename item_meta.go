@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// ItemMetadataSizeLimit is the largest metadata size of SetItemMetadataSize
+const ItemMetadataSizeLimit = 256
+
+var (
+	// ErrInvalidMetadataSize means an item metadata size which is not
+	// between 0 and ItemMetadataSizeLimit
+	ErrInvalidMetadataSize = fmt.Errorf("Invalid item metadata size")
+	// ErrMetadataSizeMismatch means a backup was stored with a different
+	// item metadata size than the instance it is loaded into
+	ErrMetadataSizeMismatch = fmt.Errorf("Backup item metadata size does not match")
+)
+
+// SetItemMetadataSize reserves sz bytes of user metadata after the data of
+// every item, see PutWithMetadata and Iterator.Metadata. The metadata is not
+// passed to the key comparator, so that items which only differ by their
+// metadata replace each other. It is kept by snapshots and stored to disk
+// with the items, backups can only be loaded into instances with the same
+// metadata size. The metadata of items merged into an instance which already
+// holds items is not restored. The metadata is not supported in block store
+// mode and ignored.
+func (cfg *Config) SetItemMetadataSize(sz int) error {
+	if sz < 0 || sz > ItemMetadataSizeLimit {
+		return ErrInvalidMetadataSize
+	}
+
+	cfg.itemMetaSize = sz
+	return nil
+}
+
+// ItemMetadataSize returns the item metadata size of the instance
+func (m *Nitro) ItemMetadataSize() int {
+	return m.itemMetaSize
+}
+
+// metadata returns the sz bytes following the item data
+func (itm *Item) metadata(sz int) (bs []byte) {
+	if itm == nil || sz == 0 {
+		return
+	}
+
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&bs))
+	hdr.Data = uintptr(unsafe.Pointer(itm)) + itemHeaderSize + uintptr(itm.dataLen)
+	hdr.Len = sz
+	hdr.Cap = sz
+	return
+}
+
+// zeroMetadata clears the metadata of an item allocated without zeroing
+func (m *Nitro) zeroMetadata(itm *Item) {
+	meta := itm.metadata(m.itemMetaSize)
+	for i := range meta {
+		meta[i] = 0
+	}
+}
+
+// itemSize returns the bytes consumed by an item, including its metadata
+func (m *Nitro) itemSize(p unsafe.Pointer) int {
+	return ItemSize(p) + m.itemMetaSize
+}
+
+// PutWithMetadata inserts an item like Put and sets its metadata, which is
+// truncated or padded with zeros to the metadata size of the instance.
+func (w *Writer) PutWithMetadata(bs []byte, meta []byte) {
+	x := w.newWriterItem(bs)
+	if x == nil {
+		w.insertError(ErrOutOfMemory)
+		return
+	}
+
+	copy(x.metadata(w.itemMetaSize), meta)
+	if _, err := w.tryInsertItem(x, nil, true, true); err != nil {
+		w.insertError(err)
+	}
+}
+
+// Metadata returns the metadata of the current item, see
+// SetItemMetadataSize. It returns nil without item metadata and in block
+// store mode. The returned data remains valid as long as the snapshot is
+// open.
+func (it *Iterator) Metadata() []byte {
+	it.checkOpen()
+	if it.snap.db.HasBlockStore() {
+		return nil
+	}
+	return (*Item)(it.iter.Get()).metadata(it.snap.db.itemMetaSize)
+}
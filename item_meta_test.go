@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestItemMetadata(t *testing.T) {
+	conf := testConf
+	if err := conf.SetItemMetadataSize(ItemMetadataSizeLimit + 1); err != ErrInvalidMetadataSize {
+		t.Errorf("Expected ErrInvalidMetadataSize, got %v", err)
+	}
+	if err := conf.SetItemMetadataSize(4); err != nil {
+		t.Fatal(err)
+	}
+	// Data shards are written by the encoders, delta shards directly
+	conf.SetDumpEncoders(2)
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	n := 100
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.PutWithMetadata([]byte(fmt.Sprintf("k%03d", i)), []byte{byte(i), 0xaa, 0xbb, 0xcc, 0xdd})
+	}
+	w.Put([]byte("plain"))
+
+	checkItems := func(db *Nitro, snap *Snapshot) {
+		itr := snap.NewIterator()
+		defer itr.Close()
+
+		count := 0
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			count++
+			expected := []byte{0, 0, 0, 0}
+			var i int
+			if _, err := fmt.Sscanf(string(itr.Get()), "k%d", &i); err == nil {
+				expected = []byte{byte(i), 0xaa, 0xbb, 0xcc}
+			}
+			if !bytes.Equal(itr.Metadata(), expected) {
+				t.Errorf("Unexpected metadata of %s: %v", itr.Get(), itr.Metadata())
+			}
+		}
+
+		if count != n+1 {
+			t.Errorf("Expected %d items, got %d", n+1, count)
+		}
+	}
+
+	snap, _ := db.NewSnapshot()
+	checkItems(db, snap)
+
+	// Items deleted during the backup are restored from the delta files
+	dir := t.TempDir()
+	var once sync.Once
+	dw := db.NewWriter()
+	err := db.StoreToDisk(dir, snap, 4, func(*ItemEntry) {
+		once.Do(func() {
+			for i := 0; i < n; i += 2 {
+				dw.Delete([]byte(fmt.Sprintf("k%03d", i)))
+			}
+
+			// Wait for the deleted items to be collected
+			s, _ := db.NewSnapshot()
+			s.Close()
+			for db.gcsnapshots.GetStats().NodeCount > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk(dir, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db2.DeltaRestored+db2.DeltaRestoreFailed == 0 {
+		t.Errorf("Expected items in the delta files")
+	}
+	checkItems(db2, snap2)
+	snap2.Close()
+
+	conf.SetItemMetadataSize(2)
+	db3 := NewWithConfig(conf)
+	defer db3.Close()
+	if _, err := db3.LoadFromDisk(dir, 4, nil); err != ErrMetadataSizeMismatch {
+		t.Errorf("Expected ErrMetadataSizeMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// ItemReader reads the data of an item. Items of the block store which span
+// several blocks are read block by block on demand, instead of being
+// assembled in memory.
+type ItemReader struct {
+	data []byte
+
+	bm    BlockManager
+	size  int64
+	chunk int
+	// Pointers of the blocks of the chain found so far
+	ptrs []blockPtr
+	buf  []byte
+	// Index of the block in buf or -1
+	curr int
+
+	off int64
+}
+
+func newItemReader(data []byte) *ItemReader {
+	return &ItemReader{data: data, size: int64(len(data))}
+}
+
+// newOverflowReader reads the overflow blocks of a stub
+func newOverflowReader(bm BlockManager, stub []byte, blockSize int) *ItemReader {
+	return &ItemReader{
+		bm:    bm,
+		size:  int64(binary.BigEndian.Uint32(stub[0:4])),
+		chunk: blockSize - overflowHeaderSize,
+		ptrs:  []blockPtr{blockPtr(binary.BigEndian.Uint64(stub[4:12]))},
+		buf:   make([]byte, blockSize),
+		curr:  -1,
+	}
+}
+
+// Size returns the size of the item
+func (r *ItemReader) Size() int64 {
+	return r.size
+}
+
+// Read implements io.Reader
+func (r *ItemReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt. Reading an offset of an item spanning
+// several blocks reads the blocks up to the offset the first time.
+func (r *ItemReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.data != nil {
+		n := copy(p, r.data[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	var n int
+	for n < len(p) && off < r.size {
+		i := int(off / int64(r.chunk))
+		if err := r.load(i); err != nil {
+			return n, err
+		}
+
+		start := int(off % int64(r.chunk))
+		end := r.chunk
+		if rem := r.size - int64(i)*int64(r.chunk); rem < int64(end) {
+			end = int(rem)
+		}
+
+		c := copy(p[n:], r.buf[overflowHeaderSize+start:overflowHeaderSize+end])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// load reads the block i of the chain into buf, following the chain from
+// the last block found so far
+func (r *ItemReader) load(i int) error {
+	if r.curr == i {
+		return nil
+	}
+
+	j := i
+	if j >= len(r.ptrs) {
+		j = len(r.ptrs) - 1
+	}
+
+	for {
+		if r.ptrs[j] == noBlock {
+			r.curr = -1
+			return ErrBlockCorrupt
+		}
+
+		if err := r.bm.ReadBlock(r.ptrs[j], r.buf); err != nil {
+			r.curr = -1
+			return err
+		}
+
+		r.curr = j
+		if j == i {
+			return nil
+		}
+
+		if j == len(r.ptrs)-1 {
+			r.ptrs = append(r.ptrs, blockPtr(binary.BigEndian.Uint64(r.buf[:overflowHeaderSize])))
+		}
+		j++
+	}
+}
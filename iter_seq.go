@@ -0,0 +1,34 @@
+//go:build go1.23
+// +build go1.23
+
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import "iter"
+
+// All returns a sequence of the items of the snapshot in key order, see
+// RangeSeq
+func (s *Snapshot) All() iter.Seq[[]byte] {
+	return s.RangeSeq(nil, nil)
+}
+
+// RangeSeq returns a sequence of the items of the snapshot in the range
+// [start, end) in key order, for range-over-func loops. A nil start or end
+// denotes an unbounded range. Every loop opens its own iterator, which
+// refreshes its SMR accessor like Range and is closed when the loop ends or
+// breaks. The item data is only valid during the loop body. The sequence
+// ends at the first error, e.g., ErrSnapshotClosed or a failed block read,
+// use Range to observe it.
+func (s *Snapshot) RangeSeq(start, end []byte) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		s.Range(start, end, yield)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build go1.23
+// +build go1.23
+
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSnapshotSeq(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n := 1000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%06d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+
+	count := 0
+	for itm := range snap.All() {
+		if string(itm) != fmt.Sprintf("key-%06d", count) {
+			t.Fatalf("Unexpected item %s", itm)
+		}
+		count++
+	}
+	if count != n {
+		t.Errorf("Expected %d items, got %d", n, count)
+	}
+
+	count = 0
+	for itm := range snap.RangeSeq([]byte("key-000100"), []byte("key-000200")) {
+		if count++; count == 50 {
+			if string(itm) != "key-000149" {
+				t.Errorf("Unexpected item %s", itm)
+			}
+			break
+		}
+	}
+
+	// Close waits for the iterators of the loops, which are closed by break
+	snap.Close()
+}
@@ -10,7 +10,10 @@
 package nitro
 
 import (
+	"bytes"
 	"github.com/elliotcourant/nitro/skiplist"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -19,6 +22,9 @@ type Iterator struct {
 	count       int
 	refreshRate int
 
+	refreshInterval time.Duration
+	lastRefresh     time.Time
+
 	snap *Snapshot
 	iter *skiplist.Iterator
 	buf  *skiplist.ActionBuffer
@@ -27,8 +33,37 @@ type Iterator struct {
 
 	block dataBlock
 	curr  []byte
+	// Position of the current item in the block, counting from 1
+	blockPos int
+
+	// Stub of the current item if it is stored in overflow blocks and has
+	// not been read, see SetStreamLargeItems
+	stub        []byte
+	streamLarge bool
+
+	// Return the items of the block index only, see SetIndexKeysOnly
+	indexOnly bool
 
 	endItm *Item
+	// Prefix of the items, see SeekPrefix
+	prefix []byte
+
+	// Moves since the iterator was positioned, see SetLimit
+	limit int
+	moves int
+
+	// Error reading a block, see Err
+	err error
+
+	// Return the delete markers of DeleteNonExist, which are delete
+	// operations for ApplyOps
+	withMarkers bool
+
+	// Return the items deleted as of the snapshot, see SetIncludeDeleted
+	includeDeleted bool
+
+	// Set by Close in debug mode
+	closed *closeInfo
 }
 
 func (it *Iterator) skipItem(ptr unsafe.Pointer) bool {
@@ -41,32 +76,178 @@ func (it *Iterator) skipItem(ptr unsafe.Pointer) bool {
 }
 
 func (it *Iterator) skipUnwanted() {
-loop:
-	if !it.iter.Valid() {
-		return
-	}
-	itm := (*Item)(it.iter.Get())
-	if itm.bornSn > it.snap.sn || (itm.deadSn > 0 && itm.deadSn <= it.snap.sn) {
+	for it.iter.Valid() && it.unwanted((*Item)(it.iter.Get())) {
 		it.iter.Next()
 		it.count++
-		goto loop
 	}
 }
 
+// skipUnwantedBackward is skipUnwanted moving to the previous items
+func (it *Iterator) skipUnwantedBackward() {
+	for it.iter.Valid() && it.unwanted((*Item)(it.iter.Get())) {
+		it.iter.Prev(it.snap.db.insCmp)
+		it.count++
+	}
+}
+
+// unwanted returns true if the item is not visible to the iterator
+func (it *Iterator) unwanted(itm *Item) bool {
+	if it.withMarkers && itm.bornSn == 0 && itm.deadSn <= it.snap.sn {
+		return false
+	}
+
+	return itm.bornSn > it.snap.sn ||
+		(!it.includeDeleted && itm.deadSn > 0 && itm.deadSn <= it.snap.sn)
+}
+
 func (it *Iterator) loadItems() {
 	if it.snap.db.HasBlockStore() && it.iter.Valid() {
+		if it.indexOnly {
+			it.curr, it.stub = (*Item)(it.iter.Get()).Bytes(), nil
+			it.blockPos = 1
+			return
+		}
+
 		n := it.GetNode()
-		if err := it.snap.db.bm.ReadBlock(blockPtr(n.DataPtr), it.blockBuf); err != nil {
-			panic(err)
+		if err := it.snap.db.bm.ReadBlock(nodeBlockPtr(n), it.blockBuf); err != nil {
+			it.err = err
+			it.curr, it.stub = nil, nil
+			return
+		}
+
+		it.block = *newDataBlock(it.blockBuf, it.snap.db.bm)
+		it.blockPos = 0
+		it.curr = it.nextInBlock()
+	}
+}
+
+// loadLastItem loads the block of the current node and moves to its last
+// item, or to the last one less than end if end is not nil
+func (it *Iterator) loadLastItem(end []byte) {
+	if !it.snap.db.HasBlockStore() || !it.iter.Valid() {
+		return
+	}
+
+	last := 0
+	for it.loadItems(); it.curr != nil; it.curr = it.nextInBlock() {
+		if end != nil {
+			if itm := it.Get(); it.err != nil || it.snap.db.keyCmp(itm, end) >= 0 {
+				break
+			}
 		}
+		last = it.blockPos
+	}
 
-		it.block = *newDataBlock(it.blockBuf)
-		it.curr = it.block.Get()
+	if it.err == nil {
+		it.seekInBlock(last)
 	}
 }
 
+// seekInBlock moves to the item at position pos of the current block, which
+// is decoded again from its start
+func (it *Iterator) seekInBlock(pos int) {
+	if it.indexOnly {
+		if it.loadItems(); pos == 0 {
+			it.curr, it.blockPos = nil, 0
+		}
+		return
+	}
+
+	it.block = *newDataBlock(it.blockBuf, it.snap.db.bm)
+	it.blockPos = 0
+	it.curr, it.stub = nil, nil
+	for it.blockPos < pos && it.err == nil {
+		if it.curr = it.nextInBlock(); it.curr == nil {
+			break
+		}
+	}
+}
+
+// nextInBlock returns the next item of the current block, recording the
+// error reading the block
+func (it *Iterator) nextInBlock() []byte {
+	if it.indexOnly {
+		return nil
+	}
+
+	var itm []byte
+	it.stub = nil
+	if it.streamLarge {
+		var overflow bool
+		if itm, overflow = it.block.next(); overflow {
+			it.stub = itm
+		}
+	} else {
+		itm = it.block.Get()
+	}
+
+	if it.block.err != nil {
+		it.err = it.block.err
+	}
+	if itm != nil {
+		it.blockPos++
+	}
+	return itm
+}
+
+// SeekLast moves cursor to the last item, or to the last item before the end
+// set by SetEnd
+func (it *Iterator) SeekLast() {
+	it.checkOpen()
+	it.err = nil
+	it.moves = 0
+	var end []byte
+	if it.endItm != nil {
+		end = it.endItm.Bytes()
+		if it.snap.db.HasBlockStore() {
+			// The block of the end may start with smaller items
+			it.iter.SeekPrev(unsafe.Pointer(it.endItm), it.skipItem)
+		} else {
+			it.iter.SeekBefore(unsafe.Pointer(it.endItm), it.snap.db.insCmp)
+		}
+	} else {
+		it.iter.SeekLast(it.snap.db.insCmp)
+	}
+
+	it.skipUnwantedBackward()
+	it.loadLastItem(end)
+	if it.snap.db.HasBlockStore() && it.err == nil && it.iter.Valid() && it.blockPos == 0 {
+		// No item of the block is before the end
+		it.iter.Prev(it.snap.db.insCmp)
+		it.skipUnwantedBackward()
+		it.loadLastItem(nil)
+	}
+}
+
+// Prev moves iterator cursor to the previous item. Every skiplist node is
+// looked up again to find its predecessor, so that Prev costs about as much
+// as a Seek. With a block store, the items of a data block are decoded
+// again up to the previous one, the previous block is read when moving past
+// the first item of a block. Prev has no effect once the iterator is not
+// valid, use SeekLast or Seek to position it again.
+func (it *Iterator) Prev() {
+	it.checkOpen()
+	if it.err != nil || !it.iter.Valid() {
+		return
+	}
+
+	it.moves++
+	if it.snap.db.HasBlockStore() && it.blockPos > 1 {
+		it.seekInBlock(it.blockPos - 1)
+		return
+	}
+
+	it.iter.Prev(it.snap.db.insCmp)
+	it.count++
+	it.skipUnwantedBackward()
+	it.loadLastItem(nil)
+}
+
 // SeekFirst moves cursor to the beginning
 func (it *Iterator) SeekFirst() {
+	it.checkOpen()
+	it.err = nil
+	it.moves = 0
 	it.iter.SeekFirst()
 	it.skipUnwanted()
 	it.loadItems()
@@ -75,21 +256,28 @@ func (it *Iterator) SeekFirst() {
 // Seek to a specified key or the next bigger one if an item with key does not
 // exist.
 func (it *Iterator) Seek(bs []byte) {
+	it.checkOpen()
 	if bs == nil {
 		it.SeekFirst()
 		return
 	}
 
+	it.err = nil
+	it.moves = 0
 	itm := it.snap.db.newItem(bs, false)
 	if it.snap.db.HasBlockStore() {
 		it.iter.SeekPrev(unsafe.Pointer(itm), it.skipItem)
 		it.skipUnwanted()
 		it.loadItems()
-		for ; it.curr != nil && it.snap.db.keyCmp(it.curr, bs) < 0; it.curr = it.block.Get() {
+		for it.curr != nil {
+			if itm := it.Get(); it.err != nil || it.snap.db.keyCmp(itm, bs) >= 0 {
+				break
+			}
+			it.curr = it.nextInBlock()
 		}
 
 		if it.curr == nil {
-			it.Next()
+			it.next()
 		}
 	} else {
 		it.iter.Seek(unsafe.Pointer(itm))
@@ -97,18 +285,65 @@ func (it *Iterator) Seek(bs []byte) {
 	}
 }
 
+// SeekPrefix moves cursor to the first item starting with prefix and sets
+// the end of the iterator after the last one, so that it becomes invalid
+// once it moves past the items with the prefix. The end is derived from the
+// bytes of the prefix, which requires a key comparator ordering items by
+// their bytes, and remains set like the end of SetEnd. An empty prefix
+// iterates over all items.
+func (it *Iterator) SeekPrefix(prefix []byte) {
+	it.checkOpen()
+	it.prefix = nil
+	it.endItm = nil
+	if len(prefix) > 0 {
+		it.prefix = append([]byte(nil), prefix...)
+		if end := prefixEnd(prefix); end != nil {
+			it.endItm = it.snap.db.newItem(end, false)
+		}
+	}
+
+	it.Seek(it.prefix)
+}
+
+// prefixEnd returns the smallest data greater than all the data starting
+// with prefix, or nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 func (it *Iterator) SetEnd(bs []byte) {
+	it.checkOpen()
 	if len(bs) > 0 {
 		it.endItm = it.snap.db.newItem(bs, false)
 	}
 }
 
-// Valid returns false when the iterator has reached the end.
+// Valid returns false when the iterator has reached the end or failed to
+// read a block, see Err.
 func (it *Iterator) Valid() bool {
+	it.checkOpen()
+	if it.err != nil || it.limit > 0 && it.moves >= it.limit {
+		return false
+	}
+
 	if it.iter.Valid() {
 		if it.endItm != nil && it.snap.db.iterCmp(it.iter.Get(), unsafe.Pointer(it.endItm)) >= 0 {
 			return false
 		}
+
+		// The end is compared with the first item of a block
+		if it.prefix != nil && it.snap.db.HasBlockStore() {
+			if itm := it.Get(); it.err != nil || !bytes.HasPrefix(itm, it.prefix) {
+				return false
+			}
+		}
 		return true
 	}
 
@@ -117,21 +352,156 @@ func (it *Iterator) Valid() bool {
 
 // Get eturns the current item data from the iterator.
 func (it *Iterator) Get() []byte {
+	it.checkOpen()
 	if it.snap.db.HasBlockStore() {
+		if it.stub != nil {
+			itm, err := readOverflow(it.snap.db.bm, it.stub, len(it.blockBuf))
+			if err != nil {
+				it.err = err
+				return nil
+			}
+			it.curr, it.stub = itm, nil
+		}
 		return it.curr
 	}
 	return (*Item)(it.iter.Get()).Bytes()
 }
 
+// SetStreamLargeItems makes the iterator skip reading the items of the block
+// store which span several blocks when moving to them. Such an item is read
+// once Get is called, e.g., by Seek for the items it compares, and Reader
+// reads it block by block instead. It has to be set before positioning the
+// iterator.
+func (it *Iterator) SetStreamLargeItems(flag bool) {
+	it.checkOpen()
+	it.streamLarge = flag
+}
+
+// SetIndexKeysOnly makes the iterator of a block store return only the items
+// held by the skiplist index, which are the first items of the data blocks,
+// without reading any block. It suits enumerating the key ranges of the
+// blocks, e.g., to split a scan, since the other items are only stored in the
+// blocks. Without a block store, the skiplist holds all the items and the
+// iterator is not affected. It has to be set before positioning the
+// iterator.
+func (it *Iterator) SetIndexKeysOnly(flag bool) {
+	it.checkOpen()
+	it.indexOnly = flag && it.snap.db.HasBlockStore()
+}
+
+// Reader returns a reader of the current item data, which remains valid
+// after the iterator moves, as long as the snapshot is open. Items of the
+// block store spanning several blocks which have not been read by Get are
+// read on demand, see SetStreamLargeItems.
+func (it *Iterator) Reader() *ItemReader {
+	it.checkOpen()
+	if it.snap.db.HasBlockStore() {
+		if it.stub != nil {
+			return newOverflowReader(it.snap.db.bm, it.stub, len(it.blockBuf))
+		}
+		return newItemReader(append([]byte(nil), it.curr...))
+	}
+	return newItemReader(it.Get())
+}
+
 // GetNode eturns the current skiplist node which holds current item.
 func (it *Iterator) GetNode() *skiplist.Node {
+	it.checkOpen()
 	return it.iter.GetNode()
 }
 
+// SetIncludeDeleted makes the iterator also return the items which were
+// deleted as of the snapshot but have not been garbage collected yet,
+// including the delete markers of DeleteNonExist. A key can then be returned
+// more than once, e.g., deleted and inserted again. Use IsDeleted and DeadSn
+// to tell them apart. It has to be set before positioning the iterator and
+// has no effect with a block store, where deletes rewrite the data blocks.
+func (it *Iterator) SetIncludeDeleted(flag bool) {
+	it.checkOpen()
+	it.includeDeleted = flag && !it.snap.db.HasBlockStore()
+}
+
+// IsDeleted returns true if the current item was deleted as of the snapshot,
+// which only happens with SetIncludeDeleted
+func (it *Iterator) IsDeleted() bool {
+	sn := it.DeadSn()
+	return sn > 0 && sn <= it.snap.sn
+}
+
+// DeadSn returns the snapshot number in which the current item was deleted
+// or 0 if it has not been deleted. Deletes after the snapshot of the
+// iterator are also reported.
+func (it *Iterator) DeadSn() uint32 {
+	it.checkOpen()
+	return atomic.LoadUint32(&(*Item)(it.iter.Get()).deadSn)
+}
+
+// Err returns the error reading or decoding a block of the block store, e.g.,
+// ErrBlockCorrupt, which ends the iteration. Seek and SeekFirst retry the
+// read.
+func (it *Iterator) Err() error {
+	it.checkOpen()
+	return it.err
+}
+
 // Next moves iterator cursor to the next item
 func (it *Iterator) Next() {
+	it.checkOpen()
+	if it.err != nil {
+		return
+	}
+
+	it.moves++
+	it.next()
+}
+
+// SetLimit makes the iterator invalid once Next and Prev have moved it n
+// times since it was last positioned by Seek, SeekFirst, SeekLast or
+// SeekPrefix, so that it returns at most n items. Items passed over by Skip
+// are not counted. A limit of 0 or less removes the limit.
+func (it *Iterator) SetLimit(n int) {
+	it.checkOpen()
+	it.limit = n
+}
+
+// Skip moves the iterator cursor n items forward, e.g., to the offset of a
+// page of items, without counting them towards the limit of SetLimit.
+//
+// Skip cannot jump over runs of items with the links of the upper skiplist
+// levels: the links do not record the number of nodes they pass, and every
+// item has to be checked for its visibility in the snapshot, so that the
+// cost of Skip remains linear in n. With a block store, the entries of a
+// data block are passed over without decoding them, and the items stored
+// in overflow blocks are not read, only the blocks on the way are.
+func (it *Iterator) Skip(n int) {
+	it.checkOpen()
+	for n > 0 && it.err == nil && it.iter.Valid() {
+		if it.snap.db.HasBlockStore() && !it.indexOnly {
+			for ; n > 1; n-- {
+				if entry, _ := it.block.next(); entry == nil {
+					break
+				}
+				it.blockPos++
+			}
+
+			if it.block.err != nil {
+				it.err = it.block.err
+				return
+			}
+		}
+
+		it.next()
+		n--
+	}
+}
+
+func (it *Iterator) next() {
+	if it.err != nil {
+		return
+	}
+
 	if it.snap.db.HasBlockStore() && it.iter.Valid() {
-		if it.curr = it.block.Get(); it.curr != nil {
+		if it.curr = it.nextInBlock(); it.curr != nil || it.err != nil {
 			return
 		}
 	}
@@ -142,6 +512,8 @@ func (it *Iterator) Next() {
 	if it.refreshRate > 0 && it.count > it.refreshRate {
 		it.Refresh()
 		it.count = 0
+	} else if it.refreshInterval > 0 && time.Since(it.lastRefresh) >= it.refreshInterval {
+		it.Refresh()
 	}
 	it.loadItems()
 }
@@ -150,29 +522,59 @@ func (it *Iterator) Next() {
 // This would enable SMR to reclaim objects faster if an iterator is
 // alive for a longer duration of time.
 func (it *Iterator) Refresh() {
+	it.checkOpen()
 	if it.Valid() {
 		itm := it.snap.db.ptrToItem(it.GetNode().Item())
 		it.iter.Close()
 		it.iter = it.snap.db.store.NewIterator(it.snap.db.iterCmp, it.buf)
 		it.iter.Seek(unsafe.Pointer(itm))
 	}
+
+	if it.refreshInterval > 0 {
+		it.lastRefresh = time.Now()
+	}
 }
 
 // SetRefreshRate sets automatic refresh frequency. By default, it is unlimited
 // If this is set, the iterator SMR accessor will be refreshed
 // after every `rate` items.
 func (it *Iterator) SetRefreshRate(rate int) {
+	it.checkOpen()
 	it.refreshRate = rate
 }
 
-// Close executes destructor for iterator
+// SetRefreshInterval refreshes the iterator SMR accessor in Next once d has
+// passed since the last refresh, in addition to SetRefreshRate. It suits
+// long-lived iterators which move slowly, e.g., paced streaming, which would
+// otherwise hold back the reclamation of deleted items.
+func (it *Iterator) SetRefreshInterval(d time.Duration) {
+	it.checkOpen()
+	it.refreshInterval = d
+	it.lastRefresh = time.Now()
+}
+
+// Close executes destructor for iterator. With UsePooledBlockBuffers, the
+// block buffer of the iterator is reused by the next iterators, so the items
+// returned by Get are no longer valid.
 func (it *Iterator) Close() {
+	it.checkOpen()
+	if debugMode {
+		it.closed = newCloseInfo()
+		it.snap.db.leaks.remove(it)
+	}
+
+	if it.blockBuf != nil && it.snap.db.poolBlockBufs {
+		it.snap.db.blockBufs.Put(it.blockBuf)
+		it.blockBuf = nil
+	}
+
 	it.snap.Close()
 	it.snap.db.store.FreeBuf(it.buf)
 	it.iter.Close()
 }
 
-// NewIterator creates an iterator for a Nitro snapshot
+// NewIterator creates an iterator for a Nitro snapshot. It returns nil if
+// the snapshot has been closed.
 func (m *Nitro) NewIterator(snap *Snapshot) *Iterator {
 	if !snap.Open() {
 		return nil
@@ -185,7 +587,15 @@ func (m *Nitro) NewIterator(snap *Snapshot) *Iterator {
 	}
 
 	if snap.db.HasBlockStore() {
-		it.blockBuf = make([]byte, blockSize, blockSize)
+		if m.poolBlockBufs {
+			it.blockBuf = m.blockBufs.Get().([]byte)
+		} else {
+			it.blockBuf = make([]byte, m.blockDataSize)
+		}
+	}
+
+	if debugMode {
+		m.leaks.add(it)
 	}
 
 	return it
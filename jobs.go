@@ -0,0 +1,257 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrJobExists means a maintenance job with the name has been added
+	ErrJobExists = fmt.Errorf("Maintenance job already exists")
+	// ErrNoJob means there is no maintenance job with the name
+	ErrNoJob = fmt.Errorf("Maintenance job does not exist")
+)
+
+// JobFunc is a periodic maintenance task, e.g., a TTL sweep or a backup
+type JobFunc func(m *Nitro) error
+
+// JobStatus describes a maintenance job
+type JobStatus struct {
+	Name     string
+	Interval time.Duration
+	Enabled  bool
+	Running  bool
+
+	Runs     int64
+	Failures int64
+
+	// Start, duration and error of the last run
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    error
+}
+
+type maintenanceJob struct {
+	fn JobFunc
+
+	// Serializes the scheduled runs with RunJob
+	runMu sync.Mutex
+
+	mu     sync.Mutex
+	status JobStatus
+	wake   chan struct{}
+}
+
+// jobScheduler runs the maintenance jobs of an instance, every job in its
+// own goroutine
+type jobScheduler struct {
+	sync.Mutex
+	jobs    map[string]*maintenanceJob
+	order   []*maintenanceJob
+	stopped bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (j *maintenanceJob) run(m *Nitro) error {
+	j.runMu.Lock()
+	defer j.runMu.Unlock()
+
+	start := time.Now()
+	j.mu.Lock()
+	j.status.Running = true
+	j.mu.Unlock()
+
+	err := j.fn(m)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	if err != nil {
+		j.status.Failures++
+	}
+	j.status.LastRun = start
+	j.status.LastDuration = time.Since(start)
+	j.status.LastError = err
+	return err
+}
+
+func (j *maintenanceJob) schedule(m *Nitro, stop chan struct{}) {
+	defer m.jobs.wg.Done()
+	for {
+		j.mu.Lock()
+		interval, enabled := j.status.Interval, j.status.Enabled
+		j.mu.Unlock()
+
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if enabled && interval > 0 {
+			timer = time.NewTimer(interval)
+			tick = timer.C
+		}
+
+		select {
+		case <-tick:
+			j.run(m)
+		case <-j.wake:
+		case <-stop:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// AddJob adds a maintenance job which is run by a background goroutine of
+// the instance every interval, measured from the end of the previous run,
+// until the instance is closed. Close waits for a running job to finish.
+// Jobs are enabled when they are added, see SetJobEnabled.
+func (m *Nitro) AddJob(name string, interval time.Duration, fn JobFunc) error {
+	m.jobs.Lock()
+	defer m.jobs.Unlock()
+
+	if m.jobs.stopped {
+		return ErrShutdown
+	}
+	if _, ok := m.jobs.jobs[name]; ok {
+		return ErrJobExists
+	}
+
+	if m.jobs.jobs == nil {
+		m.jobs.jobs = make(map[string]*maintenanceJob)
+		m.jobs.stop = make(chan struct{})
+	}
+
+	j := &maintenanceJob{
+		fn:   fn,
+		wake: make(chan struct{}, 1),
+		status: JobStatus{
+			Name:     name,
+			Interval: interval,
+			Enabled:  true,
+		},
+	}
+	m.jobs.jobs[name] = j
+	m.jobs.order = append(m.jobs.order, j)
+
+	m.jobs.wg.Add(1)
+	go j.schedule(m, m.jobs.stop)
+	return nil
+}
+
+func (m *Nitro) getJob(name string) (*maintenanceJob, error) {
+	m.jobs.Lock()
+	defer m.jobs.Unlock()
+
+	if j, ok := m.jobs.jobs[name]; ok {
+		return j, nil
+	}
+	return nil, ErrNoJob
+}
+
+// update changes the schedule of a job and restarts its timer
+func (j *maintenanceJob) update(fn func(*JobStatus)) {
+	j.mu.Lock()
+	fn(&j.status)
+	j.mu.Unlock()
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetJobEnabled enables or disables the scheduled runs of a maintenance job
+func (m *Nitro) SetJobEnabled(name string, enable bool) error {
+	j, err := m.getJob(name)
+	if err == nil {
+		j.update(func(s *JobStatus) { s.Enabled = enable })
+	}
+	return err
+}
+
+// SetJobInterval changes the interval of a maintenance job. The next run is
+// scheduled interval after the change. A zero interval disables the
+// scheduled runs.
+func (m *Nitro) SetJobInterval(name string, interval time.Duration) error {
+	j, err := m.getJob(name)
+	if err == nil {
+		j.update(func(s *JobStatus) { s.Interval = interval })
+	}
+	return err
+}
+
+// RunJob runs a maintenance job in the calling goroutine, after the running
+// scheduled run has finished, and returns its error. It does not change the
+// schedule of the job.
+func (m *Nitro) RunJob(name string) error {
+	j, err := m.getJob(name)
+	if err != nil {
+		return err
+	}
+	return j.run(m)
+}
+
+// Jobs returns the status of the maintenance jobs in the order they were
+// added
+func (m *Nitro) Jobs() []JobStatus {
+	m.jobs.Lock()
+	defer m.jobs.Unlock()
+
+	sts := make([]JobStatus, 0, len(m.jobs.order))
+	for _, j := range m.jobs.order {
+		j.mu.Lock()
+		sts = append(sts, j.status)
+		j.mu.Unlock()
+	}
+	return sts
+}
+
+// stopJobs stops the scheduled runs and waits for the running jobs
+func (m *Nitro) stopJobs() {
+	m.jobs.Lock()
+	m.jobs.stopped = true
+	stop := m.jobs.stop
+	m.jobs.Unlock()
+
+	if stop != nil {
+		close(stop)
+		m.jobs.wg.Wait()
+	}
+}
+
+// CompactionJob returns a maintenance job compacting the block store files
+// with a ratio of live blocks below minLiveRatio, see CompactBlockStore
+func CompactionJob(minLiveRatio float64) JobFunc {
+	return func(m *Nitro) error {
+		return m.CompactBlockStore(minLiveRatio)
+	}
+}
+
+// GCJob returns a maintenance job running a garbage collection pass, which
+// collects the dead snapshots skipped while another collection was running
+func GCJob() JobFunc {
+	return func(m *Nitro) error {
+		m.GC()
+		return nil
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceJobs(t *testing.T) {
+	db := NewWithConfig(testConf)
+
+	var runs int64
+	errFail := fmt.Errorf("sweep failed")
+	if err := db.AddJob("sweep", time.Millisecond, func(m *Nitro) error {
+		if atomic.AddInt64(&runs, 1)%2 == 0 {
+			return errFail
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddJob("sweep", time.Millisecond, GCJob()); err != ErrJobExists {
+		t.Errorf("Expected ErrJobExists, got %v", err)
+	}
+	db.AddJob("gc", time.Hour, GCJob())
+
+	for atomic.LoadInt64(&runs) < 10 {
+		time.Sleep(time.Millisecond)
+	}
+
+	sts := db.Jobs()
+	if len(sts) != 2 || sts[0].Name != "sweep" || sts[0].Runs < 10 ||
+		sts[0].Failures == 0 || sts[1].Name != "gc" || sts[1].Runs != 0 {
+		t.Errorf("Unexpected job status %+v", sts)
+	}
+
+	// No scheduled runs once disabled
+	db.SetJobEnabled("sweep", false)
+	time.Sleep(10 * time.Millisecond)
+	n := atomic.LoadInt64(&runs)
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt64(&runs) != n || db.Jobs()[0].Enabled {
+		t.Errorf("Expected the job to be disabled")
+	}
+
+	// Runs on demand
+	if err := db.RunJob("sweep"); err != nil && err != errFail {
+		t.Error(err)
+	}
+	if st := db.Jobs()[0]; st.Runs != n+1 || (st.LastError != nil) != ((n+1)%2 == 0) {
+		t.Errorf("Unexpected job status %+v", st)
+	}
+
+	if err := db.SetJobInterval("none", time.Second); err != ErrNoJob {
+		t.Errorf("Expected ErrNoJob, got %v", err)
+	}
+	db.SetJobInterval("gc", time.Millisecond)
+	for db.Jobs()[1].Runs == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	db.SetJobEnabled("sweep", true)
+	db.Close()
+	n = atomic.LoadInt64(&runs)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt64(&runs) != n {
+		t.Errorf("Expected no runs after Close")
+	}
+	if err := db.AddJob("late", time.Millisecond, GCJob()); err != ErrShutdown {
+		t.Errorf("Expected ErrShutdown, got %v", err)
+	}
+}
@@ -0,0 +1,404 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrKeyspacesDisabled means keyspaces were not enabled in the Config
+	ErrKeyspacesDisabled = fmt.Errorf("Keyspaces are not enabled")
+	// ErrTooManyKeyspaces means all keyspace ids are in use
+	ErrTooManyKeyspaces = fmt.Errorf("Too many keyspaces")
+)
+
+// keyspacePrefixLen is the size of the keyspace id prepended to items
+const keyspacePrefixLen = 2
+
+// UseKeyspaces partitions the instance into keyspaces. Every item is
+// prefixed with the id of its keyspace and items are ordered by keyspace
+// first and by the key comparator within a keyspace. All keyspaces share the
+// snapshot sequence numbers, so a snapshot captures all of them atomically.
+// With keyspaces enabled items must be written through keyspace writers.
+func (cfg *Config) UseKeyspaces() {
+	cfg.useKeyspaces = true
+}
+
+func newKeyspaceCompare(cmp KeyCompare) KeyCompare {
+	return func(a, b []byte) int {
+		// Items without a complete keyspace id only occur as range bounds
+		if len(a) < keyspacePrefixLen || len(b) < keyspacePrefixLen {
+			return bytes.Compare(a, b)
+		}
+
+		if c := bytes.Compare(a[:keyspacePrefixLen], b[:keyspacePrefixLen]); c != 0 {
+			return c
+		}
+		return cmp(a[keyspacePrefixLen:], b[keyspacePrefixLen:])
+	}
+}
+
+// newKeyspaceHash applies the key hash to the items without their keyspace
+// id. Items of different keyspaces with the same key share the hash.
+func newKeyspaceHash(hash KeyHash) KeyHash {
+	if hash == nil {
+		return nil
+	}
+
+	return func(itm []byte) uint64 {
+		if len(itm) < keyspacePrefixLen {
+			return hashBytes(itm)
+		}
+		return hash(itm[keyspacePrefixLen:])
+	}
+}
+
+type keyspaceRegistry struct {
+	sync.Mutex
+	byName map[string]*Keyspace
+}
+
+// Keyspace is a named partition of a Nitro instance
+type Keyspace struct {
+	db     *Nitro
+	name   string
+	id     uint16
+	prefix []byte
+
+	// Idle writers reused by LoadFromDisk, writers cannot be released
+	sync.Mutex
+	loadWriters []*KeyspaceWriter
+}
+
+// Keyspace returns the keyspace with the given name, creating it if needed
+func (m *Nitro) Keyspace(name string) (*Keyspace, error) {
+	if !m.useKeyspaces {
+		return nil, ErrKeyspacesDisabled
+	}
+
+	m.keyspaces.Lock()
+	defer m.keyspaces.Unlock()
+
+	if ks, ok := m.keyspaces.byName[name]; ok {
+		return ks, nil
+	}
+
+	if len(m.keyspaces.byName) > math.MaxUint16 {
+		return nil, ErrTooManyKeyspaces
+	}
+
+	return m.addKeyspace(name, uint16(len(m.keyspaces.byName))), nil
+}
+
+func (m *Nitro) addKeyspace(name string, id uint16) *Keyspace {
+	if m.keyspaces.byName == nil {
+		m.keyspaces.byName = make(map[string]*Keyspace)
+	}
+
+	ks := &Keyspace{db: m, name: name, id: id, prefix: make([]byte, keyspacePrefixLen)}
+	binary.BigEndian.PutUint16(ks.prefix, id)
+	m.keyspaces.byName[name] = ks
+	return ks
+}
+
+// Keyspaces returns the sorted names of all keyspaces
+func (m *Nitro) Keyspaces() []string {
+	m.keyspaces.Lock()
+	defer m.keyspaces.Unlock()
+
+	names := make([]string, 0, len(m.keyspaces.byName))
+	for name := range m.keyspaces.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name returns the name of the keyspace
+func (ks *Keyspace) Name() string {
+	return ks.name
+}
+
+func (ks *Keyspace) item(buf, bs []byte) []byte {
+	buf = append(buf[:0], ks.prefix...)
+	return append(buf, bs...)
+}
+
+// endPrefix returns the prefix of the following keyspace. The last keyspace
+// has no upper bound and nil is returned.
+func (ks *Keyspace) endPrefix() []byte {
+	if ks.id == math.MaxUint16 {
+		return nil
+	}
+
+	end := make([]byte, keyspacePrefixLen)
+	binary.BigEndian.PutUint16(end, ks.id+1)
+	return end
+}
+
+// getLoadWriters returns n writers for a load, reusing the writers of
+// previous loads
+func (ks *Keyspace) getLoadWriters(n int) []*KeyspaceWriter {
+	ks.Lock()
+	defer ks.Unlock()
+
+	writers := make([]*KeyspaceWriter, n)
+	for i := range writers {
+		if l := len(ks.loadWriters); l > 0 {
+			writers[i] = ks.loadWriters[l-1]
+			ks.loadWriters = ks.loadWriters[:l-1]
+		} else {
+			writers[i] = ks.NewWriter()
+		}
+	}
+
+	return writers
+}
+
+func (ks *Keyspace) putLoadWriters(writers []*KeyspaceWriter) {
+	ks.Lock()
+	defer ks.Unlock()
+	ks.loadWriters = append(ks.loadWriters, writers...)
+}
+
+// KeyspaceWriter is a writer scoped to a keyspace. Like Writer, it is
+// thread-unsafe.
+type KeyspaceWriter struct {
+	ks  *Keyspace
+	w   *Writer
+	buf []byte
+}
+
+// NewWriter creates a writer for the keyspace
+func (ks *Keyspace) NewWriter() *KeyspaceWriter {
+	return &KeyspaceWriter{ks: ks, w: ks.db.NewWriter()}
+}
+
+// Put inserts an item into the keyspace
+func (kw *KeyspaceWriter) Put(bs []byte) {
+	kw.buf = kw.ks.item(kw.buf, bs)
+	kw.w.Put(kw.buf)
+}
+
+// Delete removes an item from the keyspace
+func (kw *KeyspaceWriter) Delete(bs []byte) bool {
+	kw.buf = kw.ks.item(kw.buf, bs)
+	return kw.w.Delete(kw.buf)
+}
+
+// Upsert inserts or replaces an item in the keyspace, see Writer.Upsert
+func (kw *KeyspaceWriter) Upsert(bs []byte) (old []byte, replaced bool) {
+	kw.buf = kw.ks.item(kw.buf, bs)
+	old, replaced = kw.w.Upsert(kw.buf)
+	if old != nil {
+		old = old[keyspacePrefixLen:]
+	}
+	return
+}
+
+// KeyspaceIterator iterates over the items of a keyspace in a snapshot
+type KeyspaceIterator struct {
+	ks  *Keyspace
+	it  *Iterator
+	buf []byte
+}
+
+// NewIterator creates an iterator over the items of the keyspace visible in
+// snap. It returns nil if the snapshot has been closed.
+func (ks *Keyspace) NewIterator(snap *Snapshot) *KeyspaceIterator {
+	it := snap.NewIterator()
+	if it == nil {
+		return nil
+	}
+
+	it.SetEnd(ks.endPrefix())
+	return &KeyspaceIterator{ks: ks, it: it}
+}
+
+// SeekFirst moves the cursor to the first item of the keyspace
+func (ki *KeyspaceIterator) SeekFirst() {
+	ki.it.Seek(ki.ks.prefix)
+}
+
+// Seek moves the cursor to the item bs or the next bigger one
+func (ki *KeyspaceIterator) Seek(bs []byte) {
+	ki.buf = ki.ks.item(ki.buf, bs)
+	ki.it.Seek(ki.buf)
+}
+
+// Valid returns false when the iterator has reached the end of the keyspace
+func (ki *KeyspaceIterator) Valid() bool {
+	return ki.it.Valid()
+}
+
+// Get returns the current item data without the keyspace prefix
+func (ki *KeyspaceIterator) Get() []byte {
+	return ki.it.Get()[keyspacePrefixLen:]
+}
+
+// Next moves the cursor to the next item
+func (ki *KeyspaceIterator) Next() {
+	ki.it.Next()
+}
+
+// Err returns the error reading the items, see Iterator.Err
+func (ki *KeyspaceIterator) Err() error {
+	return ki.it.Err()
+}
+
+// Close releases the iterator
+func (ki *KeyspaceIterator) Close() {
+	ki.it.Close()
+}
+
+// KeyspaceSnapshot is a snapshot scoped to a keyspace
+type KeyspaceSnapshot struct {
+	ks   *Keyspace
+	snap *Snapshot
+}
+
+// NewSnapshot creates a snapshot of the keyspace. The underlying snapshot is
+// shared with the other keyspaces of the instance.
+func (ks *Keyspace) NewSnapshot() (*KeyspaceSnapshot, error) {
+	snap, err := ks.db.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyspaceSnapshot{ks: ks, snap: snap}, nil
+}
+
+// Snapshot returns the underlying instance snapshot
+func (s *KeyspaceSnapshot) Snapshot() *Snapshot {
+	return s.snap
+}
+
+// Open implements reference counting for keyspace snapshots
+func (s *KeyspaceSnapshot) Open() bool {
+	return s.snap.Open()
+}
+
+// Close releases the keyspace snapshot
+func (s *KeyspaceSnapshot) Close() {
+	s.snap.Close()
+}
+
+// NewIterator creates an iterator over the keyspace items in the snapshot
+func (s *KeyspaceSnapshot) NewIterator() *KeyspaceIterator {
+	return s.ks.NewIterator(s.snap)
+}
+
+// StoreToDisk backups the keyspace items of a snapshot to disk. Items are
+// stored without their keyspace prefix, so the backup can be restored with
+// Keyspace.LoadFromDisk or into a plain instance with Nitro.LoadFromDisk.
+// Like Nitro.StoreToDisk, the snapshot is closed once the backup is done.
+func (ks *Keyspace) StoreToDisk(dir string, snap *KeyspaceSnapshot, concurr int, itmCallback ItemCallback) error {
+	return ks.db.storeToDisk(dir, snap.snap, concurr, nil, itmCallback, ks)
+}
+
+// StoreToDiskFiltered backups the keyspace items of a snapshot accepted by
+// filter, see Nitro.StoreToDiskFiltered. The filter gets the items with
+// their keyspace prefix.
+func (ks *Keyspace) StoreToDiskFiltered(dir string, snap *KeyspaceSnapshot, concurr int,
+	filter ItemFilter, itmCallback ItemCallback) error {
+	return ks.db.storeToDisk(dir, snap.snap, concurr, filter, itmCallback, ks)
+}
+
+// LoadFromDisk inserts the items of a disk backup into the keyspace. Unlike
+// Nitro.LoadFromDisk, the instance does not need to be empty.
+func (ks *Keyspace) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*KeyspaceSnapshot, error) {
+	var files []string
+	m := ks.db
+	datadir := filepath.Join(dir, "data")
+
+	bs, err := ioutil.ReadFile(filepath.Join(datadir, "files.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := readDumpFormat(dir, m.dumpFormat)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(bs, &files)
+
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, filepath.Join(datadir, file))
+	}
+	progress := newLoadProgress(paths)
+
+	readers := make([]FileReader, len(files))
+	errors := make([]error, len(files))
+	defer func() {
+		for _, r := range readers {
+			if r != nil {
+				r.Close()
+			}
+		}
+	}()
+
+	for i, file := range files {
+		r := m.newFileReader(m.fileType, format)
+		if err := r.Open(filepath.Join(datadir, file)); err != nil {
+			return nil, err
+		}
+		progress.trackIO(r)
+		readers[i] = r
+	}
+
+	writers := ks.getLoadWriters(restoreReaders(concurr, len(files)))
+	defer ks.putLoadWriters(writers)
+
+	runShards(len(files), concurr, progress, func(id, shard int) {
+		r := readers[shard]
+		kw := writers[id]
+		for {
+			if progress.isAborted() {
+				errors[shard] = ErrLoadAborted
+				return
+			}
+
+			itm, err := r.ReadItem()
+			if err != nil {
+				errors[shard] = err
+				return
+			}
+
+			if itm == nil {
+				return
+			}
+
+			progress.restored(shard, r)
+			kw.buf = ks.item(kw.buf, itm.Bytes())
+			m.freeItem(itm)
+			if n := kw.w.Put2(kw.buf); n != nil && callb != nil {
+				callb(&ItemEntry{itm: (*Item)(n.Item()), n: n, shard: shard, progress: progress})
+			}
+		}
+	})
+
+	for _, err := range errors {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ks.NewSnapshot()
+}
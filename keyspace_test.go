@@ -0,0 +1,192 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestKeyspaces(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UseKeyspaces()
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	users, err := db.Keyspace("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, _ := db.Keyspace("orders")
+
+	uw := users.NewWriter()
+	ow := orders.NewWriter()
+	for i := 0; i < 100; i++ {
+		uw.Put([]byte(fmt.Sprintf("%03d", i)))
+		ow.Put([]byte(fmt.Sprintf("%03d", i*2)))
+	}
+	uw.Delete([]byte("050"))
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	// Writes after the snapshot must not be visible in any keyspace
+	uw.Put([]byte("999"))
+	ow.Put([]byte("999"))
+
+	count := func(ks *Keyspace, seek []byte) (n int) {
+		itr := ks.NewIterator(snap)
+		defer itr.Close()
+		if seek == nil {
+			itr.SeekFirst()
+		} else {
+			itr.Seek(seek)
+		}
+		var last []byte
+		for ; itr.Valid(); itr.Next() {
+			if last != nil && string(itr.Get()) <= string(last) {
+				t.Errorf("Unordered item %s after %s", itr.Get(), last)
+			}
+			last = append(last[:0], itr.Get()...)
+			n++
+		}
+		return
+	}
+
+	if n := count(users, nil); n != 99 {
+		t.Errorf("Expected 99 users, got %d", n)
+	}
+	if n := count(orders, nil); n != 100 {
+		t.Errorf("Expected 100 orders, got %d", n)
+	}
+	if n := count(orders, []byte("100")); n != 50 {
+		t.Errorf("Expected 50 orders after seek, got %d", n)
+	}
+
+	if ks, _ := db.Keyspace("users"); ks != users {
+		t.Errorf("Expected the existing keyspace")
+	}
+	if names := db.Keyspaces(); len(names) != 2 || names[0] != "orders" || names[1] != "users" {
+		t.Errorf("Unexpected keyspaces %v", names)
+	}
+
+	if _, err := New().Keyspace("users"); err != ErrKeyspacesDisabled {
+		t.Errorf("Expected ErrKeyspacesDisabled, got %v", err)
+	}
+}
+
+func TestKeyspaceBounds(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UseKeyspaces()
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	db.keyspaces.Lock()
+	last := db.addKeyspace("last", math.MaxUint16)
+	db.keyspaces.Unlock()
+
+	w := last.NewWriter()
+	w.Put([]byte{0x01})
+	w.Put([]byte{0xff, 0xff})
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	itr := last.NewIterator(snap)
+	defer itr.Close()
+	n := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 items in the last keyspace, got %d", n)
+	}
+
+	if c := db.keyCmp([]byte{0x00}, []byte{0x00, 0x01, 'a'}); c >= 0 {
+		t.Errorf("Expected short item to sort first, got %d", c)
+	}
+}
+
+func TestKeyspaceStoreToDisk(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := DefaultConfig()
+	cfg.UseKeyspaces()
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	users, _ := db.Keyspace("users")
+	orders, _ := db.Keyspace("orders")
+	uw, ow := users.NewWriter(), orders.NewWriter()
+	for i := 0; i < 10000; i++ {
+		uw.Put([]byte(fmt.Sprintf("u%05d", i)))
+		ow.Put([]byte(fmt.Sprintf("o%05d", i)))
+	}
+
+	snap, _ := users.NewSnapshot()
+	if err := users.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore into a different keyspace of an instance holding other data
+	db2 := NewWithConfig(cfg)
+	defer db2.Close()
+	other, _ := db2.Keyspace("other")
+	other.NewWriter().Put([]byte("x"))
+	restored, _ := db2.Keyspace("restored")
+	snap2, err := restored.LoadFromDisk(dir, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	itr := snap2.NewIterator()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if exp := fmt.Sprintf("u%05d", i); string(itr.Get()) != exp {
+			t.Fatalf("Expected %s, got %s", exp, itr.Get())
+		}
+		i++
+	}
+	itr.Close()
+	snap2.Close()
+	if i != 10000 {
+		t.Errorf("Expected 10000 items, got %d", i)
+	}
+
+	// Repeated loads reuse the writers of the keyspace
+	countWriters := func() (n int) {
+		for w := db2.wlist; w != nil; w = w.next {
+			n++
+		}
+		return
+	}
+	nw := countWriters()
+	snap2, err = restored.LoadFromDisk(dir, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap2.Close()
+	if n := countWriters(); n != nw {
+		t.Errorf("Expected %d writers after reload, got %d", nw, n)
+	}
+
+	// Keyspace backups restore into plain instances as well
+	db3 := New()
+	defer db3.Close()
+	snap3, err := db3.LoadFromDisk(dir, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap3.Close()
+	if n := db3.ItemsCount(); n != 10000 {
+		t.Errorf("Expected 10000 items, got %d", n)
+	}
+}
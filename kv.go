@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MaxKeyLength is the largest key of a key-value item, see EncodeKV
+const MaxKeyLength = math.MaxUint16
+
+// ErrKeyTooLong means a key which is longer than MaxKeyLength
+var ErrKeyTooLong = fmt.Errorf("Key exceeds the maximum key length")
+
+// UseKeyValueItems stores items as separate keys and values, see PutKV. Items
+// are encoded as [2 byte key length][key][value] and the key comparator only
+// compares the keys, so that an item cannot be inserted by Put while another
+// item with the same key and a different value is visible. PutKV replaces the
+// value of such an item. Items passed to Put, Delete, Seek and the other
+// single-blob APIs are expected in this encoding, see EncodeKV.
+func (cfg *Config) UseKeyValueItems() {
+	cfg.useKeyValue = true
+}
+
+// newKeyValueCompare applies the key comparator to the keys of the items
+func newKeyValueCompare(cmp KeyCompare) KeyCompare {
+	return func(a, b []byte) int {
+		ka, _ := DecodeKV(a)
+		kb, _ := DecodeKV(b)
+		return cmp(ka, kb)
+	}
+}
+
+// newKeyValueHash applies the key hash to the keys of the items
+func newKeyValueHash(hash KeyHash) KeyHash {
+	if hash == nil {
+		return nil
+	}
+
+	return func(itm []byte) uint64 {
+		key, _ := DecodeKV(itm)
+		return hash(key)
+	}
+}
+
+// AppendKV appends the encoding of a key and a value to buf, see EncodeKV.
+// Keys longer than MaxKeyLength are rejected with ErrKeyTooLong.
+func AppendKV(buf, key, value []byte) ([]byte, error) {
+	if len(key) > MaxKeyLength {
+		return buf, ErrKeyTooLong
+	}
+
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(key)))
+	buf = append(buf, l[:]...)
+	buf = append(buf, key...)
+	return append(buf, value...), nil
+}
+
+// EncodeKV returns the item data of a key and a value for instances with
+// UseKeyValueItems. A nil value encodes a key for lookups and deletes. It
+// panics with ErrKeyTooLong if the key is longer than MaxKeyLength.
+func EncodeKV(key, value []byte) []byte {
+	bs, err := AppendKV(make([]byte, 0, 2+len(key)+len(value)), key, value)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+// DecodeKV returns the key and the value of item data encoded by EncodeKV.
+// Data which is not a valid encoding is returned as the key.
+func DecodeKV(itm []byte) (key, value []byte) {
+	if len(itm) < 2 {
+		return itm, nil
+	}
+
+	end := 2 + int(binary.BigEndian.Uint16(itm))
+	if end > len(itm) {
+		return itm, nil
+	}
+	return itm[2:end], itm[end:]
+}
+
+// PutKV inserts an item with key and value into an instance with
+// UseKeyValueItems, replacing the value of the visible item with the same key
+// like Upsert. It panics with ErrKeyTooLong if the key is longer than
+// MaxKeyLength.
+func (w *Writer) PutKV(key, value []byte) {
+	w.kvBuf = w.appendKV(key, value)
+	w.Upsert(w.kvBuf)
+}
+
+// DeleteKV deletes the item with key from an instance with UseKeyValueItems,
+// like Delete
+func (w *Writer) DeleteKV(key []byte) bool {
+	w.kvBuf = w.appendKV(key, nil)
+	return w.Delete(w.kvBuf)
+}
+
+// appendKV encodes a key and a value into the buffer of the writer
+func (w *Writer) appendKV(key, value []byte) []byte {
+	bs, err := AppendKV(w.kvBuf[:0], key, value)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+// Key returns the key of the current item of an instance with
+// UseKeyValueItems, see DecodeKV
+func (it *Iterator) Key() []byte {
+	key, _ := DecodeKV(it.Get())
+	return key
+}
+
+// Value returns the value of the current item of an instance with
+// UseKeyValueItems, see DecodeKV
+func (it *Iterator) Value() []byte {
+	_, value := DecodeKV(it.Get())
+	return value
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestKeyValueItems(t *testing.T) {
+	conf := testConf
+	conf.UseKeyValueItems()
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	// Values larger than the keys would change the order of encoded blobs
+	n := 100
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.PutKV([]byte(fmt.Sprintf("k%d", i)), bytes.Repeat([]byte{byte(i)}, n-i))
+	}
+	w.PutKV([]byte("k1"), []byte("duplicate"))
+	w.DeleteKV([]byte("k2"))
+	if old, ok := w.Upsert(EncodeKV([]byte("k3"), []byte("new"))); !ok || !bytes.Equal(old, EncodeKV([]byte("k3"), bytes.Repeat([]byte{3}, n-3))) {
+		t.Errorf("Expected k3 to be replaced, got %q", old)
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	if snap.Count() != int64(n-1) {
+		t.Errorf("Expected %d items, got %d", n-1, snap.Count())
+	}
+
+	itr := snap.NewIterator()
+	var last []byte
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		key, value := itr.Key(), itr.Value()
+		if last != nil && string(key) <= string(last) {
+			t.Errorf("Expected %s after %s", key, last)
+		}
+		last = append(last[:0], key...)
+
+		var i int
+		fmt.Sscanf(string(key), "k%d", &i)
+		expected := bytes.Repeat([]byte{byte(i)}, n-i)
+		switch i {
+		case 1:
+			expected = []byte("duplicate")
+		case 3:
+			expected = []byte("new")
+		}
+		if i == 2 || !bytes.Equal(value, expected) {
+			t.Errorf("Unexpected value of %s: %v", key, value)
+		}
+	}
+
+	if itr.Seek(EncodeKV([]byte("k50"), nil)); !itr.Valid() || string(itr.Key()) != "k50" {
+		t.Errorf("Expected to seek to k50")
+	}
+	itr.Close()
+
+	if itm, ok := snap.Get(EncodeKV([]byte("k1"), nil)); !ok || !bytes.Equal(itm, EncodeKV([]byte("k1"), []byte("duplicate"))) {
+		t.Errorf("Unexpected item %q", itm)
+	}
+
+	if key, value := DecodeKV([]byte{0, 5, 'k'}); !bytes.Equal(key, []byte{0, 5, 'k'}) || value != nil {
+		t.Errorf("Expected invalid data to be returned as the key")
+	}
+
+	if _, err := AppendKV(nil, make([]byte, MaxKeyLength+1), nil); err != ErrKeyTooLong {
+		t.Errorf("Expected ErrKeyTooLong, got %v", err)
+	}
+}
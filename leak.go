@@ -0,0 +1,94 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// LeakReport lists the snapshots, iterators and writers which were still in
+// use when Close was called, by the stacks of the calls which created them.
+type LeakReport struct {
+	// Snapshots which were not closed as often as they were opened
+	Snapshots [][]byte
+	// Iterators which were not closed
+	Iterators [][]byte
+	// Writers with mutations which were not published by NewSnapshot. The
+	// items they deleted are never reclaimed.
+	Writers [][]byte
+}
+
+func (r *LeakReport) String() string {
+	var b bytes.Buffer
+	section := func(what string, stacks [][]byte) {
+		for _, stack := range stacks {
+			fmt.Fprintf(&b, "%s created at:\n%s\n", what, stack)
+		}
+	}
+
+	section("Snapshot", r.Snapshots)
+	section("Iterator", r.Iterators)
+	section("Writer", r.Writers)
+	return b.String()
+}
+
+// leakTracker records the creation stacks of the open snapshots and
+// iterators in debug mode
+type leakTracker struct {
+	sync.Mutex
+	objs map[interface{}][]byte
+}
+
+func (lt *leakTracker) add(obj interface{}) {
+	stack := debug.Stack()
+	lt.Lock()
+	defer lt.Unlock()
+	if lt.objs == nil {
+		lt.objs = make(map[interface{}][]byte)
+	}
+	lt.objs[obj] = stack
+}
+
+func (lt *leakTracker) remove(obj interface{}) {
+	lt.Lock()
+	defer lt.Unlock()
+	delete(lt.objs, obj)
+}
+
+// leakReport returns the objects which are still in use or nil
+func (m *Nitro) leakReport() *LeakReport {
+	r := &LeakReport{}
+
+	m.leaks.Lock()
+	for obj, stack := range m.leaks.objs {
+		switch obj.(type) {
+		case *Snapshot:
+			r.Snapshots = append(r.Snapshots, stack)
+		case *Iterator:
+			r.Iterators = append(r.Iterators, stack)
+		}
+	}
+	m.leaks.Unlock()
+
+	for w := m.wlist; w != nil; w = w.next {
+		if !w.isInternal && w.created != nil && (w.gchead != nil || w.count != 0) {
+			r.Writers = append(r.Writers, w.created)
+		}
+	}
+
+	if len(r.Snapshots) == 0 && len(r.Iterators) == 0 && len(r.Writers) == 0 {
+		return nil
+	}
+
+	return r
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"sort"
+	"unsafe"
+
+	"github.com/elliotcourant/nitro/skiplist"
+)
+
+// Number of items MultiGet moves forward to the next key before seeking it
+const multiGetMaxSteps = 16
+
+// Get returns the item of the snapshot which compares equal to key by the
+// key comparator. The item is looked up in the skiplist directly, without
+// creating an iterator. The returned data remains valid as long as the
+// snapshot is open. With a block store, the item is read from its data block
+// and copied, and false is also returned if the block cannot be read.
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	s.checkOpen()
+	if s.db.HasBlockStore() {
+		return s.getFromBlocks(key)
+	}
+
+	db := s.db
+	buf := db.store.MakeBuf()
+	defer db.store.FreeBuf(buf)
+	iter := db.store.NewIterator(db.iterCmp, buf)
+	defer iter.Close()
+
+	if itm := s.seekVisible(iter, db.newItem(key, false)); itm != nil {
+		return itm.Bytes(), true
+	}
+	return nil, false
+}
+
+// seekVisible returns the item of the snapshot with the key of x. Items with
+// the same key are ordered by the snapshot in which they were born, and only
+// one of them can be visible in a snapshot.
+func (s *Snapshot) seekVisible(iter *skiplist.Iterator, x *Item) *Item {
+	db := s.db
+	for iter.Seek(unsafe.Pointer(x)); iter.Valid(); iter.Next() {
+		itm := (*Item)(iter.Get())
+		if db.keyCmp(itm.Bytes(), x.Bytes()) != 0 {
+			break
+		}
+
+		if s.isVisible(itm) {
+			return itm
+		}
+	}
+	return nil
+}
+
+func (s *Snapshot) getFromBlocks(key []byte) ([]byte, bool) {
+	itr, err := s.OpenIterator()
+	if err != nil {
+		return nil, false
+	}
+	defer itr.Close()
+
+	if itr.Seek(key); itr.Valid() {
+		if itm := itr.Get(); itr.Err() == nil && s.db.keyCmp(itm, key) == 0 {
+			return append([]byte(nil), itm...), true
+		}
+	}
+	return nil, false
+}
+
+// MultiGet looks up the items of the snapshot which compare equal to the
+// keys and returns them in the order of the keys, with nil for the keys
+// without an item. The keys are sorted and looked up with a single iterator,
+// which moves forward to the next key when it is close instead of seeking
+// it, so that a data block of the block store is read once for all its keys.
+// The returned data remains valid as long as the snapshot is open, the items
+// of the block store are copied. It returns ErrSnapshotClosed if the snapshot
+// has been closed.
+func (s *Snapshot) MultiGet(keys [][]byte) ([][]byte, error) {
+	itr, err := s.OpenIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	itms := make([][]byte, len(keys))
+	cmp := s.db.keyCmp
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return cmp(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	positioned := false
+	for i, idx := range order {
+		key := keys[idx]
+		if i > 0 && cmp(key, keys[order[i-1]]) == 0 {
+			itms[idx] = itms[order[i-1]]
+			continue
+		}
+
+		for steps := 0; positioned && itr.Valid() && steps < multiGetMaxSteps; steps++ {
+			if cmp(itr.Get(), key) >= 0 {
+				break
+			}
+			itr.Next()
+		}
+
+		if !positioned || itr.Err() != nil || itr.Valid() && cmp(itr.Get(), key) < 0 {
+			itr.Seek(key)
+			positioned = true
+		}
+
+		if !itr.Valid() {
+			if itr.Err() == nil {
+				// The remaining keys are past the last item
+				break
+			}
+			continue
+		}
+
+		if itm := itr.Get(); itr.Err() == nil && cmp(itm, key) == 0 {
+			if s.db.HasBlockStore() {
+				itm = append([]byte(nil), itm...)
+			}
+			itms[idx] = itm
+		}
+	}
+
+	return itms, nil
+}
+
+// Exists reports whether the snapshot has an item which compares equal to
+// key, without returning its data. With a block store, the index of the
+// blocks answers for the first item of every block and only the other items
+// are looked up in the data block. False is also returned if the block
+// cannot be read.
+func (s *Snapshot) Exists(key []byte) bool {
+	s.checkOpen()
+	db := s.db
+	if db.HasBlockStore() {
+		return s.existsInBlock(key)
+	}
+
+	buf := db.store.MakeBuf()
+	defer db.store.FreeBuf(buf)
+	iter := db.store.NewIterator(db.iterCmp, buf)
+	defer iter.Close()
+
+	return s.seekVisible(iter, db.newItem(key, false)) != nil
+}
+
+func (s *Snapshot) existsInBlock(key []byte) bool {
+	itr, err := s.OpenIterator()
+	if err != nil {
+		return false
+	}
+	defer itr.Close()
+
+	// Index item of the block which may hold the key, which is the first
+	// item of the block
+	db := s.db
+	itr.iter.SeekPrev(unsafe.Pointer(db.newItem(key, false)), itr.skipItem)
+	itr.skipUnwanted()
+	if !itr.iter.Valid() {
+		return false
+	}
+
+	if c := db.keyCmp((*Item)(itr.iter.Get()).Bytes(), key); c >= 0 {
+		return c == 0
+	}
+
+	if err := db.bm.ReadBlock(nodeBlockPtr(itr.GetNode()), itr.blockBuf); err != nil {
+		return false
+	}
+
+	block := newDataBlock(itr.blockBuf, db.bm)
+	for itm := block.Get(); itm != nil; itm = block.Get() {
+		if c := db.keyCmp(itm, key); c >= 0 {
+			return c == 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSnapshotGet(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%06d", i))
+	}
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 1000
+	w := db.NewWriter()
+	for i := 0; i < n; i += 2 {
+		w.Put(key(i))
+	}
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	// Deleted and inserted again, deleted and inserted
+	for i := 0; i < 100; i += 2 {
+		w.Delete(key(i))
+	}
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	for i := 0; i < 100; i++ {
+		w.Put(key(i))
+	}
+	snap3, _ := db.NewSnapshot()
+	defer snap3.Close()
+
+	for i := 0; i < n; i++ {
+		_, ok1 := snap1.Get(key(i))
+		_, ok2 := snap2.Get(key(i))
+		itm, ok3 := snap3.Get(key(i))
+		if ok1 != (i%2 == 0) || ok2 != (i%2 == 0 && i >= 100) || ok3 != (i%2 == 0 || i < 100) {
+			t.Fatalf("Unexpected lookup of %d: %v %v %v", i, ok1, ok2, ok3)
+		}
+		if ok3 && string(itm) != string(key(i)) {
+			t.Errorf("Unexpected item %s", itm)
+		}
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		return
+	}
+
+	bdb := NewWithConfig(conf)
+	defer bdb.Close()
+	if _, err := bdb.ApplyOps(snap3, 2); err != nil {
+		t.Fatal(err)
+	}
+	bsnap, _ := bdb.NewSnapshot()
+	defer bsnap.Close()
+	for i := 0; i < n; i++ {
+		if itm, ok := bsnap.Get(key(i)); ok != (i%2 == 0 || i < 100) || ok && string(itm) != string(key(i)) {
+			t.Fatalf("Unexpected lookup of %d: %s %v", i, itm, ok)
+		}
+	}
+}
+
+func TestSnapshotMultiGet(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%06d", i))
+	}
+
+	n := 10000
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	for i := 0; i < n; i += 3 {
+		w.Put(key(i))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+
+	snaps := []*Snapshot{tsnap}
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if conf.HasBlockStore() {
+		db := NewWithConfig(conf)
+		defer db.Close()
+		if _, err := db.ApplyOps(tsnap, 2); err != nil {
+			t.Fatal(err)
+		}
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		snaps = append(snaps, snap)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var keys [][]byte
+	for i := 0; i < 2000; i++ {
+		// Dense and sparse lookups, duplicates and keys past the last item
+		keys = append(keys, key(rnd.Intn(n+100)))
+		if i%10 == 0 {
+			keys = append(keys, key(rnd.Intn(n/10)))
+		}
+	}
+
+	for _, snap := range snaps {
+		itms, err := snap.MultiGet(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, k := range keys {
+			var j int
+			fmt.Sscanf(string(k), "key-%d", &j)
+			if found := itms[i] != nil; found != (j%3 == 0 && j < n) || found && string(itms[i]) != string(k) {
+				t.Fatalf("Unexpected lookup of %s: %s (block store %v)", k, itms[i], snap.db.HasBlockStore())
+			}
+		}
+	}
+}
+
+func TestSnapshotExists(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%06d", i))
+	}
+
+	n := 10000
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	for i := 0; i < n; i += 2 {
+		w.Put(key(i))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+	for i := 0; i < 100; i += 2 {
+		w.Delete(key(i))
+	}
+	snap, _ := tdb.NewSnapshot()
+	defer snap.Close()
+
+	for i := 0; i < n; i++ {
+		if tsnap.Exists(key(i)) != (i%2 == 0) || snap.Exists(key(i)) != (i%2 == 0 && i >= 100) {
+			t.Fatalf("Unexpected membership of %d", i)
+		}
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		return
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	if _, err := db.ApplyOps(tsnap, 2); err != nil {
+		t.Fatal(err)
+	}
+	bsnap, _ := db.NewSnapshot()
+	defer bsnap.Close()
+
+	// The first items of the blocks are found in the index
+	var indexKeys [][]byte
+	buf := db.store.MakeBuf()
+	iter := db.store.NewIterator(db.iterCmp, buf)
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		indexKeys = append(indexKeys, append([]byte(nil), (*Item)(iter.Get()).Bytes()...))
+	}
+	iter.Close()
+	db.store.FreeBuf(buf)
+
+	bm := &countingBlockManager{BlockManager: db.bm}
+	db.bm = bm
+	for _, k := range indexKeys {
+		if !bsnap.Exists(k) {
+			t.Errorf("Expected %s to exist", k)
+		}
+	}
+	if bm.reads != 0 {
+		t.Errorf("Expected no block reads, got %d", bm.reads)
+	}
+
+	for i := 0; i < n; i++ {
+		if bsnap.Exists(key(i)) != (i%2 == 0) {
+			t.Fatalf("Unexpected membership of %d in the block store", i)
+		}
+	}
+}
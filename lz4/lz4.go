@@ -0,0 +1,198 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package lz4 implements the LZ4 block format.
+//
+// Blocks produced by Compress can be decoded by any LZ4 block decoder and
+// Decompress accepts blocks produced by any LZ4 block encoder. The block
+// format does not record the uncompressed size, callers that need it have to
+// store it next to the block.
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrCorrupt means the input is not a valid LZ4 block
+var ErrCorrupt = errors.New("lz4: corrupt block")
+
+const (
+	minMatch     = 4
+	hashLog      = 12
+	mfLimit      = 12 // the last match starts at least mfLimit bytes before the end
+	lastLiterals = 5  // the last lastLiterals bytes are always literals
+	maxOffset    = 65535
+)
+
+// CompressBound returns the maximum size of a compressed block of n bytes
+func CompressBound(n int) int {
+	return n + n/255 + 16
+}
+
+// DecompressBound returns the maximum size of the data of a compressed block
+// of n bytes. Every length extension byte adds at most 255 bytes of output.
+func DecompressBound(n int) int {
+	return n*255 + 15 + minMatch
+}
+
+func hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - hashLog)
+}
+
+// Compress appends the LZ4 block of src to dst and returns the result
+func Compress(dst, src []byte) []byte {
+	var table [1 << hashLog]int32
+
+	n := len(src)
+	anchor := 0
+	for i := 0; i < n-mfLimit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := hash(seq)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if ref < 0 || i-ref > maxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		ml := minMatch
+		for i+ml < n-lastLiterals && src[ref+ml] == src[i+ml] {
+			ml++
+		}
+
+		dst = appendSequence(dst, src[anchor:i], i-ref, ml)
+		i += ml
+		anchor = i
+	}
+
+	return appendSequence(dst, src[anchor:], 0, 0)
+}
+
+func appendLen(dst []byte, l int) []byte {
+	for ; l >= 255; l -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(l))
+}
+
+// appendSequence appends literals followed by a match. The last sequence of
+// a block has literals only and is denoted by a zero match length.
+func appendSequence(dst, literals []byte, offset, ml int) []byte {
+	ll := len(literals)
+
+	var token byte
+	if ll >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(ll) << 4
+	}
+
+	if ml > 0 {
+		if ml-minMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(ml - minMatch)
+		}
+	}
+
+	dst = append(dst, token)
+	if ll >= 15 {
+		dst = appendLen(dst, ll-15)
+	}
+	dst = append(dst, literals...)
+
+	if ml > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		if ml-minMatch >= 15 {
+			dst = appendLen(dst, ml-minMatch-15)
+		}
+	}
+
+	return dst
+}
+
+func readLen(src []byte, i int) (l, next int, err error) {
+	for {
+		if i >= len(src) {
+			return 0, i, ErrCorrupt
+		}
+
+		b := src[i]
+		i++
+		l += int(b)
+		if b != 255 {
+			return l, i, nil
+		}
+	}
+}
+
+// Decompress appends the data of the LZ4 block src to dst and returns the
+// result
+func Decompress(dst, src []byte) ([]byte, error) {
+	var err error
+	start := len(dst)
+
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		ll := int(token >> 4)
+		if ll == 15 {
+			var ext int
+			if ext, i, err = readLen(src, i); err != nil {
+				return dst, err
+			}
+			ll += ext
+		}
+
+		if ll > len(src)-i {
+			return dst, ErrCorrupt
+		}
+		dst = append(dst, src[i:i+ll]...)
+		i += ll
+
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return dst, ErrCorrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(dst)-start {
+			return dst, ErrCorrupt
+		}
+
+		ml := int(token & 15)
+		if ml == 15 {
+			var ext int
+			if ext, i, err = readLen(src, i); err != nil {
+				return dst, err
+			}
+			ml += ext
+		}
+		ml += minMatch
+
+		// Matches may overlap the bytes they produce
+		pos := len(dst) - offset
+		for k := 0; k < ml; k++ {
+			dst = append(dst, dst[pos+k])
+		}
+
+		// The last sequence of a block has literals only
+		if i == len(src) {
+			return dst, ErrCorrupt
+		}
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package lz4
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var json bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&json, `{"id":%d,"name":"user-%d","tags":["a","b","c"]},`, i, i%7)
+	}
+
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcdefghijklm"),
+		bytes.Repeat([]byte("x"), 1000),
+		json.Bytes(),
+		random,
+	}
+
+	for _, src := range inputs {
+		block := Compress(nil, src)
+		if len(block) > CompressBound(len(src)) {
+			t.Errorf("Block of %d bytes exceeds bound %d", len(block), CompressBound(len(src)))
+		}
+
+		out, err := Decompress([]byte("prefix"), block)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(out[6:], src) || string(out[:6]) != "prefix" {
+			t.Errorf("Round trip of %d bytes failed", len(src))
+		}
+	}
+
+	if block := Compress(nil, json.Bytes()); len(block)*4 > json.Len() {
+		t.Errorf("Expected json to compress 4x, got %d -> %d", json.Len(), len(block))
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	src := bytes.Repeat([]byte("abcd"), 100)
+	block := Compress(nil, src)
+	for i := 1; i < len(block); i++ {
+		// Some truncations end on a sequence boundary and are valid blocks
+		if out, err := Decompress(nil, block[:i]); err == nil && bytes.Equal(out, src) {
+			t.Errorf("Expected truncated block of %d bytes to fail", i)
+		}
+	}
+
+	// Offset pointing before the start of the block
+	if _, err := Decompress(nil, []byte{0x10, 'a', 0x05, 0x00}); err != ErrCorrupt {
+		t.Errorf("Expected ErrCorrupt, got %v", err)
+	}
+}
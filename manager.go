@@ -0,0 +1,446 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elliotcourant/nitro/skiplist"
+)
+
+var (
+	// ErrInstanceExists means an instance with the name is already registered
+	ErrInstanceExists = fmt.Errorf("Nitro instance already exists")
+	// ErrInstanceNotFound means no instance with the name is registered
+	ErrInstanceNotFound = fmt.Errorf("Nitro instance not found")
+	// ErrMemoryQuotaExceeded means the memory quota of a manager is used up
+	ErrMemoryQuotaExceeded = fmt.Errorf("Memory quota exceeded")
+)
+
+// ManagerConfig describes the resources shared by the instances of a Manager
+type ManagerConfig struct {
+	// MemoryQuota limits the total MemoryInUse of all instances, 0 means
+	// unlimited. Inserts block while the quota is exceeded.
+	MemoryQuota int64
+	// QuotaCheckInterval is the interval at which the memory usage is
+	// compared against the quota
+	QuotaCheckInterval time.Duration
+	// GCWorkers is the number of goroutines shared by all instances for
+	// collecting dead snapshots
+	GCWorkers int
+	// FreeWorkers is the number of goroutines shared by all instances for
+	// freeing collected items
+	FreeWorkers int
+	// GCInterval is the interval at which every instance is scheduled for
+	// garbage collection
+	GCInterval time.Duration
+}
+
+// DefaultManagerConfig returns the default manager configuration
+func DefaultManagerConfig() ManagerConfig {
+	return ManagerConfig{
+		QuotaCheckInterval: 10 * time.Millisecond,
+		GCWorkers:          2,
+		FreeWorkers:        2,
+		GCInterval:         time.Second,
+	}
+}
+
+// Manager owns a set of named Nitro instances, e.g., one per tenant or index,
+// which share a memory quota and a pool of garbage collection workers. The
+// instances do not run collection and free workers per writer, so they do
+// not write delta files during StoreToDisk and hold the snapshot instead.
+type Manager struct {
+	cfg ManagerConfig
+
+	mu     sync.RWMutex
+	dbs    map[string]*Nitro
+	closed bool
+
+	// Set while the memory usage is above the quota
+	quotaExceeded int32
+
+	pool *workerPool
+	gcq  chan *Nitro
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// gcTask is a list of nodes of an instance to be collected or freed
+type gcTask struct {
+	db   *Nitro
+	list *skiplist.Node
+}
+
+// workerPool runs the collection and free workers of all instances of a
+// Manager. Collection workers queue free tasks, but free workers never queue
+// collection tasks, so a full queue cannot deadlock the pool.
+type workerPool struct {
+	gcq    chan gcTask
+	freeq  chan gcTask
+	gcWg   sync.WaitGroup
+	freeWg sync.WaitGroup
+}
+
+func newWorkerPool(gcWorkers, freeWorkers int) *workerPool {
+	p := &workerPool{
+		gcq:   make(chan gcTask, gcchanBufSize),
+		freeq: make(chan gcTask, gcchanBufSize),
+	}
+
+	for i := 0; i < gcWorkers; i++ {
+		p.gcWg.Add(1)
+		go p.collectionWorker()
+	}
+
+	for i := 0; i < freeWorkers; i++ {
+		p.freeWg.Add(1)
+		go p.freeWorker()
+	}
+
+	return p
+}
+
+func (p *workerPool) collectionWorker() {
+	defer p.gcWg.Done()
+
+	var sts skiplist.Stats
+	sts.IsLocal(true)
+	for t := range p.gcq {
+		buf := t.db.store.MakeBuf()
+		t.db.collectList(t.list, nil, buf, &sts)
+		t.db.store.FreeBuf(buf)
+		t.db.shutdownWg1.Done()
+	}
+}
+
+func (p *workerPool) freeWorker() {
+	defer p.freeWg.Done()
+
+	var sts skiplist.Stats
+	sts.IsLocal(true)
+	for t := range p.freeq {
+		t.db.freeList(t.list, t.db.newFreeCtx(), &sts)
+		t.db.shutdownWg2.Done()
+	}
+}
+
+// collect queues the gclist of a dead snapshot of the instance
+func (p *workerPool) collect(db *Nitro, gclist *skiplist.Node) {
+	db.shutdownWg1.Add(1)
+	p.gcq <- gcTask{db: db, list: gclist}
+}
+
+// free queues a list of nodes which are no longer reachable by accessors
+func (p *workerPool) free(db *Nitro, freelist *skiplist.Node) {
+	db.shutdownWg2.Add(1)
+	p.freeq <- gcTask{db: db, list: freelist}
+}
+
+// close stops the workers once all queued tasks are done
+func (p *workerPool) close() {
+	close(p.gcq)
+	p.gcWg.Wait()
+	close(p.freeq)
+	p.freeWg.Wait()
+}
+
+// NewManager creates a Manager
+func NewManager(cfg ManagerConfig) *Manager {
+	if cfg.GCWorkers < 1 {
+		cfg.GCWorkers = 1
+	}
+
+	if cfg.FreeWorkers < 1 {
+		cfg.FreeWorkers = 1
+	}
+
+	if cfg.QuotaCheckInterval <= 0 {
+		cfg.QuotaCheckInterval = 10 * time.Millisecond
+	}
+
+	mgr := &Manager{
+		cfg:  cfg,
+		dbs:  make(map[string]*Nitro),
+		pool: newWorkerPool(cfg.GCWorkers, cfg.FreeWorkers),
+		gcq:  make(chan *Nitro, cfg.GCWorkers),
+		stop: make(chan struct{}),
+	}
+
+	for i := 0; i < cfg.GCWorkers; i++ {
+		mgr.wg.Add(1)
+		go mgr.gcWorker()
+	}
+
+	if cfg.GCInterval > 0 {
+		mgr.wg.Add(1)
+		go mgr.gcScheduler()
+	}
+
+	if cfg.MemoryQuota > 0 {
+		mgr.wg.Add(1)
+		go mgr.quotaMonitor()
+	}
+
+	return mgr
+}
+
+func (mgr *Manager) gcWorker() {
+	defer mgr.wg.Done()
+	for {
+		select {
+		case db := <-mgr.gcq:
+			mgr.mu.RLock()
+			// Instances may have been dropped while queued
+			if mgr.dbs[db.name] == db {
+				db.GC()
+			}
+			mgr.mu.RUnlock()
+		case <-mgr.stop:
+			return
+		}
+	}
+}
+
+func (mgr *Manager) gcScheduler() {
+	defer mgr.wg.Done()
+	ticker := time.NewTicker(mgr.cfg.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, db := range mgr.instances() {
+				select {
+				case mgr.gcq <- db:
+				case <-mgr.stop:
+					return
+				}
+			}
+		case <-mgr.stop:
+			return
+		}
+	}
+}
+
+func (mgr *Manager) quotaMonitor() {
+	defer mgr.wg.Done()
+	ticker := time.NewTicker(mgr.cfg.QuotaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			mgr.updateQuota()
+		case <-mgr.stop:
+			return
+		}
+	}
+}
+
+func (mgr *Manager) updateQuota() bool {
+	var exceeded int32
+	if mgr.MemoryInUse() > mgr.cfg.MemoryQuota {
+		exceeded = 1
+	}
+
+	atomic.StoreInt32(&mgr.quotaExceeded, exceeded)
+	return exceeded == 1
+}
+
+// waitQuota blocks an insert while the memory quota is exceeded. Inserts
+// resume once garbage collection or dropping instances brings the memory
+// usage below the quota, or the manager is closed.
+func (mgr *Manager) waitQuota() {
+	if atomic.LoadInt32(&mgr.quotaExceeded) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(mgr.cfg.QuotaCheckInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt32(&mgr.quotaExceeded) == 1 {
+		select {
+		case <-ticker.C:
+		case <-mgr.stop:
+			return
+		}
+	}
+}
+
+func (mgr *Manager) instances() []*Nitro {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	dbs := make([]*Nitro, 0, len(mgr.dbs))
+	for _, db := range mgr.dbs {
+		dbs = append(dbs, db)
+	}
+	return dbs
+}
+
+// Create creates and registers a new instance. Creation fails when the
+// memory quota is already used up. The instance uses the shared workers of
+// the manager and its inserts are throttled by the memory quota, so writers
+// of an instance must not be the only goroutines creating its snapshots.
+func (mgr *Manager) Create(name string, cfg Config) (*Nitro, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	if mgr.closed {
+		return nil, ErrShutdown
+	}
+
+	if _, ok := mgr.dbs[name]; ok {
+		return nil, ErrInstanceExists
+	}
+
+	if mgr.cfg.MemoryQuota > 0 && mgr.memoryInUse() >= mgr.cfg.MemoryQuota {
+		return nil, ErrMemoryQuotaExceeded
+	}
+
+	db := newWithManager(cfg, mgr)
+	db.name = name
+	mgr.dbs[name] = db
+	return db, nil
+}
+
+// Get returns the instance registered under name
+func (mgr *Manager) Get(name string) (*Nitro, bool) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	db, ok := mgr.dbs[name]
+	return db, ok
+}
+
+// Names returns the sorted names of all registered instances
+func (mgr *Manager) Names() []string {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	names := make([]string, 0, len(mgr.dbs))
+	for name := range mgr.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Drop unregisters and closes the instance registered under name
+func (mgr *Manager) Drop(name string) error {
+	mgr.mu.Lock()
+	db, ok := mgr.dbs[name]
+	delete(mgr.dbs, name)
+	mgr.mu.Unlock()
+
+	if !ok {
+		return ErrInstanceNotFound
+	}
+
+	db.Close()
+	return nil
+}
+
+func (mgr *Manager) memoryInUse() int64 {
+	var sz int64
+	for _, db := range mgr.dbs {
+		sz += db.MemoryInUse()
+	}
+	return sz
+}
+
+// MemoryInUse returns the memory used by all instances
+func (mgr *Manager) MemoryInUse() int64 {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+	return mgr.memoryInUse()
+}
+
+// QuotaExceeded reports whether the instances use more memory than the
+// quota, i.e., whether inserts are blocked
+func (mgr *Manager) QuotaExceeded() bool {
+	return mgr.cfg.MemoryQuota > 0 && mgr.updateQuota()
+}
+
+// ScheduleGC queues the instance for garbage collection by the shared
+// workers. It returns false if the queue is full.
+func (mgr *Manager) ScheduleGC(name string) bool {
+	db, ok := mgr.Get(name)
+	if !ok {
+		return false
+	}
+
+	select {
+	case mgr.gcq <- db:
+		return true
+	default:
+		return false
+	}
+}
+
+// ItemsCount returns the number of items in all instances
+func (mgr *Manager) ItemsCount() int64 {
+	var count int64
+	for _, db := range mgr.instances() {
+		count += db.ItemsCount()
+	}
+	return count
+}
+
+// DumpStats returns the aggregated statistics followed by the statistics of
+// every instance
+func (mgr *Manager) DumpStats() string {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	names := make([]string, 0, len(mgr.dbs))
+	for name := range mgr.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	str := fmt.Sprintf("instances = %d\n"+
+		"memory_in_use = %d\n"+
+		"memory_quota = %d\n", len(mgr.dbs), mgr.memoryInUse(), mgr.cfg.MemoryQuota)
+
+	for _, name := range names {
+		db := mgr.dbs[name]
+		str += fmt.Sprintf("\n[%s]\nitems_count = %d\n%s\n", name, db.ItemsCount(), db.DumpStats())
+	}
+
+	return str
+}
+
+// Close stops the shared workers and closes all instances
+func (mgr *Manager) Close() {
+	mgr.mu.Lock()
+	if mgr.closed {
+		mgr.mu.Unlock()
+		return
+	}
+	mgr.closed = true
+	dbs := mgr.dbs
+	mgr.dbs = make(map[string]*Nitro)
+	mgr.mu.Unlock()
+
+	close(mgr.stop)
+	mgr.wg.Wait()
+
+	for _, db := range dbs {
+		db.Close()
+	}
+
+	mgr.pool.close()
+}
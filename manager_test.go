@@ -0,0 +1,140 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	cfg := DefaultManagerConfig()
+	cfg.GCInterval = time.Millisecond
+	mgr := NewManager(cfg)
+	defer mgr.Close()
+
+	for _, name := range []string{"b", "a"} {
+		db, err := mgr.Create(name, DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := db.NewWriter()
+		for i := 0; i < 100; i++ {
+			w.Put([]byte(fmt.Sprintf("%s-%d", name, i)))
+		}
+		snap, _ := db.NewSnapshot()
+		snap.Close()
+	}
+
+	if _, err := mgr.Create("a", DefaultConfig()); err != ErrInstanceExists {
+		t.Errorf("Expected ErrInstanceExists, got %v", err)
+	}
+
+	if names := mgr.Names(); len(names) != 2 || names[0] != "a" {
+		t.Errorf("Unexpected names %v", names)
+	}
+
+	if c := mgr.ItemsCount(); c != 200 {
+		t.Errorf("Expected 200 items, got %d", c)
+	}
+
+	if err := mgr.Drop("b"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if _, ok := mgr.Get("b"); ok {
+		t.Errorf("Expected dropped instance to be unregistered")
+	}
+}
+
+func TestManagerQuota(t *testing.T) {
+	cfg := DefaultManagerConfig()
+	cfg.MemoryQuota = 1
+	mgr := NewManager(cfg)
+	defer mgr.Close()
+
+	db, _ := mgr.Create("a", DefaultConfig())
+	db.NewWriter().Put([]byte("item"))
+
+	if !mgr.QuotaExceeded() {
+		t.Errorf("Expected quota to be exceeded")
+	}
+
+	if _, err := mgr.Create("b", DefaultConfig()); err != ErrMemoryQuotaExceeded {
+		t.Errorf("Expected ErrMemoryQuotaExceeded, got %v", err)
+	}
+}
+
+func TestManagerSharedWorkers(t *testing.T) {
+	mgr := NewManager(DefaultManagerConfig())
+	defer mgr.Close()
+
+	db, _ := mgr.Create("a", testConf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := db.NewSnapshot()
+
+	for i := 0; i < 1000; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := db.NewSnapshot()
+	snap1.Close()
+	snap2.Close()
+
+	for i := 0; db.store.GetStats().NodeFrees != 1000; i++ {
+		if i == 1000 {
+			t.Fatalf("Expected 1000 nodes freed, got %d", db.store.GetStats().NodeFrees)
+		}
+		db.GC()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestManagerQuotaBlocksInserts(t *testing.T) {
+	cfg := DefaultManagerConfig()
+	cfg.MemoryQuota = 1 << 20
+	cfg.QuotaCheckInterval = time.Millisecond
+	mgr := NewManager(cfg)
+	defer mgr.Close()
+
+	a, _ := mgr.Create("a", DefaultConfig())
+	b, _ := mgr.Create("b", DefaultConfig())
+	wa := a.NewWriter()
+	for i := 0; !mgr.QuotaExceeded(); i++ {
+		wa.Put([]byte(fmt.Sprintf("%0100d", i)))
+	}
+
+	if err := b.NewWriter().TryPut([]byte("item")); err != ErrMemoryQuotaExceeded {
+		t.Errorf("Expected ErrMemoryQuotaExceeded, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.NewWriter().Put([]byte("item"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Expected the insert to block while the quota is exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mgr.Drop("a")
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the insert to resume once the quota is available")
+	}
+}
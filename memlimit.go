@@ -0,0 +1,141 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"math"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// MemoryCoordinatorConfig describes how Nitro memory is coordinated with the
+// Go runtime
+type MemoryCoordinatorConfig struct {
+	// Limit is the memory budget of the process shared by the Go heap and
+	// the memory Nitro allocates through the memory manager. The Go soft
+	// memory limit is set to the budget minus the off-heap usage. 0 uses
+	// the limit configured through GOMEMLIMIT or debug.SetMemoryLimit, if
+	// there is none the Go limit is left alone and usage is only reported.
+	Limit int64
+	// MinHeapLimit is the lowest Go memory limit the coordinator sets, so
+	// that a large off-heap usage does not make the Go GC run continuously
+	MinHeapLimit int64
+	// Interval is the sampling interval of the off-heap usage
+	Interval time.Duration
+	// OnReport is called after every sample with the off-heap usage and the
+	// Go memory limit in effect
+	OnReport func(offHeap, heapLimit int64)
+}
+
+// DefaultMemoryCoordinatorConfig returns the default coordinator configuration
+func DefaultMemoryCoordinatorConfig() MemoryCoordinatorConfig {
+	return MemoryCoordinatorConfig{
+		MinHeapLimit: 64 * 1024 * 1024,
+		Interval:     time.Second,
+	}
+}
+
+// MemoryCoordinator periodically samples the off-heap memory of all Nitro
+// instances and lowers the Go soft memory limit accordingly, so that the Go
+// heap and Nitro together stay within the memory budget of the process.
+type MemoryCoordinator struct {
+	cfg       MemoryCoordinatorConfig
+	origLimit int64
+
+	mu   sync.Mutex
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewMemoryCoordinator creates and starts a MemoryCoordinator
+func NewMemoryCoordinator(cfg MemoryCoordinatorConfig) *MemoryCoordinator {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+
+	c := &MemoryCoordinator{
+		cfg:       cfg,
+		origLimit: debug.SetMemoryLimit(-1),
+		stop:      make(chan struct{}),
+	}
+
+	if c.cfg.Limit == 0 && c.origLimit != math.MaxInt64 {
+		c.cfg.Limit = c.origLimit
+	}
+
+	c.Update()
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+func (c *MemoryCoordinator) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Update()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Update samples the off-heap usage and adjusts the Go memory limit right
+// away, e.g., after loading a large backup.
+func (c *MemoryCoordinator) Update() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offHeap := OffHeapMemoryInUse()
+	heapLimit := debug.SetMemoryLimit(-1)
+	if c.cfg.Limit > 0 {
+		heapLimit = c.cfg.Limit - offHeap
+		if heapLimit < c.cfg.MinHeapLimit {
+			heapLimit = c.cfg.MinHeapLimit
+		}
+		debug.SetMemoryLimit(heapLimit)
+	}
+
+	if c.cfg.OnReport != nil {
+		c.cfg.OnReport(offHeap, heapLimit)
+	}
+}
+
+// Close stops the coordinator and restores the original Go memory limit
+func (c *MemoryCoordinator) Close() {
+	close(c.stop)
+	c.wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	debug.SetMemoryLimit(c.origLimit)
+}
+
+// OffHeapMemoryInUse returns the memory used by all Nitro instances of the
+// current process which allocate through the memory manager
+func OffHeapMemoryInUse() (sz int64) {
+	buf := dbInstances.MakeBuf()
+	defer dbInstances.FreeBuf(buf)
+	iter := dbInstances.NewIterator(CompareNitro, buf)
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		db := (*Nitro)(iter.Get())
+		if db.useMemoryMgmt {
+			sz += db.MemoryInUse()
+		}
+	}
+
+	return
+}
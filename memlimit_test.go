@@ -0,0 +1,60 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/elliotcourant/nitro/mm"
+	"github.com/elliotcourant/nitro/skiplist"
+)
+
+func TestMemoryCoordinator(t *testing.T) {
+	if !skiplist.MemoryMgmtSupported {
+		t.Skip("memory manager is not supported")
+	}
+
+	cfg := DefaultConfig()
+	cfg.UseMemoryMgmt(mm.Malloc, mm.Free)
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	limit := int64(1 << 40)
+	var offHeap, heapLimit int64
+	ccfg := DefaultMemoryCoordinatorConfig()
+	ccfg.Limit = limit
+	ccfg.Interval = time.Hour
+	ccfg.OnReport = func(o, h int64) {
+		offHeap, heapLimit = o, h
+	}
+
+	orig := debug.SetMemoryLimit(-1)
+	c := NewMemoryCoordinator(ccfg)
+	if offHeap != db.MemoryInUse() || offHeap == 0 {
+		t.Errorf("Expected off-heap usage %d, got %d", db.MemoryInUse(), offHeap)
+	}
+
+	if heapLimit != limit-offHeap || debug.SetMemoryLimit(-1) != heapLimit {
+		t.Errorf("Expected heap limit %d, got %d", limit-offHeap, heapLimit)
+	}
+
+	c.Close()
+	if l := debug.SetMemoryLimit(-1); l != orig {
+		t.Errorf("Expected the original limit %d, got %d", orig, l)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+)
+
+var (
+	// ErrNoMergeOperator means Merge was called without a merge operator set
+	// in the Config
+	ErrNoMergeOperator = fmt.Errorf("Merge operator is not set")
+	// ErrMergeKeyChanged means the merge operator returned an item with a
+	// different key than the operand
+	ErrMergeKeyChanged = fmt.Errorf("Merged item does not have the key of the operand")
+)
+
+// MergeOperator combines the data of an existing item, nil if there is none,
+// with the operand passed to Merge and returns the data of the item which
+// replaces it. It has to keep the key of the operand. The existing data is
+// only valid during the call.
+type MergeOperator func(existing, operand []byte) []byte
+
+// SetMergeOperator sets the operator of Writer.Merge, e.g., adding counters
+// or the union of sets stored in the items. Unlike the merge operators of
+// LSM stores, the operands are not stored and folded by the reads, the
+// operator is applied by Merge when it is called.
+func (cfg *Config) SetMergeOperator(fn MergeOperator) {
+	cfg.mergeOperator = fn
+}
+
+// Merge replaces the item visible with the key of the operand itm by the
+// result of the merge operator, which is inserted if no item exists. It is
+// an atomic read-modify-write resolved when it is called, not when the item
+// is read: the merged item is written like an Upsert, snapshots taken before
+// only see the previous item and the operand itself is never stored. The
+// replacement is serialized with the other conditional writes of the key,
+// see PutIf, so that concurrent merges are not lost.
+func (w *Writer) Merge(itm []byte) error {
+	if w.mergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+
+	return w.replaceKey(itm, func(old []byte) ([]byte, error) {
+		merged := w.mergeOperator(old, itm)
+		if w.keyCmp(merged, itm) != 0 {
+			return nil, ErrMergeKeyChanged
+		}
+		return merged, nil
+	})
+}
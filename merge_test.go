@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	conf := DefaultConfig()
+	conf.UseKeyValueItems()
+	ndb := NewWithConfig(conf)
+	if err := ndb.NewWriter().Merge(EncodeKV([]byte("k"), nil)); err != ErrNoMergeOperator {
+		t.Errorf("Expected ErrNoMergeOperator, got %v", err)
+	}
+	ndb.Close()
+
+	// Counters adding the operands
+	conf.SetMergeOperator(func(existing, operand []byte) []byte {
+		key, delta := DecodeKV(operand)
+		_, v := DecodeKV(existing)
+		a, _ := strconv.Atoi(string(v))
+		b, _ := strconv.Atoi(string(delta))
+		return EncodeKV(key, []byte(strconv.Itoa(a+b)))
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	writers, keys, merges := 8, 4, 200
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := db.NewWriter()
+			for j := 0; j < merges; j++ {
+				k := []byte(fmt.Sprintf("counter-%d", j%keys))
+				if err := w.Merge(EncodeKV(k, []byte("2"))); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	// Merges are resolved when written, older snapshots keep the item
+	w := db.NewWriter()
+	if err := w.Merge(EncodeKV([]byte("counter-0"), []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if snap.Count() != int64(keys) {
+		t.Errorf("Expected %d items, got %d", keys, snap.Count())
+	}
+	for i := 0; i < keys; i++ {
+		itm, _ := snap.Get(EncodeKV([]byte(fmt.Sprintf("counter-%d", i)), nil))
+		if _, v := DecodeKV(itm); string(v) != strconv.Itoa(2*writers*merges/keys) {
+			t.Errorf("Unexpected counter %d: %s", i, v)
+		}
+	}
+
+	conf.SetMergeOperator(func(existing, operand []byte) []byte {
+		return EncodeKV([]byte("other"), nil)
+	})
+	kdb := NewWithConfig(conf)
+	defer kdb.Close()
+	if err := kdb.NewWriter().Merge(EncodeKV([]byte("k"), nil)); err != ErrMergeKeyChanged {
+		t.Errorf("Expected ErrMergeKeyChanged, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/elliotcourant/nitro/xxhash"
+)
+
+// MaxMerkleDepth is the maximum depth of a Merkle tree, 2^MaxMerkleDepth
+// buckets
+const MaxMerkleDepth = 20
+
+var (
+	// ErrInvalidMerkleDepth means the depth of a Merkle tree is not within
+	// [0, MaxMerkleDepth]
+	ErrInvalidMerkleDepth = fmt.Errorf("Invalid Merkle tree depth")
+	// ErrMerkleDepthMismatch means Merkle trees of different depths were
+	// compared
+	ErrMerkleDepthMismatch = fmt.Errorf("Merkle trees have different depths")
+)
+
+// MerkleTree is a tree of hashes over the items of a snapshot. The items are
+// split into 2^depth buckets by the leading depth bits of the item, so that
+// the buckets cover the same key ranges on every replica. The leaves hold
+// the digests of the buckets and every inner node the hash of its children.
+//
+// Replicas exchange their trees, which take 2^depth * 8 bytes encoded, and
+// only compare the items of the buckets reported by Diff.
+type MerkleTree struct {
+	depth int
+	// Nodes in heap order, the root at 1 and the leaves from 1<<depth
+	nodes []uint64
+}
+
+// MerkleTree computes the Merkle tree of the items of the snapshot with
+// 2^depth buckets. The items are hashed by concurrent visitors. It returns
+// the error reading the items of the block store, e.g., ErrBlockCorrupt.
+func (s *Snapshot) MerkleTree(depth int) (*MerkleTree, error) {
+	if depth < 0 || depth > MaxMerkleDepth {
+		return nil, ErrInvalidMerkleDepth
+	}
+
+	s.checkOpen()
+	nbuckets := 1 << uint(depth)
+	counts := make([]uint64, nbuckets)
+	sums := make([]uint64, nbuckets)
+	if err := s.visitItems(runtime.GOMAXPROCS(0), func(itm []byte, visitor int) {
+		b := merkleBucket(itm, depth)
+		atomic.AddUint64(&counts[b], 1)
+		atomic.AddUint64(&sums[b], xxhash.Sum64(itm))
+	}); err != nil {
+		return nil, err
+	}
+
+	leaves := make([]uint64, nbuckets)
+	for b := range leaves {
+		d := itemsDigest{count: counts[b], sum: sums[b]}
+		leaves[b] = d.Sum64()
+	}
+
+	return newMerkleTree(depth, leaves), nil
+}
+
+func newMerkleTree(depth int, leaves []uint64) *MerkleTree {
+	nbuckets := len(leaves)
+	t := &MerkleTree{
+		depth: depth,
+		nodes: make([]uint64, 2*nbuckets),
+	}
+
+	copy(t.nodes[nbuckets:], leaves)
+	var buf [16]byte
+	for i := nbuckets - 1; i > 0; i-- {
+		binary.BigEndian.PutUint64(buf[0:8], t.nodes[2*i])
+		binary.BigEndian.PutUint64(buf[8:16], t.nodes[2*i+1])
+		t.nodes[i] = xxhash.Sum64(buf[:])
+	}
+
+	return t
+}
+
+// merkleBucket returns the bucket of an item, the leading depth bits of the
+// item padded with zero bits
+func merkleBucket(itm []byte, depth int) int {
+	var prefix [4]byte
+	copy(prefix[:], itm)
+	return int(binary.BigEndian.Uint32(prefix[:]) >> uint(32-depth))
+}
+
+// Depth returns the depth of the tree
+func (t *MerkleTree) Depth() int {
+	return t.depth
+}
+
+// Root returns the root hash, which is equal for snapshots with the same
+// items
+func (t *MerkleTree) Root() uint64 {
+	return t.nodes[1]
+}
+
+// Level returns the hashes of a level of the tree, level 0 being the root
+// and level Depth the buckets
+func (t *MerkleTree) Level(level int) []uint64 {
+	return t.nodes[1<<uint(level) : 2<<uint(level)]
+}
+
+// Diff returns the buckets in which the trees differ in ascending order.
+// Only the subtrees with different hashes are compared.
+func (t *MerkleTree) Diff(o *MerkleTree) ([]int, error) {
+	if t.depth != o.depth {
+		return nil, ErrMerkleDepthMismatch
+	}
+
+	var buckets []int
+	var diff func(i int)
+	diff = func(i int) {
+		if t.nodes[i] == o.nodes[i] {
+			return
+		}
+
+		if i >= 1<<uint(t.depth) {
+			buckets = append(buckets, i-1<<uint(t.depth))
+			return
+		}
+
+		diff(2 * i)
+		diff(2*i + 1)
+	}
+
+	diff(1)
+	return buckets, nil
+}
+
+// BucketRange returns the range [start, end) of the items in a bucket, which
+// can be passed to Snapshot.Range. A nil start or end denotes an unbounded
+// range. The ranges assume that items are ordered bytewise.
+func (t *MerkleTree) BucketRange(bucket int) (start, end []byte) {
+	return merklePrefix(bucket, t.depth), merklePrefix(bucket+1, t.depth)
+}
+
+// merklePrefix returns the smallest item of a bucket or nil if the bucket is
+// out of range
+func merklePrefix(bucket, depth int) []byte {
+	if bucket <= 0 || bucket >= 1<<uint(depth) {
+		return nil
+	}
+
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(bucket)<<uint(32-depth))
+
+	// Items shorter than the prefix are padded with zero bits
+	n := len(prefix)
+	for n > 0 && prefix[n-1] == 0 {
+		n--
+	}
+	return prefix[:n]
+}
+
+// MarshalBinary encodes the buckets of the tree
+func (t *MerkleTree) MarshalBinary() ([]byte, error) {
+	leaves := t.Level(t.depth)
+	bs := make([]byte, 1+8*len(leaves))
+	bs[0] = byte(t.depth)
+	for i, h := range leaves {
+		binary.BigEndian.PutUint64(bs[1+8*i:], h)
+	}
+
+	return bs, nil
+}
+
+// UnmarshalBinary decodes a tree encoded by MarshalBinary
+func (t *MerkleTree) UnmarshalBinary(bs []byte) error {
+	if len(bs) < 1 || int(bs[0]) > MaxMerkleDepth {
+		return ErrInvalidMerkleDepth
+	}
+
+	depth := int(bs[0])
+	leaves := make([]uint64, 1<<uint(depth))
+	if len(bs) != 1+8*len(leaves) {
+		return fmt.Errorf("Invalid Merkle tree encoding of %d bytes", len(bs))
+	}
+
+	for i := range leaves {
+		leaves[i] = binary.BigEndian.Uint64(bs[1+8*i:])
+	}
+
+	*t = *newMerkleTree(depth, leaves)
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleTree(t *testing.T) {
+	tree := func(changed ...int) *MerkleTree {
+		db := NewWithConfig(testConf)
+		defer db.Close()
+
+		w := db.NewWriter()
+		for i := 0; i < 10000; i++ {
+			w.Put([]byte(fmt.Sprintf("%04x-item", i*6)))
+		}
+		for _, i := range changed {
+			w.Delete([]byte(fmt.Sprintf("%04x-item", i*6)))
+			w.Put([]byte(fmt.Sprintf("%04x-changed", i*6)))
+		}
+
+		snap, _ := w.NewSnapshot()
+		defer snap.Close()
+		mt, err := snap.MerkleTree(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mt
+	}
+
+	t1, t2 := tree(), tree(10, 5000)
+	if t1.Root() == t2.Root() {
+		t.Errorf("Expected different roots")
+	}
+
+	if buckets, _ := t1.Diff(tree()); len(buckets) != 0 {
+		t.Errorf("Expected no differences, got %v", buckets)
+	}
+
+	buckets, err := t1.Diff(t2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("Expected 2 different buckets, got %v", buckets)
+	}
+
+	for i, key := range []string{fmt.Sprintf("%04x", 10*6), fmt.Sprintf("%04x", 5000*6)} {
+		start, end := t1.BucketRange(buckets[i])
+		if bytes.Compare([]byte(key), start) < 0 || (end != nil && bytes.Compare([]byte(key), end) >= 0) {
+			t.Errorf("Expected %s in bucket range [%q, %q)", key, start, end)
+		}
+	}
+
+	bs, _ := t2.MarshalBinary()
+	var t3 MerkleTree
+	if err := t3.UnmarshalBinary(bs); err != nil {
+		t.Fatal(err)
+	}
+	if t3.Root() != t2.Root() || t3.Depth() != 10 {
+		t.Errorf("Expected decoded tree to match")
+	}
+
+	if _, err := t1.Diff(&MerkleTree{depth: 2, nodes: make([]uint64, 8)}); err != ErrMerkleDepthMismatch {
+		t.Errorf("Expected depth mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package mm
+
+import (
+	"unsafe"
+)
+
+// FreeBatch accumulates freed blocks and returns them to the allocator in
+// bulk once the batch is full. A FreeBatch is not thread safe, every
+// goroutine which frees memory should use its own batch.
+type FreeBatch struct {
+	ptrs     []unsafe.Pointer
+	freeBulk func([]unsafe.Pointer)
+}
+
+// NewFreeBatch creates a batch of the given size which is released through
+// freeBulk, FreeBulk is used if freeBulk is nil.
+func NewFreeBatch(size int, freeBulk func([]unsafe.Pointer)) *FreeBatch {
+	if size < 1 {
+		size = 1
+	}
+
+	if freeBulk == nil {
+		freeBulk = FreeBulk
+	}
+
+	return &FreeBatch{
+		ptrs:     make([]unsafe.Pointer, 0, size),
+		freeBulk: freeBulk,
+	}
+}
+
+// Free adds a block to the batch
+func (b *FreeBatch) Free(p unsafe.Pointer) {
+	b.ptrs = append(b.ptrs, p)
+	if len(b.ptrs) == cap(b.ptrs) {
+		b.Flush()
+	}
+}
+
+// Len returns the number of blocks waiting to be freed
+func (b *FreeBatch) Len() int {
+	return len(b.ptrs)
+}
+
+// Flush frees all blocks in the batch
+func (b *FreeBatch) Flush() {
+	if len(b.ptrs) > 0 {
+		b.freeBulk(b.ptrs)
+		for i := range b.ptrs {
+			b.ptrs[i] = nil
+		}
+		b.ptrs = b.ptrs[:0]
+	}
+}
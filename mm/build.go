@@ -1,4 +1,4 @@
-// +build jemalloc
+// +build jemalloc,!windows
 
 // Copyright (c) 2016 Couchbase, Inc.
 // Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
@@ -1,3 +1,5 @@
+// +build !windows
+
 // Copyright (c) 2016 Couchbase, Inc.
 // Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
 // except in compliance with the License. You may obtain a copy of the License at
@@ -56,6 +58,13 @@ void mm_free(void *p) {
 #endif
 }
 
+void mm_free_bulk(void **ptrs, size_t n) {
+    size_t i;
+    for (i = 0; i < n; i++) {
+        mm_free(ptrs[i]);
+    }
+}
+
 char *mm_stats() {
 #ifdef JEMALLOC
     return doStats();
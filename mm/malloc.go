@@ -1,3 +1,5 @@
+// +build !windows
+
 // Copyright (c) 2016 Couchbase, Inc.
 // Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
 // except in compliance with the License. You may obtain a copy of the License at
@@ -16,22 +18,10 @@ import "C"
 
 import (
 	"fmt"
-	"sync"
 	"sync/atomic"
 	"unsafe"
 )
 
-var (
-	// Debug enables debug stats
-	Debug = true
-	mu    sync.Mutex
-)
-
-var stats struct {
-	allocs uint64
-	frees  uint64
-}
-
 // Malloc implements C like memory allocator
 func Malloc(l int) unsafe.Pointer {
 	if Debug {
@@ -48,6 +38,18 @@ func Free(p unsafe.Pointer) {
 	C.mm_free(p)
 }
 
+// FreeBulk deallocates a batch of blocks with a single call into C
+func FreeBulk(ptrs []unsafe.Pointer) {
+	if len(ptrs) == 0 {
+		return
+	}
+
+	if Debug {
+		atomic.AddUint64(&stats.frees, uint64(len(ptrs)))
+	}
+	C.mm_free_bulk(&ptrs[0], C.size_t(len(ptrs)))
+}
+
 // Stats returns allocator statistics
 // Returns jemalloc stats
 func Stats() string {
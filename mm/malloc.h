@@ -22,6 +22,8 @@ void *mm_malloc(size_t);
 
 void mm_free(void *);
 
+void mm_free_bulk(void **, size_t);
+
 char *mm_stats();
 
 size_t mm_size();
@@ -0,0 +1,106 @@
+// +build !cgo,!windows
+
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package mm
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Blocks are allocated from the Go heap as pointer free byte slices and kept
+// reachable through the blocks table until they are freed. Pointers stored
+// inside a block are not scanned by the garbage collector, which is fine as
+// long as they only reference other blocks, as is the case for Nitro nodes
+// and items.
+var (
+	blocks    = make(map[uintptr][]byte)
+	allocated uint64
+)
+
+// Malloc implements C like memory allocator
+func Malloc(l int) unsafe.Pointer {
+	if Debug {
+		atomic.AddUint64(&stats.allocs, 1)
+	}
+
+	if l == 0 {
+		l = 1
+	}
+
+	b := make([]byte, l)
+	p := unsafe.Pointer(&b[0])
+
+	mu.Lock()
+	blocks[uintptr(p)] = b
+	allocated += uint64(l)
+	mu.Unlock()
+
+	return p
+}
+
+// Free implements C like memory deallocator
+func Free(p unsafe.Pointer) {
+	if Debug {
+		atomic.AddUint64(&stats.frees, 1)
+	}
+
+	mu.Lock()
+	if b, ok := blocks[uintptr(p)]; ok {
+		allocated -= uint64(len(b))
+		delete(blocks, uintptr(p))
+	}
+	mu.Unlock()
+}
+
+// FreeBulk deallocates a batch of blocks taking the allocator lock once
+func FreeBulk(ptrs []unsafe.Pointer) {
+	if Debug {
+		atomic.AddUint64(&stats.frees, uint64(len(ptrs)))
+	}
+
+	mu.Lock()
+	for _, p := range ptrs {
+		if b, ok := blocks[uintptr(p)]; ok {
+			allocated -= uint64(len(b))
+			delete(blocks, uintptr(p))
+		}
+	}
+	mu.Unlock()
+}
+
+// Stats returns allocator statistics
+func Stats() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := "==== Stats ====\n"
+	if Debug {
+		s += fmt.Sprintf("Mallocs = %d\n"+
+			"Frees   = %d\n", stats.allocs, stats.frees)
+	}
+
+	s += fmt.Sprintf("Allocated = %d\n", allocated)
+	return s
+}
+
+// Size returns total size allocated by mm allocator
+func Size() uint64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return allocated
+}
+
+// FreeOSMemory is a no-op for the Go heap backed allocator
+func FreeOSMemory() error {
+	return nil
+}
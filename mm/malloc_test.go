@@ -12,6 +12,7 @@ package mm
 import (
 	"fmt"
 	"testing"
+	"unsafe"
 )
 
 func TestMalloc(t *testing.T) {
@@ -19,3 +20,24 @@ func TestMalloc(t *testing.T) {
 	fmt.Println("size:", Size())
 	fmt.Println(Stats())
 }
+
+func TestFreeBatch(t *testing.T) {
+	var freed int
+	b := NewFreeBatch(4, func(ptrs []unsafe.Pointer) {
+		freed += len(ptrs)
+		FreeBulk(ptrs)
+	})
+
+	for i := 0; i < 10; i++ {
+		b.Free(Malloc(64))
+	}
+
+	if freed != 8 || b.Len() != 2 {
+		t.Errorf("Expected 8 freed and 2 pending, got %d and %d", freed, b.Len())
+	}
+
+	b.Flush()
+	if freed != 10 || b.Len() != 0 {
+		t.Errorf("Expected 10 freed and 0 pending, got %d and %d", freed, b.Len())
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package mm
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// On Windows the allocator is backed by a private heap created with
+// HeapCreate, so that no cgo toolchain is required.
+var (
+	kernel32        = syscall.NewLazyDLL("kernel32.dll")
+	procHeapCreate  = kernel32.NewProc("HeapCreate")
+	procHeapAlloc   = kernel32.NewProc("HeapAlloc")
+	procHeapFree    = kernel32.NewProc("HeapFree")
+	procHeapSize    = kernel32.NewProc("HeapSize")
+	procHeapCompact = kernel32.NewProc("HeapCompact")
+
+	heap      uintptr
+	allocated uint64
+)
+
+func init() {
+	h, _, err := procHeapCreate.Call(0, 0, 0)
+	if h == 0 {
+		panic(fmt.Sprintf("mm: HeapCreate failed: %v", err))
+	}
+	heap = h
+}
+
+// Malloc implements C like memory allocator
+func Malloc(l int) unsafe.Pointer {
+	if Debug {
+		atomic.AddUint64(&stats.allocs, 1)
+	}
+
+	p, _, _ := procHeapAlloc.Call(heap, 0, uintptr(l))
+	if p == 0 {
+		return nil
+	}
+
+	sz, _, _ := procHeapSize.Call(heap, 0, p)
+	atomic.AddUint64(&allocated, uint64(sz))
+	return unsafe.Pointer(p)
+}
+
+// Free implements C like memory deallocator
+func Free(p unsafe.Pointer) {
+	if Debug {
+		atomic.AddUint64(&stats.frees, 1)
+	}
+
+	sz, _, _ := procHeapSize.Call(heap, 0, uintptr(p))
+	atomic.AddUint64(&allocated, ^uint64(sz-1))
+	procHeapFree.Call(heap, 0, uintptr(p))
+}
+
+// FreeBulk deallocates a batch of blocks
+func FreeBulk(ptrs []unsafe.Pointer) {
+	for _, p := range ptrs {
+		Free(p)
+	}
+}
+
+// Stats returns allocator statistics
+func Stats() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := "==== Stats ====\n"
+	if Debug {
+		s += fmt.Sprintf("Mallocs = %d\n"+
+			"Frees   = %d\n", stats.allocs, stats.frees)
+	}
+
+	s += fmt.Sprintf("Allocated = %d\n", atomic.LoadUint64(&allocated))
+	return s
+}
+
+// Size returns total size allocated by mm allocator
+func Size() uint64 {
+	return atomic.LoadUint64(&allocated)
+}
+
+// FreeOSMemory coalesces free blocks of the heap and decommits them
+func FreeOSMemory() error {
+	if r, _, err := procHeapCompact.Call(heap, 0); r == 0 {
+		return fmt.Errorf("status: %v", err)
+	}
+
+	return nil
+}
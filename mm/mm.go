@@ -0,0 +1,31 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package mm provides a C like manual memory allocator which keeps Nitro
+// nodes and items out of reach of the Go garbage collector.
+//
+// With cgo enabled the allocator is backed by malloc (or jemalloc with the
+// jemalloc build tag). Without cgo a Go heap backed fallback is used so that
+// the package builds on every platform.
+package mm
+
+import (
+	"sync"
+)
+
+var (
+	// Debug enables debug stats
+	Debug = true
+	mu    sync.Mutex
+)
+
+var stats struct {
+	allocs uint64
+	frees  uint64
+}
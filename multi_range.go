@@ -0,0 +1,180 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ErrOverlappingRanges means the key ranges of a multi-range iterator overlap
+var ErrOverlappingRanges = fmt.Errorf("Key ranges overlap")
+
+// KeyRange is the range of keys [Start, End). A nil Start or End denotes an
+// unbounded range.
+type KeyRange struct {
+	Start []byte
+	End   []byte
+}
+
+// MultiRangeIterator iterates over the items of a snapshot in several
+// disjoint key ranges in key order. The ranges share a single skiplist
+// iterator and its buffers.
+type MultiRangeIterator struct {
+	itr    *Iterator
+	ranges []KeyRange
+	ends   []*Item
+
+	// Range of the current item
+	idx  int
+	curr []byte
+}
+
+// NewMultiRangeIterator creates an iterator over the union of disjoint key
+// ranges, which may be passed in any order. It returns ErrOverlappingRanges
+// if two ranges overlap and ErrSnapshotClosed if the snapshot has been
+// closed.
+func (s *Snapshot) NewMultiRangeIterator(ranges []KeyRange) (*MultiRangeIterator, error) {
+	cmp := s.db.keyCmp
+	sorted := append([]KeyRange(nil), ranges...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Start, sorted[j].Start
+		return a == nil && b != nil || a != nil && b != nil && cmp(a, b) < 0
+	})
+
+	for i := 1; i < len(sorted); i++ {
+		end := sorted[i-1].End
+		if end == nil || sorted[i].Start == nil || cmp(end, sorted[i].Start) > 0 {
+			return nil, ErrOverlappingRanges
+		}
+	}
+
+	itr, err := s.OpenIterator()
+	if err != nil {
+		return nil, err
+	}
+
+	it := &MultiRangeIterator{
+		itr:    itr,
+		ranges: sorted,
+		ends:   make([]*Item, len(sorted)),
+		idx:    len(sorted),
+	}
+	for i, r := range sorted {
+		if r.End != nil {
+			it.ends[i] = s.db.newItem(r.End, false)
+		}
+	}
+	return it, nil
+}
+
+// seekRange positions the cursor on the first item of the ranges from idx
+// which is not smaller than key
+func (it *MultiRangeIterator) seekRange(idx int, key []byte) {
+	cmp := it.itr.snap.db.keyCmp
+	for it.idx = idx; it.idx < len(it.ranges); it.idx++ {
+		r := it.ranges[it.idx]
+		start := r.Start
+		if key != nil && (start == nil || cmp(key, start) > 0) {
+			start = key
+		}
+
+		it.itr.endItm = it.ends[it.idx]
+		it.itr.Seek(start)
+		if it.settle() {
+			return
+		}
+	}
+	it.curr = nil
+}
+
+// settle sets the current item if the iterator is within the current range
+// and returns false if the range is exhausted. The items of a block store
+// are compared with the range end one by one, the iterator only compares the
+// first item of a block.
+func (it *MultiRangeIterator) settle() bool {
+	it.curr = nil
+	if !it.itr.Valid() {
+		return it.itr.Err() != nil
+	}
+
+	itm := it.itr.Get()
+	if it.itr.Err() != nil {
+		return true
+	}
+
+	end := it.ranges[it.idx].End
+	if end != nil && it.itr.snap.db.keyCmp(itm, end) >= 0 {
+		return false
+	}
+
+	it.curr = itm
+	return true
+}
+
+// SeekFirst moves the cursor to the first item of the ranges
+func (it *MultiRangeIterator) SeekFirst() {
+	it.seekRange(0, nil)
+}
+
+// Seek moves the cursor to the first item of the ranges with key or the next
+// bigger one
+func (it *MultiRangeIterator) Seek(bs []byte) {
+	if bs == nil {
+		it.SeekFirst()
+		return
+	}
+
+	cmp := it.itr.snap.db.keyCmp
+	idx := sort.Search(len(it.ranges), func(i int) bool {
+		end := it.ranges[i].End
+		return end == nil || cmp(end, bs) > 0
+	})
+	it.seekRange(idx, bs)
+}
+
+// Valid returns false when the iterator has reached the end of the last
+// range or failed to read a block, see Err
+func (it *MultiRangeIterator) Valid() bool {
+	return it.curr != nil
+}
+
+// Get returns the current item data
+func (it *MultiRangeIterator) Get() []byte {
+	return it.curr
+}
+
+// Next moves the cursor to the next item, which may be in the next range
+func (it *MultiRangeIterator) Next() {
+	if it.curr == nil {
+		return
+	}
+
+	it.itr.Next()
+	if !it.settle() {
+		it.seekRange(it.idx+1, nil)
+	}
+}
+
+// SetRefreshRate sets the automatic refresh frequency of the SMR accessor,
+// see Iterator.SetRefreshRate
+func (it *MultiRangeIterator) SetRefreshRate(rate int) {
+	it.itr.SetRefreshRate(rate)
+}
+
+// Err returns the error reading a block of the block store, see Iterator.Err
+func (it *MultiRangeIterator) Err() error {
+	return it.itr.Err()
+}
+
+// Close closes the iterator
+func (it *MultiRangeIterator) Close() {
+	it.itr.Close()
+}
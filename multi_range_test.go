@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMultiRangeIterator(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%06d", i))
+	}
+
+	n := 1000
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	confs := []Config{testConf}
+	if conf.HasBlockStore() {
+		confs = append(confs, conf)
+	}
+
+	for _, c := range confs {
+		db := NewWithConfig(c)
+		tdb := NewWithConfig(testConf)
+		w := tdb.NewWriter()
+		for i := 0; i < n; i++ {
+			w.Put(key(i))
+		}
+		tsnap, _ := tdb.NewSnapshot()
+		if db.HasBlockStore() {
+			db.ApplyOps(tsnap, 2)
+		} else {
+			db.IngestSorted(&sliceSource{items: func() (items [][]byte) {
+				for i := 0; i < n; i++ {
+					items = append(items, key(i))
+				}
+				return
+			}()}, 2)
+		}
+		tsnap.Close()
+		tdb.Close()
+
+		snap, _ := db.NewSnapshot()
+		ranges := []KeyRange{
+			{Start: key(990)},
+			{Start: key(100), End: key(110)},
+			{Start: key(300), End: key(300)},
+			{Start: key(500), End: key(505)},
+		}
+		itr, err := snap.NewMultiRangeIterator(ranges)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var expected []int
+		for _, r := range [][2]int{{100, 110}, {500, 505}, {990, n}} {
+			for i := r[0]; i < r[1]; i++ {
+				expected = append(expected, i)
+			}
+		}
+
+		count := 0
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if count >= len(expected) || string(itr.Get()) != string(key(expected[count])) {
+				t.Fatalf("Unexpected item %s at %d (block store %v)", itr.Get(), count, db.HasBlockStore())
+			}
+			count++
+		}
+		if count != len(expected) || itr.Err() != nil {
+			t.Errorf("Expected %d items, got %d (%v)", len(expected), count, itr.Err())
+		}
+
+		for _, s := range [][2]int{{0, 100}, {103, 103}, {110, 500}, {504, 504}, {600, 990}} {
+			if itr.Seek(key(s[0])); !itr.Valid() || string(itr.Get()) != string(key(s[1])) {
+				t.Errorf("Expected seek to %d to return %d, got %s", s[0], s[1], itr.Get())
+			}
+		}
+		if itr.Seek([]byte("z")); itr.Valid() {
+			t.Errorf("Expected no items after the ranges")
+		}
+		itr.Close()
+
+		for _, rs := range [][]KeyRange{
+			{{Start: key(1), End: key(10)}, {Start: key(5), End: key(20)}},
+			{{End: key(10)}, {Start: nil, End: key(20)}},
+			{{Start: key(10)}, {Start: key(20)}},
+		} {
+			if _, err := snap.NewMultiRangeIterator(rs); err != ErrOverlappingRanges {
+				t.Errorf("Expected ErrOverlappingRanges for %q, got %v", rs, err)
+			}
+		}
+
+		snap.Close()
+		db.Close()
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,8 +35,35 @@ var (
 	ErrMaxSnapshotsLimitReached = fmt.Errorf("Maximum snapshots limit reached")
 	// ErrShutdown means an operation on a shutdown Nitro instance
 	ErrShutdown = fmt.Errorf("Nitro instance has been shutdown")
+	// ErrInvalidBlockSize means a block size which is not a power of two
+	// between 512 bytes and 32KB
+	ErrInvalidBlockSize = fmt.Errorf("Invalid block size")
+	// ErrNotEncrypted means the instance has no encrypted block store
+	ErrNotEncrypted = fmt.Errorf("Block store is not encrypted")
+	// ErrBlockStoreUnsupported means an operation which is not available in
+	// block store mode
+	ErrBlockStoreUnsupported = fmt.Errorf("Operation is not supported in block store mode")
+	// ErrCloseTimeout means the snapshots and iterators of an instance were
+	// not released in time by CloseTimeout
+	ErrCloseTimeout = fmt.Errorf("Timed out waiting for snapshots and iterators to be released")
+	// ErrSnapshotClosed means a read of a snapshot whose last reference has
+	// been released
+	ErrSnapshotClosed = fmt.Errorf("Snapshot has been closed")
+	// ErrOutOfMemory means the memory allocator of an instance failed to
+	// allocate an item or a skiplist node
+	ErrOutOfMemory = fmt.Errorf("Memory allocation failed")
+	// ErrItemTooLarge means an item exceeds the maximum item size of an
+	// instance or the item size supported by a dump format
+	ErrItemTooLarge = fmt.Errorf("Item exceeds the maximum item size")
+	// ErrInvalidItemSize means a maximum item size which is not between 1
+	// and ItemSizeLimit
+	ErrInvalidItemSize = fmt.Errorf("Invalid maximum item size")
 )
 
+// ItemSizeLimit is the largest maximum item size of SetMaxItemSize and the
+// maximum item size by default
+const ItemSizeLimit = math.MaxInt32
+
 // KeyCompare implements item data key comparator
 type KeyCompare func([]byte, []byte) int
 
@@ -44,8 +72,10 @@ type VisitorCallback func(*Item, int) error
 
 // ItemEntry is a wrapper item struct used by backup file to Nitro restore callback
 type ItemEntry struct {
-	itm *Item
-	n   *skiplist.Node
+	itm      *Item
+	n        *skiplist.Node
+	shard    int
+	progress *loadProgress
 }
 
 // Item returns Nitro item
@@ -58,9 +88,51 @@ func (e *ItemEntry) Node() *skiplist.Node {
 	return e.n
 }
 
+// Shard returns the backup shard the item was restored from
+func (e *ItemEntry) Shard() int {
+	return e.shard
+}
+
+// Progress returns the progress of the load from disk which restored the
+// item. It returns false for items which are not restored.
+func (e *ItemEntry) Progress() (LoadProgress, bool) {
+	if e.progress == nil {
+		return LoadProgress{}, false
+	}
+
+	return e.progress.get(e.shard), true
+}
+
+// Abort stops the load from disk which restored the item, the load fails
+// with ErrLoadAborted. It has no effect for items which are not restored.
+func (e *ItemEntry) Abort() {
+	if e.progress != nil {
+		e.progress.abort()
+	}
+}
+
 // ItemCallback implements callback used for backup file to Nitro restore API
 type ItemCallback func(*ItemEntry)
 
+// NodeDataCallback receives an item and the data attached to its node
+type NodeDataCallback func(itm []byte, data interface{})
+
+// ContentionCallback is called with the item of a deleted node which could
+// not be unlinked by a writer or iterator for retries times in a row
+type ContentionCallback func(itm []byte, level, retries int)
+
+// MemoryPressureCallback is called by a writer with ErrOutOfMemory instead of
+// panicking when an insert fails to allocate memory
+type MemoryPressureCallback func(err error)
+
+// ItemFilter selects the items stored by StoreToDiskFiltered, items for
+// which it returns false are left out of the backup
+type ItemFilter func(*ItemEntry) bool
+
+// ItemCodecFn transforms item data while it is persisted or restored.
+// Returning empty data drops the item.
+type ItemCodecFn func(itm []byte) ([]byte, error)
+
 const (
 	defaultRefreshRate = 10000
 	gcchanBufSize      = 256
@@ -87,11 +159,14 @@ func CompareNitro(this unsafe.Pointer, that unsafe.Pointer) int {
 func DefaultConfig() Config {
 	var cfg Config
 	cfg.SetKeyComparator(defaultKeyCmp)
+	cfg.keyHash = hashBytes
 	cfg.fileType = RawdbFile
 	cfg.useMemoryMgmt = false
 	cfg.refreshRate = defaultRefreshRate
+	cfg.freeListSize = 1
 	// TOOD: Remove this
 	cfg.storageShards = 48
+	cfg.blockSize = defaultBlockSize
 	return cfg
 }
 
@@ -157,6 +232,7 @@ type deltaWrContext struct {
 	notifyStatus chan error
 	sn           uint32
 	fw           FileWriter
+	filter       ItemFilter
 	err          error
 }
 
@@ -170,6 +246,11 @@ func (ctx *deltaWrContext) Init() {
 // Nitro writer is thread-unsafe and should initialize separate Nitro writers
 // to perform concurrent writes from multiple threads.
 type Writer struct {
+	// Goroutine using the writer, tracked by assertions, and the number of
+	// mutations. Aligned on 32-bit platforms.
+	owner     int64
+	mutations int64
+
 	dwrCtx deltaWrContext // Used for cooperative disk snapshotting
 
 	rand   *rand.Rand
@@ -181,6 +262,28 @@ type Writer struct {
 	slSts1, slSts2, slSts3 skiplist.Stats
 	resSts                 restoreStats
 	count                  int64
+	tombstones             int64
+	limiter                unsafe.Pointer // *rateLimiter
+	itemSizes              SizeHistogram
+
+	// Internal writers maintain block store index items and do not report
+	// item lifecycle callbacks
+	isInternal bool
+
+	// Stack of the NewWriter call in debug mode
+	created []byte
+
+	// Nodes unlinked by the writer, which are handed over to the free
+	// workers in lists, see SetFreeListFlush
+	freehead, freetail *skiplist.Node
+	freeCount          int
+	freeSince          time.Time
+
+	// Arena of the item copies, see SetArena
+	arena *Arena
+
+	// Encoded item of PutKV and DeleteKV
+	kvBuf []byte
 
 	*Nitro
 	fd     *os.File
@@ -205,6 +308,10 @@ func (w *Writer) doDeltaWrite(itm *Item) {
 	ctx := &w.dwrCtx
 	if ctx.state == dwStateActive {
 		if itm.bornSn <= ctx.sn && itm.deadSn > ctx.sn {
+			if ctx.filter != nil && !ctx.filter(&ItemEntry{itm: itm}) {
+				return
+			}
+
 			if err := ctx.fw.WriteItem(itm); err != nil {
 				ctx.err = err
 			}
@@ -223,62 +330,236 @@ func (w *Writer) Put2(bs []byte) *skiplist.Node {
 	return w.insert(bs, true)
 }
 
-func (w *Writer) insert(bs []byte, isCreate bool) (n *skiplist.Node) {
+// TryPut is the same as Put, except that it returns an error instead of
+// blocking or panicking. It returns ErrMemoryQuotaExceeded while the memory
+// quota of the manager of the instance is exceeded, ErrOutOfMemory if the
+// allocator fails and ErrItemTooLarge for items exceeding MaxItemSize. The
+// item is not inserted in these cases.
+func (w *Writer) TryPut(bs []byte) error {
+	_, err := w.tryInsert(bs, true, false)
+	return err
+}
+
+// NewItemBuffer allocates an item with l bytes of data from the memory
+// allocator of the instance and returns its data, so that callers building
+// items in place can insert them with PutOwned without a copy. It returns
+// nil if the allocator fails. A buffer which is not passed to PutOwned is
+// leaked with UseMemoryMgmt.
+func (w *Writer) NewItemBuffer(l int) []byte {
+	return w.allocItem(l, w.useMemoryMgmt).Bytes()
+}
+
+// PutOwned is the same as Put, except that it inserts the buffer returned by
+// NewItemBuffer of the instance instead of a copy. The buffer may be
+// shortened, but not moved or grown. Nitro takes ownership of the buffer, it
+// must not be used by the caller after the call, even if an item with the
+// same key exists and the buffer is freed.
+func (w *Writer) PutOwned(buf []byte) {
+	// The data pointer of the slice, which may be empty
+	data := *(*unsafe.Pointer)(unsafe.Pointer(&buf))
+	x := (*Item)(unsafe.Add(data, -int(itemHeaderSize)))
+	x.dataLen = uint32(len(buf))
+	w.zeroMetadata(x)
+	if _, err := w.tryInsertItem(x, nil, true, true); err != nil {
+		w.insertError(err)
+	}
+}
+
+// insert inserts an item, waiting for the memory quota. An allocation
+// failure is reported to the memory pressure callback, or panics with
+// ErrOutOfMemory if none is registered.
+func (w *Writer) insert(bs []byte, isCreate bool) *skiplist.Node {
+	n, err := w.tryInsert(bs, isCreate, true)
+	if err != nil {
+		w.insertError(err)
+	}
+	return n
+}
+
+// insertError reports an allocation failure to the memory pressure callback
+// and panics with other errors
+func (w *Writer) insertError(err error) {
+	if err != ErrOutOfMemory || w.onMemoryPressure == nil {
+		panic(err)
+	}
+	w.onMemoryPressure(err)
+}
+
+func (w *Writer) tryInsert(bs []byte, isCreate bool, waitQuota bool) (*skiplist.Node, error) {
+	return w.tryInsertItem(nil, bs, isCreate, waitQuota)
+}
+
+// tryInsertItem inserts the item x or, if x is nil, a copy of bs. The writer
+// owns x and frees it if it is not inserted.
+func (w *Writer) tryInsertItem(x *Item, bs []byte, isCreate bool, waitQuota bool) (n *skiplist.Node, err error) {
+	defer w.exit(w.enter())
 	var success bool
-	x := w.newItem(bs, w.useMemoryMgmt)
+	sz := len(bs)
+	if x != nil {
+		sz = int(x.dataLen)
+	}
+	if sz > w.MaxItemSize() {
+		if x != nil {
+			w.freeItem(x)
+		}
+		return nil, ErrItemTooLarge
+	}
+	if !w.isInternal {
+		if err := w.enterWrite(!waitQuota); err != nil {
+			if x != nil {
+				w.freeItem(x)
+			}
+			return nil, err
+		}
+		defer w.exitWrite()
+	}
+	w.throttle()
+	if isCreate && w.mgr != nil && !w.isInternal {
+		if waitQuota {
+			w.mgr.waitQuota()
+		} else if atomic.LoadInt32(&w.mgr.quotaExceeded) == 1 {
+			if x != nil {
+				w.freeItem(x)
+			}
+			return nil, ErrMemoryQuotaExceeded
+		}
+	}
+	if x == nil {
+		if x = w.newWriterItem(bs); x == nil {
+			return nil, ErrOutOfMemory
+		}
+	}
 	if isCreate {
 		x.bornSn = w.getCurrSn()
 	} else {
 		x.deadSn = w.getCurrSn()
 	}
-	n, success = w.store.Insert2(unsafe.Pointer(x), w.insCmp, w.existCmp, w.buf,
-		w.rand.Float32, &w.slSts1)
+	itemLevel := w.store.NewLevel(w.rand.Float32)
+	n, success, err = w.store.TryInsert3(unsafe.Pointer(x), w.insCmp, w.existCmp, w.buf,
+		itemLevel, false, &w.slSts1)
+	if err != nil {
+		w.freeItem(x)
+		return nil, ErrOutOfMemory
+	}
 	if success {
 		w.count++
+		if isCreate {
+			if !w.isInternal {
+				w.itemSizes.Add(int(x.dataLen))
+			}
+			w.notifyInsert(x, n)
+		} else {
+			w.tombstones++
+			w.notifyDelete(x, n)
+		}
 	} else {
 		w.freeItem(x)
 	}
 	return
 }
 
+func (w *Writer) queueFree(x *skiplist.Node) {
+	if w.freetail == nil {
+		w.freehead = x
+		if w.freeListMaxAge > 0 {
+			w.freeSince = time.Now()
+		}
+	} else {
+		w.freetail.GClink = x
+	}
+	w.freetail = x
+	w.freeCount++
+
+	if w.freeCount >= w.freeListSize ||
+		(w.freeListMaxAge > 0 && time.Since(w.freeSince) >= w.freeListMaxAge) {
+		w.flushFree()
+	}
+}
+
+// flushFree hands the unlinked nodes over to the free workers once no
+// accessor can reach them
+func (w *Writer) flushFree() {
+	if w.freehead != nil {
+		barrier := w.store.GetAccesBarrier()
+		barrier.FlushSession(unsafe.Pointer(w.freehead))
+		w.freehead = nil
+		w.freetail = nil
+		w.freeCount = 0
+	}
+}
+
+func (w *Writer) removeItemSize(itm *Item) {
+	if !w.isInternal {
+		w.itemSizes.Remove(int(itm.dataLen))
+	}
+}
+
+func (w *Writer) notifyInsert(itm *Item, n *skiplist.Node) {
+	if w.onItemInsert != nil && !w.isInternal {
+		w.onItemInsert(&ItemEntry{itm: itm, n: n})
+	}
+}
+
+func (w *Writer) notifyDelete(itm *Item, n *skiplist.Node) {
+	if w.onItemDelete != nil && !w.isInternal {
+		w.onItemDelete(&ItemEntry{itm: itm, n: n})
+	}
+}
+
 // Delete an item
 // Delete always succeed if an item exists.
 func (w *Writer) Delete(bs []byte) (success bool) {
-	_, success = w.Delete2(bs)
-	return
+	return w.Delete2(bs) != nil
 }
 
-// Delete2 is same as Delete(). Additionally returns the deleted item's node
-func (w *Writer) Delete2(bs []byte) (n *skiplist.Node, success bool) {
-	if n := w.GetNode(bs); n != nil {
-		return n, w.DeleteNode(n)
+// Delete2 is same as Delete(). Additionally returns the skiplist node of the
+// item which was deleted. It returns nil if no visible item was deleted.
+func (w *Writer) Delete2(bs []byte) *skiplist.Node {
+	if n := w.GetNode(bs); n != nil && w.DeleteNode(n) {
+		return n
 	}
 
-	return nil, false
+	return nil
 }
 
 // DeleteNode deletes an item by specifying its skiplist Node.
 // Using this API can avoid a O(logn) lookup during Delete().
 func (w *Writer) DeleteNode(x *skiplist.Node) (success bool) {
-	defer func() {
-		if success {
-			w.count--
-		}
-	}()
-
+	defer w.exit(w.enter())
+	if !w.isInternal {
+		w.enterWrite(false)
+		defer w.exitWrite()
+	}
+	w.throttle()
 	x.GClink = nil
 	sn := w.getCurrSn()
 	gotItem := (*Item)(x.Item())
 	if gotItem.bornSn == sn {
-		success = w.store.DeleteNode(x, w.insCmp, w.buf, &w.slSts1)
+		// The callback has to observe the item before it is unlinked
+		var onDelete func(*skiplist.Node)
+		if w.onItemDelete != nil && !w.isInternal {
+			onDelete = func(n *skiplist.Node) {
+				w.notifyDelete(gotItem, n)
+			}
+		}
 
-		barrier := w.store.GetAccesBarrier()
-		barrier.FlushSession(unsafe.Pointer(x))
+		success = w.store.DeleteNode2(x, w.insCmp, w.buf, &w.slSts1, onDelete)
+		if success {
+			w.count--
+			w.removeItemSize(gotItem)
+
+			// Only the writer which unlinked the node may free it
+			w.queueFree(x)
+		}
 		return
 	}
 
 	success = atomic.CompareAndSwapUint32(&gotItem.deadSn, 0, sn)
 	if success {
+		w.count--
+		w.removeItemSize(gotItem)
+		w.notifyDelete(gotItem, x)
+		w.tombstones++
 		if w.gctail == nil {
 			w.gctail = x
 			w.gchead = w.gctail
@@ -299,9 +580,192 @@ func (w *Writer) DeleteNonExist(bs []byte) bool {
 	return w.insert(bs, false) != nil
 }
 
+// Upsert inserts an item, replacing the currently visible item with the same
+// key if one exists. It returns a copy of the replaced item data and whether
+// an item was replaced.
+//
+// If another writer deletes the existing item or inserts the same key
+// concurrently, the lookup, delete and insert are retried until the insert
+// succeeds, so that the item is never left deleted without its replacement.
+// With a rate limit configured, Upsert of an existing item consumes two
+// tokens.
+// If the new item cannot be allocated, the replaced item remains deleted.
+func (w *Writer) Upsert(bs []byte) (old []byte, replaced bool) {
+	for {
+		if n := w.GetNode(bs); n != nil {
+			data := (*Item)(n.Item()).Bytes()
+			data = append([]byte(nil), data...)
+			if !w.DeleteNode(n) {
+				continue
+			}
+			old, replaced = data, true
+		}
+
+		n, err := w.tryInsert(bs, true, true)
+		if err != nil {
+			w.insertError(err)
+			return
+		}
+
+		if n != nil {
+			return
+		}
+	}
+}
+
+// DeletePrefix deletes all visible items whose data starts with the prefix p
+// using a single scan from the prefix. Items present in earlier snapshots are
+// tombstoned and items inserted after the latest snapshot are unlinked during
+// the scan. The key comparator is expected to order items sharing a byte
+// prefix contiguously. Returns the number of deleted items.
+// DeletePrefix is not supported in block store mode and returns
+// ErrBlockStoreUnsupported.
+func (w *Writer) DeletePrefix(p []byte) (int, error) {
+	return w.deleteFrom(p, func(itm []byte) bool {
+		return bytes.HasPrefix(itm, p)
+	})
+}
+
+// DeleteRange deletes all visible items in the range [start, end) using a
+// single scan from start, like DeletePrefix. A nil start or end denotes an
+// unbounded range. Returns the number of deleted items. DeleteRange is not
+// supported in block store mode and returns ErrBlockStoreUnsupported.
+func (w *Writer) DeleteRange(start, end []byte) (int, error) {
+	return w.deleteFrom(start, func(itm []byte) bool {
+		return end == nil || w.keyCmp(itm, end) < 0
+	})
+}
+
+// deleteFrom deletes the visible items from start, or from the first item if
+// start is nil, until inRange returns false
+func (w *Writer) deleteFrom(start []byte, inRange func(itm []byte) bool) (int, error) {
+	defer w.exit(w.enter())
+	var count int
+	var freelist *skiplist.Node
+
+	if w.HasBlockStore() {
+		return 0, ErrBlockStoreUnsupported
+	}
+
+	if err := w.enterWrite(true); err != nil {
+		return 0, err
+	}
+	defer w.exitWrite()
+
+	sn := w.getCurrSn()
+	visit := func(n *skiplist.Node) (unlink, stop bool) {
+		itm := (*Item)(n.Item())
+		if !inRange(itm.Bytes()) {
+			return false, true
+		}
+
+		if atomic.LoadUint32(&itm.deadSn) != 0 {
+			return false, false
+		}
+
+		w.throttle()
+		if itm.bornSn == sn {
+			return true, false
+		}
+
+		if atomic.CompareAndSwapUint32(&itm.deadSn, 0, sn) {
+			count++
+			w.removeItemSize(itm)
+			w.notifyDelete(itm, n)
+			w.tombstones++
+			n.GClink = nil
+			if w.gctail == nil {
+				w.gctail = n
+				w.gchead = w.gctail
+			} else {
+				w.gctail.GClink = n
+				w.gctail = n
+			}
+		}
+
+		return false, false
+	}
+
+	onDelete := func(n *skiplist.Node) {
+		count++
+		w.removeItemSize((*Item)(n.Item()))
+		w.notifyDelete((*Item)(n.Item()), n)
+		n.GClink = freelist
+		freelist = n
+	}
+
+	x := skiplist.MinItem
+	if start != nil {
+		x = unsafe.Pointer(w.newItem(start, false))
+	}
+	w.store.DeleteRange(x, w.insCmp, visit, onDelete, w.buf, &w.slSts1)
+	w.count -= int64(count)
+
+	// Unlinked nodes are freed once the current accessors have left
+	if freelist != nil {
+		barrier := w.store.GetAccesBarrier()
+		barrier.FlushSession(unsafe.Pointer(freelist))
+	}
+
+	return count, nil
+}
+
+// UpdateInPlace overwrites the data of the item identified by key with bs
+// without allocating a new item or skiplist node. This is only possible when
+// bs has the same size as the existing item data, compares equal to it by the
+// key comparator and the item was inserted after the latest snapshot, so that
+// no snapshot can observe the previous value. Returns false without modifying
+// the store if the update cannot be performed in place.
+//
+// UpdateInPlace is only useful with a custom key comparator which compares a
+// part of the item data (eg. a fixed size key prefix) and ignores the rest.
+// With the default comparator equal items have identical data and there is
+// nothing to update.
+//
+// The update is reported to the item lifecycle callbacks as a delete of a
+// copy of the previous item followed by an insert of the updated item.
+//
+// The item bytes are overwritten without synchronization. Concurrent writers
+// comparing against this item may observe partially written data. This is
+// harmless when the comparator only reads bytes which are identical in the
+// old and the new data (eg. a key prefix), otherwise the caller must ensure
+// that no other writer accesses the same key concurrently.
+func (w *Writer) UpdateInPlace(key, bs []byte) bool {
+	defer w.exit(w.enter())
+	if w.HasBlockStore() {
+		return false
+	}
+
+	w.enterWrite(false)
+	defer w.exitWrite()
+
+	n := w.GetNode(key)
+	if n == nil {
+		return false
+	}
+
+	itm := (*Item)(n.Item())
+	data := itm.Bytes()
+	if itm.bornSn != w.getCurrSn() || len(data) != len(bs) || w.keyCmp(data, bs) != 0 {
+		return false
+	}
+
+	w.throttle()
+	if w.onItemDelete != nil && !w.isInternal {
+		old := w.newItem(data, false)
+		*old = *itm
+		w.notifyDelete(old, n)
+	}
+
+	copy(data, bs)
+	w.notifyInsert(itm, n)
+	return true
+}
+
 // GetNode implements lookup of an item and return its skiplist Node
 // This API enables to lookup an item without using a snapshot handle.
 func (w *Writer) GetNode(bs []byte) *skiplist.Node {
+	defer w.exit(w.enter())
 	iter := w.store.NewIterator(w.iterCmp, w.buf)
 	defer iter.Close()
 
@@ -318,6 +782,7 @@ func (w *Writer) GetNode(bs []byte) *skiplist.Node {
 // Config - Nitro instance configuration
 type Config struct {
 	keyCmp   KeyCompare
+	keyHash  KeyHash
 	insCmp   skiplist.CompareFn
 	iterCmp  skiplist.CompareFn
 	existCmp skiplist.CompareFn
@@ -329,19 +794,149 @@ type Config struct {
 	useDeltaFiles bool
 	mallocFun     skiplist.MallocFn
 	freeFun       skiplist.FreeFn
+	freeBatchSize int
+	freeBulkFun   func([]unsafe.Pointer)
+	onItemFree    ItemCallback
 	blockStoreDir string
 	storageShards int
+	blockSize     int
+	writeBufSize  int
+	poolBlockBufs bool
+	keyProvider   KeyProvider
+
+	compactLiveRatio float64
+	compactInterval  time.Duration
+
+	nodeDataCodec NodeDataCodec
+
+	onItemInsert ItemCallback
+	onItemDelete ItemCallback
+
+	onMemoryPressure MemoryPressureCallback
+	maxItemSize      int
+	failFrozenWrites bool
+
+	encodeItemFn ItemCodecFn
+	decodeItemFn ItemCodecFn
+	dumpEncoders int
+	dumpFormat   DumpFormat
+	useKeyspaces bool
+	useKeyValue  bool
+	itemMetaSize int
+
+	mergeOperator MergeOperator
+
+	onLeak func(*LeakReport)
+
+	onNodeFree NodeDataCallback
+
+	watchdogTimeout time.Duration
+	onStaleSession  SessionWatchdogCallback
+
+	idleGCPeriod time.Duration
+
+	statsInterval    time.Duration
+	statsHistorySize int
+
+	memoryLowWatermark      int64
+	memoryHighWatermark     int64
+	memoryWatermarkInterval time.Duration
+	onMemoryHigh            MemoryWatermarkCallback
+	onMemoryLow             MemoryWatermarkCallback
+
+	freeListSize   int
+	freeListMaxAge time.Duration
+
+	contentionThreshold int
+	onContention        ContentionCallback
+
+	onLoadConflict LoadConflictFn
 }
 
-// SetKeyComparator provides key comparator for the Nitro item data
+// SetKeyComparator provides key comparator for the Nitro item data. It resets
+// the key hash, so that all conditional writes, e.g., PutIf, share a single
+// lock until SetKeyHash is called.
 func (cfg *Config) SetKeyComparator(cmp KeyCompare) {
 	cfg.keyCmp = cmp
+	cfg.keyHash = nil
 	cfg.insCmp = newInsertCompare(cmp)
 	cfg.iterCmp = newIterCompare(cmp)
 	cfg.existCmp = newExistCompare(cmp)
 }
+
+// SetBlockStoreDir enables the block store with data files in the given
+// directory. It has no effect on platforms without block store support
+// (js, wasip1).
 func (cfg *Config) SetBlockStoreDir(p string) {
-	cfg.blockStoreDir = p
+	if blockStoreSupported {
+		cfg.blockStoreDir = p
+	}
+}
+
+// SetBlockSize sets the size of the blocks written to the block store. Small
+// blocks suit small fixed-size items, large blocks multi-KB items. The size
+// has to be a power of two between 512 bytes and 32KB and is recorded in
+// the block store directory, reopening it with another size fails.
+func (cfg *Config) SetBlockSize(sz int) error {
+	if sz < minBlockSize || sz > maxBlockSize || sz&(sz-1) != 0 {
+		return ErrInvalidBlockSize
+	}
+
+	cfg.blockSize = sz
+	return nil
+}
+
+// SetMaxItemSize limits the size of the items of the instance. TryPut
+// returns ErrItemTooLarge for larger items, Put, Upsert and DeleteNonExist
+// panic with it and ApplyOps fails with it. Items of any size up to the limit
+// are stored in the block store, spanning several blocks if necessary. Items
+// larger than 65535 bytes can only be stored to disk with
+// CouchbaseDumpFormat.
+func (cfg *Config) SetMaxItemSize(sz int) error {
+	if sz < 1 || sz > ItemSizeLimit {
+		return ErrInvalidItemSize
+	}
+
+	cfg.maxItemSize = sz
+	return nil
+}
+
+// MaxItemSize returns the maximum item size of the instance
+func (m *Nitro) MaxItemSize() int {
+	if m.maxItemSize > 0 {
+		return m.maxItemSize
+	}
+	return ItemSizeLimit
+}
+
+// UseWriteBuffer enables write-behind buffering of block store writes. Up to
+// size bytes of blocks per shard are buffered and flushed in the background
+// as large sequential writes. Use Nitro.Sync to wait until the blocks
+// written by ApplyOps are durable.
+func (cfg *Config) UseWriteBuffer(size int) {
+	cfg.writeBufSize = size
+}
+
+// UsePooledBlockBuffers reuses the block buffers of closed block store
+// iterators for new iterators, which saves an allocation per iterator for
+// short scans. The data returned by Iterator.Get is then only valid until the
+// iterator is closed, instead of as long as the snapshot is open.
+func (cfg *Config) UsePooledBlockBuffers() {
+	cfg.poolBlockBufs = true
+}
+
+// SetBlockStoreEncryption encrypts the block store at rest. Every data file
+// has its own data keys, which are wrapped by the master key supplied by kp.
+// Encryption reduces the usable size of a block by 32 bytes.
+func (cfg *Config) SetBlockStoreEncryption(kp KeyProvider) {
+	cfg.keyProvider = kp
+}
+
+// SetAutoCompaction periodically compacts the block store files in which
+// the ratio of live blocks fell below minLiveRatio
+func (cfg *Config) SetAutoCompaction(minLiveRatio float64, interval time.Duration) {
+	cfg.compactLiveRatio = minLiveRatio
+	cfg.compactInterval = interval
 }
 
 func (cfg *Config) HasBlockStore() bool {
@@ -350,13 +945,123 @@ func (cfg *Config) HasBlockStore() bool {
 
 // UseMemoryMgmt provides custom memory allocator for Nitro items storage
 func (cfg *Config) UseMemoryMgmt(malloc skiplist.MallocFn, free skiplist.FreeFn) {
-	if runtime.GOARCH == "amd64" {
+	if skiplist.MemoryMgmtSupported {
 		cfg.useMemoryMgmt = true
 		cfg.mallocFun = malloc
 		cfg.freeFun = free
 	}
 }
 
+// OnItemFree registers a callback invoked by the free workers before the
+// memory of a deleted item is reclaimed, when no snapshot or iterator can
+// reach the item anymore. Items are only reclaimed with UseMemoryMgmt.
+func (cfg *Config) OnItemFree(fn ItemCallback) {
+	cfg.onItemFree = fn
+}
+
+// UseBatchedFree makes the GC free workers return item and node memory to
+// the allocator in batches of size blocks through freeBulk (e.g., mm.FreeBulk)
+// instead of one free call per block. It only applies together with
+// UseMemoryMgmt.
+func (cfg *Config) UseBatchedFree(size int, freeBulk func([]unsafe.Pointer)) {
+	cfg.freeBatchSize = size
+	cfg.freeBulkFun = freeBulk
+}
+
+// OnItemInsert registers a callback invoked by a writer after an item has
+// been inserted. The callback runs on the writer goroutine and should not
+// call back into the same writer. Block store index updates performed by
+// ApplyOps are not reported.
+func (cfg *Config) OnItemInsert(fn ItemCallback) {
+	cfg.onItemInsert = fn
+}
+
+// OnItemDelete registers a callback invoked by a writer after an item has
+// been marked as deleted or a delete marker has been inserted. The callback
+// runs on the writer goroutine and should not call back into the same writer.
+func (cfg *Config) OnItemDelete(fn ItemCallback) {
+	cfg.onItemDelete = fn
+}
+
+// OnMemoryPressure registers a callback invoked by a writer when Put,
+// Upsert or DeleteNonExist fail to allocate memory for an item, e.g., to shed
+// load or spill items to disk. The operation is dropped and the writer
+// remains usable. Without a callback, the writer panics with ErrOutOfMemory.
+// Use Writer.TryPut to handle allocation failures of single inserts.
+func (cfg *Config) OnMemoryPressure(fn MemoryPressureCallback) {
+	cfg.onMemoryPressure = fn
+}
+
+// SetFreeListFlush controls how the nodes which a writer unlinks itself,
+// when it deletes items inserted after the last snapshot, are handed over to
+// the free workers. They are collected in a list per writer, which is handed
+// over once it holds size nodes or, at the next such delete, once its oldest
+// node has waited for maxAge. NewSnapshot and Close hand over all lists.
+// Every hand-over closes a barrier session, larger lists reduce that
+// overhead for delete heavy writers at the cost of reclamation latency. The
+// default size of 1 hands over every node right away.
+func (cfg *Config) SetFreeListFlush(size int, maxAge time.Duration) {
+	cfg.freeListSize = size
+	cfg.freeListMaxAge = maxAge
+}
+
+// OnNodeFree registers a callback invoked exactly once for every node with
+// the data attached by Nitro.SetNodeData, before the memory of the node is
+// reclaimed by the free workers or by Close. The data can reference external
+// resources which are safe to release in the callback, since no snapshot or
+// iterator can reach the node anymore. Nodes are only reclaimed with
+// UseMemoryMgmt and a node data codec has to be configured.
+func (cfg *Config) OnNodeFree(fn NodeDataCallback) {
+	cfg.onNodeFree = fn
+}
+
+// OnContention registers a callback invoked when a writer or iterator had
+// to restart its skiplist search threshold times in a row, because a deleted
+// node could not be unlinked while concurrent updates kept changing its
+// predecessor. It is invoked again after every threshold further restarts.
+// The callback runs on the contending goroutine and the item is only valid
+// during the callback.
+func (cfg *Config) OnContention(threshold int, fn ContentionCallback) {
+	cfg.contentionThreshold = threshold
+	cfg.onContention = fn
+}
+
+// OnLeak registers a callback invoked by Close in debug mode when snapshots
+// or iterators have not been closed, or writers have mutations which were
+// not published by NewSnapshot. Close waits until the snapshots are closed,
+// so the callback may close them.
+func (cfg *Config) OnLeak(fn func(*LeakReport)) {
+	cfg.onLeak = fn
+}
+
+// SetItemCodec registers hooks which transform the data of every item written
+// by StoreToDisk (encode) and read by LoadFromDisk (decode), e.g., to strip
+// application framing or to re-encode items between schema versions. Either
+// hook may be nil. The hooks are invoked concurrently from the per shard
+// writers and readers, and the returned data may not exceed 64KB.
+func (cfg *Config) SetItemCodec(encode, decode ItemCodecFn) {
+	cfg.encodeItemFn = encode
+	cfg.decodeItemFn = decode
+}
+
+// SetDumpEncoders sets the number of workers which run the encode hook of
+// SetItemCodec, e.g., compression, while StoreToDisk writes the data shards.
+// With more than one encoder, iterating, encoding and writing the shard files
+// are pipelined, so that encoding does not serialize behind the shard write
+// loop. By default, items are encoded by the shard writers.
+func (cfg *Config) SetDumpEncoders(n int) {
+	cfg.dumpEncoders = n
+}
+
+// SetDumpFormat selects the item encoding used by StoreToDisk. Use
+// CouchbaseDumpFormat to produce backups which upstream couchbase/nitro can
+// restore. LoadFromDisk uses the format recorded in the backup header and
+// falls back to this format for backups without a header, such as those
+// written by upstream nitro.
+func (cfg *Config) SetDumpFormat(f DumpFormat) {
+	cfg.dumpFormat = f
+}
+
 // UseDeltaInterleaving option enables to avoid additional memory required during disk backup
 // as due to locking of older snapshots. This non-intrusive backup mode
 // eliminates the need for locking garbage collectable old snapshots. But, it may
@@ -365,14 +1070,42 @@ func (cfg *Config) UseDeltaInterleaving() {
 	cfg.useDeltaFiles = true
 }
 
+// SetDeltaInterleaving enables or disables delta interleaving, see
+// UseDeltaInterleaving, on a live instance. The change takes effect for
+// subsequent StoreToDisk operations, backups in progress are not affected.
+func (m *Nitro) SetDeltaInterleaving(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&m.deltaInterleaving, v)
+}
+
+// DeltaInterleaving reports whether StoreToDisk uses delta interleaving
+func (m *Nitro) DeltaInterleaving() bool {
+	return atomic.LoadInt32(&m.deltaInterleaving) == 1
+}
+
 type restoreStats struct {
 	DeltaRestored      uint64
 	DeltaRestoreFailed uint64
+	// Delta shards which ended at a torn or corrupt record
+	DeltaTruncated uint64
 }
 
 // Nitro instance
 type Nitro struct {
+	// Fields updated with 64-bit atomics come first so that they are 64-bit
+	// aligned on 32-bit platforms
+	itemsCount int64
+	tombstones int64
+	itemSizes  SizeHistogram
+	restoreStats
+	compactor compactor
+
 	id           int
+	name         string
+	keyspaces    keyspaceRegistry
 	store        *skiplist.Skiplist
 	currSn       uint32
 	snapshots    *skiplist.Skiplist
@@ -380,7 +1113,9 @@ type Nitro struct {
 	isGCRunning  int32
 	lastGCSn     uint32
 	leastUnrefSn uint32
-	itemsCount   int64
+
+	// Delta interleaving of StoreToDisk, see SetDeltaInterleaving
+	deltaInterleaving int32
 
 	// Used to push gclist from current snapshot.
 	parentSnap *Snapshot
@@ -392,16 +1127,74 @@ type Nitro struct {
 	shardWrs []*diskWriter
 	bm       BlockManager
 
+	// Number of item bytes stored in a block
+	blockDataSize int
+	// Block buffers of the iterators, which are reused once closed with
+	// UsePooledBlockBuffers
+	blockBufs sync.Pool
+
+	// Set once an item is stored in overflow blocks
+	hasOverflowItems int32
+
+	// Set for instances created by a Manager, which share its workers
+	mgr *Manager
+
+	// Open snapshots and iterators in debug mode
+	leaks leakTracker
+
+	watchdog sessionWatchdog
+	idleGC   idleScheduler
+	segments segmentRegistry
+	jobs     jobScheduler
+
+	statsHistory statsHistory
+	opHistory    opHistory
+	arenas       arenaRegistry
+	writeGate    writeGate
+
+	// Key comparator of the configuration, before keyspaces and key-value
+	// items wrap it
+	userKeyCmp  KeyCompare
+	userKeyHash KeyHash
+
+	// Locks of the conditional writes, see PutIf
+	keyLocks keyLocks
+
+	// Set between reaching the high and the low memory watermark
+	memoryPressure int32
+
 	hasShutdown bool
 	shutdownWg1 sync.WaitGroup // GC workers and StoreToDisk task
 	shutdownWg2 sync.WaitGroup // Free workers
 
 	Config
-	restoreStats
 }
 
 // NewWithConfig creates a new Nitro instance based on provided configuration.
 func NewWithConfig(cfg Config) *Nitro {
+	return newWithManager(cfg, nil)
+}
+
+func newWithManager(cfg Config, mgr *Manager) *Nitro {
+	if cfg.blockSize == 0 {
+		cfg.blockSize = defaultBlockSize
+	}
+	if cfg.HasBlockStore() {
+		cfg.itemMetaSize = 0
+	}
+
+	userKeyCmp, userKeyHash := cfg.keyCmp, cfg.keyHash
+	if cfg.useKeyValue {
+		keyHash := cfg.keyHash
+		cfg.SetKeyComparator(newKeyValueCompare(cfg.keyCmp))
+		cfg.keyHash = newKeyValueHash(keyHash)
+	}
+	if cfg.useKeyspaces {
+		keyHash := cfg.keyHash
+		cfg.SetKeyComparator(newKeyspaceCompare(cfg.keyCmp))
+		cfg.keyHash = newKeyspaceHash(keyHash)
+	}
+
 	m := &Nitro{
 		snapshots:   skiplist.New(),
 		gcsnapshots: skiplist.New(),
@@ -409,6 +1202,13 @@ func NewWithConfig(cfg Config) *Nitro {
 		Config:      cfg,
 		gcchan:      make(chan *skiplist.Node, gcchanBufSize),
 		id:          int(atomic.AddInt64(&dbInstancesCount, 1)),
+		mgr:         mgr,
+		userKeyCmp:  userKeyCmp,
+		userKeyHash: userKeyHash,
+	}
+
+	if cfg.useDeltaFiles {
+		m.deltaInterleaving = 1
 	}
 
 	m.freechan = make(chan *skiplist.Node, gcchanBufSize)
@@ -420,15 +1220,46 @@ func NewWithConfig(cfg Config) *Nitro {
 	dbInstances.Insert(unsafe.Pointer(m), CompareNitro, buf, &dbInstances.Stats)
 
 	if cfg.HasBlockStore() {
-		var err error
-		m.bm, err = newFileBlockManager(cfg.storageShards, cfg.blockStoreDir)
+		fbm, err := newFileBlockManager(cfg.storageShards, cfg.blockStoreDir, m.blockSize, cfg.keyProvider)
 		if err != nil {
 			panic(err)
 		}
 
+		m.bm = fbm
+		m.blockDataSize = fbm.dataSize()
+		m.blockBufs.New = func() interface{} {
+			return make([]byte, m.blockDataSize)
+		}
+		m.nodeDataCodec = blockPtrCodec{}
+		if cfg.writeBufSize > 0 {
+			m.bm = newWriteBuffer(fbm, cfg.writeBufSize)
+		}
+
 		for i := 0; i < cfg.storageShards; i++ {
 			m.shardWrs = append(m.shardWrs, m.newDiskWriter(i))
 		}
+
+		if cfg.compactLiveRatio > 0 && cfg.compactInterval > 0 {
+			m.compactor.stop = make(chan struct{})
+			m.compactor.wg.Add(1)
+			go m.compactionWorker()
+		}
+	}
+
+	if m.useMemoryMgmt && m.onStaleSession != nil && m.watchdogTimeout > 0 {
+		m.startSessionWatchdog()
+	}
+
+	if m.idleGCPeriod > 0 {
+		m.startIdleScheduler()
+	}
+
+	if m.statsInterval > 0 && m.statsHistorySize > 0 {
+		m.startStatsSampler()
+	}
+
+	if m.memoryWatermarkInterval > 0 && m.memoryHighWatermark > 0 {
+		m.startWatermarkMonitor()
 	}
 
 	return m
@@ -442,7 +1273,22 @@ func (m *Nitro) newStoreConfig() skiplist.Config {
 		slCfg.Malloc = m.mallocFun
 		slCfg.Free = m.freeFun
 		slCfg.BarrierDestructor = m.newBSDestructor()
+		slCfg.TrackIterators = m.onStaleSession != nil
+	}
 
+	if fn := m.onNodeFree; fn != nil && m.nodeDataCodec != nil && !m.HasBlockStore() {
+		codec := m.nodeDataCodec
+		slCfg.OnNodeFree = func(itm unsafe.Pointer, w uint64) {
+			if v, err := codec.Decode(w); err == nil {
+				fn((*Item)(itm).Bytes(), v)
+			}
+		}
+	}
+
+	if fn := m.onContention; fn != nil {
+		slCfg.SetContentionHandler(m.contentionThreshold, func(ev skiplist.ContentionEvent) {
+			fn((*Item)(ev.Node.Item()).Bytes(), ev.Level, ev.Retries)
+		})
 	}
 	return slCfg
 }
@@ -452,7 +1298,11 @@ func (m *Nitro) newBSDestructor() skiplist.BarrierSessionDestructor {
 		// If gclist is not empty
 		if ref != nil {
 			freelist := (*skiplist.Node)(ref)
-			m.freechan <- freelist
+			if m.mgr != nil {
+				m.mgr.pool.free(m, freelist)
+			} else {
+				m.freechan <- freelist
+			}
 		}
 	}
 }
@@ -460,7 +1310,7 @@ func (m *Nitro) newBSDestructor() skiplist.BarrierSessionDestructor {
 func (m *Nitro) initSizeFuns() {
 	m.snapshots.SetItemSizeFunc(SnapshotSize)
 	m.gcsnapshots.SetItemSizeFunc(SnapshotSize)
-	m.store.SetItemSizeFunc(ItemSize)
+	m.store.SetItemSizeFunc(m.itemSize)
 }
 
 // New creates a Nitro instance using default configuration
@@ -470,22 +1320,61 @@ func New() *Nitro {
 
 // MemoryInUse returns total memory used by the Nitro instance.
 func (m *Nitro) MemoryInUse() int64 {
-	storeStats := m.aggrStoreStats()
-	return storeStats.Memory + m.snapshots.MemoryInUse() + m.gcsnapshots.MemoryInUse()
+	return m.MemoryUsage().Total()
+}
+
+// MemoryUsage breaks down the memory used by a Nitro instance by its
+// skiplists
+type MemoryUsage struct {
+	// Items and their index
+	Store skiplist.MemoryUsage
+	// Live snapshots
+	Snapshots skiplist.MemoryUsage
+	// Snapshots waiting for garbage collection
+	GCSnapshots skiplist.MemoryUsage
+}
+
+// Total returns the memory used by all skiplists
+func (u MemoryUsage) Total() int64 {
+	return u.Store.Total() + u.Snapshots.Total() + u.GCSnapshots.Total()
+}
+
+// MemoryUsage returns the memory used by the skiplists of the instance
+func (m *Nitro) MemoryUsage() MemoryUsage {
+	return MemoryUsage{
+		Store:       m.aggrStoreStats().MemoryUsed(),
+		Snapshots:   m.snapshots.MemoryUsed(),
+		GCSnapshots: m.gcsnapshots.MemoryUsed(),
+	}
 }
 
 // Close shuts down the nitro instance
 func (m *Nitro) Close() {
+	m.ResumeWrites()
+	m.stopJobs()
 	if m.parentSnap != nil {
 		m.parentSnap.Close()
 	}
 
+	if debugMode && m.onLeak != nil {
+		if r := m.leakReport(); r != nil {
+			m.onLeak(r)
+		}
+	}
+
 	// Wait until all snapshot iterators have finished
 	for s := m.snapshots.GetStats(); int(s.NodeCount) != 0; s = m.snapshots.GetStats() {
 		time.Sleep(time.Millisecond)
 	}
 
 	m.hasShutdown = true
+	m.closeSegments()
+	m.stopSessionWatchdog()
+	m.stopIdleScheduler()
+	if m.compactor.stop != nil {
+		close(m.compactor.stop)
+		m.compactor.wg.Wait()
+	}
 
 	// Acquire gc chan ownership
 	// This will make sure that no other goroutine will write to gcchan
@@ -498,10 +1387,19 @@ func (m *Nitro) Close() {
 	defer dbInstances.FreeBuf(buf)
 	dbInstances.Delete(unsafe.Pointer(m), CompareNitro, buf, &dbInstances.Stats)
 
+	// Wait for the lists queued to the shared workers
+	if m.mgr != nil {
+		m.shutdownWg1.Wait()
+	}
+
 	if m.useMemoryMgmt {
 		buf := m.snapshots.MakeBuf()
 		defer m.snapshots.FreeBuf(buf)
 
+		for w := m.wlist; w != nil; w = w.next {
+			w.flushFree()
+		}
+
 		m.shutdownWg1.Wait()
 		close(m.freechan)
 		m.shutdownWg2.Wait()
@@ -518,8 +1416,9 @@ func (m *Nitro) Close() {
 		}
 
 		for lastNode != nil {
-			m.freeItem((*Item)(lastNode.Item()))
+			itm := (*Item)(lastNode.Item())
 			m.store.FreeNode(lastNode, &m.store.Stats)
+			m.freeItem(itm)
 			lastNode = nil
 
 			if iter.Valid() {
@@ -527,9 +1426,75 @@ func (m *Nitro) Close() {
 				iter.Next()
 			}
 		}
+
+		// Reclaim the arenas once their items are freed
+		for w := m.wlist; w != nil; w = w.next {
+			w.SetArena(nil)
+		}
+	}
+
+	if wb, ok := m.bm.(*writeBuffer); ok {
+		wb.Close()
 	}
 }
 
+// CloseTimeout shuts down the nitro instance once all snapshots other than
+// the reference held by the instance itself have been closed and no
+// iterator or writer accesses the skiplist anymore. Unlike Close, which only
+// waits for the snapshots and lets the iterators finish concurrently, it
+// returns ErrCloseTimeout without shutting down if that does not happen
+// within timeout.
+func (m *Nitro) CloseTimeout(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !m.released() {
+		if time.Now().After(deadline) {
+			return ErrCloseTimeout
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	m.Close()
+	return nil
+}
+
+// released returns true if only the instance holds a snapshot reference
+// and the barrier sessions of the store have been released
+func (m *Nitro) released() bool {
+	count := int(m.snapshots.GetStats().NodeCount)
+	if m.parentSnap != nil {
+		if atomic.LoadInt32(&m.parentSnap.refCount) != 1 {
+			return false
+		}
+		count--
+	}
+
+	return count == 0 && m.store.GetAccesBarrier().Idle()
+}
+
+// Sync makes the blocks written to the block store durable. With a write
+// buffer, it waits until all buffered blocks are flushed. It is a no-op
+// without a block store.
+func (m *Nitro) Sync() error {
+	if s, ok := m.bm.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+
+	return nil
+}
+
+// RotateBlockStoreKeys generates new data keys for the block store files and
+// rewraps the existing data keys with the current master key of the key
+// provider. New blocks are encrypted with the new data keys, blocks written
+// earlier remain readable with the retired keys until they are rewritten.
+func (m *Nitro) RotateBlockStoreKeys() error {
+	fbm := m.fileBlockManager()
+	if fbm == nil || fbm.cipher == nil {
+		return ErrNotEncrypted
+	}
+
+	return fbm.cipher.Rotate()
+}
+
 func (m *Nitro) getCurrSn() uint32 {
 	return atomic.LoadUint32(&m.currSn)
 }
@@ -553,12 +1518,18 @@ func (m *Nitro) NewWriter() *Writer {
 	w.next = m.wlist
 	m.wlist = w
 	w.dwrCtx.Init()
+	if debugMode {
+		w.created = debug.Stack()
+	}
 
-	m.shutdownWg1.Add(1)
-	go m.collectionWorker(w)
-	if m.useMemoryMgmt {
-		m.shutdownWg2.Add(1)
-		go m.freeWorker(w)
+	// Instances of a Manager use its shared workers
+	if m.mgr == nil {
+		m.shutdownWg1.Add(1)
+		go m.collectionWorker(w)
+		if m.useMemoryMgmt {
+			m.shutdownWg2.Add(1)
+			go m.freeWorker(w)
+		}
 	}
 
 	return w
@@ -572,6 +1543,12 @@ type Snapshot struct {
 	count    int64
 
 	gclist *skiplist.Node
+
+	// Attached segments which had not been folded when it was created
+	segments []*ExternalSegment
+
+	// *closeInfo of the release of the last reference in debug mode
+	closed unsafe.Pointer
 }
 
 // SnapshotSize returns the memory used by Nitro snapshot metadata
@@ -627,20 +1604,135 @@ func (s *Snapshot) Open() bool {
 // Close(). Internal garbage collector takes care of freeing the items.
 func (s *Snapshot) Close() {
 	newRefcount := atomic.AddInt32(&s.refCount, -1)
+	if newRefcount < 0 {
+		if assertionsOn() {
+			s.assertRefCount(newRefcount)
+		}
+		s.checkOpen()
+	}
+
 	if newRefcount == 0 {
+		s.markClosed()
 		buf := s.db.snapshots.MakeBuf()
 		defer s.db.snapshots.FreeBuf(buf)
 
 		// Move from live snapshot list to dead list
 		s.db.snapshots.Delete(unsafe.Pointer(s), CompareSnapshot, buf, &s.db.snapshots.Stats)
 		s.db.gcsnapshots.Insert(unsafe.Pointer(s), CompareSnapshot, buf, &s.db.gcsnapshots.Stats)
+		for _, seg := range s.segments {
+			seg.release()
+		}
 		s.db.GC()
 	}
 }
 
 // NewIterator creates a new snapshot iterator
 func (s *Snapshot) NewIterator() *Iterator {
-	return s.db.NewIterator(s)
+	itr := s.db.NewIterator(s)
+	if itr == nil {
+		s.checkOpen()
+	}
+	return itr
+}
+
+// OpenIterator creates a new snapshot iterator like NewIterator, but returns
+// ErrSnapshotClosed instead of a nil iterator if the snapshot has been
+// closed. Errors reading the items are recorded by the iterator, see
+// Iterator.Err.
+func (s *Snapshot) OpenIterator() (*Iterator, error) {
+	itr := s.db.NewIterator(s)
+	if itr == nil {
+		return nil, ErrSnapshotClosed
+	}
+	return itr, nil
+}
+
+// Range invokes fn for every item in the snapshot in the range [start, end)
+// in key order. A nil start or end denotes an unbounded range. The scan stops
+// early when fn returns false. The item data is only valid during the
+// callback. It returns ErrSnapshotClosed if the snapshot has been closed or
+// the error reading the items, which ends the scan.
+func (s *Snapshot) Range(start, end []byte, fn func(itm []byte) bool) error {
+	itr, err := s.OpenIterator()
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	itr.SetRefreshRate(s.db.refreshRate)
+	itr.SetEnd(end)
+	for itr.Seek(start); itr.Valid(); itr.Next() {
+		itm := itr.Get()
+		if end != nil && s.db.keyCmp(itm, end) >= 0 {
+			return nil
+		}
+
+		if !fn(itm) {
+			return nil
+		}
+	}
+
+	return itr.Err()
+}
+
+// ParallelRange splits the range [start, end) into `partitions` partitions
+// using the skiplist index levels and scans them concurrently. fn is invoked
+// concurrently for items from different partitions along with the partition
+// id. The scan of all partitions stops early when fn returns false or a
+// partition fails to read its items, whose error is returned.
+func (s *Snapshot) ParallelRange(start, end []byte, partitions int,
+	fn func(itm []byte, partition int) bool) error {
+	var wg sync.WaitGroup
+	var stop int32
+
+	db := s.db
+	bounds := [][]byte{start}
+	barrier := db.store.GetAccesBarrier()
+	token := barrier.Acquire()
+
+	var startPtr, endPtr unsafe.Pointer
+	if start != nil {
+		startPtr = unsafe.Pointer(db.newItem(start, false))
+	}
+	if end != nil {
+		endPtr = unsafe.Pointer(db.newItem(end, false))
+	}
+
+	for _, p := range db.store.GetRangeSplitItemsInRange(startPtr, endPtr, db.iterCmp, partitions) {
+		bounds = append(bounds, db.ptrToItem(p).Bytes())
+	}
+	barrier.Release(token)
+	bounds = append(bounds, end)
+
+	errs := make([]error, len(bounds)-1)
+	for i := 0; i < len(bounds)-1; i++ {
+		wg.Add(1)
+		go func(partition int) {
+			defer wg.Done()
+			errs[partition] = s.Range(bounds[partition], bounds[partition+1], func(itm []byte) bool {
+				if atomic.LoadInt32(&stop) == 1 {
+					return false
+				}
+
+				if !fn(itm, partition) {
+					atomic.StoreInt32(&stop, 1)
+					return false
+				}
+				return true
+			})
+			if errs[partition] != nil {
+				atomic.StoreInt32(&stop, 1)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // CompareSnapshot implements comparator for snapshots based on snapshot number
@@ -655,7 +1747,23 @@ func CompareSnapshot(this, that unsafe.Pointer) int {
 // This is a thread-unsafe API.
 // While this API is invoked, no other Nitro writer should concurrently call any
 // public APIs such as Put*() and Delete*().
+//
+// With a block store, it waits for a running ApplyOps or block store
+// compaction, whose writers are internal to the instance.
 func (m *Nitro) NewSnapshot() (*Snapshot, error) {
+	if m.HasBlockStore() {
+		m.compactor.Lock()
+		defer m.compactor.Unlock()
+	}
+
+	// Excludes the background folds of the attached segments
+	m.segments.Lock()
+	defer m.segments.Unlock()
+
+	if assertionsOn() {
+		m.assertNoActiveWriters()
+	}
+
 	buf := m.snapshots.MakeBuf()
 	defer m.snapshots.FreeBuf(buf)
 
@@ -673,15 +1781,23 @@ func (m *Nitro) NewSnapshot() (*Snapshot, error) {
 
 		w.gchead = nil
 		w.gctail = nil
+		w.flushFree()
 
 		// Update global stats
 		m.store.Stats.Merge(&w.slSts1)
+		m.itemSizes.Merge(&w.itemSizes)
 		atomic.AddInt64(&m.itemsCount, w.count)
 		w.count = 0
+		atomic.AddInt64(&m.tombstones, w.tombstones)
+		w.tombstones = 0
 	}
 
 	snap := &Snapshot{db: m, sn: m.getCurrSn(), refCount: 2, count: m.ItemsCount()}
+	snap.segments = m.segments.acquire()
 	m.snapshots.Insert(unsafe.Pointer(snap), CompareSnapshot, buf, &m.snapshots.Stats)
+	if debugMode {
+		m.leaks.add(snap)
+	}
 	if m.parentSnap != nil {
 		m.parentSnap.gclist = head
 		m.parentSnap.Close()
@@ -701,6 +1817,14 @@ func (m *Nitro) ItemsCount() int64 {
 	return atomic.LoadInt64(&m.itemsCount)
 }
 
+// TombstonesCount returns the number of deleted items which are retained,
+// since live snapshots can still see them, plus the delete markers of
+// DeleteNonExist. Like ItemsCount, it includes the deletes of writers as of
+// the latest snapshot.
+func (m *Nitro) TombstonesCount() int64 {
+	return atomic.LoadInt64(&m.tombstones)
+}
+
 func (m *Nitro) collectionWorker(w *Writer) {
 	buf := m.store.MakeBuf()
 	defer m.store.FreeBuf(buf)
@@ -715,38 +1839,96 @@ func (m *Nitro) collectionWorker(w *Writer) {
 				close(w.dwrCtx.closed)
 				return
 			}
-			for n := gclist; n != nil; n = n.GClink {
-				w.doDeltaWrite((*Item)(n.Item()))
-				m.store.DeleteNode(n, m.insCmp, buf, &w.slSts2)
-			}
-
-			m.store.Stats.Merge(&w.slSts2)
+			m.collectList(gclist, w, buf, &w.slSts2)
+		}
+	}
+}
 
-			barrier := m.store.GetAccesBarrier()
-			barrier.FlushSession(unsafe.Pointer(gclist))
+// collectList unlinks the nodes of a dead snapshot and hands them over to
+// the free workers once no accessor can reach them. Without a writer, no
+// delta writes are done.
+func (m *Nitro) collectList(gclist *skiplist.Node, w *Writer,
+	buf *skiplist.ActionBuffer, sts *skiplist.Stats) {
+	var count int64
+	for n := gclist; n != nil; n = n.GClink {
+		if w != nil {
+			w.doDeltaWrite((*Item)(n.Item()))
 		}
+		m.store.DeleteNode(n, m.insCmp, buf, sts)
+		count++
+	}
+	atomic.AddInt64(&m.tombstones, -count)
+
+	m.store.Stats.Merge(sts)
+
+	barrier := m.store.GetAccesBarrier()
+	barrier.FlushSession(unsafe.Pointer(gclist))
+}
+
+// freeCtx holds the buffers used for freeing nodes and items
+type freeCtx struct {
+	rbuf, obuf []byte
+	batch      *mm.FreeBatch
+}
+
+func (m *Nitro) newFreeCtx() *freeCtx {
+	ctx := &freeCtx{}
+	if m.HasBlockStore() {
+		ctx.rbuf = make([]byte, m.blockDataSize)
+		ctx.obuf = make([]byte, m.blockDataSize)
+	}
+
+	if m.useMemoryMgmt && m.freeBatchSize > 0 {
+		ctx.batch = mm.NewFreeBatch(m.freeBatchSize, m.freeBulkFun)
 	}
+
+	return ctx
 }
 
 func (m *Nitro) freeWorker(w *Writer) {
+	ctx := m.newFreeCtx()
 	for freelist := range m.freechan {
-		for n := freelist; n != nil; {
-			dnode := n
-			n = n.GClink
+		m.freeList(freelist, ctx, &w.slSts3)
+	}
 
-			if m.HasBlockStore() {
-				m.bm.DeleteBlock(blockPtr(dnode.DataPtr))
-			}
+	m.shutdownWg2.Done()
+}
 
-			itm := (*Item)(dnode.Item())
-			m.freeItem(itm)
-			m.store.FreeNode(dnode, &w.slSts3)
+// freeList frees the nodes and items of a list collected by collectList
+func (m *Nitro) freeList(freelist *skiplist.Node, ctx *freeCtx, sts *skiplist.Stats) {
+	if m.HasBlockStore() {
+		m.enterWrite(false)
+		defer m.exitWrite()
+	}
+
+	for n := freelist; n != nil; {
+		dnode := n
+		n = n.GClink
+
+		if m.HasBlockStore() {
+			m.deleteBlock(nodeBlockPtr(dnode), ctx.rbuf, ctx.obuf)
+		}
+
+		itm := (*Item)(dnode.Item())
+		if m.onItemFree != nil {
+			m.onItemFree(&ItemEntry{itm: itm, n: dnode})
 		}
 
-		m.store.Stats.Merge(&w.slSts3)
+		if ctx.batch != nil {
+			if !m.freeArenaItem(unsafe.Pointer(itm)) {
+				ctx.batch.Free(unsafe.Pointer(itm))
+			}
+			m.store.FreeNodeWith(dnode, ctx.batch.Free, sts)
+		} else {
+			m.store.FreeNode(dnode, sts)
+			m.freeItem(itm)
+		}
 	}
 
-	m.shutdownWg2.Done()
+	if ctx.batch != nil {
+		ctx.batch.Flush()
+	}
+	m.store.Stats.Merge(sts)
 }
 
 // Invariant: Each snapshot n is dependent on snapshot n-1.
@@ -768,7 +1950,11 @@ func (m *Nitro) collectDead() {
 		}
 
 		m.lastGCSn = sn.sn
-		m.gcchan <- sn.gclist
+		if m.mgr != nil {
+			m.mgr.pool.collect(m, sn.gclist)
+		} else {
+			m.gcchan <- sn.gclist
+		}
 		m.gcsnapshots.DeleteNode(node, CompareSnapshot, buf2, &m.gcsnapshots.Stats)
 	}
 }
@@ -808,6 +1994,12 @@ func (m *Nitro) ptrToItem(itmPtr unsafe.Pointer) *Item {
 // This API divides the range of keys in a snapshot into `shards` range partitions
 // Number of concurrent worker threads used can be specified.
 func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concurrency int) error {
+	return m.visitRange(snap, nil, nil, callb, shards, concurrency)
+}
+
+// visitRange is a Visitor restricted to the items in [start, end)
+func (m *Nitro) visitRange(snap *Snapshot, start, end []byte,
+	callb VisitorCallback, shards int, concurrency int) error {
 	var wg sync.WaitGroup
 
 	wch := make(chan int, shards)
@@ -816,7 +2008,7 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 		panic("snapshot cannot be nil")
 	}
 
-	pivotItems := m.partitionPivots(snap, shards)
+	pivotItems := m.rangePivots(m.partitionPivots(snap, shards), start, end)
 	errors := make([]error, len(pivotItems)-1)
 
 	// Run workers
@@ -846,6 +2038,11 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 						return
 					}
 				}
+
+				if err := itr.Err(); err != nil {
+					errors[shard] = err
+					return
+				}
 			}
 		}(&wg)
 	}
@@ -877,7 +2074,7 @@ func (m *Nitro) numWriters() int {
 }
 
 func (m *Nitro) changeDeltaWrState(state int,
-	writers []FileWriter, snap *Snapshot) error {
+	writers []FileWriter, snap *Snapshot, filter ItemFilter) error {
 
 	var err error
 
@@ -886,6 +2083,7 @@ func (m *Nitro) changeDeltaWrState(state int,
 		if state == dwStateInit {
 			w.dwrCtx.sn = snap.sn
 			w.dwrCtx.fw = writers[id]
+			w.dwrCtx.filter = filter
 		}
 
 		// send
@@ -913,7 +2111,29 @@ func (m *Nitro) changeDeltaWrState(state int,
 
 // StoreToDisk backups Nitro snapshot to disk
 // Concurrent threads are used to perform backup and concurrency can be specified.
+// The statistics of the backup files can be read with DumpInfo.
 func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback ItemCallback) (err error) {
+	return m.storeToDisk(dir, snap, concurr, nil, itmCallback, nil)
+}
+
+// StoreToDiskFiltered backups the items of a Nitro snapshot accepted by
+// filter, e.g., to leave out expired items. The filter is called
+// concurrently and itmCallback is only called for the stored items.
+func (m *Nitro) StoreToDiskFiltered(dir string, snap *Snapshot, concurr int,
+	filter ItemFilter, itmCallback ItemCallback) (err error) {
+	return m.storeToDisk(dir, snap, concurr, filter, itmCallback, nil)
+}
+
+// storeToDisk backups a snapshot. If ks is not nil, only the items of the
+// keyspace are stored and their keyspace prefix is stripped.
+func (m *Nitro) storeToDisk(dir string, snap *Snapshot, concurr int,
+	filter ItemFilter, itmCallback ItemCallback, ks *Keyspace) (err error) {
+
+	began := time.Now()
+	var items int64
+	defer func() {
+		m.recordOperation(OpStoreToDisk, began, items, err)
+	}()
 
 	var snapClosed bool
 	defer func() {
@@ -931,6 +2151,13 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 	os.MkdirAll(datadir, 0755)
 	shards := runtime.NumCPU()
 
+	// Closed once the shard writers are closed
+	var encoders *encoderPool
+	if m.encodeItemFn != nil && m.dumpEncoders > 1 {
+		encoders = newEncoderPool(m.dumpEncoders)
+		defer encoders.close()
+	}
+
 	writers := make([]FileWriter, shards)
 	files := make([]string, shards)
 	defer func() {
@@ -941,8 +2168,26 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		}
 	}()
 
+	// Written once the delta shards are complete
+	manifest := DumpManifest{Format: m.dumpFormat.String()}
+	defer func() {
+		if err == nil {
+			err = writeDumpManifest(dir, &manifest)
+		}
+	}()
+
+	var start, end []byte
+	var stripLen int
+	if ks != nil {
+		manifest.Keyspace = ks.name
+		start, end, stripLen = ks.prefix, ks.endPrefix(), keyspacePrefixLen
+	}
+
 	for shard := 0; shard < shards; shard++ {
-		w := m.newFileWriter(m.fileType)
+		w := m.newFileWriter(m.fileType, stripLen)
+		if encoders != nil {
+			w = m.newPipelinedFileWriter(m.fileType, stripLen, encoders)
+		}
 		file := fmt.Sprintf("shard-%d", shard)
 		datafile := filepath.Join(datadir, file)
 		if err := w.Open(datafile); err != nil {
@@ -953,8 +2198,12 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		files[shard] = file
 	}
 
-	// Initialize and setup delta processing
-	if m.useDeltaFiles {
+	// Initialize and setup delta processing. Delta writes are not scoped to a
+	// keyspace, so keyspace backups hold the snapshot instead. Delta writes
+	// are done by the per-writer collection workers, so instances using the
+	// shared workers of a Manager hold the snapshot as well.
+	useDeltas := m.DeltaInterleaving() && ks == nil && m.mgr == nil
+	if useDeltas {
 		deltaWriters := make([]FileWriter, m.numWriters())
 		deltaFiles := make([]string, m.numWriters())
 		defer func() {
@@ -968,7 +2217,7 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		deltadir := filepath.Join(dir, "delta")
 		os.MkdirAll(deltadir, 0755)
 		for id := 0; id < m.numWriters(); id++ {
-			dw := m.newFileWriter(m.fileType)
+			dw := m.newDeltaFileWriter(m.fileType, m.dumpFormat)
 			file := fmt.Sprintf("shard-%d", id)
 			deltafile := filepath.Join(deltadir, file)
 			if err = dw.Open(deltafile); err != nil {
@@ -978,7 +2227,7 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 			deltaFiles[id] = file
 		}
 
-		if err = m.changeDeltaWrState(dwStateInit, deltaWriters, snap); err != nil {
+		if err = m.changeDeltaWrState(dwStateInit, deltaWriters, snap, filter); err != nil {
 			return err
 		}
 
@@ -990,12 +2239,14 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		snapClosed = true
 		fakeSnap := *snap
 		fakeSnap.refCount = 1
+		fakeSnap.closed = nil
 		snap = &fakeSnap
 
 		defer func() {
-			if err = m.changeDeltaWrState(dwStateTerminate, nil, nil); err == nil {
+			if err = m.changeDeltaWrState(dwStateTerminate, nil, nil, nil); err == nil {
 				bs, _ := json.Marshal(deltaFiles)
 				ioutil.WriteFile(filepath.Join(deltadir, "files.json"), bs, 0660)
+				manifest.DeltaShards, err = closeDumpWriters(deltaWriters, deltaFiles)
 			}
 		}()
 	}
@@ -1005,29 +2256,70 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 			return ErrShutdown
 		}
 
+		var entry *ItemEntry
+		if filter != nil || itmCallback != nil {
+			entry = &ItemEntry{itm: itm, n: nil}
+		}
+
+		if filter != nil && !filter(entry) {
+			return nil
+		}
+
 		w := writers[shard]
 		if err := w.WriteItem(itm); err != nil {
 			return err
 		}
 
 		if itmCallback != nil {
-			itmCallback(&ItemEntry{itm: itm, n: nil})
+			itmCallback(entry)
 		}
 
 		return nil
 	}
 
-	if err = m.Visitor(snap, visitorCallback, shards, concurr); err == nil {
+	if err = m.visitRange(snap, start, end, visitorCallback, shards, concurr); err == nil {
 		bs, _ := json.Marshal(files)
 		ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, 0660)
+		hdr := dumpHeader{Format: m.dumpFormat.String(), FramedDeltas: useDeltas,
+			MetadataSize: m.itemMetaSize}
+		if ks != nil {
+			hdr.Keyspace = ks.name
+		}
+		err = writeDumpHeader(dir, hdr)
+	}
+
+	if err == nil {
+		manifest.Shards, err = closeDumpWriters(writers, files)
+		items = manifest.Items()
 	}
 
 	return err
 }
 
-// LoadFromDisk restores Nitro from a disk backup
-func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snapshot, error) {
-	var wg sync.WaitGroup
+// LoadFromDisk restores Nitro from a disk backup using concurr shard
+// readers. With AdaptiveConcurrency, the number of readers is adjusted to
+// the restore throughput. Backups loaded into an instance which already
+// holds items are merged with them, see SetLoadConflictFn.
+func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (snap *Snapshot, err error) {
+	began := time.Now()
+	var items int64
+	defer func() {
+		m.recordOperation(OpLoadFromDisk, began, items, err)
+	}()
+
+	if !m.isEmpty() {
+		snap, items, err = m.mergeFromDisk(dir, concurr, callb)
+		return snap, err
+	}
+
+	if snap, err = m.loadFromDisk(dir, concurr, callb); err == nil {
+		items = snap.Count()
+	}
+	return snap, err
+}
+
+// loadFromDisk restores a backup into an empty instance
+func (m *Nitro) loadFromDisk(dir string, concurr int, callb ItemCallback) (*Snapshot, error) {
 	var files []string
 	var bs []byte
 	var err error
@@ -1036,19 +2328,54 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	if bs, err = ioutil.ReadFile(filepath.Join(datadir, "files.json")); err != nil {
 		return nil, err
 	}
+
+	format, err := readDumpFormat(dir, m.dumpFormat)
+	if err != nil {
+		return nil, err
+	}
 	json.Unmarshal(bs, &files)
 
-	var nodeCallb skiplist.NodeCallback
-	wchan := make(chan int)
+	hdr, err := readDumpHeader(dir)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.MetadataSize != m.itemMetaSize {
+		return nil, ErrMetadataSizeMismatch
+	}
+
+	// Backups with framed delta shards were written with delta interleaving,
+	// which may have been disabled since
+	useDeltas := m.DeltaInterleaving() || hdr.FramedDeltas
+	deltadir := filepath.Join(dir, "delta")
+	var deltaFiles []string
+	if useDeltas {
+		if bs, err := ioutil.ReadFile(filepath.Join(deltadir, "files.json")); err == nil {
+			json.Unmarshal(bs, &deltaFiles)
+		}
+	}
+
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, filepath.Join(datadir, file))
+	}
+	for _, file := range deltaFiles {
+		paths = append(paths, filepath.Join(deltadir, file))
+	}
+	progress := newLoadProgress(paths)
+
 	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
-	b.SetItemSizeFunc(ItemSize)
+	b.SetItemSizeFunc(m.itemSize)
 	segments := make([]*skiplist.Segment, len(files))
 	readers := make([]FileReader, len(files))
 	errors := make([]error, len(files))
 
-	if callb != nil {
-		nodeCallb = func(n *skiplist.Node) {
-			callb(&ItemEntry{itm: (*Item)(n.Item()), n: n})
+	nodeCallb := func(shard int) skiplist.NodeCallback {
+		if callb == nil {
+			return nil
+		}
+
+		return func(n *skiplist.Node) {
+			callb(&ItemEntry{itm: (*Item)(n.Item()), n: n, shard: shard, progress: progress})
 		}
 	}
 
@@ -1062,45 +2389,38 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 	for i, file := range files {
 		segments[i] = b.NewSegment()
-		segments[i].SetNodeCallback(nodeCallb)
-		r := m.newFileReader(m.fileType)
+		segments[i].SetNodeCallback(nodeCallb(i))
+		r := m.newFileReader(m.fileType, format)
 		datafile := filepath.Join(datadir, file)
 		if err := r.Open(datafile); err != nil {
 			return nil, err
 		}
 
+		progress.trackIO(r)
 		readers[i] = r
 	}
 
-	for i := 0; i < concurr; i++ {
-		wg.Add(1)
-		go func(wg *sync.WaitGroup) {
-			defer wg.Done()
-
-			for shard := range wchan {
-				r := readers[shard]
-			loop:
-				for {
-					itm, err := r.ReadItem()
-					if err != nil {
-						errors[shard] = err
-						return
-					}
+	runShards(len(files), concurr, progress, func(id, shard int) {
+		r := readers[shard]
+		for {
+			if progress.isAborted() {
+				errors[shard] = ErrLoadAborted
+				return
+			}
 
-					if itm == nil {
-						break loop
-					}
-					segments[shard].Add(unsafe.Pointer(itm))
-				}
+			itm, err := r.ReadItem()
+			if err != nil {
+				errors[shard] = err
+				return
 			}
-		}(&wg)
-	}
 
-	for i := range files {
-		wchan <- i
-	}
-	close(wchan)
-	wg.Wait()
+			if itm == nil {
+				return
+			}
+			progress.restored(shard, r)
+			segments[shard].Add(unsafe.Pointer(itm))
+		}
+	})
 
 	for _, err := range errors {
 		if err != nil {
@@ -1111,20 +2431,15 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	m.store = b.Assemble(segments...)
 
 	// Delta processing
-	if m.useDeltaFiles {
+	if useDeltas {
 		m.DeltaRestoreFailed = 0
 		m.DeltaRestored = 0
+		m.DeltaTruncated = 0
 
-		wchan := make(chan int)
-		deltadir := filepath.Join(dir, "delta")
-		var files []string
-		if bs, err := ioutil.ReadFile(filepath.Join(deltadir, "files.json")); err == nil {
-			json.Unmarshal(bs, &files)
-		}
-
+		files := deltaFiles
 		readers := make([]FileReader, len(files))
 		errors := make([]error, len(files))
-		writers := make([]*Writer, concurr)
+		writers := make([]*Writer, restoreReaders(concurr, len(files)))
 
 		defer func() {
 			for _, r := range readers {
@@ -1135,63 +2450,66 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		}()
 
 		for i, file := range files {
-			r := m.newFileReader(m.fileType)
+			r := m.newDeltaFileReader(m.fileType, format, hdr.FramedDeltas)
 			deltafile := filepath.Join(deltadir, file)
 			if err := r.Open(deltafile); err != nil {
 				return nil, err
 			}
 
+			progress.trackIO(r)
 			readers[i] = r
 		}
 
-		for i := 0; i < concurr; i++ {
+		for i := range writers {
 			writers[i] = m.newWriter()
-			wg.Add(1)
-			go func(wg *sync.WaitGroup, id int) {
-				defer wg.Done()
-
-				for shard := range wchan {
-					r := readers[shard]
-				loop:
-					for {
-						itm, err := r.ReadItem()
-						if err != nil {
-							errors[shard] = err
-							return
-						}
-
-						if itm == nil {
-							break loop
-						}
-
-						w := writers[id]
-						if n, success := w.store.Insert2(unsafe.Pointer(itm),
-							w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.slSts1); success {
-
-							w.resSts.DeltaRestored++
-							if nodeCallb != nil {
-								nodeCallb(n)
-							}
-						} else {
-							w.freeItem(itm)
-							w.resSts.DeltaRestoreFailed++
-						}
+		}
+
+		runShards(len(files), concurr, progress, func(id, shard int) {
+			r := readers[shard]
+			w := writers[id]
+			pshard := len(segments) + shard
+			callb := nodeCallb(pshard)
+			for {
+				if progress.isAborted() {
+					errors[shard] = ErrLoadAborted
+					return
+				}
+
+				itm, err := r.ReadItem()
+				if err != nil {
+					errors[shard] = err
+					return
+				}
+
+				if itm == nil {
+					if tr, ok := r.(interface{ truncatedTail() bool }); ok && tr.truncatedTail() {
+						w.resSts.DeltaTruncated++
 					}
+					return
 				}
 
-				// Aggregate stats
-				w := writers[id]
-				m.store.Stats.Merge(&w.slSts1)
-				atomic.AddUint64(&m.restoreStats.DeltaRestored, w.resSts.DeltaRestored)
-				atomic.AddUint64(&m.restoreStats.DeltaRestoreFailed, w.resSts.DeltaRestoreFailed)
-			}(&wg, i)
-		}
+				progress.restored(pshard, r)
+				if n, success := w.store.Insert2(unsafe.Pointer(itm),
+					w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.slSts1); success {
+
+					w.resSts.DeltaRestored++
+					if callb != nil {
+						callb(n)
+					}
+				} else {
+					w.freeItem(itm)
+					w.resSts.DeltaRestoreFailed++
+				}
+			}
+		})
 
-		for i := range files {
-			wchan <- i
+		// Aggregate stats
+		for _, w := range writers {
+			m.store.Stats.Merge(&w.slSts1)
+			atomic.AddUint64(&m.restoreStats.DeltaRestored, w.resSts.DeltaRestored)
+			atomic.AddUint64(&m.restoreStats.DeltaRestoreFailed, w.resSts.DeltaRestoreFailed)
+			atomic.AddUint64(&m.restoreStats.DeltaTruncated, w.resSts.DeltaTruncated)
 		}
-		close(wchan)
-		wg.Wait()
 
 		for _, err := range errors {
 			if err != nil {
@@ -1207,7 +2525,35 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 // DumpStats returns Nitro statistics
 func (m *Nitro) DumpStats() string {
-	return m.aggrStoreStats().String()
+	str := m.aggrStoreStats().String()
+	str += fmt.Sprintf("\ntombstones = %d\n", m.TombstonesCount())
+	if rlSts := m.aggrRateLimiterStats(); rlSts.Ops > 0 {
+		str += "\n" + rlSts.String()
+	}
+
+	if h := m.ItemSizeStats(); h.Count > 0 {
+		str += "\nitem_size_distribution:\n" + h.String()
+	}
+
+	if m.HasBlockStore() {
+		str += "\n" + m.BlockStoreStats().String()
+	}
+
+	if totals := m.OperationTotals(); len(totals) > 0 {
+		str += "\noperations:\n"
+		for _, t := range totals {
+			str += t.String() + "\n"
+		}
+	}
+
+	return str
+}
+
+// StoreStats returns the statistics of the skiplist which stores the items,
+// including the partial statistics of the writers and GC workers. The
+// changes of writers are only complete after NewSnapshot.
+func (m *Nitro) StoreStats() skiplist.StatsReport {
+	return m.aggrStoreStats()
 }
 
 func (m *Nitro) aggrStoreStats() skiplist.StatsReport {
@@ -1233,10 +2579,3 @@ func MemoryInUse() (sz int64) {
 
 	return
 }
-
-// Debug enables debug mode
-// Additional details will be logged in the statistics
-func Debug(flag bool) {
-	skiplist.Debug = flag
-	mm.Debug = flag
-}
@@ -10,18 +10,27 @@
 package nitro
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
 )
 import "sync/atomic"
 import "os"
+import "path/filepath"
+import "io"
+import "io/ioutil"
+import "sort"
+import "strings"
 import "testing"
 import "time"
 import "math/rand"
 import "sync"
 import "runtime"
 import "encoding/binary"
+import "hash/crc32"
+import "bufio"
+import "unsafe"
 import "github.com/elliotcourant/nitro/mm"
+import "github.com/elliotcourant/nitro/skiplist"
 
 var testConf Config
 
@@ -32,80 +41,6 @@ func init() {
 	Debug(true)
 }
 
-func TestBlocksPerf(t *testing.T) {
-	t.Skip()
-	dir, err := ioutil.TempDir("", "nitro")
-	if err != nil {
-		panic(err)
-	}
-	defer os.RemoveAll(dir)
-	conf := testConf
-	conf.blockStoreDir = dir
-	db := NewWithConfig(conf)
-	defer db.Close()
-
-	cf := DefaultConfig()
-	cf.UseMemoryMgmt(mm.Malloc, mm.Free)
-	tdb := NewWithConfig(cf)
-
-	total := 100000000
-	thr := 8
-	max := total / thr
-	var wg sync.WaitGroup
-	for i := 0; i < thr; i++ {
-		wg.Add(1)
-		go func(id int, n int, wg *sync.WaitGroup) {
-			defer wg.Done()
-			w := tdb.NewWriter()
-			buf := make([]byte, 8)
-			for x := 0; x < n; x++ {
-				binary.LittleEndian.PutUint64(buf, uint64(x+id*n))
-				w.Put(buf)
-			}
-		}(i, max, &wg)
-	}
-
-	tx := time.Now()
-	wg.Wait()
-	fmt.Println(time.Since(tx), total)
-
-	snp, _ := tdb.NewSnapshot()
-	t0 := time.Now()
-	fmt.Println(db.ApplyOps(snp, 8))
-	fmt.Println("took", time.Since(t0))
-	db.NewSnapshot()
-
-	snp.Close()
-	go tdb.Close()
-
-	tdb = NewWithConfig(cf)
-
-	max = max / 8
-	for i := 0; i < thr; i++ {
-		wg.Add(1)
-		go func(id int, n int, wg *sync.WaitGroup) {
-			defer wg.Done()
-			w := tdb.NewWriter()
-			buf := make([]byte, 8)
-			for x := 0; x < n; x++ {
-				binary.LittleEndian.PutUint64(buf, uint64(x+id*n+total))
-				w.Put(buf)
-			}
-		}(i, max, &wg)
-	}
-
-	tx = time.Now()
-	wg.Wait()
-	fmt.Println(time.Since(tx), total)
-
-	snp, _ = tdb.NewSnapshot()
-	t0 = time.Now()
-	fmt.Println(db.ApplyOps(snp, 8))
-	db.NewSnapshot()
-	fmt.Println("took", time.Since(t0))
-
-}
-
 func TestBatchOps(t *testing.T) {
 	conf := testConf
 	conf.blockStoreDir = "/tmp/"
@@ -411,7 +346,6 @@ func TestLoadStoreDisk(t *testing.T) {
 
 	fmt.Printf("Storing to disk took %v\n", time.Since(t0))
 
-	snap.Close()
 	db = NewWithConfig(testConf)
 	defer db.Close()
 	t0 = time.Now()
@@ -434,6 +368,119 @@ func TestLoadStoreDisk(t *testing.T) {
 	fmt.Println(db.DumpStats())
 }
 
+func TestItemCodec(t *testing.T) {
+	for _, encoders := range []int{1, 4} {
+		t.Run(fmt.Sprintf("encoders=%d", encoders), func(t *testing.T) {
+			testItemCodec(t, encoders)
+		})
+	}
+}
+
+func testItemCodec(t *testing.T, encoders int) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	cfg := testConf
+	cfg.SetDumpEncoders(encoders)
+	cfg.SetItemCodec(func(itm []byte) ([]byte, error) {
+		if bytes.HasSuffix(itm, []byte("0")) {
+			return nil, nil
+		}
+		return append([]byte("v1:"), itm...), nil
+	}, func(itm []byte) ([]byte, error) {
+		if !bytes.HasPrefix(itm, []byte("v1:")) {
+			return nil, fmt.Errorf("missing framing %s", itm)
+		}
+		return itm[3:], nil
+	})
+
+	db := NewWithConfig(cfg)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 1000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("item-%04d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	if dm, err := DumpInfo("db.dump"); err != nil || dm.Items() != int64(n-n/10) {
+		t.Errorf("Expected %d items in the manifest, got %v", n-n/10, err)
+	}
+
+	db2 := NewWithConfig(cfg)
+	defer db2.Close()
+	snap, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	count := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		// Items ending in 0 are dropped by the codec
+		i := count + count/9 + 1
+		if exp := fmt.Sprintf("item-%04d", i); string(itr.Get()) != exp {
+			t.Errorf("Expected %s, got %s", exp, itr.Get())
+		}
+		count++
+	}
+
+	if count != n-n/10 {
+		t.Errorf("Expected %d items, got %d", n-n/10, count)
+	}
+}
+
+func TestCouchbaseDumpFormat(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	cfg := DefaultConfig()
+	cfg.SetDumpFormat(CouchbaseDumpFormat)
+	db := NewWithConfig(cfg)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 1000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("item-%04d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	// The format is negotiated through the header
+	db2 := New()
+	defer db2.Close()
+	snap, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	if c := CountItems(snap); c != n {
+		t.Errorf("Expected %d items, got %d", n, c)
+	}
+	snap.Close()
+
+	// Upstream dumps have no header and require the format to be configured
+	os.Remove(filepath.Join("db.dump", dumpHeaderFile))
+	db3 := NewWithConfig(cfg)
+	defer db3.Close()
+	snap, err = db3.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	if c := CountItems(snap); c != n {
+		t.Errorf("Expected %d items, got %d", n, c)
+	}
+	snap.Close()
+}
+
 func TestStoreDiskShutdown(t *testing.T) {
 	os.RemoveAll("db.dump")
 	var wg sync.WaitGroup
@@ -456,7 +503,6 @@ func TestStoreDiskShutdown(t *testing.T) {
 	}()
 
 	snap0.Close()
-	snap.Close()
 	db.Close()
 
 	if err := <-errch; err != ErrShutdown {
@@ -584,6 +630,40 @@ func TestMemoryInUse(t *testing.T) {
 	dumpStats()
 }
 
+func TestBatchedFree(t *testing.T) {
+	conf := DefaultConfig()
+	conf.UseMemoryMgmt(mm.Malloc, mm.Free)
+	conf.UseBatchedFree(64, mm.FreeBulk)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 5000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+
+	for i := 0; i < 5000; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap1.Close()
+	snap2, _ := w.NewSnapshot()
+	snap3, _ := w.NewSnapshot()
+	defer snap3.Close()
+	snap2.Close()
+
+	for i := 0; i < 100 && db.aggrStoreStats().NodeFrees < 5000; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if db.useMemoryMgmt {
+		if frees := db.aggrStoreStats().NodeFrees; frees != 5000 {
+			t.Errorf("Expected 5000 node frees, got %d", frees)
+		}
+	}
+}
+
 func TestFullScan(t *testing.T) {
 	var wg sync.WaitGroup
 	db := NewWithConfig(testConf)
@@ -823,6 +903,107 @@ func TestLoadDeltaStoreDisk(t *testing.T) {
 	fmt.Println(db.DumpStats())
 	fmt.Println("Restored", db.DeltaRestored)
 	fmt.Println("RestoredFailed", db.DeltaRestoreFailed)
+	if db.DeltaTruncated != 0 {
+		t.Errorf("Expected no truncated delta shards, got %d", db.DeltaTruncated)
+	}
+}
+
+func TestDeltaFileTornTail(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	path := filepath.Join(t.TempDir(), "shard-0")
+	w := db.newDeltaFileWriter(db.fileType, db.dumpFormat)
+	if err := w.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := w.WriteItem(db.newItem([]byte(fmt.Sprintf("item-%04d", i)), false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	read := func() (n int, truncated bool) {
+		r := db.newDeltaFileReader(db.fileType, db.dumpFormat, true)
+		if err := r.Open(path); err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		for {
+			itm, err := r.ReadItem()
+			if err != nil {
+				t.Fatal(err)
+			} else if itm == nil {
+				return n, r.(*rawFileReader).truncatedTail()
+			}
+			db.freeItem(itm)
+			n++
+		}
+	}
+
+	if n, truncated := read(); n != 100 || truncated {
+		t.Errorf("Expected 100 items, got %d (truncated %v)", n, truncated)
+	}
+
+	// Torn write of the last record
+	fi, _ := os.Stat(path)
+	os.Truncate(path, fi.Size()-deltaFrameHeaderSize-3)
+	if n, truncated := read(); n != 99 || !truncated {
+		t.Errorf("Expected 99 items of a truncated file, got %d (truncated %v)", n, truncated)
+	}
+
+	// Corrupt record
+	bs, _ := ioutil.ReadFile(path)
+	bs[10*(deltaFrameHeaderSize+9)+deltaFrameHeaderSize] ^= 0xff
+	ioutil.WriteFile(path, bs, 0660)
+	if n, truncated := read(); n != 10 || !truncated {
+		t.Errorf("Expected 10 items of a corrupt file, got %d (truncated %v)", n, truncated)
+	}
+}
+
+func TestSetDeltaInterleaving(t *testing.T) {
+	db := New()
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("item-%04d", i)))
+	}
+
+	for _, enable := range []bool{true, false} {
+		db.SetDeltaInterleaving(enable)
+		if db.DeltaInterleaving() != enable {
+			t.Errorf("Expected delta interleaving %v", enable)
+		}
+
+		dir := t.TempDir()
+		snap, _ := db.NewSnapshot()
+		if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		dm, err := DumpInfo(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(dm.DeltaShards) > 0) != enable {
+			t.Errorf("Expected delta shards %v, got %d", enable, len(dm.DeltaShards))
+		}
+
+		// Instances without delta interleaving restore the delta shards
+		db2 := New()
+		snap2, err := db2.LoadFromDisk(dir, 4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snap2.Count() != 1000 {
+			t.Errorf("Expected 1000 items, got %d", snap2.Count())
+		}
+		snap2.Close()
+		db2.Close()
+	}
 }
 
 func TestExecuteConcurrGCWorkers(t *testing.T) {
@@ -895,6 +1076,43 @@ func TestCloseWithActiveIterators(t *testing.T) {
 
 }
 
+func TestCloseTimeout(t *testing.T) {
+	db := NewWithConfig(testConf)
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := w.NewSnapshot()
+	itr := snap.NewIterator()
+	snap.Close()
+
+	if err := db.CloseTimeout(10 * time.Millisecond); err != ErrCloseTimeout {
+		t.Fatalf("Expected ErrCloseTimeout, got %v", err)
+	}
+
+	// The instance is still usable after a timeout
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		count := 0
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			count++
+		}
+		time.Sleep(50 * time.Millisecond)
+		itr.Close()
+		if count != 10000 {
+			t.Errorf("Expected 10000 items, got %d", count)
+		}
+	}()
+
+	if err := db.CloseTimeout(10 * time.Second); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	wg.Wait()
+}
+
 func TestSimpleGet(t *testing.T) {
 	db := NewWithConfig(testConf)
 	w := db.NewWriter()
@@ -922,3 +1140,2373 @@ func TestSimpleGet(t *testing.T) {
 		}
 	}
 }
+
+func TestDelete2(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	key := []byte(fmt.Sprintf("%010d", 1))
+	w.Put(key)
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	n := w.Delete2(key)
+	if n == nil {
+		t.Errorf("Expected deleted node")
+	} else if got := string((*Item)(n.Item()).Bytes()); got != string(key) {
+		t.Errorf("Expected %s, got %s", string(key), got)
+	}
+
+	if n := w.Delete2(key); n != nil {
+		t.Errorf("Expected nil node for already deleted item")
+	}
+
+	if n := w.Delete2([]byte("missing")); n != nil {
+		t.Errorf("Expected nil node for non-existent item")
+	}
+}
+
+func TestItemCallbacks(t *testing.T) {
+	var inserts, deletes int
+	conf := testConf
+	conf.OnItemInsert(func(e *ItemEntry) {
+		if e.Node() == nil || e.Item() == nil {
+			t.Errorf("Expected item entry with node")
+		}
+		inserts++
+	})
+	var lastDeleted string
+	conf.OnItemDelete(func(e *ItemEntry) {
+		lastDeleted = string(e.Item().Bytes())
+		deletes++
+	})
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	// Duplicates should not be reported
+	w.Put([]byte(fmt.Sprintf("%010d", 0)))
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	for i := 0; i < 40; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	w.Delete([]byte("missing"))
+
+	// Delete of an item inserted within the current snapshot
+	w.Put([]byte("current"))
+	w.Delete([]byte("current"))
+	if lastDeleted != "current" {
+		t.Errorf("Expected delete callback for current, got %s", lastDeleted)
+	}
+
+	// Delete marker for a non-existent item
+	w.DeleteNonExist([]byte("marker"))
+
+	if inserts != 101 {
+		t.Errorf("Expected 101 inserts, got %d", inserts)
+	}
+
+	if deletes != 42 {
+		t.Errorf("Expected 42 deletes, got %d", deletes)
+	}
+}
+
+func TestUpdateInPlace(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(a[:4], b[:4])
+	})
+
+	var inserted, deleted string
+	conf.OnItemInsert(func(e *ItemEntry) {
+		inserted = string(e.Item().Bytes())
+	})
+	conf.OnItemDelete(func(e *ItemEntry) {
+		deleted = string(e.Item().Bytes())
+	})
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("key1val1"))
+	if !w.UpdateInPlace([]byte("key1"), []byte("key1val2")) {
+		t.Errorf("Expected in-place update")
+	}
+
+	if w.UpdateInPlace([]byte("key1"), []byte("key1value3")) {
+		t.Errorf("Expected size mismatch to fail")
+	}
+
+	if deleted != "key1val1" || inserted != "key1val2" {
+		t.Errorf("Expected callbacks for key1val1 -> key1val2, got %s -> %s", deleted, inserted)
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	itr.SeekFirst()
+	if got := string(itr.Get()); got != "key1val2" {
+		t.Errorf("Expected key1val2, got %s", got)
+	}
+
+	if w.UpdateInPlace([]byte("key1"), []byte("key1val4")) {
+		t.Errorf("Expected update of snapshotted item to fail")
+	}
+
+	if got := string(itr.Get()); got != "key1val2" {
+		t.Errorf("Expected snapshot to be unchanged, got %s", got)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(a[:4], b[:4])
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	if _, replaced := w.Upsert([]byte("key1val1")); replaced {
+		t.Errorf("Expected insert of new item")
+	}
+
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	old, replaced := w.Upsert([]byte("key1val2"))
+	if !replaced || string(old) != "key1val1" {
+		t.Errorf("Expected key1val1 to be replaced, got %s", string(old))
+	}
+
+	old, replaced = w.Upsert([]byte("key1val3"))
+	if !replaced || string(old) != "key1val2" {
+		t.Errorf("Expected key1val2 to be replaced, got %s", string(old))
+	}
+
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	for snap, exp := range map[*Snapshot]string{snap1: "key1val1", snap2: "key1val3"} {
+		itr := snap.NewIterator()
+		count := 0
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if got := string(itr.Get()); got != exp {
+				t.Errorf("Expected %s, got %s", exp, got)
+			}
+			count++
+		}
+		itr.Close()
+
+		if count != 1 {
+			t.Errorf("Expected 1 item, got %d", count)
+		}
+	}
+}
+
+func TestUpsertConcurrent(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(a[:4], b[:4])
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(w *Writer, id int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				w.Upsert([]byte(fmt.Sprintf("key1%02d%04d", id, j)))
+			}
+		}(db.NewWriter(), i)
+	}
+	wg.Wait()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	if count := snap.Count(); count != 1 {
+		t.Errorf("Expected 1 item, got %d", count)
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("a-%05d", i)))
+		w.Put([]byte(fmt.Sprintf("b-%05d", i)))
+	}
+
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 1000; i < 1100; i++ {
+		w.Put([]byte(fmt.Sprintf("a-%05d", i)))
+	}
+
+	if n, err := w.DeletePrefix([]byte("a-")); err != nil || n != 1100 {
+		t.Errorf("Expected 1100 deleted items, got %d (%v)", n, err)
+	}
+
+	if n, _ := w.DeletePrefix([]byte("a-")); n != 0 {
+		t.Errorf("Expected 0 deleted items, got %d", n)
+	}
+
+	// Re-insert of unlinked items within the same snapshot
+	for i := 1000; i < 1100; i++ {
+		w.Put([]byte(fmt.Sprintf("a-%05d", i)))
+	}
+	if n, _ := w.DeletePrefix([]byte("a-01")); n != 100 {
+		t.Errorf("Expected 100 deleted items, got %d", n)
+	}
+
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	VerifyCount(snap1, 2000, t)
+	VerifyCount(snap2, 1000, t)
+}
+
+func TestDeleteRange(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put(key(i))
+	}
+
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	// Items of the snapshot are tombstoned, newer items are unlinked
+	for i := 1000; i < 1100; i++ {
+		w.Put(key(i))
+	}
+	if n, err := w.DeleteRange(key(900), key(1050)); err != nil || n != 150 {
+		t.Errorf("Expected 150 deleted items, got %d (%v)", n, err)
+	}
+	if n, _ := w.DeleteRange(key(900), key(1050)); n != 0 {
+		t.Errorf("Expected 0 deleted items, got %d", n)
+	}
+	if n, _ := w.DeleteRange(nil, key(100)); n != 100 {
+		t.Errorf("Expected 100 deleted items, got %d", n)
+	}
+	if n, _ := w.DeleteRange(key(1060), nil); n != 40 {
+		t.Errorf("Expected 40 deleted items, got %d", n)
+	}
+
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	VerifyCount(snap1, 1000, t)
+	VerifyCount(snap2, 810, t)
+	if _, ok := snap2.Get(key(1055)); !ok {
+		t.Errorf("Expected items after the range to remain")
+	}
+}
+
+func TestSnapshotRange(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	var got []string
+	snap.Range([]byte(fmt.Sprintf("%010d", 100)), []byte(fmt.Sprintf("%010d", 200)),
+		func(itm []byte) bool {
+			got = append(got, string(itm))
+			return true
+		})
+
+	if len(got) != 100 || got[0] != fmt.Sprintf("%010d", 100) ||
+		got[99] != fmt.Sprintf("%010d", 199) {
+		t.Errorf("Unexpected range result of %d items", len(got))
+	}
+
+	count := 0
+	snap.Range(nil, nil, func(itm []byte) bool {
+		count++
+		return count < 10
+	})
+
+	if count != 10 {
+		t.Errorf("Expected early exit after 10 items, got %d", count)
+	}
+}
+
+func TestParallelRange(t *testing.T) {
+	const n = 10000
+	var wg sync.WaitGroup
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	wg.Add(1)
+	doInsert(db, &wg, n, false, false)
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	start := make([]byte, 8)
+	end := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, 100)
+	binary.BigEndian.PutUint64(end, 9100)
+
+	var counts [8]int64
+	var sum int64
+	snap.ParallelRange(start, end, 8, func(itm []byte, partition int) bool {
+		atomic.AddInt64(&sum, int64(binary.BigEndian.Uint64(itm)))
+		atomic.AddInt64(&counts[partition], 1)
+		return true
+	})
+
+	total := int64(0)
+	for _, c := range counts {
+		total += c
+	}
+
+	if total != 9000 {
+		t.Errorf("Expected 9000 items, got %d", total)
+	}
+
+	if exp := int64((100 + 9099) * 9000 / 2); sum != exp {
+		t.Errorf("Expected sum %d, got %d", exp, sum)
+	}
+
+	if counts[1] == 0 {
+		t.Errorf("Expected range to be partitioned")
+	}
+}
+
+func TestStoreToWriter(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	var buf bytes.Buffer
+	if err := db.StoreToWriter(snap, &buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("trailer")
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	w2 := db2.NewWriter()
+	w2.Put([]byte(fmt.Sprintf("%010d", 0)))
+
+	r := bufio.NewReader(&buf)
+	n, err := db2.LoadFromReader(r, w2, func(itm []byte) bool {
+		return itm[9]%2 == 0
+	})
+	if err != nil || n != 500 {
+		t.Fatalf("Expected 500 items loaded, got %d, %v", n, err)
+	}
+
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "trailer" {
+		t.Errorf("Expected the stream to end before the trailer, got %q", rest)
+	}
+
+	snap2, _ := db2.NewSnapshot()
+	defer snap2.Close()
+	if c := snap2.Count(); c != 500 {
+		t.Errorf("Expected 500 items, got %d", c)
+	}
+
+	if _, err := db2.LoadFromReader(strings.NewReader("x"), w2, nil); err != ErrInvalidStream {
+		t.Errorf("Expected ErrInvalidStream, got %v", err)
+	}
+}
+
+func TestApplyOpsDelete(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	apply := func(fn func(w *Writer)) {
+		tdb := NewWithConfig(DefaultConfig())
+		defer tdb.Close()
+		fn(tdb.NewWriter())
+		snap, _ := tdb.NewSnapshot()
+		defer snap.Close()
+		if _, err := db.ApplyOps(snap, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apply(func(w *Writer) {
+		for i := 0; i < 100; i++ {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+	})
+
+	apply(func(w *Writer) {
+		for i := 0; i < 200; i += 2 {
+			w.DeleteNonExist([]byte(fmt.Sprintf("%010d", i)))
+		}
+	})
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	it := snap.NewIterator()
+	defer it.Close()
+
+	i := 1
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		if exp := fmt.Sprintf("%010d", i); string(it.Get()) != exp {
+			t.Fatalf("Expected %s, got %s", exp, it.Get())
+		}
+		i += 2
+	}
+
+	if i != 101 {
+		t.Errorf("Expected 50 items, got %d", (i-1)/2)
+	}
+}
+
+func TestBlockStoreLargeItems(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	item := func(i int) []byte {
+		bs := []byte(fmt.Sprintf("%010d", i))
+		if i%10 == 0 {
+			bs = append(bs, bytes.Repeat([]byte{byte(i)}, defaultBlockSize*(1+i%3)+i)...)
+		}
+		return bs
+	}
+
+	apply := func(fn func(w *Writer)) {
+		tdb := NewWithConfig(DefaultConfig())
+		defer tdb.Close()
+		fn(tdb.NewWriter())
+		snap, _ := tdb.NewSnapshot()
+		defer snap.Close()
+		if _, err := db.ApplyOps(snap, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	verify := func(exp []int) {
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		it := snap.NewIterator()
+		defer it.Close()
+
+		i := 0
+		for it.SeekFirst(); it.Valid(); it.Next() {
+			if i >= len(exp) || !bytes.Equal(it.Get(), item(exp[i])) {
+				t.Fatalf("Unexpected item %d of %d bytes", i, len(it.Get()))
+			}
+			i++
+		}
+
+		if i != len(exp) {
+			t.Errorf("Expected %d items, got %d", len(exp), i)
+		}
+	}
+
+	var exp []int
+	apply(func(w *Writer) {
+		for i := 0; i < 200; i += 2 {
+			w.Put(item(i))
+			exp = append(exp, i)
+		}
+	})
+	verify(exp)
+
+	// Interleave new items, so that blocks holding large items are rewritten
+	exp = exp[:0]
+	apply(func(w *Writer) {
+		for i := 1; i < 200; i += 2 {
+			w.Put(item(i))
+		}
+	})
+	for i := 0; i < 200; i++ {
+		exp = append(exp, i)
+	}
+	verify(exp)
+}
+
+// failingBlockManager fails the block reads once fail is set and returns
+// blocks with an invalid entry length once corrupt is set
+type failingBlockManager struct {
+	BlockManager
+	fail    int32
+	corrupt int32
+}
+
+var errReadBlock = fmt.Errorf("read failed")
+
+func (bm *failingBlockManager) ReadBlock(bptr blockPtr, buf []byte) error {
+	if atomic.LoadInt32(&bm.fail) == 1 {
+		return errReadBlock
+	}
+
+	err := bm.BlockManager.ReadBlock(bptr, buf)
+	if atomic.LoadInt32(&bm.corrupt) == 1 {
+		binary.BigEndian.PutUint16(buf[0:2], uint16(len(buf)))
+	}
+	return err
+}
+
+func TestBlockStoreReadError(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	src := &sliceSource{}
+	for i := 0; i < 10000; i++ {
+		src.items = append(src.items, []byte(fmt.Sprintf("key-%010d", i)))
+	}
+	if _, err := db.IngestSorted(src, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	bm := &failingBlockManager{BlockManager: db.bm}
+	db.bm = bm
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	it := snap.NewIterator()
+	defer it.Close()
+
+	count := 0
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		if count++; count == 5000 {
+			atomic.StoreInt32(&bm.fail, 1)
+		}
+	}
+
+	if it.Err() != errReadBlock || count >= 10000 {
+		t.Errorf("Expected the read error to end the iteration, got %v after %d items", it.Err(), count)
+	}
+
+	if err := db.StoreToWriter(snap, ioutil.Discard); err != errReadBlock {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+
+	// Seek retries the read
+	atomic.StoreInt32(&bm.fail, 0)
+	it.Seek([]byte("key-0000009000"))
+	if !it.Valid() || it.Err() != nil || string(it.Get()) != "key-0000009000" {
+		t.Errorf("Expected the iterator to recover, got %v", it.Err())
+	}
+
+	atomic.StoreInt32(&bm.corrupt, 1)
+	it.SeekFirst()
+	if it.Valid() || it.Err() != ErrBlockCorrupt {
+		t.Errorf("Expected ErrBlockCorrupt, got %v", it.Err())
+	}
+
+	if err := snap.Range(nil, nil, func([]byte) bool { return true }); err != ErrBlockCorrupt {
+		t.Errorf("Expected ErrBlockCorrupt, got %v", err)
+	}
+	if err := snap.ParallelRange(nil, nil, 4, func([]byte, int) bool { return true }); err != ErrBlockCorrupt {
+		t.Errorf("Expected ErrBlockCorrupt, got %v", err)
+	}
+	if _, err := snap.Checksum(); err != ErrBlockCorrupt {
+		t.Errorf("Expected ErrBlockCorrupt, got %v", err)
+	}
+	if _, err := snap.MerkleTree(4); err != ErrBlockCorrupt {
+		t.Errorf("Expected ErrBlockCorrupt, got %v", err)
+	}
+	atomic.StoreInt32(&bm.corrupt, 0)
+}
+
+func TestSnapshotClosedError(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	db.NewWriter().Put([]byte("item"))
+	snap, _ := db.NewSnapshot()
+	snap.Close()
+
+	// The instance releases its reference with the next snapshot
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	if it, err := snap.OpenIterator(); it != nil || err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got %v", err)
+	}
+	if err := snap.Range(nil, nil, func([]byte) bool { return true }); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got %v", err)
+	}
+	if itms, err := snap.MultiGet([][]byte{[]byte("item")}); itms != nil || err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got %v", err)
+	}
+}
+
+func TestOutOfMemory(t *testing.T) {
+	if !skiplist.MemoryMgmtSupported {
+		t.Skip("memory management is not supported")
+	}
+
+	// Fails the allocation after skip successful ones
+	var skip, failing int32
+	malloc := func(sz int) unsafe.Pointer {
+		if atomic.LoadInt32(&failing) == 1 && atomic.AddInt32(&skip, -1) < 0 {
+			atomic.StoreInt32(&failing, 0)
+			return nil
+		}
+		return mm.Malloc(sz)
+	}
+	failAfter := func(n int32) {
+		atomic.StoreInt32(&skip, n)
+		atomic.StoreInt32(&failing, 1)
+	}
+
+	var pressure []error
+	conf := testConf
+	conf.UseMemoryMgmt(malloc, mm.Free)
+	conf.OnMemoryPressure(func(err error) {
+		pressure = append(pressure, err)
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+
+	// Item and node allocation failures
+	for i := int32(0); i < 2; i++ {
+		failAfter(i)
+		if err := w.TryPut([]byte("item")); err != ErrOutOfMemory {
+			t.Errorf("Expected ErrOutOfMemory, got %v", err)
+		}
+	}
+
+	failAfter(0)
+	w.Put([]byte("item"))
+	w.Put([]byte("item"))
+	failAfter(0)
+	if _, replaced := w.Upsert([]byte("item2")); replaced {
+		t.Errorf("Expected no item to be replaced")
+	}
+	if len(pressure) != 2 || pressure[0] != ErrOutOfMemory || pressure[1] != ErrOutOfMemory {
+		t.Errorf("Expected two memory pressure callbacks, got %v", pressure)
+	}
+
+	snap, _ := db.NewSnapshot()
+	if CountItems(snap) != 1 || snap.Count() != 1 {
+		t.Errorf("Expected only one item to be inserted, got %d", CountItems(snap))
+	}
+	snap.Close()
+
+	conf.OnMemoryPressure(nil)
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	defer func() {
+		if r := recover(); r != ErrOutOfMemory {
+			t.Errorf("Expected a panic with ErrOutOfMemory, got %v", r)
+		}
+	}()
+	failAfter(0)
+	db2.NewWriter().Put([]byte("item"))
+}
+
+func TestPutOwned(t *testing.T) {
+	for _, conf := range []Config{testConf, DefaultConfig()} {
+		db := NewWithConfig(conf)
+		w := db.NewWriter()
+		n := 1000
+		for i := 0; i < n; i++ {
+			buf := w.NewItemBuffer(32)
+			l := copy(buf, fmt.Sprintf("%010d", i))
+			w.PutOwned(buf[:l])
+		}
+
+		// Existing items are kept and the buffer is freed
+		buf := w.NewItemBuffer(10)
+		copy(buf, fmt.Sprintf("%010d", 0))
+		w.PutOwned(buf)
+
+		snap, _ := db.NewSnapshot()
+		if got := CountItems(snap); got != n {
+			t.Errorf("Expected %d items, got %d", n, got)
+		}
+		itr := snap.NewIterator()
+		i := 0
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+				t.Errorf("Expected %s, got %s", exp, itr.Get())
+			}
+			i++
+		}
+		itr.Close()
+		snap.Close()
+		db.Close()
+	}
+}
+
+func TestMaxItemSize(t *testing.T) {
+	conf := testConf
+	for _, sz := range []int{0, -1} {
+		if err := conf.SetMaxItemSize(sz); err != ErrInvalidItemSize {
+			t.Errorf("Expected ErrInvalidItemSize for %d, got %v", sz, err)
+		}
+	}
+
+	max := 1 << 20
+	conf.SetMaxItemSize(max)
+	db := NewWithConfig(conf)
+	defer db.Close()
+	if db.MaxItemSize() != max {
+		t.Errorf("Expected max item size %d, got %d", max, db.MaxItemSize())
+	}
+
+	big := bytes.Repeat([]byte{1}, max)
+	w := db.NewWriter()
+	if err := w.TryPut(append(big, 1)); err != ErrItemTooLarge {
+		t.Errorf("Expected ErrItemTooLarge, got %v", err)
+	}
+	if err := w.TryPut(big); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != ErrItemTooLarge {
+				t.Errorf("Expected a panic with ErrItemTooLarge, got %v", r)
+			}
+		}()
+		w.Put(append(big, 2))
+	}()
+
+	// Items up to the limit span several blocks of a block store
+	bconf := conf
+	bconf.SetBlockStoreDir(t.TempDir())
+	bdb := NewWithConfig(bconf)
+	defer bdb.Close()
+
+	snap, _ := db.NewSnapshot()
+	if _, err := bdb.ApplyOps(snap, 1); err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+
+	bsnap, _ := bdb.NewSnapshot()
+	itr, _ := bsnap.OpenIterator()
+	itr.SeekFirst()
+	if !itr.Valid() || !bytes.Equal(itr.Get(), big) {
+		t.Errorf("Expected the largest item in the block store")
+	}
+	itr.Close()
+	bsnap.Close()
+
+	// Larger items of other instances cannot be applied
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	tdb.NewWriter().Put(append(big, 3))
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+	if _, err := bdb.ApplyOps(tsnap, 1); err != ErrItemTooLarge {
+		t.Errorf("Expected ErrItemTooLarge, got %v", err)
+	}
+}
+
+// countingBlockManager counts the block reads
+type countingBlockManager struct {
+	BlockManager
+	reads int64
+}
+
+func (bm *countingBlockManager) ReadBlock(bptr blockPtr, buf []byte) error {
+	atomic.AddInt64(&bm.reads, 1)
+	return bm.BlockManager.ReadBlock(bptr, buf)
+}
+
+func TestIteratorReader(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+	conf.SetBlockSize(1024)
+
+	large := make([]byte, 100000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	large[0] = 'b'
+	items := [][]byte{[]byte("a"), large, []byte("c")}
+
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	for _, itm := range items {
+		w.Put(itm)
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	if _, err := db.ApplyOps(tsnap, 1); err != nil {
+		t.Fatal(err)
+	}
+	bm := &countingBlockManager{BlockManager: db.bm}
+	db.bm = bm
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	it := snap.NewIterator()
+	defer it.Close()
+	it.SetStreamLargeItems(true)
+
+	var readers []*ItemReader
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		readers = append(readers, it.Reader())
+	}
+	if reads := atomic.LoadInt64(&bm.reads); reads > 2 {
+		t.Errorf("Expected only data blocks to be read, got %d reads", reads)
+	}
+
+	if len(readers) != len(items) {
+		t.Fatalf("Expected %d items, got %d", len(items), len(readers))
+	}
+	for i, r := range readers {
+		data, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(data, items[i]) || r.Size() != int64(len(items[i])) {
+			t.Errorf("Unexpected item %d (%v)", i, err)
+		}
+	}
+
+	r := readers[1]
+	for _, off := range []int64{99990, 5, 50000, 1015, 0} {
+		buf := make([]byte, 20)
+		n, err := r.ReadAt(buf, off)
+		exp := large[off:]
+		if len(exp) > len(buf) {
+			exp = exp[:len(buf)]
+		}
+		if !bytes.Equal(buf[:n], exp) || (n < len(buf)) != (err == io.EOF) {
+			t.Errorf("Unexpected read at %d: %d bytes (%v)", off, n, err)
+		}
+	}
+
+	it.Seek(large[:1])
+	if !it.Valid() || !bytes.Equal(it.Get(), large) {
+		t.Errorf("Expected Seek to return the large item")
+	}
+}
+
+func TestBlockStoreBlockSize(t *testing.T) {
+	conf := testConf
+	for _, sz := range []int{0, 256, 1000, 65536} {
+		if err := conf.SetBlockSize(sz); err != ErrInvalidBlockSize {
+			t.Errorf("Expected ErrInvalidBlockSize for %d, got %v", sz, err)
+		}
+	}
+
+	dir := t.TempDir()
+	conf.SetBlockStoreDir(dir)
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+
+	if err := conf.SetBlockSize(1024); err != nil {
+		t.Fatal(err)
+	}
+
+	db := NewWithConfig(conf)
+	tdb := NewWithConfig(DefaultConfig())
+	w := tdb.NewWriter()
+	n := 1000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	// One item spanning several blocks
+	w.Put(append([]byte("z"), bytes.Repeat([]byte{1}, 4000)...))
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 1); err != nil {
+		t.Fatal(err)
+	}
+	tsnap.Close()
+	tdb.Close()
+
+	snap, _ := db.NewSnapshot()
+	it := snap.NewIterator()
+	count := 0
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		if count < n && string(it.Get()) != fmt.Sprintf("%010d", count) {
+			t.Errorf("Unexpected item %s", it.Get())
+		}
+		count++
+	}
+	it.Close()
+	snap.Close()
+	db.Close()
+
+	if count != n+1 {
+		t.Errorf("Expected %d items, got %d", n+1, count)
+	}
+
+	conf.SetBlockSize(2048)
+	if _, err := newFileBlockManager(conf.storageShards, dir, conf.blockSize, nil); err == nil {
+		t.Errorf("Expected block size mismatch error")
+	}
+
+	if _, err := newFileBlockManager(conf.storageShards, dir, 1024, nil); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestBlockStoreIteratorBuffers(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+	conf.UsePooledBlockBuffers()
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	tdb := NewWithConfig(testConf)
+	w := tdb.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 2); err != nil {
+		t.Fatal(err)
+	}
+	tsnap.Close()
+	tdb.Close()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	// Short-lived iterators share the block buffers of the closed ones
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				key := []byte(fmt.Sprintf("%010d", rnd.Intn(n)))
+				it := snap.NewIterator()
+				it.Seek(key)
+				if !it.Valid() || !bytes.Equal(it.Get(), key) {
+					t.Errorf("Expected %s, got %s", key, it.Get())
+				}
+				it.Close()
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+}
+
+func TestBlockStoreIteratorItemAfterClose(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	tdb := NewWithConfig(testConf)
+	w := tdb.NewWriter()
+	n := 1000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 2); err != nil {
+		t.Fatal(err)
+	}
+	tsnap.Close()
+	tdb.Close()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	// Without pooled block buffers, items remain valid after their iterator
+	// is closed
+	it := snap.NewIterator()
+	it.SeekFirst()
+	itm := it.Get()
+	it.Close()
+	for i := 0; i < 100; i++ {
+		it := snap.NewIterator()
+		it.Seek([]byte(fmt.Sprintf("%010d", n-1-i)))
+		it.Close()
+	}
+
+	if expected := fmt.Sprintf("%010d", 0); string(itm) != expected {
+		t.Errorf("Expected %s, got %s", expected, itm)
+	}
+}
+
+func TestBlockStoreWriteBuffer(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+	conf.UseWriteBuffer(8 * defaultBlockSize)
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	item := func(i int) []byte {
+		bs := []byte(fmt.Sprintf("%010d", i))
+		if i%100 == 0 {
+			bs = append(bs, bytes.Repeat([]byte{byte(i)}, 3*defaultBlockSize)...)
+		}
+		return bs
+	}
+
+	n := 20000
+	tdb := NewWithConfig(DefaultConfig())
+	w := tdb.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put(item(i))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 4); err != nil {
+		t.Fatal(err)
+	}
+	tsnap.Close()
+	tdb.Close()
+
+	verify := func() {
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		it := snap.NewIterator()
+		defer it.Close()
+
+		i := 0
+		for it.SeekFirst(); it.Valid(); it.Next() {
+			if !bytes.Equal(it.Get(), item(i)) {
+				t.Fatalf("Unexpected item %d of %d bytes", i, len(it.Get()))
+			}
+			i++
+		}
+
+		if i != n {
+			t.Errorf("Expected %d items, got %d", n, i)
+		}
+	}
+
+	verify()
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	wb := db.bm.(*writeBuffer)
+	for i := range wb.shards {
+		if len(wb.shards[i].pending) != 0 {
+			t.Errorf("Shard %d has %d unflushed blocks", i, len(wb.shards[i].pending))
+		}
+	}
+
+	// All blocks have to be readable from the files
+	db.bm = wb.fbm
+	verify()
+	db.bm = wb
+}
+
+func TestBlockStoreEncryption(t *testing.T) {
+	for _, wbuf := range []int{0, 8 * defaultBlockSize} {
+		conf := testConf
+		dir := t.TempDir()
+		conf.SetBlockStoreDir(dir)
+		if !conf.HasBlockStore() {
+			t.Skip("block store is not supported")
+		}
+
+		kp := &StaticKeyProvider{
+			Current: "k1",
+			Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+		}
+		conf.SetBlockStoreEncryption(kp)
+		conf.UseWriteBuffer(wbuf)
+		db := NewWithConfig(conf)
+
+		item := func(i int) []byte {
+			bs := []byte(fmt.Sprintf("secret-%010d", i))
+			if i%100 == 0 {
+				bs = append(bs, bytes.Repeat([]byte{byte(i)}, 2*defaultBlockSize)...)
+			}
+			return bs
+		}
+
+		apply := func(start, end int) {
+			tdb := NewWithConfig(DefaultConfig())
+			defer tdb.Close()
+			w := tdb.NewWriter()
+			for i := start; i < end; i++ {
+				w.Put(item(i))
+			}
+			tsnap, _ := tdb.NewSnapshot()
+			defer tsnap.Close()
+			if _, err := db.ApplyOps(tsnap, 4); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		verify := func(n int) {
+			snap, _ := db.NewSnapshot()
+			defer snap.Close()
+			it := snap.NewIterator()
+			defer it.Close()
+
+			i := 0
+			for it.SeekFirst(); it.Valid(); it.Next() {
+				if !bytes.Equal(it.Get(), item(i)) {
+					t.Fatalf("Unexpected item %d of %d bytes", i, len(it.Get()))
+				}
+				i++
+			}
+
+			if i != n {
+				t.Errorf("Expected %d items, got %d", n, i)
+			}
+		}
+
+		apply(0, 5000)
+		verify(5000)
+
+		kp.Current = "k2"
+		kp.Keys["k2"] = bytes.Repeat([]byte{2}, 32)
+		if err := db.RotateBlockStoreKeys(); err != nil {
+			t.Fatal(err)
+		}
+
+		apply(5000, 10000)
+		verify(10000)
+
+		// Blocks encrypted with retired keys are rewritten
+		if err := db.CompactBlockStore(0); err != nil {
+			t.Fatal(err)
+		}
+		if sts := db.BlockStoreStats(); sts.BlocksRelocated == 0 {
+			t.Errorf("Expected blocks to be re-encrypted")
+		}
+		verify(10000)
+
+		// Retired keys are dropped once the relocated blocks are freed
+		bc := db.fileBlockManager().cipher
+		for i := 0; ; i++ {
+			retired := false
+			for shard := range bc.files {
+				retired = retired || bc.hasRetiredKeys(shard)
+			}
+
+			if !retired {
+				break
+			} else if i == 1000 {
+				t.Fatalf("Expected no blocks with retired keys")
+			}
+			verify(10000)
+			time.Sleep(time.Millisecond)
+		}
+
+		for _, fk := range bc.files {
+			fk.RLock()
+			if len(fk.aeads) != 1 || len(fk.meta.Keys) != 1 {
+				t.Errorf("Expected retired keys of %s to be dropped, got %d", fk.path, len(fk.aeads))
+			}
+			fk.RUnlock()
+		}
+
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		files, _ := filepath.Glob(filepath.Join(dir, "blockstore-*.data"))
+		for _, f := range files {
+			bs, _ := ioutil.ReadFile(f)
+			if bytes.Contains(bs, []byte("secret-")) {
+				t.Errorf("%s contains plaintext", f)
+			}
+		}
+
+		// The data keys are only wrapped by the current master key
+		delete(kp.Keys, "k1")
+		fbm, err := newFileBlockManager(conf.storageShards, dir, conf.blockSize, kp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bm := db.bm
+		db.bm = fbm
+		verify(10000)
+		db.bm = bm
+		db.Close()
+
+		if _, err := newFileBlockManager(conf.storageShards, dir, conf.blockSize, nil); err == nil {
+			t.Errorf("Expected error for encrypted block store without key provider")
+		}
+
+		kp.Keys["k2"] = bytes.Repeat([]byte{3}, 32)
+		if _, err := newFileBlockManager(conf.storageShards, dir, conf.blockSize, kp); err == nil {
+			t.Errorf("Expected error for wrong master key")
+		}
+	}
+}
+
+func TestBlockStoreCompaction(t *testing.T) {
+	conf := testConf
+	dir := t.TempDir()
+	conf.SetBlockStoreDir(dir)
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	item := func(i int) []byte {
+		bs := []byte(fmt.Sprintf("%010d-", i))
+		bs = append(bs, bytes.Repeat([]byte{'x'}, 80)...)
+		if i%1000 == 0 {
+			bs = append(bs, bytes.Repeat([]byte{byte(i)}, 2*defaultBlockSize)...)
+		}
+		return bs
+	}
+
+	var exp []int
+	apply := func(start, end int) {
+		tdb := NewWithConfig(DefaultConfig())
+		defer tdb.Close()
+		w := tdb.NewWriter()
+		for i := start; i < end; i += 2 {
+			w.Put(item(i))
+			exp = append(exp, i)
+		}
+		sort.Ints(exp)
+		tsnap, _ := tdb.NewSnapshot()
+		defer tsnap.Close()
+		if _, err := db.ApplyOps(tsnap, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Blocks of replaced index nodes are deleted by the free workers
+	waitFree := func() {
+		for i := 0; i < 50; i++ {
+			snap, _ := db.NewSnapshot()
+			snap.Close()
+			db.GC()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	verify := func() {
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		it := snap.NewIterator()
+		defer it.Close()
+
+		i := 0
+		for it.SeekFirst(); it.Valid(); it.Next() {
+			if i >= len(exp) || !bytes.Equal(it.Get(), item(exp[i])) {
+				t.Fatalf("Unexpected item %d of %d bytes", i, len(it.Get()))
+			}
+			i++
+		}
+
+		if i != len(exp) {
+			t.Errorf("Expected %d items, got %d", len(exp), i)
+		}
+	}
+
+	n := 20000
+	apply(0, n)
+	waitFree()
+	verify()
+
+	// Interleave items into the first half, its blocks are rewritten at the
+	// end of the file
+	apply(1, n/2)
+	waitFree()
+	verify()
+	sts := db.BlockStoreStats().Files[0]
+	if sts.LiveRatio() > 0.8 {
+		t.Fatalf("Expected fragmentation, got %+v", sts)
+	}
+	live := sts.Blocks - sts.FreeBlocks
+
+	if !strings.Contains(db.DumpStats(), "block_store_fragmentation") {
+		t.Errorf("Expected fragmentation in stats")
+	}
+
+	if err := db.CompactBlockStore(0.8); err != nil {
+		t.Fatal(err)
+	}
+	waitFree()
+	verify()
+
+	sts = db.BlockStoreStats().Files[0]
+	if sts.Blocks > live+live/10 {
+		t.Errorf("Expected the file to shrink to about %d blocks, got %+v", live, sts)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "blockstore-0.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() > sts.Blocks*defaultBlockSize {
+		t.Errorf("Expected file size up to %d, got %d", sts.Blocks*defaultBlockSize, fi.Size())
+	}
+
+	if sts := db.BlockStoreStats(); sts.Compactions != 1 || sts.BlocksRelocated == 0 {
+		t.Errorf("Unexpected stats %+v", sts)
+	}
+}
+
+func TestBlockStoreCompactionSnapshot(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	// Snapshots are not created while a compaction modifies the index
+	db.compactor.Lock()
+	done := make(chan struct{})
+	go func() {
+		snap, _ := db.NewSnapshot()
+		snap.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Expected NewSnapshot to wait for the compaction")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	db.compactor.Unlock()
+	<-done
+}
+
+func TestLoadProgress(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db.dump")
+	db := NewWithConfig(DefaultConfig())
+	w := db.NewWriter()
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	var mu sync.Mutex
+	var last LoadProgress
+	shardItems := make(map[int]int64)
+	db = NewWithConfig(DefaultConfig())
+	snap, err := db.LoadFromDisk(dir, 4, func(e *ItemEntry) {
+		p, ok := e.Progress()
+		if !ok {
+			t.Errorf("Expected load progress")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if p.Shard != e.Shard() || p.ShardItems <= shardItems[p.Shard] {
+			t.Errorf("Unexpected shard progress %v", p)
+		}
+		shardItems[p.Shard] = p.ShardItems
+		if p.Items > last.Items {
+			last = p
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+	db.Close()
+
+	if last.Items != int64(n) || last.Completion() != 1 || last.TotalBytes == 0 {
+		t.Errorf("Unexpected final progress %v", last)
+	}
+
+	db = NewWithConfig(DefaultConfig())
+	defer db.Close()
+	var count int64
+	_, err = db.LoadFromDisk(dir, 4, func(e *ItemEntry) {
+		if atomic.AddInt64(&count, 1) == 100 {
+			e.Abort()
+		}
+	})
+	if err != ErrLoadAborted {
+		t.Errorf("Expected ErrLoadAborted, got %v", err)
+	}
+
+	if count >= int64(n) {
+		t.Errorf("Expected the load to stop early, restored %d items", count)
+	}
+}
+
+func TestLoadAdaptiveConcurrency(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db.dump")
+	db := NewWithConfig(DefaultConfig())
+	w := db.NewWriter()
+	n := 50000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(dir, snap, 8, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = NewWithConfig(DefaultConfig())
+	defer db.Close()
+	snap, err := db.LoadFromDisk(dir, AdaptiveConcurrency, func(e *ItemEntry) {
+		p, _ := e.Progress()
+		if p.Readers < 1 || p.Readers > maxRestoreReaders(8) {
+			t.Errorf("Unexpected number of readers %d", p.Readers)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	if count := CountItems(snap); count != n {
+		t.Errorf("Expected %d items, got %d", n, count)
+	}
+}
+
+func TestLoadFromDiskMerge(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db.dump")
+	item := func(i int, v string) []byte {
+		return []byte(fmt.Sprintf("k:%05d=%s", i, v))
+	}
+
+	// Items are compared by the key before the '='
+	keyCmp := func(a, b []byte) int {
+		return bytes.Compare(a[:bytes.IndexByte(a, '=')], b[:bytes.IndexByte(b, '=')])
+	}
+
+	conf := DefaultConfig()
+	conf.SetKeyComparator(keyCmp)
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put(item(i, "backup"))
+	}
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for _, resolve := range []LoadConflictFn{nil, KeepExisting} {
+		conf := conf
+		conf.SetLoadConflictFn(resolve)
+		db := NewWithConfig(conf)
+		w := db.NewWriter()
+		for i := 500; i < 1500; i++ {
+			w.Put(item(i, "live"))
+		}
+
+		snap, err := db.LoadFromDisk(dir, 4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i := 0
+		snap.Range(nil, nil, func(itm []byte) bool {
+			v := "live"
+			if i < 500 || (i < 1000 && resolve == nil) {
+				v = "backup"
+			}
+
+			if !bytes.Equal(itm, item(i, v)) {
+				t.Errorf("Expected %s, got %s", item(i, v), itm)
+				return false
+			}
+			i++
+			return true
+		})
+
+		if i != 1500 {
+			t.Errorf("Expected 1500 items, got %d", i)
+		}
+
+		snap.Close()
+		db.Close()
+	}
+}
+
+func TestStoreToDiskFiltered(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db.dump")
+	db := NewWithConfig(DefaultConfig())
+	w := db.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	w.Put([]byte("meta:version"))
+
+	var stored int64
+	snap, _ := db.NewSnapshot()
+	err := db.StoreToDiskFiltered(dir, snap, 4, func(e *ItemEntry) bool {
+		bs := e.Item().Bytes()
+		return !bytes.HasPrefix(bs, []byte("meta:")) && bs[len(bs)-1] != '0'
+	}, func(e *ItemEntry) {
+		atomic.AddInt64(&stored, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if stored != int64(n-n/10) {
+		t.Errorf("Expected %d stored items, got %d", n-n/10, stored)
+	}
+
+	db = NewWithConfig(DefaultConfig())
+	defer db.Close()
+	snap, err = db.LoadFromDisk(dir, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	count := 0
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		bs := itr.Get()
+		if bytes.HasPrefix(bs, []byte("meta:")) || bs[len(bs)-1] == '0' {
+			t.Errorf("Unexpected item %s", bs)
+		}
+		count++
+	}
+	itr.Close()
+
+	if count != n-n/10 {
+		t.Errorf("Expected %d restored items, got %d", n-n/10, count)
+	}
+}
+
+func TestDumpInfo(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db.dump")
+	if _, err := DumpInfo(dir); err != ErrNoDumpManifest {
+		t.Errorf("Expected ErrNoDumpManifest, got %v", err)
+	}
+
+	db := NewWithConfig(DefaultConfig())
+	defer db.Close()
+	w := db.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dm, err := DumpInfo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dm.Format != "native" || dm.Items() != int64(n) {
+		t.Errorf("Unexpected manifest format %s with %d items", dm.Format, dm.Items())
+	}
+
+	var minKey, maxKey []byte
+	for _, s := range dm.Shards {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "data", s.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if int64(len(bs)) != s.Bytes || crc32.Checksum(bs, crc32.MakeTable(crc32.Castagnoli)) != s.Checksum {
+			t.Errorf("Shard %s does not match its manifest entry", s.File)
+		}
+
+		if s.Items == 0 {
+			continue
+		}
+
+		// [2 byte len][10 byte key] items and a terminator
+		if int64(len(bs)) != 12*s.Items+2 {
+			t.Errorf("Shard %s has %d bytes for %d items", s.File, len(bs), s.Items)
+		}
+
+		if minKey == nil || bytes.Compare(s.MinKey, minKey) < 0 {
+			minKey = s.MinKey
+		}
+		if maxKey == nil || bytes.Compare(s.MaxKey, maxKey) > 0 {
+			maxKey = s.MaxKey
+		}
+	}
+
+	if string(minKey) != fmt.Sprintf("%010d", 0) || string(maxKey) != fmt.Sprintf("%010d", n-1) {
+		t.Errorf("Unexpected key range %s - %s", minKey, maxKey)
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	expectPanic := func(what string, fn func()) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				t.Errorf("Expected %s to panic", what)
+			} else if msg := fmt.Sprint(r); !strings.Contains(msg, "used after Close") ||
+				!strings.Contains(msg, "TestUseAfterClose") {
+				t.Errorf("Unexpected panic for %s: %s", what, msg)
+			}
+		}()
+		fn()
+	}
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	w.Put([]byte("a"))
+
+	snap, _ := db.NewSnapshot()
+	itr := snap.NewIterator()
+	itr.SeekFirst()
+	itr.Close()
+	expectPanic("Iterator.Valid", func() { itr.Valid() })
+	expectPanic("Iterator.Next", func() { itr.Next() })
+	expectPanic("Iterator.Close", func() { itr.Close() })
+
+	// The writer holds the other reference until the next snapshot
+	snap.Close()
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	expectPanic("Snapshot.NewIterator", func() { snap.NewIterator() })
+	expectPanic("Snapshot.Close", func() { snap.Close() })
+}
+
+func TestLeakReport(t *testing.T) {
+	var report *LeakReport
+	var itr *Iterator
+	var snap *Snapshot
+
+	conf := testConf
+	conf.OnLeak(func(r *LeakReport) {
+		report = r
+		itr.Close()
+		snap.Close()
+	})
+
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	w.Put([]byte("a"))
+	snap, _ = db.NewSnapshot()
+	itr = snap.NewIterator()
+	w.Put([]byte("b"))
+	db.Close()
+
+	if report == nil {
+		t.Fatalf("Expected a leak report")
+	}
+
+	if len(report.Snapshots) != 1 || len(report.Iterators) != 1 || len(report.Writers) != 1 {
+		t.Errorf("Unexpected leak report %s", report)
+	}
+
+	if !strings.Contains(report.String(), "TestLeakReport") {
+		t.Errorf("Expected creation stacks in %s", report)
+	}
+
+	db = NewWithConfig(conf)
+	report = nil
+	w = db.NewWriter()
+	w.Put([]byte("a"))
+	snap, _ = db.NewSnapshot()
+	itr = snap.NewIterator()
+	itr.Close()
+	snap.Close()
+	db.Close()
+
+	if report != nil {
+		t.Errorf("Unexpected leak report %s", report)
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	sts := db.StoreStats()
+	if sts.NodeAllocs != 1000 || sts.NodeCount != 1000 || sts.LevelOccupancy[0] != 1000 {
+		t.Errorf("Unexpected stats %v", sts)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	u := db.MemoryUsage()
+	if u.Store.Items < 1000*10 || u.Snapshots.Nodes == 0 {
+		t.Errorf("Unexpected memory usage %+v", u)
+	}
+
+	if u.Total() != db.MemoryInUse() {
+		t.Errorf("Expected total %d, got %d", db.MemoryInUse(), u.Total())
+	}
+}
+
+func TestSessionWatchdog(t *testing.T) {
+	stale := make(chan skiplist.StaleSession, 10)
+	conf := testConf
+	conf.SetSessionWatchdog(20*time.Millisecond, func(ss skiplist.StaleSession) {
+		stale <- ss
+	})
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	snap, _ := w.NewSnapshot()
+	itr := snap.NewIterator()
+	snap.Close()
+
+	// Deleting an item of the current snapshot closes the session of the
+	// iterator
+	w.Put([]byte("a"))
+	w.Delete([]byte("a"))
+
+	select {
+	case ss := <-stale:
+		if ss.Accessors != 1 || len(ss.Stacks) != 1 ||
+			!strings.Contains(string(ss.Stacks[0]), "TestSessionWatchdog") {
+			t.Errorf("Unexpected stale session %+v", ss)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected a stale session")
+	}
+
+	itr.Close()
+}
+
+func TestIteratorRefreshInterval(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	itr.SetRefreshInterval(10 * time.Millisecond)
+
+	itr.SeekFirst()
+	accessor := itr.iter
+	itr.Next()
+	if itr.iter != accessor {
+		t.Errorf("Expected no refresh before the interval")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	itr.Next()
+	if itr.iter == accessor {
+		t.Errorf("Expected a refresh after the interval")
+	}
+
+	count := 2
+	for ; itr.Valid(); itr.Next() {
+		if expected := fmt.Sprintf("%010d", count); string(itr.Get()) != expected {
+			t.Fatalf("Expected %s, got %s", expected, itr.Get())
+		}
+		count++
+	}
+
+	if count != 100 {
+		t.Errorf("Expected 100 items, got %d", count)
+	}
+}
+
+func TestIdleGC(t *testing.T) {
+	conf := testConf
+	conf.SetIdleGC(20 * time.Millisecond)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	waitPasses := func(n int64) {
+		for i := 0; i < 500 && db.IdleGCPasses() < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if passes := db.IdleGCPasses(); passes != n {
+			t.Fatalf("Expected %d idle passes, got %d", n, passes)
+		}
+	}
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	waitPasses(1)
+
+	// No pass without mutations
+	time.Sleep(100 * time.Millisecond)
+	waitPasses(1)
+
+	w.Delete([]byte(fmt.Sprintf("%010d", 0)))
+	waitPasses(2)
+}
+
+func TestFreeListFlush(t *testing.T) {
+	var freed int64
+	conf := testConf
+	conf.SetFreeListFlush(10, 0)
+	conf.OnItemFree(func(*ItemEntry) {
+		atomic.AddInt64(&freed, 1)
+	})
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	putDelete := func(n int) {
+		for i := 0; i < n; i++ {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+			w.Delete([]byte(fmt.Sprintf("%010d", i)))
+		}
+	}
+
+	waitFreed := func(n int64) {
+		for i := 0; i < 100 && atomic.LoadInt64(&freed) < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if got := atomic.LoadInt64(&freed); got != n {
+			t.Fatalf("Expected %d freed items, got %d", n, got)
+		}
+	}
+
+	putDelete(5)
+	time.Sleep(50 * time.Millisecond)
+	waitFreed(0)
+
+	putDelete(5)
+	waitFreed(10)
+
+	putDelete(3)
+	snap, _ := w.NewSnapshot()
+	snap.Close()
+	waitFreed(13)
+}
+
+func TestIteratorIncludeDeleted(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for _, k := range []string{"a", "b", "c"} {
+		w.Put([]byte(k))
+	}
+
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	w.Delete([]byte("b"))
+	w.DeleteNonExist([]byte("d"))
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	scan := func(includeDeleted bool) (items []string) {
+		itr := snap2.NewIterator()
+		defer itr.Close()
+		itr.SetIncludeDeleted(includeDeleted)
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			itm := string(itr.Get())
+			if itr.IsDeleted() {
+				itm += fmt.Sprintf("-%d", itr.DeadSn())
+			}
+			items = append(items, itm)
+		}
+		return
+	}
+
+	if items := scan(false); fmt.Sprint(items) != "[a c]" {
+		t.Errorf("Unexpected items %v", items)
+	}
+
+	if items := scan(true); fmt.Sprint(items) != "[a b-2 c d-2]" {
+		t.Errorf("Unexpected items %v", items)
+	}
+}
+
+func TestTombstonesCount(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap1, _ := w.NewSnapshot()
+	for i := 0; i < 10; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	// Deletes of items of the current snapshot leave no tombstone
+	w.Put([]byte("x"))
+	w.Delete([]byte("x"))
+	w.DeleteNonExist([]byte("y"))
+
+	snap2, _ := w.NewSnapshot()
+	if n := db.TombstonesCount(); n != 11 {
+		t.Errorf("Expected 11 tombstones, got %d", n)
+	}
+
+	// Only the delete marker remains once no snapshot sees the deletes
+	snap1.Close()
+	snap2.Close()
+	snap3, _ := w.NewSnapshot()
+	defer snap3.Close()
+
+	for i := 0; i < 100 && db.TombstonesCount() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := db.TombstonesCount(); n != 1 {
+		t.Errorf("Expected 1 tombstone, got %d", n)
+	}
+}
+
+func TestIteratorPrev(t *testing.T) {
+	n := 5000
+	check := func(t *testing.T, snap *Snapshot, keys []string) {
+		itr := snap.NewIterator()
+		defer itr.Close()
+
+		i := len(keys) - 1
+		for itr.SeekLast(); itr.Valid(); itr.Prev() {
+			if i < 0 || string(itr.Get()) != keys[i] {
+				t.Fatalf("Expected item %d, got %s", i, itr.Get())
+			}
+			i--
+		}
+		if i != -1 || itr.Err() != nil {
+			t.Errorf("Expected %d items, %d are left, %v", len(keys), i+1, itr.Err())
+		}
+
+		// Changing direction returns the same items
+		itr.Seek([]byte(keys[100]))
+		itr.Next()
+		itr.Prev()
+		if !itr.Valid() || string(itr.Get()) != keys[100] {
+			t.Errorf("Expected %s, got %s", keys[100], itr.Get())
+		}
+
+		end := keys[len(keys)/2]
+		itr.SetEnd([]byte(end))
+		for itr.SeekLast(); itr.Valid(); itr.Prev() {
+			if string(itr.Get()) < end {
+				break
+			}
+		}
+		if !itr.Valid() || string(itr.Get()) != keys[len(keys)/2-1] {
+			t.Errorf("Expected %s before the end, got %s", keys[len(keys)/2-1], itr.Get())
+		}
+	}
+
+	t.Run("skiplist", func(t *testing.T) {
+		db := NewWithConfig(testConf)
+		defer db.Close()
+
+		w := db.NewWriter()
+		var keys []string
+		for i := 0; i < n; i++ {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+
+		// Items deleted or inserted after the snapshot are skipped, the
+		// versions of the items inserted again follow the visible ones
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("%010d", i))
+			switch i % 3 {
+			case 0:
+				w.Delete(key)
+			case 1:
+				w.Delete(key)
+				w.Put(key)
+			}
+			w.Put([]byte(fmt.Sprintf("%010d-new", i)))
+			keys = append(keys, string(key))
+		}
+		w.Upsert([]byte(fmt.Sprintf("%010d", n-1)))
+		check(t, snap, keys)
+	})
+
+	t.Run("reinserted", func(t *testing.T) {
+		db := NewWithConfig(testConf)
+		defer db.Close()
+
+		w := db.NewWriter()
+		for _, k := range []string{"a", "b", "c"} {
+			w.Put([]byte(k))
+		}
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		w.Delete([]byte("b"))
+		w.Put([]byte("b"))
+		w.Upsert([]byte("c"))
+
+		itr := snap.NewIterator()
+		defer itr.Close()
+		var got []string
+		for itr.SeekLast(); itr.Valid(); itr.Prev() {
+			got = append(got, string(itr.Get()))
+		}
+		if strings.Join(got, ",") != "c,b,a" {
+			t.Errorf("Expected c,b,a, got %v", got)
+		}
+	})
+
+	t.Run("blockstore", func(t *testing.T) {
+		conf := testConf
+		conf.SetBlockStoreDir(t.TempDir())
+		if !conf.HasBlockStore() {
+			t.Skip("block store is not supported")
+		}
+
+		db := NewWithConfig(conf)
+		defer db.Close()
+		tdb := NewWithConfig(testConf)
+		w := tdb.NewWriter()
+		var keys []string
+		for i := 0; i < n; i++ {
+			keys = append(keys, fmt.Sprintf("%010d", i))
+			w.Put([]byte(keys[i]))
+		}
+		tsnap, _ := tdb.NewSnapshot()
+		if _, err := db.ApplyOps(tsnap, 2); err != nil {
+			t.Fatal(err)
+		}
+		tsnap.Close()
+		tdb.Close()
+
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		check(t, snap, keys)
+	})
+}
+
+func TestIteratorSeekPrefix(t *testing.T) {
+	var keys []string
+	for _, p := range []string{"a", "ab", "b", "b\xff", "b\xff\xff", "c"} {
+		for i := 0; i < 500; i++ {
+			keys = append(keys, fmt.Sprintf("%s%04d", p, i))
+		}
+	}
+
+	check := func(t *testing.T, snap *Snapshot) {
+		itr := snap.NewIterator()
+		defer itr.Close()
+
+		for _, p := range []string{"a", "ab", "b\xff", "c", "d", ""} {
+			var expected []string
+			for _, k := range keys {
+				if strings.HasPrefix(k, p) {
+					expected = append(expected, k)
+				}
+			}
+
+			var got []string
+			for itr.SeekPrefix([]byte(p)); itr.Valid(); itr.Next() {
+				got = append(got, string(itr.Get()))
+			}
+			if strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Errorf("Prefix %q: expected %d items, got %d", p, len(expected), len(got))
+			}
+		}
+
+		itr.SeekPrefix([]byte("ab"))
+		if itr.SeekLast(); !itr.Valid() || string(itr.Get()) != "ab0499" {
+			t.Errorf("Expected the last item with the prefix, got %q", itr.Get())
+		}
+	}
+
+	t.Run("skiplist", func(t *testing.T) {
+		db := NewWithConfig(testConf)
+		defer db.Close()
+
+		w := db.NewWriter()
+		for _, k := range keys {
+			w.Put([]byte(k))
+		}
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		check(t, snap)
+	})
+
+	t.Run("blockstore", func(t *testing.T) {
+		conf := testConf
+		conf.SetBlockStoreDir(t.TempDir())
+		if !conf.HasBlockStore() {
+			t.Skip("block store is not supported")
+		}
+
+		db := NewWithConfig(conf)
+		defer db.Close()
+		tdb := NewWithConfig(testConf)
+		w := tdb.NewWriter()
+		for _, k := range keys {
+			w.Put([]byte(k))
+		}
+		tsnap, _ := tdb.NewSnapshot()
+		if _, err := db.ApplyOps(tsnap, 2); err != nil {
+			t.Fatal(err)
+		}
+		tsnap.Close()
+		tdb.Close()
+
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		check(t, snap)
+	})
+}
+
+func TestIteratorLimitSkip(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n := 1000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+
+	// Pages of 30 items
+	page := 30
+	itr.SetLimit(page)
+	for offset := 0; offset < n; offset += page {
+		itr.SeekFirst()
+		itr.Skip(offset)
+		count := 0
+		for ; itr.Valid(); itr.Next() {
+			if expected := fmt.Sprintf("%010d", offset+count); string(itr.Get()) != expected {
+				t.Fatalf("Expected %s, got %s", expected, itr.Get())
+			}
+			count++
+		}
+
+		expected := page
+		if n-offset < page {
+			expected = n - offset
+		}
+		if count != expected {
+			t.Errorf("Expected %d items at offset %d, got %d", expected, offset, count)
+		}
+	}
+
+	itr.SetLimit(0)
+	itr.SeekFirst()
+	if itr.Skip(n + 10); itr.Valid() {
+		t.Errorf("Expected the iterator to be exhausted")
+	}
+}
+
+func TestIteratorSkipBlockStore(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+	conf.SetBlockSize(1024)
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	tdb := NewWithConfig(testConf)
+	w := tdb.NewWriter()
+	n := 2000
+	item := func(i int) string {
+		key := fmt.Sprintf("%010d", i)
+		if i%10 == 0 {
+			// Stored in overflow blocks
+			key += strings.Repeat("x", 3000)
+		}
+		return key
+	}
+	for i := 0; i < n; i++ {
+		w.Put([]byte(item(i)))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 2); err != nil {
+		t.Fatal(err)
+	}
+	tsnap.Close()
+	tdb.Close()
+
+	bm := &countingBlockManager{BlockManager: db.bm}
+	db.bm = bm
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	itr := snap.NewIterator()
+	defer itr.Close()
+
+	for _, offset := range []int{0, 1, 9, 10, 11, 555, 1234, n - 1} {
+		itr.SeekFirst()
+		if itr.Skip(offset); !itr.Valid() || string(itr.Get()) != item(offset) {
+			t.Errorf("Expected item %d after Skip", offset)
+		}
+	}
+
+	// The items in overflow blocks are not read
+	itr.SeekFirst()
+	reads := atomic.LoadInt64(&bm.reads)
+	itr.Skip(n - 1)
+	skipReads := atomic.LoadInt64(&bm.reads) - reads
+
+	itr.SeekFirst()
+	reads = atomic.LoadInt64(&bm.reads)
+	for i := 0; i < n-1; i++ {
+		itr.Next()
+	}
+	if nextReads := atomic.LoadInt64(&bm.reads) - reads; skipReads >= nextReads {
+		t.Errorf("Expected Skip to read less than %d blocks, got %d", nextReads, skipReads)
+	}
+
+	if itr.Skip(10); itr.Valid() || itr.Err() != nil {
+		t.Errorf("Expected the iterator to be exhausted, got %v", itr.Err())
+	}
+}
+
+func TestIndexKeysOnly(t *testing.T) {
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+	conf.SetBlockSize(1024)
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	tdb := NewWithConfig(testConf)
+	w := tdb.NewWriter()
+	n := 5000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 2); err != nil {
+		t.Fatal(err)
+	}
+	tsnap.Close()
+	tdb.Close()
+
+	bm := &countingBlockManager{BlockManager: db.bm}
+	db.bm = bm
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	it := snap.NewIterator()
+	defer it.Close()
+	it.SetIndexKeysOnly(true)
+
+	var keys []string
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Get()))
+	}
+
+	if len(keys) < 2 || len(keys) >= n || keys[0] != fmt.Sprintf("%010d", 0) {
+		t.Errorf("Expected the first items of the blocks, got %d items from %s", len(keys), keys[0])
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Errorf("Expected the items in order")
+	}
+
+	it.Seek([]byte(keys[1][:9]))
+	if !it.Valid() || string(it.Get()) != keys[1] {
+		t.Errorf("Expected %s, got %s", keys[1], it.Get())
+	}
+	if it.SeekLast(); !it.Valid() || string(it.Get()) != keys[len(keys)-1] {
+		t.Errorf("Expected %s, got %s", keys[len(keys)-1], it.Get())
+	}
+
+	if reads := atomic.LoadInt64(&bm.reads); reads != 0 {
+		t.Errorf("Expected no block reads, got %d", reads)
+	}
+}
@@ -0,0 +1,149 @@
+package nitro
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/elliotcourant/nitro/skiplist"
+)
+
+var (
+	// ErrNodeDataCodecExists means a codec with the name is already registered
+	ErrNodeDataCodecExists = fmt.Errorf("Node data codec already exists")
+	// ErrUnknownNodeDataCodec means no codec with the name is registered
+	ErrUnknownNodeDataCodec = fmt.Errorf("Unknown node data codec")
+	// ErrNoNodeDataCodec means the instance has no node data codec configured
+	ErrNoNodeDataCodec = fmt.Errorf("No node data codec configured")
+	// ErrNodeDataReserved means the node data word is used by the block store
+	ErrNodeDataReserved = fmt.Errorf("Node data is reserved for the block store")
+)
+
+// NodeDataCodec converts the auxiliary data attached to items to and from
+// the 64-bit data word of their skiplist nodes, e.g., an offset into an
+// external file or an index hint. Node data is not part of StoreToDisk
+// backups.
+type NodeDataCodec interface {
+	Encode(v interface{}) (uint64, error)
+	Decode(w uint64) (interface{}, error)
+}
+
+// Uint64Codec stores uint64 values as they are
+type Uint64Codec struct{}
+
+func (Uint64Codec) Encode(v interface{}) (uint64, error) {
+	w, ok := v.(uint64)
+	if !ok {
+		return 0, fmt.Errorf("Expected uint64 node data, got %T", v)
+	}
+
+	return w, nil
+}
+
+func (Uint64Codec) Decode(w uint64) (interface{}, error) {
+	return w, nil
+}
+
+// blockPtrCodec is the codec of instances with a block store, where node
+// data holds the pointer to the data block of an index node
+type blockPtrCodec struct{}
+
+func (blockPtrCodec) Encode(v interface{}) (uint64, error) {
+	bptr, ok := v.(blockPtr)
+	if !ok {
+		return 0, fmt.Errorf("Expected block pointer node data, got %T", v)
+	}
+
+	return uint64(bptr), nil
+}
+
+func (blockPtrCodec) Decode(w uint64) (interface{}, error) {
+	return blockPtr(w), nil
+}
+
+var nodeDataCodecs = struct {
+	sync.RWMutex
+	codecs map[string]NodeDataCodec
+}{
+	codecs: map[string]NodeDataCodec{
+		"uint64": Uint64Codec{},
+	},
+}
+
+// RegisterNodeDataCodec registers a codec which can be selected with
+// Config.SetNodeDataCodec
+func RegisterNodeDataCodec(name string, codec NodeDataCodec) error {
+	nodeDataCodecs.Lock()
+	defer nodeDataCodecs.Unlock()
+
+	if _, ok := nodeDataCodecs.codecs[name]; ok {
+		return ErrNodeDataCodecExists
+	}
+
+	nodeDataCodecs.codecs[name] = codec
+	return nil
+}
+
+func lookupNodeDataCodec(name string) (NodeDataCodec, bool) {
+	nodeDataCodecs.RLock()
+	defer nodeDataCodecs.RUnlock()
+
+	codec, ok := nodeDataCodecs.codecs[name]
+	return codec, ok
+}
+
+// SetNodeDataCodec selects the registered codec used by Nitro.SetNodeData and
+// Nitro.NodeData
+func (cfg *Config) SetNodeDataCodec(name string) error {
+	codec, ok := lookupNodeDataCodec(name)
+	if !ok {
+		return ErrUnknownNodeDataCodec
+	}
+
+	cfg.nodeDataCodec = codec
+	return nil
+}
+
+func (m *Nitro) checkNodeData() error {
+	if m.HasBlockStore() {
+		return ErrNodeDataReserved
+	}
+
+	if m.nodeDataCodec == nil {
+		return ErrNoNodeDataCodec
+	}
+
+	return nil
+}
+
+// SetNodeData attaches v to the node of an item, e.g., as returned by
+// Writer.Put2 or Iterator.GetNode
+func (m *Nitro) SetNodeData(n *skiplist.Node, v interface{}) error {
+	if err := m.checkNodeData(); err != nil {
+		return err
+	}
+
+	w, err := m.nodeDataCodec.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	n.SetData(w)
+	return nil
+}
+
+// NodeData returns the data attached to the node of an item
+func (m *Nitro) NodeData(n *skiplist.Node) (interface{}, error) {
+	if err := m.checkNodeData(); err != nil {
+		return nil, err
+	}
+
+	return m.nodeDataCodec.Decode(n.Data())
+}
+
+func nodeBlockPtr(n *skiplist.Node) blockPtr {
+	return blockPtr(n.Data())
+}
+
+func setNodeBlockPtr(n *skiplist.Node, bptr blockPtr) {
+	n.SetData(uint64(bptr))
+}
@@ -0,0 +1,148 @@
+package nitro
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type extentCodec struct{}
+
+type extent struct {
+	off uint32
+	len uint32
+}
+
+func (extentCodec) Encode(v interface{}) (uint64, error) {
+	e, ok := v.(extent)
+	if !ok {
+		return 0, fmt.Errorf("unexpected %T", v)
+	}
+	return uint64(e.off)<<32 | uint64(e.len), nil
+}
+
+func (extentCodec) Decode(w uint64) (interface{}, error) {
+	return extent{off: uint32(w >> 32), len: uint32(w)}, nil
+}
+
+func TestNodeData(t *testing.T) {
+	if err := RegisterNodeDataCodec("test-extent", extentCodec{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RegisterNodeDataCodec("test-extent", extentCodec{}); err != ErrNodeDataCodecExists {
+		t.Errorf("Expected ErrNodeDataCodecExists, got %v", err)
+	}
+
+	conf := DefaultConfig()
+	if err := conf.SetNodeDataCodec("unknown"); err != ErrUnknownNodeDataCodec {
+		t.Errorf("Expected ErrUnknownNodeDataCodec, got %v", err)
+	}
+
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	if err := db.SetNodeData(w.Put2([]byte("a")), extent{}); err != ErrNoNodeDataCodec {
+		t.Errorf("Expected ErrNoNodeDataCodec, got %v", err)
+	}
+	db.Close()
+
+	if err := conf.SetNodeDataCodec("test-extent"); err != nil {
+		t.Fatal(err)
+	}
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	w = db.NewWriter()
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		node := w.Put2([]byte(fmt.Sprintf("%010d", i)))
+		if err := db.SetNodeData(node, extent{off: uint32(i * 100), len: uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.SetNodeData(w.GetNode([]byte("0000000000")), uint64(1)); err == nil {
+		t.Errorf("Expected encoding error")
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	it := snap.NewIterator()
+	defer it.Close()
+
+	i := 0
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		v, err := db.NodeData(it.GetNode())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := (extent{off: uint32(i * 100), len: uint32(i)}); v != exp {
+			t.Errorf("Expected %v, got %v", exp, v)
+		}
+		i++
+	}
+
+	if i != n {
+		t.Errorf("Expected %d items, got %d", n, i)
+	}
+}
+
+func TestNodeFree(t *testing.T) {
+	var mu sync.Mutex
+	freed := make(map[string]int)
+
+	conf := testConf
+	if err := conf.SetNodeDataCodec("uint64"); err != nil {
+		t.Fatal(err)
+	}
+	conf.OnNodeFree(func(itm []byte, data interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		if key := fmt.Sprintf("%010d", data.(uint64)); key != string(itm) {
+			t.Errorf("Expected data %s for %s", key, itm)
+		}
+		freed[string(itm)]++
+	})
+
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	n := 100
+	for i := 0; i < n; i++ {
+		node := w.Put2([]byte(fmt.Sprintf("%010d", i)))
+		if err := db.SetNodeData(node, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, _ := w.NewSnapshot()
+	snap.Close()
+	for i := 0; i < n/2; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	for i := 0; i < 2; i++ {
+		snap, _ = w.NewSnapshot()
+		snap.Close()
+	}
+
+	for count := 0; count < n/2; {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		count = len(freed)
+		mu.Unlock()
+	}
+
+	db.Close()
+	if len(freed) != n {
+		t.Errorf("Expected %d freed nodes, got %d", n, len(freed))
+	}
+
+	for k, c := range freed {
+		if c != 1 {
+			t.Errorf("Node %s freed %d times", k, c)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// +build !windows,!js,!wasip1
+
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nodetable
+
+import (
+	"fmt"
+	"hash/crc32"
+	"runtime/debug"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestMemoryOverhead(t *testing.T) {
+	n := 100000
+	table := New(crc32.ChecksumIEEE, equalObject)
+	objects := make([]*object, n)
+	for i := 0; i < n; i++ {
+		objects[i] = mkObject(fmt.Sprintf("key-%d", i), i)
+	}
+
+	var rusage1, rusage2 syscall.Rusage
+	debug.FreeOSMemory()
+	syscall.Getrusage(syscall.RUSAGE_SELF, &rusage1)
+	for i := 0; i < n; i++ {
+		table.Update(objects[i].key, unsafe.Pointer(objects[i]))
+	}
+	debug.FreeOSMemory()
+	syscall.Getrusage(syscall.RUSAGE_SELF, &rusage2)
+
+	rss := (rusage2.Maxrss - rusage1.Maxrss)
+	fmt.Println("Memory used for hashtable:", rss)
+	fmt.Println("Overhead per item:", float32(rss)/float32(n))
+}
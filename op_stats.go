@@ -0,0 +1,159 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Names of the operations recorded by RecentOperations
+const (
+	// OpApplyOps is a batch of operations applied to a block store, by
+	// ApplyOps or by the batch paths built on it
+	OpApplyOps = "apply-ops"
+	// OpStoreToDisk is a backup written by StoreToDisk
+	OpStoreToDisk = "store-to-disk"
+	// OpLoadFromDisk is a backup restored by LoadFromDisk
+	OpLoadFromDisk = "load-from-disk"
+)
+
+// Number of recent operations kept by an instance
+const opHistorySize = 32
+
+var opNames = []string{OpApplyOps, OpStoreToDisk, OpLoadFromDisk}
+
+// OperationRecord describes a completed ApplyOps, StoreToDisk or LoadFromDisk
+// call. Items is the number of inserted and removed items for OpApplyOps, of
+// stored items for OpStoreToDisk and of restored items for OpLoadFromDisk.
+type OperationRecord struct {
+	Op       string
+	Start    time.Time
+	Duration time.Duration
+	Items    int64
+	Err      error
+}
+
+// Throughput returns the items processed per second
+func (r OperationRecord) Throughput() float64 {
+	return throughput(r.Items, r.Duration)
+}
+
+func (r OperationRecord) String() string {
+	s := fmt.Sprintf("%s: %d items in %v (%.0f items/s)", r.Op, r.Items, r.Duration,
+		r.Throughput())
+	if r.Err != nil {
+		s += fmt.Sprintf(", error: %v", r.Err)
+	}
+	return s
+}
+
+// OperationTotals aggregates all the calls of an operation since the instance
+// was created
+type OperationTotals struct {
+	Op       string
+	Count    int64
+	Errors   int64
+	Items    int64
+	Duration time.Duration
+}
+
+// Throughput returns the average items processed per second
+func (t OperationTotals) Throughput() float64 {
+	return throughput(t.Items, t.Duration)
+}
+
+func (t OperationTotals) String() string {
+	return fmt.Sprintf("%s: count = %d, errors = %d, items = %d, duration = %v (%.0f items/s)",
+		t.Op, t.Count, t.Errors, t.Items, t.Duration, t.Throughput())
+}
+
+func throughput(items int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(items) / d.Seconds()
+}
+
+// opHistory is the ring buffer of the recent operations
+type opHistory struct {
+	sync.Mutex
+	records [opHistorySize]OperationRecord
+	next    int
+	full    bool
+
+	totals map[string]*OperationTotals
+}
+
+func (m *Nitro) recordOperation(op string, start time.Time, items int64, err error) {
+	r := OperationRecord{
+		Op:       op,
+		Start:    start,
+		Duration: time.Since(start),
+		Items:    items,
+		Err:      err,
+	}
+
+	h := &m.opHistory
+	h.Lock()
+	defer h.Unlock()
+
+	h.records[h.next] = r
+	if h.next++; h.next == len(h.records) {
+		h.next = 0
+		h.full = true
+	}
+
+	if h.totals == nil {
+		h.totals = make(map[string]*OperationTotals)
+	}
+	t := h.totals[op]
+	if t == nil {
+		t = &OperationTotals{Op: op}
+		h.totals[op] = t
+	}
+	t.Count++
+	if err != nil {
+		t.Errors++
+	}
+	t.Items += items
+	t.Duration += r.Duration
+}
+
+// RecentOperations returns the last ApplyOps, StoreToDisk and LoadFromDisk
+// calls of the instance, the oldest first
+func (m *Nitro) RecentOperations() []OperationRecord {
+	h := &m.opHistory
+	h.Lock()
+	defer h.Unlock()
+
+	var records []OperationRecord
+	if h.full {
+		records = append(records, h.records[h.next:]...)
+	}
+	return append(records, h.records[:h.next]...)
+}
+
+// OperationTotals returns the totals of the operations which were called at
+// least once, in the order OpApplyOps, OpStoreToDisk, OpLoadFromDisk
+func (m *Nitro) OperationTotals() []OperationTotals {
+	h := &m.opHistory
+	h.Lock()
+	defer h.Unlock()
+
+	var totals []OperationTotals
+	for _, op := range opNames {
+		if t := h.totals[op]; t != nil {
+			totals = append(totals, *t)
+		}
+	}
+	return totals
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecentOperations(t *testing.T) {
+	n := 1000
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if !conf.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	tdb := NewWithConfig(testConf)
+	w := tdb.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%06d", i)))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := db.RecentOperations()
+	if len(ops) != 1 || ops[0].Op != OpApplyOps || ops[0].Items != int64(n) || ops[0].Err != nil {
+		t.Fatalf("Unexpected operations %+v", ops)
+	}
+
+	dir := filepath.Join(t.TempDir(), "backup")
+	if err := tdb.StoreToDisk(dir, tsnap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	tdb.Close()
+
+	ldb := NewWithConfig(testConf)
+	defer ldb.Close()
+	for i := 0; i < 2; i++ {
+		snap, err := ldb.LoadFromDisk(dir, 4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snap.Close()
+	}
+	if _, err := ldb.LoadFromDisk(filepath.Join(dir, "missing"), 4, nil); err == nil {
+		t.Fatal("Expected a load error")
+	}
+
+	ops = ldb.RecentOperations()
+	if len(ops) != 3 {
+		t.Fatalf("Expected 3 operations, got %+v", ops)
+	}
+	for i, op := range ops[:2] {
+		if op.Op != OpLoadFromDisk || op.Items != int64(n) || op.Err != nil || op.Throughput() <= 0 {
+			t.Errorf("Unexpected load %d: %v", i, op)
+		}
+	}
+	if ops[2].Err == nil {
+		t.Errorf("Expected the failed load to be recorded, got %v", ops[2])
+	}
+
+	// Only the last operations are kept, the totals include all of them
+	for i := 0; i < opHistorySize; i++ {
+		ldb.LoadFromDisk(filepath.Join(dir, "missing"), 4, nil)
+	}
+	if ops = ldb.RecentOperations(); len(ops) != opHistorySize || ops[0].Err == nil {
+		t.Errorf("Expected the last %d operations, got %d", opHistorySize, len(ops))
+	}
+
+	totals := ldb.OperationTotals()
+	if len(totals) != 1 || totals[0].Count != int64(opHistorySize+3) ||
+		totals[0].Errors != int64(opHistorySize+1) || totals[0].Items != int64(2*n) {
+		t.Errorf("Unexpected totals %+v", totals)
+	}
+
+	if !strings.Contains(ldb.DumpStats(), OpLoadFromDisk) {
+		t.Errorf("Expected the operations in the stats")
+	}
+}
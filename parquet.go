@@ -0,0 +1,352 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ExportType is the type of a column of an exported file
+type ExportType int
+
+const (
+	// ExportBytes is a binary column, values are []byte or string
+	ExportBytes ExportType = iota
+	// ExportString is a UTF-8 string column, values are []byte or string
+	ExportString
+	// ExportInt64 is a 64-bit integer column, values are int64
+	ExportInt64
+	// ExportDouble is a 64-bit floating point column, values are float64
+	ExportDouble
+)
+
+// Number of rows of a Parquet row group
+const parquetRowGroupSize = 1 << 16
+
+var parquetMagic = []byte("PAR1")
+
+// ErrExportValue means a column mapping returned a value which does not
+// match the column type
+var ErrExportValue = fmt.Errorf("Value does not match the export column type")
+
+// ExportColumn maps the items of a snapshot to a column of an exported file.
+// Value returns the column value of an item and is called with the item data,
+// which is only valid during the call. For instances storing keys and values
+// in items, a mapping usually splits the item into a key and a value column.
+type ExportColumn struct {
+	Name  string
+	Type  ExportType
+	Value func(itm []byte) interface{}
+}
+
+// parquetColumn buffers the PLAIN encoded values of a row group
+type parquetColumn struct {
+	ExportColumn
+	data []byte
+}
+
+func (c *parquetColumn) add(itm []byte) error {
+	v := c.Value(itm)
+	switch c.Type {
+	case ExportBytes, ExportString:
+		var bs []byte
+		switch x := v.(type) {
+		case []byte:
+			bs = x
+		case string:
+			bs = []byte(x)
+		default:
+			return ErrExportValue
+		}
+		c.data = binary.LittleEndian.AppendUint32(c.data, uint32(len(bs)))
+		c.data = append(c.data, bs...)
+	case ExportInt64:
+		x, ok := v.(int64)
+		if !ok {
+			return ErrExportValue
+		}
+		c.data = binary.LittleEndian.AppendUint64(c.data, uint64(x))
+	case ExportDouble:
+		x, ok := v.(float64)
+		if !ok {
+			return ErrExportValue
+		}
+		c.data = binary.LittleEndian.AppendUint64(c.data, math.Float64bits(x))
+	default:
+		return ErrExportValue
+	}
+
+	return nil
+}
+
+// Parquet physical types
+func (c *parquetColumn) physicalType() int32 {
+	switch c.Type {
+	case ExportInt64:
+		return 2
+	case ExportDouble:
+		return 5
+	}
+	return 6
+}
+
+// parquetChunk describes a column chunk written to the file
+type parquetChunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+type parquetRowGroup struct {
+	chunks []parquetChunk
+	rows   int64
+	size   int64
+}
+
+// ExportParquet writes the items of the snapshot in key order to w as an
+// Apache Parquet file and returns the number of rows. Every item is a row
+// with the columns of the schema, all of them required. A nil schema exports
+// the items as a single binary column named "item". Values are PLAIN encoded
+// and not compressed, in row groups of 65536 rows.
+func (s *Snapshot) ExportParquet(w io.Writer, schema []ExportColumn) (int64, error) {
+	if schema == nil {
+		schema = []ExportColumn{{
+			Name:  "item",
+			Type:  ExportBytes,
+			Value: func(itm []byte) interface{} { return itm },
+		}}
+	}
+
+	cols := make([]*parquetColumn, len(schema))
+	for i, c := range schema {
+		cols[i] = &parquetColumn{ExportColumn: c}
+	}
+
+	bw := bufio.NewWriterSize(w, DiskBlockSize)
+	if _, err := bw.Write(parquetMagic); err != nil {
+		return 0, err
+	}
+
+	var groups []parquetRowGroup
+	var rows, groupRows int64
+	offset := int64(len(parquetMagic))
+
+	flush := func() error {
+		g := parquetRowGroup{rows: groupRows}
+		for _, c := range cols {
+			var t thriftWriter
+			t.i32(1, 0) // DATA_PAGE
+			t.i32(2, int32(len(c.data)))
+			t.i32(3, int32(len(c.data)))
+			t.beginStruct(5)
+			t.i32(1, int32(groupRows))
+			t.i32(2, 0) // PLAIN
+			t.i32(3, 3) // RLE
+			t.i32(4, 3) // RLE
+			t.endStruct()
+			t.endStruct()
+
+			if _, err := bw.Write(t.buf); err != nil {
+				return err
+			}
+			if _, err := bw.Write(c.data); err != nil {
+				return err
+			}
+
+			chunk := parquetChunk{offset: offset, size: int64(len(t.buf) + len(c.data)), values: groupRows}
+			g.chunks = append(g.chunks, chunk)
+			g.size += chunk.size
+			offset += chunk.size
+			c.data = c.data[:0]
+		}
+
+		groups = append(groups, g)
+		groupRows = 0
+		return nil
+	}
+
+	itr, err := s.OpenIterator()
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		for _, c := range cols {
+			if err := c.add(itr.Get()); err != nil {
+				return rows, err
+			}
+		}
+
+		rows++
+		if groupRows++; groupRows == parquetRowGroupSize {
+			if err := flush(); err != nil {
+				return rows, err
+			}
+		}
+	}
+
+	if err := itr.Err(); err != nil {
+		return rows, err
+	}
+
+	if groupRows > 0 {
+		if err := flush(); err != nil {
+			return rows, err
+		}
+	}
+
+	footer := parquetFooter(cols, groups, rows)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(footer)))
+	footer = append(footer, parquetMagic...)
+	if _, err := bw.Write(footer); err != nil {
+		return rows, err
+	}
+
+	return rows, bw.Flush()
+}
+
+// parquetFooter encodes the FileMetaData of a Parquet file
+func parquetFooter(cols []*parquetColumn, groups []parquetRowGroup, rows int64) []byte {
+	var t thriftWriter
+	t.i32(1, 1)
+
+	// Schema root followed by the columns
+	t.beginList(2, thriftStruct, len(cols)+1)
+	t.beginElem()
+	t.binary(4, []byte("schema"))
+	t.i32(5, int32(len(cols)))
+	t.endStruct()
+	for _, c := range cols {
+		t.beginElem()
+		t.i32(1, c.physicalType())
+		t.i32(3, 0) // REQUIRED
+		t.binary(4, []byte(c.Name))
+		if c.Type == ExportString {
+			t.i32(6, 0) // UTF8
+		}
+		t.endStruct()
+	}
+
+	t.i64(3, rows)
+	t.beginList(4, thriftStruct, len(groups))
+	for _, g := range groups {
+		t.beginElem()
+		t.beginList(1, thriftStruct, len(cols))
+		for i, c := range cols {
+			chunk := g.chunks[i]
+			t.beginElem()
+			t.i64(2, chunk.offset)
+			t.beginStruct(3)
+			t.i32(1, c.physicalType())
+			t.beginList(2, thriftI32, 1)
+			t.buf = binary.AppendUvarint(t.buf, zigzag(0)) // PLAIN
+			t.beginList(3, thriftBinary, 1)
+			t.buf = binary.AppendUvarint(t.buf, uint64(len(c.Name)))
+			t.buf = append(t.buf, c.Name...)
+			t.i32(4, 0) // UNCOMPRESSED
+			t.i64(5, chunk.values)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.i64(2, g.size)
+		t.i64(3, g.rows)
+		t.endStruct()
+	}
+
+	t.binary(6, []byte("nitro"))
+	t.endStruct()
+	return t.buf
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes thrift structs with the compact protocol, which is
+// used for the metadata of Parquet files
+type thriftWriter struct {
+	buf  []byte
+	last int16
+	// Last field ids of the enclosing structs
+	stack []int16
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.buf = binary.AppendUvarint(t.buf, zigzag(int64(id)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.buf = binary.AppendUvarint(t.buf, zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.buf = binary.AppendUvarint(t.buf, zigzag(v))
+}
+
+func (t *thriftWriter) binary(id int16, v []byte) {
+	t.field(id, thriftBinary)
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(v)))
+	t.buf = append(t.buf, v...)
+}
+
+func (t *thriftWriter) beginList(id int16, elemType byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf = append(t.buf, byte(size)<<4|elemType)
+	} else {
+		t.buf = append(t.buf, 0xf0|elemType)
+		t.buf = binary.AppendUvarint(t.buf, uint64(size))
+	}
+}
+
+// beginStruct starts a struct field
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElem()
+}
+
+// beginElem starts a struct element of a list
+func (t *thriftWriter) beginElem() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf = append(t.buf, 0)
+	if n := len(t.stack); n > 0 {
+		t.last = t.stack[n-1]
+		t.stack = t.stack[:n-1]
+	}
+}
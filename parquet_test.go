@@ -0,0 +1,149 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+type thriftStructValue map[int16]interface{}
+
+// readThrift decodes a thrift compact struct into a map of field values
+func readThrift(buf []byte) (thriftStructValue, []byte) {
+	s := thriftStructValue{}
+	var last int16
+	for {
+		b := buf[0]
+		buf = buf[1:]
+		if b == 0 {
+			return s, buf
+		}
+
+		typ := b & 0x0f
+		if delta := int16(b >> 4); delta != 0 {
+			last += delta
+		} else {
+			v, n := binary.Uvarint(buf)
+			last, buf = int16(int64(v>>1)^-int64(v&1)), buf[n:]
+		}
+		s[last], buf = readThriftValue(typ, buf)
+	}
+}
+
+func readThriftValue(typ byte, buf []byte) (interface{}, []byte) {
+	switch typ {
+	case thriftI32, thriftI64:
+		v, n := binary.Uvarint(buf)
+		return int64(v>>1) ^ -int64(v&1), buf[n:]
+	case thriftBinary:
+		l, n := binary.Uvarint(buf)
+		return buf[n : n+int(l)], buf[n+int(l):]
+	case thriftList:
+		size, elem := int(buf[0]>>4), buf[0]&0x0f
+		buf = buf[1:]
+		if size == 15 {
+			v, n := binary.Uvarint(buf)
+			size, buf = int(v), buf[n:]
+		}
+
+		var list []interface{}
+		for i := 0; i < size; i++ {
+			var v interface{}
+			v, buf = readThriftValue(elem, buf)
+			list = append(list, v)
+		}
+		return list, buf
+	case thriftStruct:
+		return readThrift(buf)
+	}
+	panic(fmt.Sprintf("unexpected thrift type %d", typ))
+}
+
+func TestExportParquet(t *testing.T) {
+	n := parquetRowGroupSize + 1000
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	schema := []ExportColumn{
+		{Name: "key", Type: ExportString, Value: func(itm []byte) interface{} { return string(itm) }},
+		{Name: "id", Type: ExportInt64, Value: func(itm []byte) interface{} {
+			id, _ := strconv.ParseInt(string(itm[4:]), 10, 64)
+			return id
+		}},
+	}
+
+	var buf bytes.Buffer
+	if rows, err := snap.ExportParquet(&buf, schema); err != nil || rows != int64(n) {
+		t.Fatalf("Expected %d rows, got %d (%v)", n, rows, err)
+	}
+
+	file := buf.Bytes()
+	if !bytes.HasPrefix(file, parquetMagic) || !bytes.HasSuffix(file, parquetMagic) {
+		t.Fatalf("Expected the Parquet magic")
+	}
+	l := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	meta, _ := readThrift(file[len(file)-8-l:])
+
+	if meta[3].(int64) != int64(n) || len(meta[2].([]interface{})) != 3 {
+		t.Fatalf("Expected %d rows and 2 columns", n)
+	}
+
+	groups := meta[4].([]interface{})
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 row groups, got %d", len(groups))
+	}
+
+	// Read the values of the column chunks
+	id := 0
+	for _, g := range groups {
+		chunks := g.(thriftStructValue)[1].([]interface{})
+		cmeta := chunks[1].(thriftStructValue)[3].(thriftStructValue)
+		off := cmeta[9].(int64)
+		hdr, data := readThrift(file[off:])
+		count := int(hdr[5].(thriftStructValue)[1].(int64))
+
+		for i := 0; i < count; i++ {
+			if got := int64(binary.LittleEndian.Uint64(data[i*8:])); got != int64(id) {
+				t.Fatalf("Expected id %d, got %d", id, got)
+			}
+			id++
+		}
+
+		cmeta = chunks[0].(thriftStructValue)[3].(thriftStructValue)
+		hdr, data = readThrift(file[cmeta[9].(int64):])
+		if hdr[2].(int64) != int64(count*18) {
+			t.Errorf("Expected %d bytes of keys, got %d", count*18, hdr[2].(int64))
+		}
+		key := data[4 : 4+binary.LittleEndian.Uint32(data)]
+		if string(key) != fmt.Sprintf("key-%010d", id-count) {
+			t.Errorf("Expected key %d, got %s", id-count, key)
+		}
+	}
+
+	if id != n {
+		t.Errorf("Expected %d ids, got %d", n, id)
+	}
+
+	schema[1].Value = func(itm []byte) interface{} { return 1 }
+	if _, err := snap.ExportParquet(&buf, schema); err != ErrExportValue {
+		t.Errorf("Expected ErrExportValue, got %v", err)
+	}
+}
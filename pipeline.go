@@ -0,0 +1,206 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"sync"
+)
+
+// encodeBatchSize is the number of items encoded by an encoder at once
+const encodeBatchSize = 256
+
+// encodeBatch is a batch of items of a shard file which is encoded by the
+// encoder pool and written by the file writer in order
+type encodeBatch struct {
+	f     *rawFileWriter
+	keys  [][]byte
+	metas [][]byte
+	arena []byte
+
+	out  bytes.Buffer
+	kept []int
+	err  error
+	done chan struct{}
+}
+
+func (b *encodeBatch) add(key, meta []byte) {
+	off := len(b.arena)
+	b.arena = append(b.arena, key...)
+	b.keys = append(b.keys, b.arena[off:len(b.arena):len(b.arena)])
+	if len(meta) > 0 {
+		off = len(b.arena)
+		b.arena = append(b.arena, meta...)
+		b.metas = append(b.metas, b.arena[off:len(b.arena):len(b.arena)])
+	}
+}
+
+func (b *encodeBatch) encode() {
+	buf := make([]byte, encodeBufSize)
+	var metaBuf []byte
+	for i, key := range b.keys {
+		data, ok, err := b.f.encode(key)
+		if err != nil {
+			b.err = err
+			return
+		} else if !ok {
+			continue
+		}
+
+		if b.metas != nil {
+			data = withMetadata(data, b.metas[i], &metaBuf)
+		}
+
+		if b.err = encodeItemBytes(data, buf, &b.out, b.f.format); b.err != nil {
+			return
+		}
+		b.kept = append(b.kept, i)
+	}
+}
+
+// encoderPool runs the item codec of the shard files of a backup
+type encoderPool struct {
+	ch chan *encodeBatch
+	wg sync.WaitGroup
+}
+
+func newEncoderPool(n int) *encoderPool {
+	p := &encoderPool{ch: make(chan *encodeBatch, n)}
+	for i := 0; i < n; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for b := range p.ch {
+				b.encode()
+				close(b.done)
+			}
+		}()
+	}
+
+	return p
+}
+
+// close stops the encoders, the files using the pool have to be closed
+func (p *encoderPool) close() {
+	close(p.ch)
+	p.wg.Wait()
+}
+
+// pipelinedFileWriter is a backup file writer which hands batches of items
+// to an encoder pool and writes the encoded batches in order from a
+// separate goroutine
+type pipelinedFileWriter struct {
+	*rawFileWriter
+	encoders *encoderPool
+
+	batch   *encodeBatch
+	pending chan *encodeBatch
+	done    chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func (m *Nitro) newPipelinedFileWriter(t FileType, stripLen int, encoders *encoderPool) FileWriter {
+	var w FileWriter
+	if t == RawdbFile {
+		w = &pipelinedFileWriter{
+			rawFileWriter: &rawFileWriter{db: m, format: m.dumpFormat, stripLen: stripLen},
+			encoders:      encoders,
+		}
+	}
+	return w
+}
+
+func (f *pipelinedFileWriter) Open(path string) error {
+	if err := f.rawFileWriter.Open(path); err != nil {
+		return err
+	}
+
+	f.pending = make(chan *encodeBatch, 2*cap(f.encoders.ch))
+	f.done = make(chan struct{})
+	go f.writeBatches()
+	return nil
+}
+
+func (f *pipelinedFileWriter) writeBatches() {
+	defer close(f.done)
+	for b := range f.pending {
+		<-b.done
+		if f.error() != nil {
+			continue
+		}
+
+		err := b.err
+		if err == nil {
+			_, err = f.w.Write(b.out.Bytes())
+		}
+
+		if err != nil {
+			f.mu.Lock()
+			f.err = err
+			f.mu.Unlock()
+			continue
+		}
+
+		for _, i := range b.kept {
+			f.track(b.keys[i])
+		}
+	}
+}
+
+func (f *pipelinedFileWriter) error() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *pipelinedFileWriter) flushBatch() {
+	if f.batch != nil {
+		f.pending <- f.batch
+		f.encoders.ch <- f.batch
+		f.batch = nil
+	}
+}
+
+func (f *pipelinedFileWriter) WriteItem(itm *Item) error {
+	if err := f.error(); err != nil {
+		return err
+	}
+
+	key := itm.Bytes()
+	if len(key) == 0 {
+		// The terminator is written by Close
+		return nil
+	}
+
+	if f.batch == nil {
+		f.batch = &encodeBatch{f: f.rawFileWriter, done: make(chan struct{})}
+	}
+
+	if f.batch.add(key, itm.metadata(f.db.itemMetaSize)); len(f.batch.keys) == encodeBatchSize {
+		f.flushBatch()
+	}
+
+	return nil
+}
+
+func (f *pipelinedFileWriter) Close() error {
+	f.flushBatch()
+	close(f.pending)
+	<-f.done
+
+	if err := f.error(); err != nil {
+		f.fd.Close()
+		return err
+	}
+
+	return f.rawFileWriter.Close()
+}
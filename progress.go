@@ -0,0 +1,142 @@
+package nitro
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ErrLoadAborted means a load from disk was aborted by its item callback
+var ErrLoadAborted = fmt.Errorf("Load from disk aborted")
+
+// LoadProgress describes the progress of a load from disk when an item is
+// restored. Shards are numbered by backup data file, followed by the delta
+// files.
+type LoadProgress struct {
+	Shard      int
+	ShardItems int64
+	Items      int64
+	BytesRead  int64
+	TotalBytes int64
+	Elapsed    time.Duration
+	// Number of concurrent shard readers
+	Readers int
+}
+
+// Completion returns the fraction of the backup files which is read
+func (p LoadProgress) Completion() float64 {
+	if p.TotalBytes == 0 {
+		return 1
+	}
+
+	c := float64(p.BytesRead) / float64(p.TotalBytes)
+	if c > 1 {
+		c = 1
+	}
+	return c
+}
+
+// Remaining estimates the time until the load completes
+func (p LoadProgress) Remaining() time.Duration {
+	c := p.Completion()
+	if c == 0 {
+		return 0
+	}
+
+	return time.Duration(float64(p.Elapsed) * (1 - c) / c)
+}
+
+func (p LoadProgress) String() string {
+	return fmt.Sprintf("shard %d: %d items, total %d items, %d/%d bytes (%.1f%%), %v remaining",
+		p.Shard, p.ShardItems, p.Items, p.BytesRead, p.TotalBytes, 100*p.Completion(),
+		p.Remaining())
+}
+
+// loadProgress tracks a load from disk for item callbacks
+type loadProgress struct {
+	items      int64
+	bytesRead  int64
+	totalBytes int64
+	aborted    int32
+	readers    int32
+	// Number of readers waiting for I/O
+	ioDepth    int32
+	start      time.Time
+	shardItems []int64
+	// Bytes read from each shard, updated by its reader only
+	shardBytes []int64
+}
+
+func newLoadProgress(files []string) *loadProgress {
+	p := &loadProgress{
+		start:      time.Now(),
+		shardItems: make([]int64, len(files)),
+		shardBytes: make([]int64, len(files)),
+	}
+
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			p.totalBytes += fi.Size()
+		}
+	}
+
+	return p
+}
+
+// restored accounts for an item read by the reader of a shard
+func (p *loadProgress) restored(shard int, r FileReader) {
+	atomic.AddInt64(&p.items, 1)
+	atomic.AddInt64(&p.shardItems[shard], 1)
+	if br, ok := r.(interface{ BytesRead() int64 }); ok {
+		n := br.BytesRead()
+		atomic.AddInt64(&p.bytesRead, n-p.shardBytes[shard])
+		p.shardBytes[shard] = n
+	}
+}
+
+func (p *loadProgress) abort() {
+	atomic.StoreInt32(&p.aborted, 1)
+}
+
+func (p *loadProgress) isAborted() bool {
+	return atomic.LoadInt32(&p.aborted) == 1
+}
+
+func (p *loadProgress) get(shard int) LoadProgress {
+	return LoadProgress{
+		Shard:      shard,
+		ShardItems: atomic.LoadInt64(&p.shardItems[shard]),
+		Items:      atomic.LoadInt64(&p.items),
+		BytesRead:  atomic.LoadInt64(&p.bytesRead),
+		TotalBytes: p.totalBytes,
+		Elapsed:    time.Since(p.start),
+		Readers:    int(atomic.LoadInt32(&p.readers)),
+	}
+}
+
+// countingReader counts the bytes read from a backup file
+type countingReader struct {
+	n     int64
+	r     *os.File
+	depth *int32
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	if cr.depth != nil {
+		atomic.AddInt32(cr.depth, 1)
+		defer atomic.AddInt32(cr.depth, -1)
+	}
+
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+// trackIO makes readers which support it account their pending reads in
+// the I/O queue depth of the load
+func (p *loadProgress) trackIO(r FileReader) {
+	if tr, ok := r.(interface{ trackIO(*int32) }); ok {
+		tr.trackIO(&p.ioDepth)
+	}
+}
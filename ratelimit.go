@@ -0,0 +1,142 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// RateLimiterStats describes the throttling applied to a writer
+type RateLimiterStats struct {
+	Ops      int64
+	Waits    int64
+	WaitTime time.Duration
+}
+
+func (s RateLimiterStats) String() string {
+	return fmt.Sprintf(
+		"ratelimit_ops       = %d\n"+
+			"ratelimit_waits     = %d\n"+
+			"ratelimit_wait_time = %v",
+		s.Ops, s.Waits, s.WaitTime)
+}
+
+// rateLimiter implements a token bucket. It is owned by a single writer and
+// only the stats are accessed concurrently. The writer holds it as an
+// unsafe.Pointer so that the stats can be read while the limit is changed.
+type rateLimiter struct {
+	ops      int64
+	waits    int64
+	waitTime int64
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(opsPerSec float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:   opsPerSec,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (rl *rateLimiter) wait() {
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	if rl.tokens < 1 {
+		d := time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+		time.Sleep(d)
+		rl.last = time.Now()
+		rl.tokens = 1
+		atomic.AddInt64(&rl.waits, 1)
+		atomic.AddInt64(&rl.waitTime, int64(rl.last.Sub(now)))
+	}
+
+	rl.tokens--
+	atomic.AddInt64(&rl.ops, 1)
+}
+
+func (rl *rateLimiter) stats() RateLimiterStats {
+	return RateLimiterStats{
+		Ops:      atomic.LoadInt64(&rl.ops),
+		Waits:    atomic.LoadInt64(&rl.waits),
+		WaitTime: time.Duration(atomic.LoadInt64(&rl.waitTime)),
+	}
+}
+
+// SetRateLimit caps the number of mutations performed by the writer to
+// opsPerSec with bursts of up to burst operations. A non-positive opsPerSec
+// removes the limit. Setting or removing the limit resets the writer's rate
+// limiter statistics. This is useful for throttling background bulk loaders
+// so that they do not affect foreground latency.
+func (w *Writer) SetRateLimit(opsPerSec float64, burst int) {
+	if opsPerSec <= 0 {
+		atomic.StorePointer(&w.limiter, nil)
+		return
+	}
+
+	atomic.StorePointer(&w.limiter, unsafe.Pointer(newRateLimiter(opsPerSec, burst)))
+}
+
+func (w *Writer) getLimiter() *rateLimiter {
+	return (*rateLimiter)(atomic.LoadPointer(&w.limiter))
+}
+
+// RateLimiterStats returns the throttling statistics of the writer
+func (w *Writer) RateLimiterStats() RateLimiterStats {
+	if l := w.getLimiter(); l != nil {
+		return l.stats()
+	}
+
+	return RateLimiterStats{}
+}
+
+// throttle is called once for every mutation, which is also counted for
+// the detection of write-idle periods
+func (w *Writer) throttle() {
+	atomic.AddInt64(&w.mutations, 1)
+	if l := w.getLimiter(); l != nil {
+		l.wait()
+	}
+}
+
+// RateLimiterStats returns the throttling statistics aggregated over all
+// writers of the Nitro instance
+func (m *Nitro) RateLimiterStats() RateLimiterStats {
+	return m.aggrRateLimiterStats()
+}
+
+func (m *Nitro) aggrRateLimiterStats() RateLimiterStats {
+	var sts RateLimiterStats
+	for w := m.wlist; w != nil; w = w.next {
+		wSts := w.RateLimiterStats()
+		sts.Ops += wSts.Ops
+		sts.Waits += wSts.Waits
+		sts.WaitTime += wSts.WaitTime
+	}
+
+	return sts
+}
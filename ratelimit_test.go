@@ -0,0 +1,53 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterRateLimit(t *testing.T) {
+	db := New()
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.SetRateLimit(1000, 10)
+
+	t0 := time.Now()
+	for i := 0; i < 210; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	dur := time.Since(t0)
+
+	if dur < 150*time.Millisecond {
+		t.Errorf("Expected writes to be throttled, took %v", dur)
+	}
+
+	sts := w.RateLimiterStats()
+	if sts.Ops != 210 || sts.Waits == 0 {
+		t.Errorf("Unexpected rate limiter stats\n%s", sts)
+	}
+
+	if dbSts := db.RateLimiterStats(); dbSts != sts {
+		t.Errorf("Expected aggregated stats to match writer stats\n%s", dbSts)
+	}
+
+	if !strings.Contains(db.DumpStats(), "ratelimit_ops       = 210") {
+		t.Errorf("Expected rate limiter stats in DumpStats")
+	}
+
+	w.SetRateLimit(0, 0)
+	if sts := w.RateLimiterStats(); sts.Ops != 0 {
+		t.Errorf("Expected empty stats after removing limit, got %d ops", sts.Ops)
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elliotcourant/nitro"
+)
+
+// FollowerOptions configures a Follower
+type FollowerOptions struct {
+	// Compare orders item keys and must match the comparator of the Nitro
+	// instance. bytes.Compare is used if nil.
+	Compare nitro.KeyCompare
+	// HeartbeatTimeout is the time after which a silent leader connection
+	// is considered dead
+	HeartbeatTimeout time.Duration
+	// RetryInterval is the delay between reconnect attempts
+	RetryInterval time.Duration
+	// OnCommit is invoked after a change set has been applied
+	OnCommit func(seqno uint64)
+}
+
+// DefaultFollowerOptions returns the default follower options
+func DefaultFollowerOptions() FollowerOptions {
+	return FollowerOptions{
+		Compare:          bytes.Compare,
+		HeartbeatTimeout: 5 * time.Second,
+		RetryInterval:    time.Second,
+	}
+}
+
+// Follower applies the snapshots published by a leader to a Nitro instance.
+// The instance should not be modified by anyone else and it should be read
+// through the snapshots returned by Snapshot, as the follower creates its
+// snapshots.
+type Follower struct {
+	seqno uint64
+
+	db   *nitro.Nitro
+	addr string
+	opts FollowerOptions
+	w    *nitro.Writer
+
+	// Operations of the batch which is not committed yet
+	ops []op
+	// Full copy of the leader snapshot received in the batch
+	stage *nitro.Nitro
+
+	mu      sync.Mutex
+	snap    *nitro.Snapshot
+	conn    net.Conn
+	running bool
+	closed  bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewFollower creates a follower replicating from the leader at addr
+func NewFollower(db *nitro.Nitro, addr string, opts FollowerOptions) *Follower {
+	if opts.Compare == nil {
+		opts.Compare = bytes.Compare
+	}
+
+	snap, _ := db.NewSnapshot()
+	return &Follower{
+		db:   db,
+		addr: addr,
+		opts: opts,
+		w:    db.NewWriter(),
+		snap: snap,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Seqno returns the sequence number of the last applied change set
+func (f *Follower) Seqno() uint64 {
+	return atomic.LoadUint64(&f.seqno)
+}
+
+// Snapshot returns the snapshot created at the last commit. The caller has
+// to close it. Returns nil once the follower is closed.
+func (f *Follower) Snapshot() *nitro.Snapshot {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.snap == nil || !f.snap.Open() {
+		return nil
+	}
+	return f.snap
+}
+
+// Run replicates from the leader, reconnecting on failures, until Close is
+// called
+func (f *Follower) Run() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return ErrClosed
+	}
+	f.running = true
+	f.mu.Unlock()
+
+	defer close(f.done)
+	for {
+		conn, err := net.DialTimeout("tcp", f.addr, f.opts.HeartbeatTimeout)
+		if err == nil {
+			if f.setConn(conn) {
+				f.replicate(conn)
+			}
+			conn.Close()
+		}
+
+		// Batches are only applied once they are complete
+		f.discard()
+
+		select {
+		case <-f.stop:
+			return ErrClosed
+		case <-time.After(f.opts.RetryInterval):
+		}
+	}
+}
+
+func (f *Follower) setConn(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conn = conn
+	return !f.closed
+}
+
+func (f *Follower) replicate(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	if err := writeMessage(w, message{typ: msgHello, seqno: f.Seqno()}); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(f.opts.HeartbeatTimeout))
+
+		var m message
+		var err error
+		if m, buf, err = readMessage(r, buf); err != nil {
+			return err
+		}
+
+		switch m.typ {
+		case msgReset:
+			err = f.load(r)
+		case msgPut:
+			f.ops = append(f.ops, op{data: copyBytes(m.data)})
+		case msgDelete:
+			f.ops = append(f.ops, op{del: true, data: copyBytes(m.data)})
+		case msgCommit:
+			err = f.commit(m.seqno)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// load receives a full copy of the leader snapshot into a staging instance.
+// It replaces the contents of the instance at the commit.
+func (f *Follower) load(r *bufio.Reader) error {
+	f.discard()
+
+	cfg := nitro.DefaultConfig()
+	cfg.SetKeyComparator(f.opts.Compare)
+	f.stage = nitro.NewWithConfig(cfg)
+	_, err := f.db.LoadFromReader(r, f.stage.NewWriter(), nil)
+	return err
+}
+
+// discard drops the batch which is not committed
+func (f *Follower) discard() {
+	f.ops = nil
+	if f.stage != nil {
+		f.stage.Close()
+		f.stage = nil
+	}
+}
+
+// commit applies the batch and publishes it to readers with a new snapshot.
+// Replacing the previous snapshot lets the garbage collector reclaim the
+// items removed by the batch.
+func (f *Follower) commit(seqno uint64) error {
+	defer f.discard()
+
+	f.mu.Lock()
+	prev := f.snap
+	f.mu.Unlock()
+
+	var err error
+	if f.stage != nil {
+		err = f.apply(func(put, del func([]byte)) error {
+			return f.reset(prev, put, del)
+		})
+	} else {
+		err = f.apply(func(put, del func([]byte)) error {
+			for _, o := range f.ops {
+				if o.del {
+					del(o.data)
+				} else {
+					put(o.data)
+				}
+			}
+			return nil
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	snap, err := f.db.NewSnapshot()
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		snap.Close()
+		return ErrClosed
+	}
+	f.snap = snap
+	f.mu.Unlock()
+	prev.Close()
+
+	atomic.StoreUint64(&f.seqno, seqno)
+	if f.opts.OnCommit != nil {
+		f.opts.OnCommit(seqno)
+	}
+	return nil
+}
+
+// apply passes the operations of a batch to fn. Instances with a block
+// store are only modified through ApplyOps, so the operations are collected
+// in a temporary instance first.
+func (f *Follower) apply(fn func(put, del func([]byte)) error) error {
+	if !f.db.HasBlockStore() {
+		return fn(func(bs []byte) { f.w.Upsert(bs) },
+			func(bs []byte) { f.w.Delete(bs) })
+	}
+
+	cfg := nitro.DefaultConfig()
+	cfg.SetKeyComparator(f.opts.Compare)
+	opsDB := nitro.NewWithConfig(cfg)
+	defer opsDB.Close()
+
+	w := opsDB.NewWriter()
+	if err := fn(func(bs []byte) { w.Upsert(bs) },
+		func(bs []byte) { w.DeleteNonExist(bs) }); err != nil {
+		return err
+	}
+
+	snap, err := opsDB.NewSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	_, err = f.db.ApplyOps(snap, 1)
+	return err
+}
+
+// reset turns the committed snapshot into the staged copy of the leader
+// snapshot by merging both in key order
+func (f *Follower) reset(prev *nitro.Snapshot, put, del func([]byte)) error {
+	snap, err := f.stage.NewSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	ita := prev.NewIterator()
+	defer ita.Close()
+	itb := snap.NewIterator()
+	defer itb.Close()
+
+	ita.SeekFirst()
+	itb.SeekFirst()
+	for ita.Valid() || itb.Valid() {
+		switch {
+		case !itb.Valid():
+			del(ita.Get())
+			ita.Next()
+		case !ita.Valid():
+			put(itb.Get())
+			itb.Next()
+		default:
+			c := f.opts.Compare(ita.Get(), itb.Get())
+			if c < 0 {
+				del(ita.Get())
+				ita.Next()
+			} else if c > 0 {
+				put(itb.Get())
+				itb.Next()
+			} else {
+				if !bytes.Equal(ita.Get(), itb.Get()) {
+					put(itb.Get())
+				}
+				ita.Next()
+				itb.Next()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *Follower) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.snap != nil {
+		f.snap.Close()
+		f.snap = nil
+	}
+}
+
+// Close stops replication, waits for Run to return and releases the
+// snapshot of the last commit
+func (f *Follower) Close() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+
+	f.closed = true
+	close(f.stop)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	running := f.running
+	f.mu.Unlock()
+
+	if running {
+		<-f.done
+	}
+	f.release()
+}
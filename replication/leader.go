@@ -0,0 +1,372 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/elliotcourant/nitro"
+)
+
+// ErrClosed is returned when the leader or follower has been closed
+var ErrClosed = errors.New("replication: closed")
+
+// LeaderOptions configures a Leader
+type LeaderOptions struct {
+	// Compare orders item keys and must match the comparator of the Nitro
+	// instance. bytes.Compare is used if nil.
+	Compare nitro.KeyCompare
+	// Heartbeat is the interval at which idle connections are pinged
+	Heartbeat time.Duration
+	// MaxLog is the number of change sets retained for resuming followers
+	MaxLog int
+}
+
+// DefaultLeaderOptions returns the default leader options
+func DefaultLeaderOptions() LeaderOptions {
+	return LeaderOptions{
+		Compare:   bytes.Compare,
+		Heartbeat: time.Second,
+		MaxLog:    128,
+	}
+}
+
+type op struct {
+	del  bool
+	data []byte
+}
+
+type changeSet struct {
+	seqno uint64
+	ops   []op
+}
+
+// Leader publishes snapshots of a Nitro instance to followers
+type Leader struct {
+	db   *nitro.Nitro
+	opts LeaderOptions
+
+	// Serializes Publish, so that the diff is computed without holding mu
+	pubMu sync.Mutex
+
+	mu      sync.Mutex
+	seqno   uint64
+	snap    *nitro.Snapshot
+	log     []changeSet
+	notify  chan struct{}
+	closed  bool
+	conns   map[net.Conn]struct{}
+	serveWg sync.WaitGroup
+}
+
+// NewLeader creates a replication leader for db
+func NewLeader(db *nitro.Nitro, opts LeaderOptions) *Leader {
+	if opts.Compare == nil {
+		opts.Compare = bytes.Compare
+	}
+
+	return &Leader{
+		db:     db,
+		opts:   opts,
+		notify: make(chan struct{}),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Publish takes a snapshot of the database, records its difference to the
+// previously published snapshot and makes it available to followers.
+// Returns the sequence number of the published snapshot. Followers are not
+// blocked while the difference is computed.
+func (l *Leader) Publish() (uint64, error) {
+	l.pubMu.Lock()
+	defer l.pubMu.Unlock()
+
+	snap, err := l.db.NewSnapshot()
+	if err != nil {
+		return 0, err
+	}
+
+	// Only Publish replaces the published snapshot
+	l.mu.Lock()
+	prev, closed := l.snap, l.closed
+	l.mu.Unlock()
+
+	if closed {
+		snap.Close()
+		return 0, ErrClosed
+	}
+
+	ops := diff(prev, snap, l.opts.Compare)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		snap.Close()
+		return 0, ErrClosed
+	}
+
+	if prev != nil {
+		prev.Close()
+	}
+
+	l.snap = snap
+	l.seqno++
+	l.log = append(l.log, changeSet{seqno: l.seqno, ops: ops})
+	if len(l.log) > l.opts.MaxLog {
+		l.log = append([]changeSet(nil), l.log[len(l.log)-l.opts.MaxLog:]...)
+	}
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+	return l.seqno, nil
+}
+
+// diff returns the operations which turn snapshot a into snapshot b
+func diff(a, b *nitro.Snapshot, cmp nitro.KeyCompare) []op {
+	var ops []op
+	var ita *nitro.Iterator
+
+	if a != nil {
+		ita = a.NewIterator()
+		defer ita.Close()
+		ita.SeekFirst()
+	}
+
+	itb := b.NewIterator()
+	defer itb.Close()
+	itb.SeekFirst()
+
+	for {
+		aValid := ita != nil && ita.Valid()
+		bValid := itb.Valid()
+
+		switch {
+		case !aValid && !bValid:
+			return ops
+		case !bValid:
+			ops = append(ops, op{del: true, data: copyBytes(ita.Get())})
+			ita.Next()
+		case !aValid:
+			ops = append(ops, op{data: copyBytes(itb.Get())})
+			itb.Next()
+		default:
+			c := cmp(ita.Get(), itb.Get())
+			if c < 0 {
+				ops = append(ops, op{del: true, data: copyBytes(ita.Get())})
+				ita.Next()
+			} else if c > 0 {
+				ops = append(ops, op{data: copyBytes(itb.Get())})
+				itb.Next()
+			} else {
+				if !bytes.Equal(ita.Get(), itb.Get()) {
+					ops = append(ops, op{data: copyBytes(itb.Get())})
+				}
+				ita.Next()
+				itb.Next()
+			}
+		}
+	}
+}
+
+func copyBytes(bs []byte) []byte {
+	return append([]byte(nil), bs...)
+}
+
+// Seqno returns the sequence number of the latest published snapshot
+func (l *Leader) Seqno() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seqno
+}
+
+// Serve accepts follower connections until the listener fails or the leader
+// is closed
+func (l *Leader) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			return err
+		}
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.Close()
+			return ErrClosed
+		}
+		l.conns[conn] = struct{}{}
+		l.serveWg.Add(1)
+		l.mu.Unlock()
+
+		go func() {
+			defer l.serveWg.Done()
+			l.serveConn(conn)
+
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// pending returns the change sets after seqno. If they are no longer
+// retained, reset is true and the latest snapshot is returned with an
+// additional reference which the caller has to release.
+func (l *Leader) pending(seqno uint64) (sets []changeSet, snap *nitro.Snapshot,
+	latest uint64, notify chan struct{}, err error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil, nil, 0, nil, ErrClosed
+	}
+
+	latest, notify = l.seqno, l.notify
+	if seqno == l.seqno || l.snap == nil {
+		return
+	}
+
+	if seqno > l.seqno || len(l.log) == 0 || l.log[0].seqno > seqno+1 {
+		if l.snap.Open() {
+			snap = l.snap
+		}
+		return
+	}
+
+	for _, cs := range l.log {
+		if cs.seqno > seqno {
+			sets = append(sets, cs)
+		}
+	}
+	return
+}
+
+func (l *Leader) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	conn.SetReadDeadline(time.Now().Add(l.opts.Heartbeat * 10))
+	hello, _, err := readMessage(r, nil)
+	if err != nil || hello.typ != msgHello {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Detect disconnects while waiting for changes
+	closed := make(chan struct{})
+	go func() {
+		r.ReadByte()
+		close(closed)
+	}()
+
+	seqno := hello.seqno
+	for {
+		sets, snap, latest, notify, err := l.pending(seqno)
+		if err != nil {
+			return
+		}
+
+		if snap != nil {
+			err = l.sendSnapshot(w, snap, latest)
+			snap.Close()
+		} else {
+			for _, cs := range sets {
+				if err = l.sendChangeSet(w, cs); err != nil {
+					break
+				}
+			}
+		}
+
+		if err == nil {
+			err = w.Flush()
+		}
+
+		if err != nil {
+			return
+		}
+		seqno = latest
+
+		select {
+		case <-notify:
+		case <-closed:
+			return
+		case <-time.After(l.opts.Heartbeat):
+			if writeMessage(w, message{typ: msgHeartbeat}) != nil || w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+func (l *Leader) sendSnapshot(w *bufio.Writer, snap *nitro.Snapshot, seqno uint64) error {
+	if err := writeMessage(w, message{typ: msgReset}); err != nil {
+		return err
+	}
+
+	if err := l.db.StoreToWriter(snap, w); err != nil {
+		return err
+	}
+
+	return writeMessage(w, message{typ: msgCommit, seqno: seqno})
+}
+
+func (l *Leader) sendChangeSet(w *bufio.Writer, cs changeSet) error {
+	for _, o := range cs.ops {
+		typ := msgPut
+		if o.del {
+			typ = msgDelete
+		}
+
+		if err := writeMessage(w, message{typ: typ, data: o.data}); err != nil {
+			return err
+		}
+	}
+
+	return writeMessage(w, message{typ: msgCommit, seqno: cs.seqno})
+}
+
+// Close disconnects all followers and releases the published snapshot
+func (l *Leader) Close() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+
+	l.closed = true
+	close(l.notify)
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+
+	l.serveWg.Wait()
+
+	l.pubMu.Lock()
+	defer l.pubMu.Unlock()
+	if l.snap != nil {
+		l.snap.Close()
+		l.snap = nil
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package replication implements a minimal leader/follower replication
+// transport for Nitro over TCP.
+//
+// The leader publishes snapshots. Every published snapshot gets a sequence
+// number and the difference to the previously published snapshot is retained
+// in a bounded in-memory log. A follower connects, announces the last
+// sequence number it has applied and receives either the missing change sets
+// or, if they are no longer retained, a full copy of the latest snapshot
+// written with StoreToWriter. The leader sends heartbeats while idle and
+// followers reconnect and resume after connection failures.
+//
+// Change sets and full copies are applied by the follower as a batch which
+// ends with a commit. Followers with a block store apply the batch with
+// ApplyOps. A snapshot is created at every commit, so readers of the
+// follower never observe a partially applied batch.
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	msgHello byte = iota + 1
+	msgReset
+	msgPut
+	msgDelete
+	msgCommit
+	msgHeartbeat
+)
+
+const maxMessageSize = 64 * 1024 * 1024
+
+var errMessageTooLarge = errors.New("replication: message too large")
+
+type message struct {
+	typ   byte
+	seqno uint64
+	data  []byte
+}
+
+func writeMessage(w *bufio.Writer, m message) error {
+	var hdr [9]byte
+	hdr[0] = m.typ
+	switch m.typ {
+	case msgHello, msgCommit:
+		binary.BigEndian.PutUint64(hdr[1:9], m.seqno)
+		_, err := w.Write(hdr[:9])
+		return err
+	case msgPut, msgDelete:
+		binary.BigEndian.PutUint32(hdr[1:5], uint32(len(m.data)))
+		if _, err := w.Write(hdr[:5]); err != nil {
+			return err
+		}
+		_, err := w.Write(m.data)
+		return err
+	default:
+		return w.WriteByte(m.typ)
+	}
+}
+
+// readMessage reads the next message. The data of the returned message is
+// only valid until the next call.
+func readMessage(r *bufio.Reader, buf []byte) (message, []byte, error) {
+	var m message
+	var hdr [8]byte
+
+	typ, err := r.ReadByte()
+	if err != nil {
+		return m, buf, err
+	}
+
+	m.typ = typ
+	switch typ {
+	case msgHello, msgCommit:
+		if _, err = io.ReadFull(r, hdr[:8]); err == nil {
+			m.seqno = binary.BigEndian.Uint64(hdr[:8])
+		}
+	case msgPut, msgDelete:
+		if _, err = io.ReadFull(r, hdr[:4]); err != nil {
+			break
+		}
+
+		l := int(binary.BigEndian.Uint32(hdr[:4]))
+		if l > maxMessageSize {
+			return m, buf, errMessageTooLarge
+		}
+
+		if cap(buf) < l {
+			buf = make([]byte, l)
+		}
+		m.data = buf[:l]
+		_, err = io.ReadFull(r, m.data)
+	case msgReset, msgHeartbeat:
+	default:
+		err = fmt.Errorf("replication: unknown message type %d", typ)
+	}
+
+	return m, buf, err
+}
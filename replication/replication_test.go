@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package replication
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elliotcourant/nitro"
+)
+
+func items(f *Follower) []string {
+	snap := f.Snapshot()
+	defer snap.Close()
+
+	var out []string
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		out = append(out, string(itr.Get()))
+	}
+	return out
+}
+
+func waitSeqno(t *testing.T, f *Follower, seqno uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for f.Seqno() < seqno {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower stuck at seqno %d, expected %d", f.Seqno(), seqno)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	testReplication(t, nitro.DefaultConfig())
+}
+
+func TestReplicationBlockStore(t *testing.T) {
+	cfg := nitro.DefaultConfig()
+	cfg.SetBlockStoreDir(t.TempDir())
+	if !cfg.HasBlockStore() {
+		t.Skip("block store is not supported")
+	}
+
+	testReplication(t, cfg)
+}
+
+func testReplication(t *testing.T, cfg nitro.Config) {
+	leaderDB := nitro.New()
+	defer leaderDB.Close()
+	followerDB := nitro.NewWithConfig(cfg)
+	defer followerDB.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultLeaderOptions()
+	opts.Heartbeat = 10 * time.Millisecond
+	opts.MaxLog = 2
+	leader := NewLeader(leaderDB, opts)
+	go leader.Serve(ln)
+	defer leader.Close()
+
+	w := leaderDB.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("item-%03d", i)))
+	}
+	seqno, _ := leader.Publish()
+
+	fopts := DefaultFollowerOptions()
+	fopts.RetryInterval = 10 * time.Millisecond
+	follower := NewFollower(followerDB, ln.Addr().String(), fopts)
+	go follower.Run()
+	defer follower.Close()
+
+	waitSeqno(t, follower, seqno)
+	if got := items(follower); len(got) != 100 {
+		t.Fatalf("expected 100 items, got %d", len(got))
+	}
+
+	// Incremental change sets
+	for i := 0; i < 50; i++ {
+		w.Delete([]byte(fmt.Sprintf("item-%03d", i)))
+	}
+	w.Put([]byte("item-999"))
+	seqno, _ = leader.Publish()
+	waitSeqno(t, follower, seqno)
+
+	got := items(follower)
+	if len(got) != 51 || got[0] != "item-050" || got[50] != "item-999" {
+		t.Fatalf("unexpected items after diff %v", got)
+	}
+
+	// Change sets dropped from the log require a full resync
+	follower.Close()
+	for i := 0; i < 5; i++ {
+		w.Put([]byte(fmt.Sprintf("new-%d", i)))
+		seqno, _ = leader.Publish()
+	}
+
+	follower = NewFollower(followerDB, ln.Addr().String(), fopts)
+	follower.seqno = seqno - 5
+	go follower.Run()
+	defer follower.Close()
+	waitSeqno(t, follower, seqno)
+
+	if got := items(follower); len(got) != 56 {
+		t.Fatalf("expected 56 items after resync, got %d", len(got))
+	}
+}
@@ -0,0 +1,238 @@
+package nitro
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdaptiveConcurrency lets LoadFromDisk choose the number of concurrent shard
+// readers based on the observed restore throughput
+const AdaptiveConcurrency = 0
+
+var restoreTuneInterval = 100 * time.Millisecond
+
+// maxRestoreReaders bounds the number of shard readers of an adaptive
+// restore. Readers waiting for I/O do not use a CPU.
+func maxRestoreReaders(nshards int) int {
+	n := 4 * runtime.GOMAXPROCS(0)
+	if n > nshards {
+		n = nshards
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
+
+// restoreReaders returns the maximum number of shard readers of a restore
+func restoreReaders(concurr, nshards int) int {
+	if concurr > 0 {
+		return concurr
+	}
+
+	return maxRestoreReaders(nshards)
+}
+
+// runShards calls fn for every shard from concurrent readers, fn gets the id
+// of the reader. With a positive concurr, the number of readers is fixed.
+// Otherwise readers are added while the throughput improves and removed when
+// it drops while the readers are waiting for I/O.
+func runShards(nshards, concurr int, p *loadProgress, fn func(id, shard int)) {
+	var wg sync.WaitGroup
+	shards := make(chan int, nshards)
+	for i := 0; i < nshards; i++ {
+		shards <- i
+	}
+	close(shards)
+
+	if concurr > 0 {
+		atomic.StoreInt32(&p.readers, int32(concurr))
+		for i := 0; i < concurr; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				for shard := range shards {
+					fn(id, shard)
+				}
+			}(i)
+		}
+
+		wg.Wait()
+		return
+	}
+
+	maxReaders := maxRestoreReaders(nshards)
+	remaining := int64(nshards)
+	reader := func(id int) {
+		defer wg.Done()
+		for atomic.LoadInt64(&remaining) > 0 {
+			// Readers beyond the limit are parked
+			if int32(id) >= atomic.LoadInt32(&p.readers) {
+				time.Sleep(restoreTuneInterval / 10)
+				continue
+			}
+
+			shard, ok := <-shards
+			if !ok {
+				return
+			}
+
+			atomic.AddInt64(&remaining, -1)
+			fn(id, shard)
+		}
+	}
+
+	// All readers are started, readers beyond the limit stay parked
+	limit := 1
+	if maxReaders > 1 {
+		limit = 2
+	}
+	atomic.StoreInt32(&p.readers, int32(limit))
+
+	for i := 0; i < maxReaders; i++ {
+		wg.Add(1)
+		go reader(i)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	ticker := time.NewTicker(restoreTuneInterval)
+	defer ticker.Stop()
+
+	var best float64
+	lastBytes, lastTime := atomic.LoadInt64(&p.bytesRead), time.Now()
+	for {
+		select {
+		case <-finished:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		bytes := atomic.LoadInt64(&p.bytesRead)
+		rate := float64(bytes-lastBytes) / now.Sub(lastTime).Seconds()
+		lastBytes, lastTime = bytes, now
+		depth := int(atomic.LoadInt32(&p.ioDepth))
+
+		switch {
+		case rate > best*1.05 && limit < maxReaders:
+			best = rate
+			limit++
+		case rate < best*0.8 && limit > 1 && depth >= limit/2:
+			// Too many readers for the device
+			best = rate
+			limit--
+		case rate > best:
+			best = rate
+		}
+
+		atomic.StoreInt32(&p.readers, int32(limit))
+	}
+}
+
+// LoadConflictFn resolves the conflict between an item of an instance and
+// an item with the same key loaded from a backup. It returns the item to
+// keep.
+type LoadConflictFn func(existing, loaded []byte) []byte
+
+// KeepExisting is a LoadConflictFn which keeps the items of the instance
+func KeepExisting(existing, loaded []byte) []byte {
+	return existing
+}
+
+// ReplaceExisting is a LoadConflictFn which replaces the items of the
+// instance with the items of the backup
+func ReplaceExisting(existing, loaded []byte) []byte {
+	return loaded
+}
+
+// SetLoadConflictFn sets how LoadFromDisk resolves conflicts between the
+// items of a non-empty instance and the items of the backup. The default is
+// ReplaceExisting.
+func (cfg *Config) SetLoadConflictFn(fn LoadConflictFn) {
+	cfg.onLoadConflict = fn
+}
+
+// isEmpty reports whether the instance holds no items, including deleted
+// items which are not garbage collected yet
+func (m *Nitro) isEmpty() bool {
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	iter := m.store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+
+	iter.SeekFirst()
+	return !iter.Valid()
+}
+
+// mergeFromDisk loads a backup into a temporary instance and merges its
+// items into the instance in key order. The item callback observes the items
+// of the temporary instance. It also returns the number of loaded items.
+func (m *Nitro) mergeFromDisk(dir string, concurr int, callb ItemCallback) (*Snapshot, int64, error) {
+	conf := DefaultConfig()
+	conf.SetKeyComparator(m.keyCmp)
+	conf.fileType = m.fileType
+	conf.useDeltaFiles = m.DeltaInterleaving()
+	conf.decodeItemFn = m.decodeItemFn
+	conf.dumpFormat = m.dumpFormat
+	conf.itemMetaSize = m.itemMetaSize
+	tmp := NewWithConfig(conf)
+	defer tmp.Close()
+
+	loaded, err := tmp.LoadFromDisk(dir, concurr, callb)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer loaded.Close()
+	items := loaded.Count()
+
+	snap, err := m.NewSnapshot()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer snap.Close()
+
+	resolve := m.onLoadConflict
+	if resolve == nil {
+		resolve = ReplaceExisting
+	}
+
+	err = m.modify(restoreReaders(concurr, runtime.GOMAXPROCS(0)), func(put, del func([]byte)) error {
+		ita := snap.NewIterator()
+		defer ita.Close()
+		itb := loaded.NewIterator()
+		defer itb.Close()
+
+		ita.SeekFirst()
+		for itb.SeekFirst(); itb.Valid(); itb.Next() {
+			itm := itb.Get()
+			for ita.Valid() && m.keyCmp(ita.Get(), itm) < 0 {
+				ita.Next()
+			}
+
+			if !ita.Valid() || m.keyCmp(ita.Get(), itm) != 0 {
+				put(itm)
+			} else if res := resolve(ita.Get(), itm); !bytes.Equal(res, ita.Get()) {
+				put(res)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	merged, err := m.NewSnapshot()
+	return merged, items, err
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Number of skiplist nodes sampled from the index levels for estimations
+const defaultSampleSize = 4096
+
+// isVisible reports whether the item is part of the snapshot
+func (s *Snapshot) isVisible(itm *Item) bool {
+	return itm.bornSn != 0 && itm.bornSn <= s.sn && (itm.deadSn == 0 || itm.deadSn > s.sn)
+}
+
+// sampleItems invokes fn for the snapshot items sampled from the skiplist
+// index levels along with the approximate number of items each one represents.
+func (s *Snapshot) sampleItems(n int, fn func(itm *Item, weight float64)) {
+	db := s.db
+	barrier := db.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	itms, weight := db.store.SampleItems(n)
+	for _, p := range itms {
+		if itm := (*Item)(p); s.isVisible(itm) {
+			fn(itm, weight)
+		}
+	}
+}
+
+// CountPrefixes returns the approximate number of items for every distinct
+// key prefix of length `depth` bytes in the snapshot. Items shorter than depth
+// are accounted under their full data. The counts are estimated by sampling
+// the upper levels of the skiplist and are not available in block store mode.
+func (s *Snapshot) CountPrefixes(depth int) map[string]int64 {
+	if s.db.HasBlockStore() {
+		return nil
+	}
+
+	counts := make(map[string]float64)
+	s.sampleItems(defaultSampleSize, func(itm *Item, weight float64) {
+		bs := itm.Bytes()
+		if len(bs) > depth {
+			bs = bs[:depth]
+		}
+		counts[string(bs)] += weight
+	})
+
+	result := make(map[string]int64, len(counts))
+	for k, v := range counts {
+		result[k] = int64(v + 0.5)
+	}
+
+	return result
+}
+
+// SampleKeys returns up to n items of the snapshot drawn approximately
+// uniformly at random, in key order, e.g., to plan the partitioning of key
+// ranges. The items are drawn from the nodes of the lowest skiplist index
+// level with at least n nodes. Since the node towers are built randomly,
+// these nodes are a random subset of the items and a sample costs O(n)
+// instead of a scan. Fewer items are returned if the snapshot has fewer than
+// about n items. With a block store, the first items of randomly drawn data
+// blocks are returned.
+func (s *Snapshot) SampleKeys(n int) [][]byte {
+	if n <= 0 {
+		return nil
+	}
+
+	var keys [][]byte
+	var seen int
+	s.sampleItems(n, func(itm *Item, weight float64) {
+		// Reservoir sampling of the nodes of the level
+		if seen++; len(keys) < n {
+			keys = append(keys, append([]byte(nil), itm.Bytes()...))
+		} else if j := rand.Intn(seen); j < n {
+			keys[j] = append(keys[j][:0], itm.Bytes()...)
+		}
+	})
+
+	sort.Slice(keys, func(i, j int) bool {
+		return s.db.keyCmp(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+// MemoryInRange returns the approximate number of bytes consumed by skiplist
+// nodes and items in the key range [start, end). A nil start or end denotes
+// an unbounded range. All item versions held in memory, including the ones
+// only visible to older snapshots, are accounted. The estimate is based on
+// sampling the upper levels of the skiplist.
+func (m *Nitro) MemoryInRange(start, end []byte) int64 {
+	var totalCount, totalItemBytes, count, itemBytes float64
+
+	barrier := m.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	itms, weight := m.store.SampleItems(defaultSampleSize)
+	for _, p := range itms {
+		itm := (*Item)(p)
+		sz := float64(m.itemSize(p)) * weight
+		totalCount += weight
+		totalItemBytes += sz
+
+		bs := itm.Bytes()
+		if (start == nil || m.keyCmp(bs, start) >= 0) && (end == nil || m.keyCmp(bs, end) < 0) {
+			count += weight
+			itemBytes += sz
+		}
+	}
+
+	if totalCount == 0 {
+		return 0
+	}
+
+	nodeBytes := float64(m.aggrStoreStats().Memory) - totalItemBytes
+	if nodeBytes < 0 {
+		nodeBytes = 0
+	}
+
+	return int64(itemBytes + nodeBytes*count/totalCount)
+}
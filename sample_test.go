@@ -0,0 +1,126 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCountPrefixes(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 8000; i++ {
+		w.Put([]byte(fmt.Sprintf("%c-%06d", 'a'+i%4, i)))
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	counts := snap.CountPrefixes(1)
+	if len(counts) != 4 {
+		t.Errorf("Expected 4 prefixes, got %v", counts)
+	}
+
+	var total int64
+	for p, c := range counts {
+		if c < 1000 || c > 3000 {
+			t.Errorf("Prefix %s count %d is too far from 2000", p, c)
+		}
+		total += c
+	}
+
+	if total < 6000 || total > 10000 {
+		t.Errorf("Total estimate %d is too far from 8000", total)
+	}
+}
+
+func TestMemoryInRange(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 8000; i++ {
+		w.Put([]byte(fmt.Sprintf("%06d", i)))
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	total := db.MemoryInRange(nil, nil)
+	if inUse := db.store.MemoryInUse(); total < inUse*9/10 || total > inUse*11/10 {
+		t.Errorf("Expected estimate %d close to %d", total, inUse)
+	}
+
+	half := db.MemoryInRange(nil, []byte(fmt.Sprintf("%06d", 4000)))
+	if half < total/3 || half > total*2/3 {
+		t.Errorf("Expected estimate %d close to half of %d", half, total)
+	}
+}
+
+func TestSampleKeys(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 100000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%06d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	// Deleted items are not sampled
+	for i := 0; i < n/2; i++ {
+		w.Delete([]byte(fmt.Sprintf("%06d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	keys := snap1.SampleKeys(1000)
+	if len(keys) != 1000 {
+		t.Fatalf("Expected 1000 keys, got %d", len(keys))
+	}
+
+	var quarters [4]int
+	for i, k := range keys {
+		if i > 0 && string(keys[i-1]) >= string(k) {
+			t.Fatalf("Expected keys in order, got %s after %s", k, keys[i-1])
+		}
+		var v int
+		fmt.Sscanf(string(k), "%d", &v)
+		quarters[v*4/n]++
+	}
+	for q, c := range quarters {
+		if c < 150 || c > 350 {
+			t.Errorf("Quarter %d has %d keys, expected about 250", q, c)
+		}
+	}
+
+	for _, k := range snap2.SampleKeys(500) {
+		if string(k) < fmt.Sprintf("%06d", n/2) {
+			t.Errorf("Unexpected deleted key %s", k)
+		}
+	}
+
+	small := NewWithConfig(testConf)
+	defer small.Close()
+	sw := small.NewWriter()
+	for i := 0; i < 5; i++ {
+		sw.Put([]byte{byte(i)})
+	}
+	snap3, _ := sw.NewSnapshot()
+	defer snap3.Close()
+	if keys := snap3.SampleKeys(10); len(keys) != 5 {
+		t.Errorf("Expected all 5 keys, got %d", len(keys))
+	}
+}
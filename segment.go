@@ -0,0 +1,529 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	segmentMagic = 0x4e534547 // "NSEG"
+
+	// Every segmentIndexInterval-th item of a segment is indexed
+	segmentIndexInterval = 64
+
+	// Segment footer: index offset, items count and magic
+	segmentFooterSize = 20
+
+	// Number of items folded into the skiplist at once
+	segmentFoldChunk = 1024
+)
+
+// ErrInvalidSegment means a file is not a segment written by WriteSegment
+var ErrInvalidSegment = fmt.Errorf("Invalid segment file")
+
+// WriteSegment writes the items of a pre-sorted source to a read-only
+// segment file which can be attached to instances with the same key
+// comparator by AttachSegment, and returns the number of items. The segment
+// stores the items followed by a sparse index of the keys. The order of the
+// items is validated like IngestSorted.
+//
+// Segment layout:
+// [4 len][item]... [4 len][key][8 offset]... [8 index offset][8 count][4 magic]
+func (m *Nitro) WriteSegment(path string, src SortedSource) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	type indexEntry struct {
+		key    []byte
+		offset int64
+	}
+
+	w := bufio.NewWriterSize(f, DiskBlockSize)
+	r := &sortedReader{m: m, src: src}
+	buf := make([]byte, segmentFooterSize)
+
+	var index []indexEntry
+	var offset int64
+	writeRecord := func(bs []byte) error {
+		binary.BigEndian.PutUint32(buf[0:4], uint32(len(bs)))
+		if _, err := w.Write(buf[0:4]); err != nil {
+			return err
+		}
+		_, err := w.Write(bs)
+		offset += 4 + int64(len(bs))
+		return err
+	}
+
+	for {
+		bs, err := r.next()
+		if err != nil {
+			return r.count, err
+		} else if bs == nil {
+			break
+		}
+
+		if (r.count-1)%segmentIndexInterval == 0 {
+			index = append(index, indexEntry{key: append([]byte(nil), bs...), offset: offset})
+		}
+		if err := writeRecord(bs); err != nil {
+			return r.count, err
+		}
+	}
+
+	indexOffset := offset
+	for _, e := range index {
+		if err := writeRecord(e.key); err != nil {
+			return r.count, err
+		}
+		binary.BigEndian.PutUint64(buf[0:8], uint64(e.offset))
+		if _, err := w.Write(buf[0:8]); err != nil {
+			return r.count, err
+		}
+	}
+
+	binary.BigEndian.PutUint64(buf[0:8], uint64(indexOffset))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(r.count))
+	binary.BigEndian.PutUint32(buf[16:20], segmentMagic)
+	if _, err := w.Write(buf); err != nil {
+		return r.count, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return r.count, err
+	}
+	return r.count, f.Sync()
+}
+
+// ExternalSegment is a read-only segment file attached to an instance by
+// AttachSegment
+type ExternalSegment struct {
+	m    *Nitro
+	path string
+	f    *os.File
+
+	count   int64
+	dataEnd int64
+	keys    [][]byte
+	offsets []int64
+
+	// References of the instance and the snapshots, the file is closed
+	// with the last one
+	refs int32
+
+	done    chan struct{}
+	foldErr error
+}
+
+func (m *Nitro) openSegment(path string) (*ExternalSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seg, err := m.readSegmentIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	seg.path = path
+	return seg, nil
+}
+
+func (m *Nitro) readSegmentIndex(f *os.File) (*ExternalSegment, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := fi.Size()
+	buf := make([]byte, segmentFooterSize)
+	if size < segmentFooterSize {
+		return nil, ErrInvalidSegment
+	}
+	if _, err := f.ReadAt(buf, size-segmentFooterSize); err != nil {
+		return nil, err
+	}
+
+	seg := &ExternalSegment{
+		m:       m,
+		f:       f,
+		dataEnd: int64(binary.BigEndian.Uint64(buf[0:8])),
+		count:   int64(binary.BigEndian.Uint64(buf[8:16])),
+		refs:    1,
+		done:    make(chan struct{}),
+	}
+	if binary.BigEndian.Uint32(buf[16:20]) != segmentMagic ||
+		seg.dataEnd > size-segmentFooterSize {
+		return nil, ErrInvalidSegment
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, seg.dataEnd, size-segmentFooterSize-seg.dataEnd))
+	for {
+		if _, err := io.ReadFull(r, buf[0:4]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, ErrInvalidSegment
+		}
+
+		key := make([]byte, binary.BigEndian.Uint32(buf[0:4]))
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, ErrInvalidSegment
+		}
+		if _, err := io.ReadFull(r, buf[0:8]); err != nil {
+			return nil, ErrInvalidSegment
+		}
+
+		seg.keys = append(seg.keys, key)
+		seg.offsets = append(seg.offsets, int64(binary.BigEndian.Uint64(buf[0:8])))
+	}
+
+	return seg, nil
+}
+
+// Path returns the path of the segment file
+func (s *ExternalSegment) Path() string {
+	return s.path
+}
+
+// Count returns the number of items in the segment
+func (s *ExternalSegment) Count() int64 {
+	return s.count
+}
+
+// Folded returns true once all items of the segment have been inserted into
+// the skiplist and the segment has been detached
+func (s *ExternalSegment) Folded() bool {
+	select {
+	case <-s.done:
+		return s.foldErr == nil
+	default:
+		return false
+	}
+}
+
+// Wait blocks until the background fold of the segment has finished and
+// returns its error. A segment which could not be folded remains attached.
+func (s *ExternalSegment) Wait() error {
+	<-s.done
+	return s.foldErr
+}
+
+func (s *ExternalSegment) acquire() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+func (s *ExternalSegment) release() {
+	if atomic.AddInt32(&s.refs, -1) == 0 {
+		s.f.Close()
+	}
+}
+
+// segmentCursor reads the items of a segment in key order
+type segmentCursor struct {
+	seg  *ExternalSegment
+	r    *bufio.Reader
+	left int64
+	buf  [4]byte
+	curr []byte
+	err  error
+}
+
+func (c *segmentCursor) reset(offset int64) {
+	c.left = c.seg.dataEnd - offset
+	c.r = bufio.NewReaderSize(io.NewSectionReader(c.seg.f, offset, c.left), DiskBlockSize)
+	c.next()
+}
+
+func (c *segmentCursor) seekFirst() {
+	c.reset(0)
+}
+
+// seek positions the cursor at the first item not smaller than key
+func (c *segmentCursor) seek(key []byte) {
+	cmp := c.seg.m.keyCmp
+	i := sort.Search(len(c.seg.keys), func(i int) bool {
+		return cmp(c.seg.keys[i], key) > 0
+	})
+
+	var offset int64
+	if i > 0 {
+		offset = c.seg.offsets[i-1]
+	}
+
+	for c.reset(offset); c.curr != nil && cmp(c.curr, key) < 0; c.next() {
+	}
+}
+
+func (c *segmentCursor) next() {
+	c.curr = nil
+	if c.left <= 0 || c.err != nil {
+		return
+	}
+
+	if _, err := io.ReadFull(c.r, c.buf[:]); err != nil {
+		c.err = err
+		return
+	}
+
+	l := int(binary.BigEndian.Uint32(c.buf[:]))
+	data := make([]byte, l)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.err = err
+		return
+	}
+
+	c.left -= 4 + int64(l)
+	c.curr = data
+}
+
+// segmentRegistry holds the segments attached to an instance
+type segmentRegistry struct {
+	// Serializes folding with NewSnapshot, which may not run concurrently
+	// with writers
+	sync.Mutex
+	list []*ExternalSegment
+	last *ExternalSegment
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// acquire returns the attached segments with a reference for a snapshot.
+// The caller holds the lock.
+func (r *segmentRegistry) acquire() []*ExternalSegment {
+	for _, seg := range r.list {
+		seg.acquire()
+	}
+	return r.list
+}
+
+// AttachSegment attaches a segment file written by WriteSegment. Its items
+// are visible instantly in the merged iterators of the snapshots created
+// afterwards, while a background job folds them into the skiplist through a
+// writer. The segment is detached once folded, snapshots created from then
+// on find the items in the skiplist.
+//
+// An item of the skiplist takes precedence over the items with the same key
+// of the segments, which take precedence in the order they were attached.
+// Items of a segment cannot be deleted before the segment is folded, see
+// ExternalSegment.Wait. Block stores are not supported.
+func (m *Nitro) AttachSegment(path string) (*ExternalSegment, error) {
+	if m.HasBlockStore() {
+		return nil, ErrBlockStoreUnsupported
+	}
+
+	seg, err := m.openSegment(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m.segments.Lock()
+	defer m.segments.Unlock()
+
+	if m.segments.stop == nil {
+		m.segments.stop = make(chan struct{})
+	}
+	m.segments.list = append(m.segments.list[:len(m.segments.list):len(m.segments.list)], seg)
+
+	// Segments are folded in the order they were attached
+	prev := m.segments.last
+	m.segments.last = seg
+	w := m.NewWriter()
+
+	m.segments.wg.Add(1)
+	go func() {
+		defer m.segments.wg.Done()
+		if prev != nil {
+			<-prev.done
+		}
+
+		seg.foldErr = m.foldSegment(seg, w)
+		close(seg.done)
+	}()
+
+	return seg, nil
+}
+
+// foldSegment inserts the items of a segment into the skiplist in chunks,
+// each of them excluding NewSnapshot, and detaches the segment
+func (m *Nitro) foldSegment(seg *ExternalSegment, w *Writer) error {
+	c := &segmentCursor{seg: seg}
+	c.seekFirst()
+
+	for c.curr != nil {
+		select {
+		case <-m.segments.stop:
+			return ErrShutdown
+		default:
+		}
+
+		m.segments.Lock()
+		for i := 0; i < segmentFoldChunk && c.curr != nil; i++ {
+			w.Put(c.curr)
+			c.next()
+		}
+		m.segments.Unlock()
+	}
+
+	if c.err != nil {
+		return c.err
+	}
+
+	m.segments.Lock()
+	defer m.segments.Unlock()
+
+	var list []*ExternalSegment
+	for _, s := range m.segments.list {
+		if s != seg {
+			list = append(list, s)
+		}
+	}
+	m.segments.list = list
+	seg.release()
+	return nil
+}
+
+// closeSegments stops the background folds and releases the segments
+func (m *Nitro) closeSegments() {
+	m.segments.Lock()
+	stop := m.segments.stop
+	m.segments.Unlock()
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	m.segments.wg.Wait()
+	for _, seg := range m.segments.list {
+		seg.release()
+	}
+	m.segments.list = nil
+}
+
+// MergedIterator iterates over the items of a snapshot and the segments
+// attached when the snapshot was created in key order
+type MergedIterator struct {
+	itr     *Iterator
+	cursors []*segmentCursor
+
+	// Source of the current item, -1 for the skiplist
+	src  int
+	curr []byte
+}
+
+// NewMergedIterator creates an iterator which merges the items of the
+// snapshot with the items of the attached segments which have not been
+// folded into the skiplist as of the snapshot.
+func (s *Snapshot) NewMergedIterator() *MergedIterator {
+	itr := s.NewIterator()
+	if itr == nil {
+		return nil
+	}
+
+	it := &MergedIterator{itr: itr}
+	for _, seg := range s.segments {
+		it.cursors = append(it.cursors, &segmentCursor{seg: seg})
+	}
+	return it
+}
+
+// pick selects the smallest current item of the sources
+func (it *MergedIterator) pick() {
+	cmp := it.itr.snap.db.keyCmp
+	it.src, it.curr = -1, nil
+	if it.itr.Valid() {
+		it.curr = it.itr.Get()
+	}
+
+	for i, c := range it.cursors {
+		if c.curr != nil && (it.curr == nil || cmp(c.curr, it.curr) < 0) {
+			it.src, it.curr = i, c.curr
+		}
+	}
+}
+
+// SeekFirst moves the cursor to the beginning
+func (it *MergedIterator) SeekFirst() {
+	it.itr.SeekFirst()
+	for _, c := range it.cursors {
+		c.seekFirst()
+	}
+	it.pick()
+}
+
+// Seek moves the cursor to the item with key or the next bigger one
+func (it *MergedIterator) Seek(bs []byte) {
+	if bs == nil {
+		it.SeekFirst()
+		return
+	}
+
+	it.itr.Seek(bs)
+	for _, c := range it.cursors {
+		c.seek(bs)
+	}
+	it.pick()
+}
+
+// Valid returns false when the iterator has reached the end
+func (it *MergedIterator) Valid() bool {
+	return it.curr != nil
+}
+
+// Get returns the current item data
+func (it *MergedIterator) Get() []byte {
+	return it.curr
+}
+
+// Next moves the cursor to the next item, skipping the items with the same
+// key in the other sources
+func (it *MergedIterator) Next() {
+	cmp := it.itr.snap.db.keyCmp
+	key := it.curr
+	if it.itr.Valid() && cmp(it.itr.Get(), key) == 0 {
+		it.itr.Next()
+	}
+	for _, c := range it.cursors {
+		if c.curr != nil && cmp(c.curr, key) == 0 {
+			c.next()
+		}
+	}
+	it.pick()
+}
+
+// Err returns the first error reading the snapshot or the segments
+func (it *MergedIterator) Err() error {
+	if err := it.itr.Err(); err != nil {
+		return err
+	}
+	for _, c := range it.cursors {
+		if c.err != nil {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// Close releases the iterator
+func (it *MergedIterator) Close() {
+	it.itr.Close()
+}
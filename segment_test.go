@@ -0,0 +1,113 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func countMerged(t *testing.T, snap *Snapshot, start []byte) int {
+	it := snap.NewMergedIterator()
+	defer it.Close()
+
+	count := 0
+	var last []byte
+	for it.Seek(start); it.Valid(); it.Next() {
+		if last != nil && bytes.Compare(last, it.Get()) >= 0 {
+			t.Fatalf("Expected items in key order, got %s after %s", it.Get(), last)
+		}
+		last = append(last[:0], it.Get()...)
+		count++
+	}
+
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestAttachSegment(t *testing.T) {
+	n := 20000
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	// Odd keys in the skiplist, multiples of 4 in the segment, which
+	// overlaps the skiplist for the keys 10000 to 20000
+	w := db.NewWriter()
+	for i := 1; i < n; i += 2 {
+		w.Put([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+	for i := n / 2; i < n; i += 4 {
+		w.Put([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+
+	src := &sliceSource{}
+	for i := 0; i < n; i += 4 {
+		src.items = append(src.items, []byte(fmt.Sprintf("key-%010d", i)))
+	}
+
+	path := filepath.Join(t.TempDir(), "segment")
+	if count, err := db.WriteSegment(path, src); err != nil || count != int64(n/4) {
+		t.Fatalf("Expected %d items, got %d (%v)", n/4, count, err)
+	}
+
+	seg, err := db.AttachSegment(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg.Count() != int64(n/4) {
+		t.Errorf("Expected %d items, got %d", n/4, seg.Count())
+	}
+
+	expected := n/2 + n/4
+	snap, _ := db.NewSnapshot()
+	if got := countMerged(t, snap, nil); got != expected {
+		t.Errorf("Expected %d items, got %d", expected, got)
+	}
+	// Odd keys and multiples of 4 from 10004
+	if got := countMerged(t, snap, []byte("key-0000010001")); got != 5000+2499 {
+		t.Errorf("Expected %d items, got %d", 5000+2499, got)
+	}
+
+	if err := seg.Wait(); err != nil || !seg.Folded() {
+		t.Fatalf("Expected the segment to be folded (%v)", err)
+	}
+
+	// The items of the segment remain visible in the older snapshot
+	snap2, _ := db.NewSnapshot()
+	if got := countMerged(t, snap, nil); got != expected {
+		t.Errorf("Expected %d items, got %d", expected, got)
+	}
+	if len(snap2.segments) != 0 || CountItems(snap2) != expected || countMerged(t, snap2, nil) != expected {
+		t.Errorf("Expected %d items in the skiplist", expected)
+	}
+	snap.Close()
+	snap2.Close()
+
+	bad := filepath.Join(t.TempDir(), "bad")
+	ioutil.WriteFile(bad, []byte("not a segment file"), 0644)
+	if _, err := db.AttachSegment(bad); err != ErrInvalidSegment {
+		t.Errorf("Expected ErrInvalidSegment, got %v", err)
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(t.TempDir())
+	if conf.HasBlockStore() {
+		bs := NewWithConfig(conf)
+		defer bs.Close()
+		if _, err := bs.AttachSegment(path); err != ErrBlockStoreUnsupported {
+			t.Errorf("Expected ErrBlockStoreUnsupported, got %v", err)
+		}
+	}
+}
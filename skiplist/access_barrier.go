@@ -99,7 +99,8 @@ type AccessBarrier struct {
 	freeSeqno           uint64
 	isDestructorRunning int32
 
-	active bool
+	active  bool
+	tracker sessionTracker
 	sync.Mutex
 }
 
@@ -131,7 +132,8 @@ func (ab *AccessBarrier) doCleanup() {
 			return
 		}
 
-		ab.freeSeqno++
+		atomic.StoreUint64(&ab.freeSeqno, ab.freeSeqno+1)
+		ab.tracker.destroySession(bs)
 		ab.callb(bs.objectRef)
 		ab.freeq.DeleteNode(node, CompareBS, buf2, &ab.freeq.Stats)
 	}
@@ -158,6 +160,10 @@ func (ab *AccessBarrier) Acquire() *BarrierSession {
 func (ab *AccessBarrier) Release(bs *BarrierSession) {
 	if ab.active {
 		liveCount := atomic.AddInt32(bs.liveCount, -1)
+		if assertionsEnabled && Debug {
+			assertReleased(bs, liveCount)
+		}
+
 		if liveCount == barrierFlushOffset {
 			buf := ab.freeq.MakeBuf()
 			defer ab.freeq.FreeBuf(buf)
@@ -189,8 +195,24 @@ func (ab *AccessBarrier) FlushSession(ref unsafe.Pointer) {
 		bs.objectRef = ref
 		ab.activeSeqno++
 		bs.seqno = ab.activeSeqno
+		ab.tracker.closeSession(bs)
 
 		atomic.AddInt32(bs.liveCount, barrierFlushOffset+1)
 		ab.Release(bs)
 	}
 }
+
+// Idle returns true if no accessor is in the current barrier session and
+// the destructors of all closed sessions have been called
+func (ab *AccessBarrier) Idle() bool {
+	if ab.active {
+		ab.Lock()
+		defer ab.Unlock()
+
+		bs := (*BarrierSession)(atomic.LoadPointer(&ab.session))
+		return atomic.LoadInt32(bs.liveCount) == 0 &&
+			atomic.LoadUint64(&ab.freeSeqno) == ab.activeSeqno
+	}
+
+	return true
+}
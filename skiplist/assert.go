@@ -0,0 +1,30 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package skiplist
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Assertions are compiled in with the nitro_debug build tag and checked if
+// Debug is set.
+
+// assertReleased panics if a barrier session is released more often than
+// it was acquired. An open session never drops below zero accessors and a
+// closed session, whose count is offset by barrierFlushOffset, never drops
+// below the offset.
+func assertReleased(bs *BarrierSession, liveCount int32) {
+	if liveCount < 0 || (liveCount < barrierFlushOffset && atomic.LoadInt32(&bs.closed) > 0) {
+		panic(fmt.Sprintf("skiplist: assertion failed: barrier session %d released "+
+			"more often than it was acquired, every Acquire needs exactly one Release "+
+			"(iterators release their session in Close)", bs.seqno))
+	}
+}
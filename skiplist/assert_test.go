@@ -0,0 +1,34 @@
+// +build nitro_debug
+
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package skiplist
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestBarrierAssertions(t *testing.T) {
+	Debug = true
+	defer func() { Debug = false }()
+
+	ab := newAccessBarrier(true, func(unsafe.Pointer) {})
+	bs := ab.Acquire()
+	ab.Release(bs)
+
+	defer func() {
+		if r, _ := recover().(string); !strings.Contains(r, "released more often than it was acquired") {
+			t.Errorf("Expected barrier assertion, got %v", r)
+		}
+	}()
+	ab.Release(bs)
+}
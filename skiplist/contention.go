@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package skiplist
+
+import "unsafe"
+
+// ContentionEvent describes an accessor which had to restart its path search
+// repeatedly because a deleted node could not be unlinked, as concurrent
+// updates kept changing its predecessor
+type ContentionEvent struct {
+	// Item searched by the accessor
+	Item unsafe.Pointer
+	// Deleted node which could not be unlinked and its level
+	Node  *Node
+	Level int
+	// Number of consecutive restarts
+	Retries int
+}
+
+// ContentionFn is called on the accessor goroutine, while the node is still
+// protected by the access barrier
+type ContentionFn func(ev ContentionEvent)
+
+// checkContention reports every ContentionThreshold consecutive restarts
+func (s *Skiplist) checkContention(itm unsafe.Pointer, n *Node, level, retries int) {
+	if s.OnContention != nil && s.ContentionThreshold > 0 &&
+		retries%s.ContentionThreshold == 0 {
+		s.OnContention(ContentionEvent{Item: itm, Node: n, Level: level, Retries: retries})
+	}
+}
@@ -9,6 +9,7 @@
 
 package skiplist
 
+import "runtime/debug"
 import "sync/atomic"
 import "unsafe"
 
@@ -28,12 +29,18 @@ type Iterator struct {
 func (s *Skiplist) NewIterator(cmp CompareFn,
 	buf *ActionBuffer) *Iterator {
 
-	return &Iterator{
+	it := &Iterator{
 		cmp: cmp,
 		s:   s,
 		buf: buf,
 		bs:  s.barrier.Acquire(),
 	}
+
+	if Debug && s.TrackIterators && it.bs != nil {
+		s.barrier.tracker.addIterator(it, debug.Stack())
+	}
+
+	return it
 }
 
 // SeekFirst moves cursor to the start
@@ -122,6 +129,7 @@ func (it *Iterator) Next() {
 		return
 	}
 
+	var retries int
 retry:
 	it.valid = true
 	next, deleted := it.curr.getNext(0)
@@ -138,6 +146,8 @@ retry:
 			it.prev = it.buf.preds[0]
 			it.curr = it.buf.succs[0]
 			if found && last == it.curr {
+				retries++
+				it.s.checkContention(last.Item(), last, 0, retries)
 				goto retry
 			}
 		}
@@ -147,7 +157,58 @@ retry:
 	}
 }
 
+// SeekLast moves cursor to the last item. cmp orders the nodes like the
+// comparator of the inserts, see Prev.
+func (it *Iterator) SeekLast(cmp CompareFn) {
+	it.deleted = false
+	last := it.s.head
+	for i := int(atomic.LoadInt32(&it.s.level)); i >= 0; i-- {
+		for {
+			next, _ := last.getNext(i)
+			if next == it.s.tail {
+				break
+			}
+			last = next
+		}
+	}
+
+	if _, deleted := last.getNext(0); deleted {
+		it.SeekBefore(last.Item(), cmp)
+		return
+	}
+
+	it.prev = nil
+	it.curr = last
+	it.valid = last != it.s.head
+}
+
+// Prev moves iterator to the previous item. The nodes do not link to their
+// predecessors, so the path of the current item is looked up again with
+// cmp, which has to order the nodes like the comparator of the inserts. The
+// comparator of the iterator may find several nodes equal, e.g., the
+// versions of an item, and the previous ones would be skipped.
+func (it *Iterator) Prev(cmp CompareFn) {
+	it.deleted = false
+	if !it.Valid() {
+		return
+	}
+
+	it.SeekBefore(it.curr.Item(), cmp)
+}
+
+// SeekBefore moves cursor to the last item less than itm by cmp
+func (it *Iterator) SeekBefore(itm unsafe.Pointer, cmp CompareFn) {
+	it.deleted = false
+	it.s.findPath(itm, cmp, it.buf, &it.s.Stats)
+	it.prev = nil
+	it.curr = it.buf.preds[0]
+	it.valid = it.curr != it.s.head
+}
+
 // Close is a destructor
 func (it *Iterator) Close() {
+	if Debug && it.s.TrackIterators && it.bs != nil {
+		it.s.barrier.tracker.removeIterator(it)
+	}
 	it.s.barrier.Release(it.bs)
 }
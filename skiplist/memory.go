@@ -0,0 +1,51 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package skiplist
+
+import "fmt"
+
+// MemoryUsage breaks down the memory used by the linked nodes of a skiplist.
+// With memory management the node sizes are the allocated sizes, otherwise
+// they are estimates which do not include the overhead of the Go allocator.
+// Item sizes are reported by the ItemSize function of the skiplist.
+type MemoryUsage struct {
+	// Node headers
+	Nodes int64
+	// Next pointers of all levels of the nodes
+	Towers int64
+	// Items referenced by the nodes
+	Items int64
+}
+
+// Total returns the total memory used
+func (u MemoryUsage) Total() int64 {
+	return u.Nodes + u.Towers + u.Items
+}
+
+func (u MemoryUsage) String() string {
+	return fmt.Sprintf("nodes = %d, towers = %d, items = %d", u.Nodes, u.Towers, u.Items)
+}
+
+// MemoryUsed computes the memory usage from the node distribution
+func (report StatsReport) MemoryUsed() MemoryUsage {
+	var u MemoryUsage
+	for i, c := range report.NodeDistribution {
+		u.Nodes += c * int64(nodeHdrSize)
+		u.Towers += c * int64(i+1) * int64(nodeRefSize)
+	}
+
+	u.Items = report.Memory - u.Nodes - u.Towers
+	return u
+}
+
+// MemoryUsed returns the memory used by the nodes, their towers and items
+func (s *Skiplist) MemoryUsed() MemoryUsage {
+	return s.GetStats().MemoryUsed()
+}
@@ -1,4 +1,4 @@
-// +build !amd64
+// +build !amd64 nitro_safe
 
 // Copyright (c) 2016 Couchbase, Inc.
 // Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
@@ -17,6 +17,13 @@ import (
 	"unsafe"
 )
 
+// MemoryMgmtSupported reports whether nodes can be placed in memory obtained
+// from a custom allocator. The portable node layout used on non-amd64
+// platforms and in safe mode (nitro_safe build tag) keeps node links
+// in immutable Go heap references so that every link update is visible to the
+// race detector and the garbage collector.
+const MemoryMgmtSupported = false
+
 // Node represents skiplist entry
 type Node struct {
 	level   int
@@ -39,11 +46,14 @@ func (n Node) Level() int {
 	return n.level
 }
 
+var nodeHdrSize = unsafe.Sizeof(Node{})
+
+// Every level needs a next pointer and the NodeRef it points to
+var nodeRefSize = unsafe.Sizeof(unsafe.Pointer(nil)) + unsafe.Sizeof(NodeRef{})
+
 // Size returns memory used by the node
 func (n Node) Size() int {
-	return int(unsafe.Sizeof(n) +
-		uintptr(n.level+1)*(unsafe.Sizeof(unsafe.Pointer(nil))+
-			unsafe.Sizeof(NodeRef{})))
+	return int(nodeHdrSize + uintptr(n.level+1)*nodeRefSize)
 }
 
 // Item returns item held by the node
@@ -108,3 +118,6 @@ func (n *Node) dcasNext(level int, prevPtr, newPtr *Node, prevIsdeleted, newIsde
 
 	return swapped
 }
+
+func debugMarkFree(n *Node) {
+}
@@ -1,3 +1,5 @@
+// +build amd64,!nitro_safe
+
 // Copyright (c) 2016 Couchbase, Inc.
 // Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
 // except in compliance with the License. You may obtain a copy of the License at
@@ -285,6 +287,9 @@ func allocNode(itm unsafe.Pointer, level int, malloc MallocFn) *Node {
 		block = unsafe.Pointer(reflect.New(nodeTypes[level]).Pointer())
 	} else {
 		block = malloc(int(nodeTypes[level].Size()))
+		if block == nil {
+			return nil
+		}
 	}
 
 	n := (*Node)(block)
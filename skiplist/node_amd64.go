@@ -1,3 +1,5 @@
+// +build amd64,!nitro_safe
+
 // Copyright (c) 2016 Couchbase, Inc.
 // Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
 // except in compliance with the License. You may obtain a copy of the License at
@@ -35,6 +37,10 @@ var nodeRefFlagSize = unsafe.Sizeof(NodeRef{}.flag)
 
 const deletedFlag = 0xff
 
+// MemoryMgmtSupported reports whether nodes can be placed in memory obtained
+// from a custom allocator
+const MemoryMgmtSupported = true
+
 // Node represents skiplist node header
 type Node struct {
 	itm     unsafe.Pointer
@@ -44,12 +50,12 @@ type Node struct {
 }
 
 // Level returns the level of a node in the skiplist
-func (n Node) Level() int {
+func (n *Node) Level() int {
 	return int(n.level)
 }
 
 // Size returns memory used by the node
-func (n Node) Size() int {
+func (n *Node) Size() int {
 	return int(nodeHdrSize + uintptr(n.level+1)*nodeRefSize)
 }
 
@@ -74,6 +80,11 @@ type NodeRef struct {
 	ptr  *Node
 }
 
+// Node links are addressed and decoded with pointer arithmetic which the
+// checkptr instrumentation of -race builds rejects, the link accessors opt
+// out of it.
+//
+//go:nocheckptr
 func (n *Node) setNext(level int, ptr *Node, deleted bool) {
 	nlevel := n.level
 	ref := (*NodeRef)(unsafe.Pointer(uintptr(unsafe.Pointer(n)) + nodeHdrSize + nodeRefSize*uintptr(level)))
@@ -85,6 +96,7 @@ func (n *Node) setNext(level int, ptr *Node, deleted bool) {
 	}
 }
 
+//go:nocheckptr
 func (n *Node) getNext(level int) (*Node, bool) {
 	nodeRefAddr := uintptr(unsafe.Pointer(n)) + nodeHdrSize + nodeRefSize*uintptr(level)
 	wordAddr := (*uint64)(unsafe.Pointer(nodeRefAddr + uintptr(7)))
@@ -103,6 +115,8 @@ func (n *Node) getNext(level int) (*Node, bool) {
 // is always 0x00). CAS operation can be performed at this location to set
 // least-significant to 0xff (denotes deleted). Same applies for loading delete
 // flag and the address atomically.
+//
+//go:nocheckptr
 func (n *Node) dcasNext(level int, prevPtr, newPtr *Node, prevIsdeleted, newIsdeleted bool) bool {
 	nodeRefAddr := uintptr(unsafe.Pointer(n)) + nodeHdrSize + nodeRefSize*uintptr(level)
 	wordAddr := (*uint64)(unsafe.Pointer(nodeRefAddr + uintptr(7)))
@@ -0,0 +1,19 @@
+package skiplist
+
+import "sync/atomic"
+
+// Data returns the 64-bit data word of the node. The word is owned by the
+// user of the skiplist, e.g., the block pointer of a Nitro block store.
+func (n *Node) Data() uint64 {
+	return atomic.LoadUint64(&n.DataPtr)
+}
+
+// SetData sets the 64-bit data word of the node
+func (n *Node) SetData(v uint64) {
+	atomic.StoreUint64(&n.DataPtr, v)
+}
+
+// CompareAndSwapData sets the 64-bit data word of the node if it holds old
+func (n *Node) CompareAndSwapData(old, v uint64) bool {
+	return atomic.CompareAndSwapUint64(&n.DataPtr, old, v)
+}
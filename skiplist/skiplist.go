@@ -10,8 +10,9 @@
 package skiplist
 
 import (
+	"errors"
+	"math"
 	"math/rand"
-	"runtime"
 	"sync/atomic"
 	"unsafe"
 )
@@ -33,9 +34,13 @@ func defaultItemSize(unsafe.Pointer) int {
 	return 0
 }
 
-// MallocFn is a custom memory allocator
+// MallocFn is a custom memory allocator. It returns nil if the memory
+// cannot be allocated.
 type MallocFn func(int) unsafe.Pointer
 
+// ErrOutOfMemory means the custom allocator failed to allocate a node
+var ErrOutOfMemory = errors.New("Node allocation failed")
+
 // FreeFn is a custom memory deallocator
 type FreeFn func(unsafe.Pointer)
 
@@ -47,13 +52,34 @@ type Config struct {
 	Malloc            MallocFn
 	Free              FreeFn
 	BarrierDestructor BarrierSessionDestructor
+
+	ContentionThreshold int
+	OnContention        ContentionFn
+
+	// Called by FreeNode and FreeNodeWith before the memory of a node is
+	// released, e.g., to release the resources referenced by its data
+	OnNodeFree NodeFreeFn
+
+	// Record the creation stacks of iterators in debug mode, which are
+	// reported by AccessBarrier.StaleSessions
+	TrackIterators bool
 }
 
+// NodeFreeFn receives the item and data of a node which is freed
+type NodeFreeFn func(itm unsafe.Pointer, data uint64)
+
 // SetItemSizeFunc configures item size function
 func (cfg *Config) SetItemSizeFunc(fn ItemSizeFn) {
 	cfg.ItemSize = fn
 }
 
+// SetContentionHandler configures fn to be called whenever an accessor
+// restarted its path search threshold times in a row
+func (cfg *Config) SetContentionHandler(threshold int, fn ContentionFn) {
+	cfg.ContentionThreshold = threshold
+	cfg.OnContention = fn
+}
+
 // DefaultConfig returns default skiplist configuration
 func DefaultConfig() Config {
 	return Config{
@@ -64,10 +90,12 @@ func DefaultConfig() Config {
 
 // Skiplist - core data structure
 type Skiplist struct {
+	// Stats is updated with 64-bit atomics and must stay the first field
+	// to be 64-bit aligned on 32-bit platforms
+	Stats   Stats
 	head    *Node
 	tail    *Node
 	level   int32
-	Stats   Stats
 	barrier *AccessBarrier
 
 	newNode  func(itm unsafe.Pointer, level int) *Node
@@ -83,7 +111,7 @@ func New() *Skiplist {
 
 // NewWithConfig creates a config from given config
 func NewWithConfig(cfg Config) *Skiplist {
-	if runtime.GOARCH != "amd64" {
+	if !MemoryMgmtSupported {
 		cfg.UseMemoryMgmt = false
 	}
 
@@ -127,10 +155,28 @@ func (s *Skiplist) GetAccesBarrier() *AccessBarrier {
 
 // FreeNode deallocates the skiplist node memory
 func (s *Skiplist) FreeNode(n *Node, sts *Stats) {
+	if s.OnNodeFree != nil {
+		s.OnNodeFree(n.Item(), n.Data())
+	}
 	s.freeNode(n)
 	sts.AddInt64(&sts.nodeFrees, 1)
 }
 
+// FreeNodeWith deallocates the skiplist node memory through free instead of
+// the configured deallocator, e.g., to batch frees
+func (s *Skiplist) FreeNodeWith(n *Node, free FreeFn, sts *Stats) {
+	if s.OnNodeFree != nil {
+		s.OnNodeFree(n.Item(), n.Data())
+	}
+	if s.UseMemoryMgmt {
+		if Debug {
+			debugMarkFree(n)
+		}
+		free(unsafe.Pointer(n))
+	}
+	sts.AddInt64(&sts.nodeFrees, 1)
+}
+
 // ActionBuffer is a temporary buffer used by skiplist operations
 type ActionBuffer struct {
 	preds []*Node
@@ -196,6 +242,7 @@ func (s *Skiplist) findPath2(itm unsafe.Pointer, cmp CompareFn,
 	skipItm func(unsafe.Pointer) bool,
 	buf *ActionBuffer, sts *Stats) (foundNode *Node) {
 	var cmpVal = 1
+	var retries int
 
 retry:
 	prev := s.head
@@ -210,6 +257,8 @@ retry:
 			for deleted {
 				if !s.helpDelete(i, pred, curr, next, sts) {
 					sts.AddUint64(&sts.readConflicts, 1)
+					retries++
+					s.checkContention(itm, curr, i, retries)
 					goto retry
 				}
 
@@ -256,14 +305,29 @@ func (s *Skiplist) Insert2(itm unsafe.Pointer, inscmp CompareFn, eqCmp CompareFn
 	return s.Insert3(itm, inscmp, eqCmp, buf, itemLevel, false, sts)
 }
 
-// Insert3 is more verbose version of Insert2
+// Insert3 is more verbose version of Insert2. It panics with ErrOutOfMemory
+// if the node cannot be allocated.
 func (s *Skiplist) Insert3(itm unsafe.Pointer, insCmp CompareFn, eqCmp CompareFn,
 	buf *ActionBuffer, itemLevel int, skipFindPath bool, sts *Stats) (*Node, bool) {
+	x, success, err := s.TryInsert3(itm, insCmp, eqCmp, buf, itemLevel, skipFindPath, sts)
+	if err != nil {
+		panic(err)
+	}
+	return x, success
+}
+
+// TryInsert3 is the same as Insert3, except that it returns ErrOutOfMemory
+// without modifying the skiplist if the node cannot be allocated
+func (s *Skiplist) TryInsert3(itm unsafe.Pointer, insCmp CompareFn, eqCmp CompareFn,
+	buf *ActionBuffer, itemLevel int, skipFindPath bool, sts *Stats) (*Node, bool, error) {
 
 	token := s.barrier.Acquire()
 	defer s.barrier.Release(token)
 
 	x := s.newNode(itm, itemLevel)
+	if x == nil {
+		return nil, false, ErrOutOfMemory
+	}
 
 retry:
 	if skipFindPath {
@@ -273,7 +337,7 @@ retry:
 			eqCmp != nil && Compare(eqCmp, itm, buf.preds[0].Item()) == 0 {
 
 			s.freeNode(x)
-			return nil, false
+			return nil, false, nil
 		}
 	}
 
@@ -314,7 +378,7 @@ finished:
 	sts.AddInt64(&sts.nodeAllocs, 1)
 	sts.AddInt64(&sts.levelNodesCount[itemLevel], 1)
 	sts.AddInt64(&sts.usedBytes, int64(s.Size(x)))
-	return x, true
+	return x, true, nil
 }
 
 func (s *Skiplist) softDelete(delNode *Node, sts *Stats) bool {
@@ -346,7 +410,7 @@ func (s *Skiplist) Delete(itm unsafe.Pointer, cmp CompareFn,
 	}
 
 	delNode := buf.succs[0]
-	return s.deleteNode(delNode, cmp, buf, sts)
+	return s.deleteNode(delNode, cmp, buf, sts, nil)
 }
 
 // DeleteNode an item from the skiplist by specifying its node
@@ -355,12 +419,27 @@ func (s *Skiplist) DeleteNode(n *Node, cmp CompareFn,
 	token := s.barrier.Acquire()
 	defer s.barrier.Release(token)
 
-	return s.deleteNode(n, cmp, buf, sts)
+	return s.deleteNode(n, cmp, buf, sts, nil)
+}
+
+// DeleteNode2 is same as DeleteNode(). Additionally calls onDelete once the
+// node has been marked as deleted by this call and before it is unlinked by
+// this call, while the node is still protected by the access barrier.
+func (s *Skiplist) DeleteNode2(n *Node, cmp CompareFn,
+	buf *ActionBuffer, sts *Stats, onDelete func(*Node)) bool {
+	token := s.barrier.Acquire()
+	defer s.barrier.Release(token)
+
+	return s.deleteNode(n, cmp, buf, sts, onDelete)
 }
 
-func (s *Skiplist) deleteNode(n *Node, cmp CompareFn, buf *ActionBuffer, sts *Stats) bool {
+func (s *Skiplist) deleteNode(n *Node, cmp CompareFn, buf *ActionBuffer,
+	sts *Stats, onDelete func(*Node)) bool {
 	itm := n.Item()
 	if s.softDelete(n, sts) {
+		if onDelete != nil {
+			onDelete(n)
+		}
 		s.findPath(itm, cmp, buf, sts)
 		return true
 	}
@@ -368,6 +447,68 @@ func (s *Skiplist) deleteNode(n *Node, cmp CompareFn, buf *ActionBuffer, sts *St
 	return false
 }
 
+// DeleteRange visits the nodes from the position of start onwards in order
+// and deletes the nodes for which fn returns unlink, until fn returns stop.
+// onDelete is called for every node deleted by this call before it is
+// unlinked. The nodes are unlinked from every level during the same scan
+// using the predecessors seen at each level. A path search is only needed
+// when a concurrent update of a predecessor is detected.
+// Returns the number of nodes deleted.
+func (s *Skiplist) DeleteRange(start unsafe.Pointer, cmp CompareFn,
+	fn func(*Node) (unlink, stop bool), onDelete func(*Node),
+	buf *ActionBuffer, sts *Stats) (count int) {
+	token := s.barrier.Acquire()
+	defer s.barrier.Release(token)
+
+	s.findPath(start, cmp, buf, sts)
+	preds := buf.preds
+	curr := buf.succs[0]
+	for curr != s.tail {
+		next, deleted := curr.getNext(0)
+		if deleted {
+			curr = next
+			continue
+		}
+
+		unlink, stop := fn(curr)
+		if stop {
+			break
+		}
+
+		level := curr.Level()
+		if !unlink || !s.softDelete(curr, sts) {
+			for i := 0; i <= level; i++ {
+				preds[i] = curr
+			}
+			curr = next
+			continue
+		}
+
+		if onDelete != nil {
+			onDelete(curr)
+		}
+
+		unlinked := true
+		for i := level; i >= 0; i-- {
+			next, _ := curr.getNext(i)
+			if !s.helpDelete(i, preds[i], curr, next, sts) {
+				unlinked = false
+			}
+		}
+
+		// A predecessor was modified concurrently, the path search unlinks
+		// the node from the remaining levels and refreshes the predecessors
+		if !unlinked {
+			s.findPath(curr.Item(), cmp, buf, sts)
+		}
+
+		count++
+		curr, _ = curr.getNext(0)
+	}
+
+	return
+}
+
 // GetRangeSplitItems returns `nways` split range pivots of the skiplist items
 // Explicit barrier and release should be used by the caller before
 // and after this function call
@@ -402,3 +543,104 @@ repeat:
 
 	return itms
 }
+
+// GetRangeSplitItemsInRange returns up to `nways-1` pivot items which split
+// the items in the range [start, end) into `nways` partitions. The topmost
+// level having enough nodes within the range is used for picking pivots.
+// A nil start or end denotes an unbounded range.
+// Explicit barrier and release should be used by the caller before
+// and after this function call
+func (s *Skiplist) GetRangeSplitItemsInRange(start, end unsafe.Pointer,
+	cmp CompareFn, nways int) []unsafe.Pointer {
+	var itms []unsafe.Pointer
+	var deleted bool
+
+	if nways < 2 {
+		return nil
+	}
+
+	if start == nil {
+		start = MinItem
+	}
+
+	if end == nil {
+		end = MaxItem
+	}
+
+	buf := s.MakeBuf()
+	defer s.FreeBuf(buf)
+
+repeat:
+	s.findPath(start, cmp, buf, &s.Stats)
+
+	for l := int(atomic.LoadInt32(&s.level)); l >= 0; l-- {
+		itms = itms[:0]
+		node := buf.preds[l]
+		if node == nil {
+			continue
+		}
+
+		for {
+			node, deleted = node.getNext(l)
+			if deleted {
+				goto repeat
+			}
+
+			if node == nil || node == s.tail || Compare(cmp, node.Item(), end) >= 0 {
+				break
+			}
+
+			if Compare(cmp, node.Item(), start) > 0 {
+				itms = append(itms, node.Item())
+			}
+		}
+
+		if len(itms) >= nways-1 {
+			break
+		}
+	}
+
+	if len(itms) <= nways-1 {
+		return itms
+	}
+
+	pivots := make([]unsafe.Pointer, 0, nways-1)
+	for i := 1; i < nways; i++ {
+		pivots = append(pivots, itms[i*len(itms)/nways])
+	}
+
+	return pivots
+}
+
+// SampleItems returns the items from the topmost level which holds at least
+// `n` nodes, along with the approximate number of items each sample
+// represents. All the items are returned if the skiplist holds fewer than `n`
+// items.
+// Explicit barrier and release should be used by the caller before
+// and after this function call
+func (s *Skiplist) SampleItems(n int) ([]unsafe.Pointer, float64) {
+	var itms []unsafe.Pointer
+
+	level := 0
+	var count int64
+	for l := int(atomic.LoadInt32(&s.level)); l >= 0; l-- {
+		count += atomic.LoadInt64(&s.Stats.levelNodesCount[l])
+		if count >= int64(n) {
+			level = l
+			break
+		}
+	}
+
+	// Deleted nodes are skipped, their next links stay valid while the
+	// caller holds the access barrier
+	node, _ := s.head.getNext(level)
+	for node != nil && node != s.tail {
+		next, deleted := node.getNext(level)
+		if !deleted {
+			itms = append(itms, node.Item())
+		}
+		node = next
+	}
+
+	return itms, math.Pow(1/p, float64(level))
+}
@@ -48,6 +48,41 @@ func TestInsert(t *testing.T) {
 	}
 }
 
+func TestDeleteRange(t *testing.T) {
+	s := New()
+	cmp := CompareInt
+	buf := s.MakeBuf()
+	defer s.FreeBuf(buf)
+
+	for i := 0; i < 2000; i++ {
+		itm := intKeyItem(i)
+		s.Insert(unsafe.Pointer(&itm), cmp, buf, &s.Stats)
+	}
+
+	var deleted int
+	start := intKeyItem(500)
+	count := s.DeleteRange(unsafe.Pointer(&start), cmp, func(n *Node) (bool, bool) {
+		v := int(*(*intKeyItem)(n.Item()))
+		return v%2 == 0, v >= 1500
+	}, func(*Node) { deleted++ }, buf, &s.Stats)
+
+	if count != 500 || deleted != 500 {
+		t.Errorf("Expected 500 deleted nodes, got %d (%d callbacks)", count, deleted)
+	}
+
+	if c := s.GetStats().NodeCount; c != 1500 {
+		t.Errorf("Expected 1500 nodes, got %d", c)
+	}
+
+	for l := 0; l <= MaxLevel; l++ {
+		for n, _ := s.head.getNext(l); n != s.tail; n, _ = n.getNext(l) {
+			if v := int(*(*intKeyItem)(n.Item())); v >= 500 && v < 1500 && v%2 == 0 {
+				t.Fatalf("Deleted node %d is linked at level %d", v, l)
+			}
+		}
+	}
+}
+
 func doInsert(sl *Skiplist, wg *sync.WaitGroup, n int, isRand bool) {
 	defer wg.Done()
 	buf := sl.MakeBuf()
@@ -84,6 +119,24 @@ func doGet(sl *Skiplist, wg *sync.WaitGroup, n int) {
 
 }
 
+// TestConcurrentAccess is small enough to be run with -race, alone or with the
+// nitro_safe tag to select the portable node layout
+func TestConcurrentAccess(t *testing.T) {
+	var wg sync.WaitGroup
+	sl := New()
+	n := 2000
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go doInsert(sl, &wg, n, true)
+		go doGet(sl, &wg, n)
+	}
+	wg.Wait()
+
+	if c := sl.GetStats().NodeCount; c != 4*n {
+		t.Errorf("Expected %d nodes, got %d", 4*n, c)
+	}
+}
+
 func TestInsertPerf(t *testing.T) {
 	var wg sync.WaitGroup
 	sl := New()
@@ -196,3 +249,92 @@ func TestBuilder(t *testing.T) {
 	}
 
 }
+
+func TestContentionHandler(t *testing.T) {
+	var events []ContentionEvent
+	cfg := DefaultConfig()
+	cfg.SetContentionHandler(1, func(ev ContentionEvent) {
+		events = append(events, ev)
+	})
+
+	s := NewWithConfig(cfg)
+	buf := s.MakeBuf()
+	defer s.FreeBuf(buf)
+
+	var nodes []*Node
+	for i := 0; i < 10; i++ {
+		itm := intKeyItem(i)
+		n, _ := s.Insert3(unsafe.Pointer(&itm), CompareInt, nil, buf, 0, false, &s.Stats)
+		nodes = append(nodes, n)
+	}
+
+	// Delete 3 and 4 while the search passes 3, so that 4 cannot be
+	// unlinked from its deleted predecessor
+	injected := false
+	cmp := func(this, that unsafe.Pointer) int {
+		if !injected && this == nodes[3].Item() {
+			injected = true
+			s.softDelete(nodes[3], &s.Stats)
+			s.softDelete(nodes[4], &s.Stats)
+		}
+		return CompareInt(this, that)
+	}
+
+	itm := intKeyItem(5)
+	if s.findPath(unsafe.Pointer(&itm), cmp, buf, &s.Stats) != nodes[5] {
+		t.Errorf("Expected to find item 5")
+	}
+
+	if len(events) != 1 || events[0].Node != nodes[4] || events[0].Level != 0 ||
+		events[0].Retries != 1 || events[0].Item != unsafe.Pointer(&itm) {
+		t.Errorf("Unexpected contention events %+v", events)
+	}
+}
+
+func TestLevelOccupancy(t *testing.T) {
+	s := New()
+	buf := s.MakeBuf()
+	defer s.FreeBuf(buf)
+
+	levels := []int{0, 0, 0, 1, 1, 2}
+	s.level = 2
+	for i, level := range levels {
+		itm := intKeyItem(i)
+		s.Insert3(unsafe.Pointer(&itm), CompareInt, nil, buf, level, false, &s.Stats)
+	}
+
+	sts := s.GetStats()
+	if sts.NodeCount != 6 || sts.NodeDistribution[1] != 2 {
+		t.Errorf("Unexpected stats %v", sts)
+	}
+
+	expected := []int64{6, 3, 1, 0}
+	for i, c := range expected {
+		if sts.LevelOccupancy[i] != c {
+			t.Errorf("Expected %d nodes at level %d, got %d", c, i, sts.LevelOccupancy[i])
+		}
+	}
+}
+
+func TestMemoryUsed(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SetItemSizeFunc(func(unsafe.Pointer) int { return 10 })
+	s := NewWithConfig(cfg)
+	buf := s.MakeBuf()
+	defer s.FreeBuf(buf)
+
+	s.level = 1
+	for i, level := range []int{0, 0, 1} {
+		itm := intKeyItem(i)
+		s.Insert3(unsafe.Pointer(&itm), CompareInt, nil, buf, level, false, &s.Stats)
+	}
+
+	u := s.MemoryUsed()
+	if u.Nodes != 3*int64(nodeHdrSize) || u.Towers != 4*int64(nodeRefSize) || u.Items != 30 {
+		t.Errorf("Unexpected memory usage %v", u)
+	}
+
+	if u.Total() != s.MemoryInUse() {
+		t.Errorf("Expected total %d, got %d", s.MemoryInUse(), u.Total())
+	}
+}
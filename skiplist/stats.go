@@ -14,14 +14,29 @@ import "sync/atomic"
 
 // StatsReport is used for reporting skiplist statistics
 type StatsReport struct {
-	ReadConflicts       uint64
-	InsertConflicts     uint64
+	// Failed path searches which had to restart from the head, because a
+	// deleted node could not be unlinked
+	ReadConflicts uint64
+	// Failed inserts which had to search the path again, because the
+	// predecessor changed concurrently
+	InsertConflicts uint64
+	// Average number of levels a node is linked into
 	NextPointersPerNode float64
-	NodeDistribution    [MaxLevel + 1]int64
-	NodeCount           int
-	SoftDeletes         int64
-	Memory              int64
-
+	// Number of nodes by their highest level
+	NodeDistribution [MaxLevel + 1]int64
+	// Number of nodes linked into each level, i.e., the nodes whose highest
+	// level is at least that level. Levels whose occupancy is far from
+	// NodeCount/4^level indicate a poorly balanced skiplist.
+	LevelOccupancy [MaxLevel + 1]int64
+	// Number of linked nodes, including the deleted nodes which have not
+	// been unlinked yet
+	NodeCount int
+	// Nodes marked as deleted, which have not been unlinked yet
+	SoftDeletes int64
+	// Bytes used by the nodes and their items
+	Memory int64
+
+	// Number of nodes allocated and freed
 	NodeAllocs int64
 	NodeFrees  int64
 }
@@ -41,6 +56,12 @@ func (report *StatsReport) Apply(s *Stats) {
 		totalNextPtrs += (i + 1) * int(nodesAtlevel)
 	}
 
+	var occupancy int64
+	for i := MaxLevel; i >= 0; i-- {
+		occupancy += report.NodeDistribution[i]
+		report.LevelOccupancy[i] = occupancy
+	}
+
 	report.SoftDeletes += s.softDeletes
 	report.NodeCount = totalNodes
 	report.NextPointersPerNode = float64(totalNextPtrs) / float64(totalNodes)
@@ -127,6 +148,12 @@ func (report StatsReport) String() string {
 		str += fmt.Sprintf("level%d => %d\n", i, c)
 	}
 
+	str += "\nlevel_occupancy:\n"
+
+	for i, c := range report.LevelOccupancy {
+		str += fmt.Sprintf("level%d => %d\n", i, c)
+	}
+
 	return str
 }
 
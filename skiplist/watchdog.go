@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package skiplist
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StaleSession describes a closed barrier session which has not terminated
+// in time. Until it terminates, neither its nodes nor the nodes of any later
+// session can be reclaimed.
+type StaleSession struct {
+	Seqno uint64
+	// Time since the session was closed
+	Age time.Duration
+	// Number of accessors which have not left the session. A session
+	// without accessors waits for an earlier session.
+	Accessors int
+	// Creation stacks of the iterators in the session, recorded in debug mode
+	Stacks [][]byte
+}
+
+// sessionTracker records when the barrier sessions were closed and, in
+// debug mode, which iterators hold them
+type sessionTracker struct {
+	sync.Mutex
+	closed map[*BarrierSession]time.Time
+	iters  map[*Iterator][]byte
+}
+
+func (t *sessionTracker) closeSession(bs *BarrierSession) {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed == nil {
+		t.closed = make(map[*BarrierSession]time.Time)
+	}
+	t.closed[bs] = time.Now()
+}
+
+func (t *sessionTracker) destroySession(bs *BarrierSession) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.closed, bs)
+}
+
+func (t *sessionTracker) addIterator(it *Iterator, stack []byte) {
+	t.Lock()
+	defer t.Unlock()
+	if t.iters == nil {
+		t.iters = make(map[*Iterator][]byte)
+	}
+	t.iters[it] = stack
+}
+
+func (t *sessionTracker) removeIterator(it *Iterator) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.iters, it)
+}
+
+// StaleSessions returns the sessions which were closed at least timeout ago
+// and have not terminated, in session order
+func (ab *AccessBarrier) StaleSessions(timeout time.Duration) []StaleSession {
+	if !ab.active {
+		return nil
+	}
+
+	t := &ab.tracker
+	t.Lock()
+	defer t.Unlock()
+
+	var stale []StaleSession
+	now := time.Now()
+	for bs, closedAt := range t.closed {
+		if age := now.Sub(closedAt); age >= timeout {
+			ss := StaleSession{Seqno: bs.seqno, Age: age}
+			if n := atomic.LoadInt32(bs.liveCount) - barrierFlushOffset; n > 0 {
+				ss.Accessors = int(n)
+			}
+
+			for it, stack := range t.iters {
+				if it.bs == bs {
+					ss.Stacks = append(ss.Stacks, stack)
+				}
+			}
+			stale = append(stale, ss)
+		}
+	}
+
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Seqno < stale[j].Seqno })
+	return stale
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrNoSplitDirs means SplitDump was called without output directories
+var ErrNoSplitDirs = fmt.Errorf("No output directories for the split backup")
+
+// SplitDump splits a backup written by StoreToDisk into len(dirs) backups
+// holding disjoint key ranges of about the same number of items, e.g., to
+// restore a large dataset in parallel onto the machines of a sharded
+// deployment. The data shards of a backup are written in key order, the
+// split is planned from the item counts and key ranges of the manifest.
+// Data shards owned by a single split backup are copied as is, the others
+// are split item by item. The items of the delta shards are routed to the
+// split backup owning their key.
+//
+// Backups without a manifest cannot be split.
+func (m *Nitro) SplitDump(dir string, dirs []string) error {
+	n := len(dirs)
+	if n == 0 {
+		return ErrNoSplitDirs
+	}
+
+	dm, err := DumpInfo(dir)
+	if err != nil {
+		return err
+	}
+
+	hdr, err := readDumpHeader(dir)
+	if err != nil {
+		return err
+	}
+	if hdr.MetadataSize != m.itemMetaSize {
+		return ErrMetadataSizeMismatch
+	}
+
+	format, err := readDumpFormat(dir, m.dumpFormat)
+	if err != nil {
+		return err
+	}
+
+	manifests := make([]DumpManifest, n)
+	files := make([][]string, n)
+	for g, out := range dirs {
+		manifests[g] = DumpManifest{Format: dm.Format, Keyspace: dm.Keyspace}
+		files[g] = []string{}
+		if err := os.MkdirAll(filepath.Join(out, "data"), 0755); err != nil {
+			return err
+		}
+	}
+
+	// The i-th item of the backup is owned by split backup i * n / total,
+	// the key range of a split backup starts at its first item
+	total := dm.Items()
+	owner := func(i int64) int {
+		return int(i * int64(n) / total)
+	}
+
+	starts := make([][]byte, n)
+	var seen int64
+	for _, s := range dm.Shards {
+		if s.Items == 0 {
+			continue
+		}
+
+		g := owner(seen)
+		if owner(seen+s.Items-1) == g {
+			if err := copyDumpFile(filepath.Join(dir, "data", s.File),
+				filepath.Join(dirs[g], "data", s.File)); err != nil {
+				return err
+			}
+
+			if starts[g] == nil {
+				starts[g] = s.MinKey
+			}
+			files[g] = append(files[g], s.File)
+			manifests[g].Shards = append(manifests[g].Shards, s)
+		} else if err := m.splitDataShard(dir, dirs, s.File, format, seen,
+			owner, starts, files, manifests); err != nil {
+			return err
+		}
+
+		seen += s.Items
+	}
+
+	for g, out := range dirs {
+		bs, _ := json.Marshal(files[g])
+		if err := ioutil.WriteFile(filepath.Join(out, "data", "files.json"), bs, 0660); err != nil {
+			return err
+		}
+	}
+
+	// route returns the split backup owning a key
+	route := func(key []byte) int {
+		r := 0
+		for g, start := range starts {
+			if start != nil && m.keyCmp(start, key) <= 0 {
+				r = g
+			}
+		}
+		return r
+	}
+
+	if len(dm.DeltaShards) > 0 {
+		if err := m.splitDeltaShards(dir, dirs, dm.DeltaShards, format,
+			hdr.FramedDeltas, route, manifests); err != nil {
+			return err
+		}
+	}
+
+	for g, out := range dirs {
+		if err := writeDumpHeader(out, hdr); err != nil {
+			return err
+		}
+		if err := writeDumpManifest(out, &manifests[g]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitDataShard writes the items of a data shard to the data shards of the
+// same name of the split backups owning them. The first item of the shard is
+// the seen-th item of the backup.
+func (m *Nitro) splitDataShard(dir string, dirs []string, file string, format DumpFormat,
+	seen int64, owner func(int64) int, starts [][]byte, files [][]string,
+	manifests []DumpManifest) (err error) {
+
+	r := m.newFileReader(m.fileType, format)
+	if err := r.Open(filepath.Join(dir, "data", file)); err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var writers []FileWriter
+	var groups []int
+	defer func() {
+		for _, w := range writers {
+			if w != nil {
+				w.Close()
+			}
+		}
+	}()
+
+	for i := seen; ; i++ {
+		itm, err := r.ReadItem()
+		if err != nil {
+			return err
+		} else if itm == nil {
+			break
+		}
+
+		g := owner(i)
+		if len(groups) == 0 || groups[len(groups)-1] != g {
+			w := m.newFormatFileWriter(m.fileType, format, 0)
+			if err := w.Open(filepath.Join(dirs[g], "data", file)); err != nil {
+				m.freeItem(itm)
+				return err
+			}
+
+			if starts[g] == nil {
+				starts[g] = append([]byte(nil), itm.Bytes()...)
+			}
+			writers = append(writers, w)
+			groups = append(groups, g)
+		}
+
+		err = writers[len(writers)-1].WriteItem(itm)
+		m.freeItem(itm)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, len(writers))
+	for k := range names {
+		names[k] = file
+	}
+
+	infos, err := closeDumpWriters(writers, names)
+	if err != nil {
+		return err
+	}
+
+	for k, g := range groups {
+		files[g] = append(files[g], file)
+		manifests[g].Shards = append(manifests[g].Shards, infos[k])
+	}
+
+	return nil
+}
+
+// splitDeltaShards writes the items of every delta shard of a backup to the
+// delta shard of the same name of the split backup owning them
+func (m *Nitro) splitDeltaShards(dir string, dirs []string, shards []DumpShardInfo,
+	format DumpFormat, framed bool, route func([]byte) int, manifests []DumpManifest) error {
+
+	var files []string
+	for _, out := range dirs {
+		if err := os.MkdirAll(filepath.Join(out, "delta"), 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range shards {
+		files = append(files, s.File)
+		if err := m.splitDeltaShard(dir, dirs, s.File, format, framed, route, manifests); err != nil {
+			return err
+		}
+	}
+
+	bs, _ := json.Marshal(files)
+	for _, out := range dirs {
+		if err := ioutil.WriteFile(filepath.Join(out, "delta", "files.json"), bs, 0660); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Nitro) splitDeltaShard(dir string, dirs []string, file string, format DumpFormat,
+	framed bool, route func([]byte) int, manifests []DumpManifest) (err error) {
+
+	r := m.newDeltaFileReader(m.fileType, format, framed)
+	if err := r.Open(filepath.Join(dir, "delta", file)); err != nil {
+		return err
+	}
+	defer r.Close()
+
+	writers := make([]FileWriter, len(dirs))
+	files := make([]string, len(dirs))
+	defer func() {
+		for _, w := range writers {
+			if w != nil {
+				w.Close()
+			}
+		}
+	}()
+
+	for g, out := range dirs {
+		w := m.newFormatFileWriter(m.fileType, format, 0)
+		if framed {
+			w = m.newDeltaFileWriter(m.fileType, format)
+		}
+		if err := w.Open(filepath.Join(out, "delta", file)); err != nil {
+			return err
+		}
+		writers[g] = w
+		files[g] = file
+	}
+
+	for {
+		itm, err := r.ReadItem()
+		if err != nil {
+			return err
+		} else if itm == nil {
+			break
+		}
+
+		err = writers[route(itm.Bytes())].WriteItem(itm)
+		m.freeItem(itm)
+		if err != nil {
+			return err
+		}
+	}
+
+	infos, err := closeDumpWriters(writers, files)
+	if err != nil {
+		return err
+	}
+
+	for g := range manifests {
+		manifests[g].DeltaShards = append(manifests[g].DeltaShards, infos[g])
+	}
+
+	return nil
+}
+
+func copyDumpFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := openFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
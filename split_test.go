@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitDump(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 20000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+
+	dir := t.TempDir()
+	if err := db.StoreToDisk(dir, snap, 8, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dirs = append(dirs, filepath.Join(dir, fmt.Sprintf("split-%d", i)))
+	}
+	if err := db.SplitDump(dir, dirs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The split backups hold consecutive key ranges
+	next := 0
+	for _, d := range dirs {
+		dm, err := DumpInfo(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dm.Items() == 0 || dm.Items() > int64(n)/2 {
+			t.Errorf("Unbalanced split backup %s with %d items", d, dm.Items())
+		}
+
+		db2 := NewWithConfig(testConf)
+		snap2, err := db2.LoadFromDisk(d, 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		itr := snap2.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if exp := fmt.Sprintf("key-%010d", next); string(itr.Get()) != exp {
+				t.Fatalf("Expected %s, got %s", exp, itr.Get())
+			}
+			next++
+		}
+		itr.Close()
+		snap2.Close()
+		db2.Close()
+	}
+
+	if next != n {
+		t.Errorf("Expected %d items, got %d", n, next)
+	}
+
+	if err := db.SplitDump(dir, nil); err != ErrNoSplitDirs {
+		t.Errorf("Expected ErrNoSplitDirs, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"sync"
+	"time"
+)
+
+// StatsSamplerJob is the name of the maintenance job of SetStatsSampling
+const StatsSamplerJob = "stats-sampler"
+
+// StatsSample holds the metrics of an instance at a point in time. Item and
+// node counts are published by NewSnapshot.
+type StatsSample struct {
+	Time time.Time
+
+	// Memory used by the items, their index and the snapshots
+	MemoryInUse int64
+	Items       int64
+	Tombstones  int64
+	Nodes       int64
+
+	// Live snapshots and dead snapshots waiting for garbage collection
+	Snapshots   int64
+	GCSnapshots int64
+
+	// Writer mutations per second since the previous sample
+	MutationRate float64
+}
+
+// statsHistory is the ring buffer of the samples
+type statsHistory struct {
+	sync.Mutex
+	samples []StatsSample
+	next    int
+	full    bool
+
+	last      time.Time
+	mutations int64
+}
+
+// SetStatsSampling samples the metrics of the instance every interval and
+// keeps the last size samples, see StatsHistory. Sampling is a maintenance
+// job named StatsSamplerJob.
+func (cfg *Config) SetStatsSampling(interval time.Duration, size int) {
+	cfg.statsInterval = interval
+	cfg.statsHistorySize = size
+}
+
+func (m *Nitro) startStatsSampler() {
+	m.statsHistory.samples = make([]StatsSample, m.statsHistorySize)
+	m.AddJob(StatsSamplerJob, m.statsInterval, func(m *Nitro) error {
+		m.sampleStats()
+		return nil
+	})
+}
+
+func (m *Nitro) sampleStats() {
+	now := time.Now()
+	mem := m.MemoryUsage()
+	s := StatsSample{
+		Time:        now,
+		MemoryInUse: m.store.MemoryInUse() + mem.Snapshots.Total() + mem.GCSnapshots.Total(),
+		Items:       m.ItemsCount(),
+		Tombstones:  m.TombstonesCount(),
+		Nodes:       int64(m.store.GetStats().NodeCount),
+		Snapshots:   int64(m.snapshots.GetStats().NodeCount),
+		GCSnapshots: int64(m.gcsnapshots.GetStats().NodeCount),
+	}
+
+	mutations := m.mutations()
+
+	h := &m.statsHistory
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.last.IsZero() {
+		if secs := now.Sub(h.last).Seconds(); secs > 0 {
+			s.MutationRate = float64(mutations-h.mutations) / secs
+		}
+	}
+	h.last, h.mutations = now, mutations
+
+	h.samples[h.next] = s
+	if h.next++; h.next == len(h.samples) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// StatsHistory returns the samples of SetStatsSampling, the oldest first
+func (m *Nitro) StatsHistory() []StatsSample {
+	h := &m.statsHistory
+	h.Lock()
+	defer h.Unlock()
+
+	var samples []StatsSample
+	if h.full {
+		samples = append(samples, h.samples[h.next:]...)
+	}
+	return append(samples, h.samples[:h.next]...)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStatsHistory(t *testing.T) {
+	conf := testConf
+	conf.SetStatsSampling(time.Millisecond, 5)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	if st := db.Jobs(); len(st) != 1 || st[0].Name != StatsSamplerJob {
+		t.Fatalf("Expected the sampler job, got %+v", st)
+	}
+
+	// Samples are taken while the job is disabled only by RunJob
+	db.SetJobEnabled(StatsSamplerJob, false)
+	time.Sleep(5 * time.Millisecond)
+	start := len(db.StatsHistory())
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	db.RunJob(StatsSamplerJob)
+	h := db.StatsHistory()
+	if len(h) != start+1 {
+		t.Fatalf("Expected %d samples, got %d", start+1, len(h))
+	}
+
+	s := h[len(h)-1]
+	if s.Items != 1000 || s.Nodes != 1000 || s.Snapshots == 0 || s.MemoryInUse == 0 {
+		t.Errorf("Unexpected sample %+v", s)
+	}
+	if start > 0 && s.MutationRate <= 0 {
+		t.Errorf("Expected a mutation rate, got %+v", s)
+	}
+
+	// Only the last samples are kept
+	db.SetJobEnabled(StatsSamplerJob, true)
+	for db.Jobs()[0].Runs < 20 {
+		time.Sleep(time.Millisecond)
+	}
+
+	h = db.StatsHistory()
+	if len(h) != 5 {
+		t.Fatalf("Expected 5 samples, got %d", len(h))
+	}
+	for i := 1; i < len(h); i++ {
+		if h[i].Time.Before(h[i-1].Time) {
+			t.Errorf("Expected the samples in time order")
+		}
+	}
+}
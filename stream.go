@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidStream means a stream was not written by StoreToWriter
+var ErrInvalidStream = fmt.Errorf("Invalid item stream")
+
+// StoreToWriter writes the items of a snapshot to w in key order. The stream
+// starts with the dump format of the instance and ends with an empty item,
+// so that it can be embedded in other protocols. Unlike StoreToDisk, the
+// backup encode and decode functions are not applied.
+func (m *Nitro) StoreToWriter(snap *Snapshot, w io.Writer) error {
+	bw, ok := w.(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriterSize(w, DiskBlockSize)
+	}
+
+	if err := bw.WriteByte(byte(m.dumpFormat)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, encodeBufSize)
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if err := encodeItemBytes(itr.Get(), buf, bw, m.dumpFormat); err != nil {
+			return err
+		}
+	}
+
+	if err := itr.Err(); err != nil {
+		return err
+	}
+
+	if err := encodeItemBytes(nil, buf, bw, m.dumpFormat); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// LoadFromReader reads a stream written by StoreToWriter and inserts its
+// items through w, replacing the items with the same key. If fn is not nil,
+// it is called with every item in stream order and items for which it
+// returns false are not inserted. Returns the number of inserted items.
+//
+// If r is not a *bufio.Reader, it may be read beyond the end of the stream.
+func (m *Nitro) LoadFromReader(r io.Reader, w *Writer, fn func(itm []byte) bool) (int64, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(r, DiskBlockSize)
+	}
+
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	format := DumpFormat(b)
+	if _, ok := dumpFormatNames[format]; !ok {
+		return 0, ErrInvalidStream
+	}
+
+	var count int64
+	buf := make([]byte, encodeBufSize)
+	for {
+		itm, err := m.decodeItem(buf, br, format)
+		if err != nil {
+			if itm != nil {
+				m.freeItem(itm)
+			}
+			return count, err
+		}
+
+		if itm == nil {
+			return count, nil
+		}
+
+		if data := itm.Bytes(); fn == nil || fn(data) {
+			w.Upsert(data)
+			count++
+		}
+		m.freeItem(itm)
+	}
+}
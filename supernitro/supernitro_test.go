@@ -104,11 +104,11 @@ func doInsert(id int, db *SuperNitro, ch chan bool, wg *sync.WaitGroup, n int, i
 	w := db.NewWriter()
 	rnd := rand.New(rand.NewSource(int64(rand.Int())))
 	for i := 0; i < n; i++ {
-		var val int
+		var val int64
 		if isRand {
-			val = rnd.Int()%1000000000 + id*10000000000
+			val = rnd.Int63()%1000000000 + int64(id)*10000000000
 		} else {
-			val = i + id*n
+			val = int64(i + id*n)
 		}
 		if shouldSnap && i%100000 == 0 {
 			ch <- true
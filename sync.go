@@ -0,0 +1,146 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// syncMerkleDepth is the depth of the Merkle trees compared by SyncFrom
+const syncMerkleDepth = 12
+
+// Syncer is the peer of an anti-entropy sync, e.g., the client of a remote
+// replica
+type Syncer interface {
+	// MerkleTree returns the Merkle tree of the items of the peer
+	MerkleTree(depth int) (*MerkleTree, error)
+	// Range invokes fn for the items of the peer in the range [start, end)
+	// in key order. A nil start or end denotes an unbounded range. The item
+	// data is only valid during the callback.
+	Range(start, end []byte, fn func(itm []byte) bool) error
+}
+
+type snapshotSyncer struct {
+	snap *Snapshot
+}
+
+// SnapshotSyncer returns a Syncer which serves the items of a snapshot
+func SnapshotSyncer(snap *Snapshot) Syncer {
+	return snapshotSyncer{snap: snap}
+}
+
+func (s snapshotSyncer) MerkleTree(depth int) (*MerkleTree, error) {
+	return s.snap.MerkleTree(depth)
+}
+
+func (s snapshotSyncer) Range(start, end []byte, fn func(itm []byte) bool) error {
+	return s.snap.Range(start, end, fn)
+}
+
+// SyncStats describes the work done by SyncFrom
+type SyncStats struct {
+	// Merkle tree buckets in which the instances differed
+	Buckets int
+	// Items fetched from the peer
+	ItemsFetched int64
+	// Items inserted or replaced
+	ItemsInserted int64
+	// Items deleted
+	ItemsDeleted int64
+}
+
+func (s SyncStats) String() string {
+	return fmt.Sprintf("buckets = %d, items_fetched = %d, "+
+		"items_inserted = %d, items_deleted = %d",
+		s.Buckets, s.ItemsFetched, s.ItemsInserted, s.ItemsDeleted)
+}
+
+// SyncFrom repairs the instance from a peer, e.g., a replica after a
+// network partition. The Merkle trees of both instances are compared and
+// only the items of the buckets in which they differ are fetched from the
+// peer. Items missing from the peer are deleted, other items are replaced by
+// the items of the peer. The changes are visible in the next snapshot.
+//
+// The Merkle tree buckets assume that items are ordered bytewise. SyncFrom
+// creates a snapshot, it has the same restrictions as NewSnapshot.
+func (m *Nitro) SyncFrom(peer Syncer) (SyncStats, error) {
+	var sts SyncStats
+
+	snap, err := m.NewSnapshot()
+	if err != nil {
+		return sts, err
+	}
+	defer snap.Close()
+
+	local, err := snap.MerkleTree(syncMerkleDepth)
+	if err != nil {
+		return sts, err
+	}
+
+	remote, err := peer.MerkleTree(syncMerkleDepth)
+	if err != nil {
+		return sts, err
+	}
+
+	buckets, err := local.Diff(remote)
+	if err != nil || len(buckets) == 0 {
+		return sts, err
+	}
+
+	err = m.modify(1, func(put, del func([]byte)) error {
+		var items [][]byte
+		for _, b := range buckets {
+			sts.Buckets++
+			start, end := local.BucketRange(b)
+
+			items = items[:0]
+			if err := peer.Range(start, end, func(itm []byte) bool {
+				items = append(items, append([]byte(nil), itm...))
+				return true
+			}); err != nil {
+				return err
+			}
+			sts.ItemsFetched += int64(len(items))
+
+			// Merge the items of the bucket in key order
+			i := 0
+			if err := snap.Range(start, end, func(itm []byte) bool {
+				for ; i < len(items) && m.keyCmp(items[i], itm) < 0; i++ {
+					put(items[i])
+					sts.ItemsInserted++
+				}
+
+				if i < len(items) && m.keyCmp(items[i], itm) == 0 {
+					if !bytes.Equal(items[i], itm) {
+						put(items[i])
+						sts.ItemsInserted++
+					}
+					i++
+				} else {
+					del(itm)
+					sts.ItemsDeleted++
+				}
+				return true
+			}); err != nil {
+				return err
+			}
+
+			for ; i < len(items); i++ {
+				put(items[i])
+				sts.ItemsInserted++
+			}
+		}
+
+		return nil
+	})
+
+	return sts, err
+}
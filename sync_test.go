@@ -0,0 +1,72 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSyncFrom(t *testing.T) {
+	n := 20000
+	// Keys are spread over the Merkle tree buckets
+	key := func(i int, v string) []byte {
+		return []byte(fmt.Sprintf("%08x:%s", uint32(i)*2654435761, v))
+	}
+
+	peer := NewWithConfig(testConf)
+	defer peer.Close()
+	pw := peer.NewWriter()
+	for i := 0; i < n; i++ {
+		pw.Put(key(i, "v1"))
+	}
+	psnap, _ := peer.NewSnapshot()
+	defer psnap.Close()
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		switch {
+		case i == 100:
+			// Missing
+		case i == 200:
+			w.Put(key(i, "v2"))
+		default:
+			w.Put(key(i, "v1"))
+		}
+	}
+	w.Put([]byte("extra"))
+	snap, _ := db.NewSnapshot()
+	snap.Close()
+
+	sts, err := db.SyncFrom(SnapshotSyncer(psnap))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sts.ItemsInserted != 2 || sts.ItemsDeleted != 2 {
+		t.Errorf("Unexpected sync stats %v", sts)
+	}
+
+	if sts.ItemsFetched >= int64(n)/10 {
+		t.Errorf("Expected only the divergent buckets to be fetched, got %v", sts)
+	}
+
+	snap, _ = db.NewSnapshot()
+	defer snap.Close()
+	if snapChecksum(t, snap) != snapChecksum(t, psnap) {
+		t.Errorf("Expected instances to be in sync")
+	}
+
+	if sts, _ := db.SyncFrom(SnapshotSyncer(psnap)); sts.Buckets != 0 {
+		t.Errorf("Expected no differences, got %v", sts)
+	}
+}
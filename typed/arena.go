@@ -0,0 +1,182 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package typed
+
+import (
+	"bytes"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/elliotcourant/nitro/mm"
+)
+
+// ArenaStats describes the values held by a ValueArena
+type ArenaStats struct {
+	// Values is the number of distinct values stored
+	Values int64
+	// References is the number of references to the stored values
+	References int64
+	// StoredBytes is the size of the distinct values
+	StoredBytes int64
+	// SavedBytes is the size of the duplicate references which did not
+	// need to be stored
+	SavedBytes int64
+}
+
+// arenaValue is the header of a value block, the value bytes follow it
+type arenaValue struct {
+	refs int64
+	hash uint64
+	slot uint64
+	len  uint32
+}
+
+var arenaValueSize = unsafe.Sizeof(arenaValue{})
+
+func (v *arenaValue) bytes() (bs []byte) {
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&bs))
+	hdr.Data = uintptr(unsafe.Pointer(v)) + arenaValueSize
+	hdr.Len = int(v.len)
+	hdr.Cap = hdr.Len
+	return
+}
+
+// ValueArena stores values off-heap through the mm allocator and
+// deduplicates equal values. Every stored value is reference counted and
+// freed once its last reference is released. Values are addressed by
+// handles which stay valid until released. A handle is the index of the
+// value in the slot table, slots of freed values are reused.
+type ValueArena struct {
+	mu    sync.RWMutex
+	index map[uint64][]*arenaValue
+	slots []*arenaValue
+	free  []uint64
+	stats ArenaStats
+}
+
+// NewValueArena creates an empty ValueArena
+func NewValueArena() *ValueArena {
+	return &ValueArena{index: make(map[uint64][]*arenaValue)}
+}
+
+func hashValue(bs []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(bs)
+	return h.Sum64()
+}
+
+// Acquire returns the handle of a value equal to bs, storing a copy of bs
+// if there is none, and takes a reference to it.
+func (a *ValueArena) Acquire(bs []byte) uint64 {
+	hash := hashValue(bs)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stats.References++
+	for _, v := range a.index[hash] {
+		if bytes.Equal(v.bytes(), bs) {
+			v.refs++
+			a.stats.SavedBytes += int64(len(bs))
+			return v.slot
+		}
+	}
+
+	v := (*arenaValue)(mm.Malloc(int(arenaValueSize) + len(bs)))
+	*v = arenaValue{refs: 1, hash: hash, len: uint32(len(bs))}
+	copy(v.bytes(), bs)
+
+	if n := len(a.free); n > 0 {
+		v.slot = a.free[n-1]
+		a.free = a.free[:n-1]
+		a.slots[v.slot] = v
+	} else {
+		v.slot = uint64(len(a.slots))
+		a.slots = append(a.slots, v)
+	}
+
+	a.index[hash] = append(a.index[hash], v)
+	a.stats.Values++
+	a.stats.StoredBytes += int64(len(bs))
+	return v.slot
+}
+
+// Get returns the value of a handle. The returned slice refers to off-heap
+// memory and is only valid while the caller holds a reference.
+func (a *ValueArena) Get(h uint64) []byte {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.slots[h].bytes()
+}
+
+// Release drops a reference to the value of a handle
+func (a *ValueArena) Release(h uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	v := a.slots[h]
+
+	a.stats.References--
+	if v.refs--; v.refs > 0 {
+		a.stats.SavedBytes -= int64(v.len)
+		return
+	}
+
+	a.remove(v)
+}
+
+func (a *ValueArena) remove(v *arenaValue) {
+	vals := a.index[v.hash]
+	for i, x := range vals {
+		if x == v {
+			vals[i] = vals[len(vals)-1]
+			vals = vals[:len(vals)-1]
+			break
+		}
+	}
+
+	if len(vals) == 0 {
+		delete(a.index, v.hash)
+	} else {
+		a.index[v.hash] = vals
+	}
+
+	a.slots[v.slot] = nil
+	a.free = append(a.free, v.slot)
+	a.stats.Values--
+	a.stats.StoredBytes -= int64(v.len)
+	mm.Free(unsafe.Pointer(v))
+}
+
+// Stats returns the arena statistics
+func (a *ValueArena) Stats() ArenaStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stats
+}
+
+// Close frees all values regardless of their references
+func (a *ValueArena) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, vals := range a.index {
+		for _, v := range vals {
+			mm.Free(unsafe.Pointer(v))
+		}
+	}
+
+	a.index = make(map[uint64][]*arenaValue)
+	a.slots = nil
+	a.free = nil
+	a.stats = ArenaStats{}
+}
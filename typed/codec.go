@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package typed
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShortBuffer = errors.New("typed: short buffer")
+
+// Codec converts values of type T to and from bytes. Encode appends the
+// encoding of v to buf and returns the extended buffer.
+type Codec[T any] interface {
+	Encode(buf []byte, v T) []byte
+	Decode(b []byte) (T, error)
+}
+
+// BytesCodec stores byte slices as is. Decoded slices alias the item data
+// and are only valid while the snapshot they were read from is open.
+type BytesCodec struct{}
+
+// Encode appends v to buf
+func (BytesCodec) Encode(buf []byte, v []byte) []byte {
+	return append(buf, v...)
+}
+
+// Decode returns b
+func (BytesCodec) Decode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+// StringCodec stores strings as their bytes
+type StringCodec struct{}
+
+// Encode appends v to buf
+func (StringCodec) Encode(buf []byte, v string) []byte {
+	return append(buf, v...)
+}
+
+// Decode returns a copy of b as a string
+func (StringCodec) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// Uint64Codec stores integers in big endian byte order, so that the encoded
+// keys sort in numeric order with the default byte comparator
+type Uint64Codec struct{}
+
+// Encode appends v to buf
+func (Uint64Codec) Encode(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// Decode reads a big endian integer from b
+func (Uint64Codec) Decode(b []byte) (uint64, error) {
+	if len(b) < 8 {
+		return 0, errShortBuffer
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Int64Codec stores integers in big endian byte order with the sign bit
+// flipped, so that the encoded keys sort in numeric order with the default
+// byte comparator
+type Int64Codec struct{}
+
+// Encode appends v to buf
+func (Int64Codec) Encode(buf []byte, v int64) []byte {
+	return Uint64Codec{}.Encode(buf, uint64(v)^(1<<63))
+}
+
+// Decode reads an integer encoded by Encode from b
+func (Int64Codec) Decode(b []byte) (int64, error) {
+	v, err := Uint64Codec{}.Decode(b)
+	return int64(v ^ (1 << 63)), err
+}
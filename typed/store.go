@@ -0,0 +1,443 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package typed provides a type safe key/value API on top of Nitro.
+//
+// A Store encodes every key/value pair into a single Nitro item laid out as
+//
+//	[uvarint key length][key bytes][value bytes]
+//
+// and orders items by comparing the encoded keys with a user supplied
+// comparator, so that applications do not have to hand roll item framing
+// and comparators.
+//
+// With Options.CompressValues the value bytes are prefixed with a tag byte
+// and values above the threshold are stored as
+//
+//	[tag][uvarint value length][lz4 block]
+//
+// With Options.DedupValues the (compressed) value bytes are replaced by an
+// 8 byte handle of a value stored once in an off-heap ValueArena.
+package typed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"github.com/elliotcourant/nitro"
+	"github.com/elliotcourant/nitro/lz4"
+)
+
+var errBadItem = errors.New("typed: malformed item")
+
+// Value tags used with Options.CompressValues
+const (
+	valueRaw byte = iota
+	valueLZ4
+)
+
+// Options configures a Store
+type Options[K, V any] struct {
+	// Keys encodes and decodes keys
+	Keys Codec[K]
+	// Values encodes and decodes values
+	Values Codec[V]
+	// Compare orders encoded keys, bytes.Compare is used if nil
+	Compare nitro.KeyCompare
+	// Config is the configuration of the underlying Nitro instance. Its key
+	// comparator and item free callback are replaced by the Store.
+	Config nitro.Config
+	// CompressValues compresses encoded values of at least CompressValues
+	// bytes with lz4 when they are stored and decompresses them when they
+	// are read. 0 disables compression.
+	CompressValues int
+	// DedupValues stores equal values once in an off-heap ValueArena.
+	// Values are released when the items referring to them are reclaimed,
+	// which requires Config.UseMemoryMgmt; otherwise they are kept until
+	// the Store is closed.
+	DedupValues bool
+}
+
+// CompressionStats describes the values compressed by a Store
+type CompressionStats struct {
+	// Values is the number of compressed values
+	Values int64
+	// RawBytes is the size of the compressed values before compression
+	RawBytes int64
+	// CompressedBytes is the size of the compressed values
+	CompressedBytes int64
+	// Incompressible is the number of values above the threshold which
+	// were stored uncompressed as they did not shrink
+	Incompressible int64
+}
+
+// Ratio returns the compression ratio of the compressed values
+func (cs CompressionStats) Ratio() float64 {
+	if cs.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(cs.RawBytes) / float64(cs.CompressedBytes)
+}
+
+// Store is a typed key/value store backed by a Nitro instance
+type Store[K, V any] struct {
+	compression CompressionStats
+
+	db     *nitro.Nitro
+	keys   Codec[K]
+	values Codec[V]
+	cmp    nitro.KeyCompare
+	arena  *ValueArena
+
+	compressAt int
+}
+
+// New creates a Store. Options.Config should be obtained from
+// nitro.DefaultConfig.
+func New[K, V any](opts Options[K, V]) *Store[K, V] {
+	s := &Store[K, V]{
+		keys:       opts.Keys,
+		values:     opts.Values,
+		cmp:        opts.Compare,
+		compressAt: opts.CompressValues,
+	}
+
+	if s.cmp == nil {
+		s.cmp = bytes.Compare
+	}
+
+	cfg := opts.Config
+	cfg.SetKeyComparator(s.compareItems)
+	if opts.DedupValues {
+		s.arena = NewValueArena()
+		cfg.OnItemFree(s.releaseValue)
+	}
+
+	s.db = nitro.NewWithConfig(cfg)
+	return s
+}
+
+func (s *Store[K, V]) releaseValue(e *nitro.ItemEntry) {
+	if _, value, err := splitItem(e.Item().Bytes()); err == nil && len(value) == 8 {
+		s.arena.Release(binary.LittleEndian.Uint64(value))
+	}
+}
+
+// ValueStats returns the statistics of the value arena. They are empty
+// unless Options.DedupValues is set.
+func (s *Store[K, V]) ValueStats() ArenaStats {
+	if s.arena == nil {
+		return ArenaStats{}
+	}
+	return s.arena.Stats()
+}
+
+// CompressionStats returns the statistics of value compression
+func (s *Store[K, V]) CompressionStats() CompressionStats {
+	return CompressionStats{
+		Values:          atomic.LoadInt64(&s.compression.Values),
+		RawBytes:        atomic.LoadInt64(&s.compression.RawBytes),
+		CompressedBytes: atomic.LoadInt64(&s.compression.CompressedBytes),
+		Incompressible:  atomic.LoadInt64(&s.compression.Incompressible),
+	}
+}
+
+// DB returns the underlying Nitro instance
+func (s *Store[K, V]) DB() *nitro.Nitro {
+	return s.db
+}
+
+// Close shuts down the underlying Nitro instance
+func (s *Store[K, V]) Close() {
+	s.db.Close()
+	if s.arena != nil {
+		s.arena.Close()
+	}
+}
+
+func splitItem(itm []byte) (key, value []byte, err error) {
+	l, n := binary.Uvarint(itm)
+	if n <= 0 || uint64(len(itm)-n) < l {
+		return nil, nil, errBadItem
+	}
+
+	return itm[n : n+int(l)], itm[n+int(l):], nil
+}
+
+func itemKey(itm []byte) []byte {
+	key, _, err := splitItem(itm)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func (s *Store[K, V]) compareItems(a, b []byte) int {
+	return s.cmp(itemKey(a), itemKey(b))
+}
+
+// encodeItem frames the key and value into an item. The key is encoded after
+// a reserved length prefix which is moved into place once its size is known.
+func (s *Store[K, V]) encodeItem(buf []byte, k K, v *V) []byte {
+	const maxPrefix = binary.MaxVarintLen64
+
+	buf = append(buf[:0], make([]byte, maxPrefix)...)
+	buf = s.keys.Encode(buf, k)
+	kl := len(buf) - maxPrefix
+
+	var prefix [maxPrefix]byte
+	n := binary.PutUvarint(prefix[:], uint64(kl))
+	start := maxPrefix - n
+	copy(buf[start:], prefix[:n])
+	buf = buf[start:]
+
+	if v != nil {
+		buf = s.values.Encode(buf, *v)
+	}
+	return buf
+}
+
+func (s *Store[K, V]) decodeItem(itm []byte) (k K, v V, err error) {
+	key, value, err := splitItem(itm)
+	if err != nil {
+		return
+	}
+
+	if k, err = s.keys.Decode(key); err != nil {
+		return
+	}
+
+	v, err = s.decodeValue(value)
+	return
+}
+
+// decodeValue decodes the value part of an item, resolving arena handles
+// and decompressing values
+func (s *Store[K, V]) decodeValue(value []byte) (v V, err error) {
+	if s.arena != nil {
+		if len(value) != 8 {
+			return v, errBadItem
+		}
+		value = s.arena.Get(binary.LittleEndian.Uint64(value))
+	}
+
+	if s.compressAt > 0 {
+		if value, err = decompressValue(value); err != nil {
+			return
+		}
+	}
+
+	return s.values.Decode(value)
+}
+
+// compressValue appends the tagged value to dst, compressing it if it is
+// above the threshold and shrinks
+func (s *Store[K, V]) compressValue(dst, value []byte) []byte {
+	if len(value) >= s.compressAt {
+		dst = append(dst, valueLZ4)
+		dst = binary.AppendUvarint(dst, uint64(len(value)))
+		dst = lz4.Compress(dst, value)
+		if len(dst) <= len(value) {
+			atomic.AddInt64(&s.compression.Values, 1)
+			atomic.AddInt64(&s.compression.RawBytes, int64(len(value)))
+			atomic.AddInt64(&s.compression.CompressedBytes, int64(len(dst)))
+			return dst
+		}
+
+		atomic.AddInt64(&s.compression.Incompressible, 1)
+		dst = dst[:0]
+	}
+
+	return append(append(dst, valueRaw), value...)
+}
+
+func decompressValue(value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return nil, errBadItem
+	}
+
+	switch value[0] {
+	case valueRaw:
+		return value[1:], nil
+	case valueLZ4:
+		l, n := binary.Uvarint(value[1:])
+		if n <= 0 || l > uint64(lz4.DecompressBound(len(value)-1-n)) {
+			return nil, errBadItem
+		}
+
+		out, err := lz4.Decompress(make([]byte, 0, l), value[1+n:])
+		if err != nil || uint64(len(out)) != l {
+			return nil, errBadItem
+		}
+		return out, nil
+	}
+
+	return nil, errBadItem
+}
+
+// Writer is a typed wrapper around nitro.Writer. Like nitro.Writer, it is not
+// thread-safe and every concurrent goroutine should use its own Writer.
+type Writer[K, V any] struct {
+	s    *Store[K, V]
+	w    *nitro.Writer
+	buf  []byte
+	vbuf []byte
+	cbuf []byte
+}
+
+// NewWriter creates a Writer
+func (s *Store[K, V]) NewWriter() *Writer[K, V] {
+	return &Writer[K, V]{s: s, w: s.db.NewWriter()}
+}
+
+// Put stores v under k, replacing an existing value
+func (w *Writer[K, V]) Put(k K, v V) {
+	if w.s.arena == nil && w.s.compressAt == 0 {
+		w.buf = w.s.encodeItem(w.buf, k, &v)
+		w.w.Upsert(w.buf)
+		return
+	}
+
+	w.vbuf = w.s.values.Encode(w.vbuf[:0], v)
+	value := w.vbuf
+	if w.s.compressAt > 0 {
+		w.cbuf = w.s.compressValue(w.cbuf[:0], value)
+		value = w.cbuf
+	}
+
+	w.buf = w.s.encodeItem(w.buf, k, nil)
+	if w.s.arena == nil {
+		w.buf = append(w.buf, value...)
+		w.w.Upsert(w.buf)
+		return
+	}
+
+	h := w.s.arena.Acquire(value)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, h)
+	w.w.Upsert(w.buf)
+}
+
+// Delete removes k and reports whether it was present
+func (w *Writer[K, V]) Delete(k K) bool {
+	w.buf = w.s.encodeItem(w.buf, k, nil)
+	return w.w.Delete(w.buf)
+}
+
+// Snapshot is a typed wrapper around nitro.Snapshot
+type Snapshot[K, V any] struct {
+	s    *Store[K, V]
+	snap *nitro.Snapshot
+}
+
+// NewSnapshot creates an immutable snapshot of the store
+func (s *Store[K, V]) NewSnapshot() (*Snapshot[K, V], error) {
+	snap, err := s.db.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot[K, V]{s: s, snap: snap}, nil
+}
+
+// Close releases the snapshot
+func (snap *Snapshot[K, V]) Close() {
+	snap.snap.Close()
+}
+
+// Get returns the value stored under k
+func (snap *Snapshot[K, V]) Get(k K) (v V, found bool, err error) {
+	itr := snap.NewIterator()
+	if itr == nil {
+		return
+	}
+	defer itr.Close()
+
+	if itr.Seek(k); !itr.Valid() {
+		return
+	}
+
+	key := snap.s.encodeItem(nil, k, nil)
+	if snap.s.compareItems(itr.itr.Get(), key) != 0 {
+		return
+	}
+
+	_, v, err = snap.s.decodeItem(itr.itr.Get())
+	return v, err == nil, err
+}
+
+// Iterator is a typed wrapper around nitro.Iterator
+type Iterator[K, V any] struct {
+	s   *Store[K, V]
+	itr *nitro.Iterator
+	buf []byte
+}
+
+// NewIterator creates an iterator over the snapshot. It returns nil if the
+// snapshot has already been closed.
+func (snap *Snapshot[K, V]) NewIterator() *Iterator[K, V] {
+	itr := snap.snap.NewIterator()
+	if itr == nil {
+		return nil
+	}
+
+	return &Iterator[K, V]{s: snap.s, itr: itr}
+}
+
+// SeekFirst moves the iterator to the smallest key
+func (it *Iterator[K, V]) SeekFirst() {
+	it.itr.SeekFirst()
+}
+
+// Seek moves the iterator to k or the next bigger key
+func (it *Iterator[K, V]) Seek(k K) {
+	it.buf = it.s.encodeItem(it.buf, k, nil)
+	it.itr.Seek(it.buf)
+}
+
+// SetEnd sets an exclusive upper bound for the iteration
+func (it *Iterator[K, V]) SetEnd(k K) {
+	it.itr.SetEnd(it.s.encodeItem(nil, k, nil))
+}
+
+// Valid returns false when the iterator has reached the end
+func (it *Iterator[K, V]) Valid() bool {
+	return it.itr.Valid()
+}
+
+// Next moves the iterator to the next key
+func (it *Iterator[K, V]) Next() {
+	it.itr.Next()
+}
+
+// Key decodes the current key
+func (it *Iterator[K, V]) Key() (K, error) {
+	key, _, err := splitItem(it.itr.Get())
+	if err != nil {
+		var k K
+		return k, err
+	}
+	return it.s.keys.Decode(key)
+}
+
+// Value decodes the current value
+func (it *Iterator[K, V]) Value() (V, error) {
+	_, value, err := splitItem(it.itr.Get())
+	if err != nil {
+		var v V
+		return v, err
+	}
+	return it.s.decodeValue(value)
+}
+
+// Close releases the iterator
+func (it *Iterator[K, V]) Close() {
+	it.itr.Close()
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package typed
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elliotcourant/nitro"
+	"github.com/elliotcourant/nitro/mm"
+	"github.com/elliotcourant/nitro/skiplist"
+)
+
+func newTestStore() *Store[int64, string] {
+	return New(Options[int64, string]{
+		Keys:   Int64Codec{},
+		Values: StringCodec{},
+		Config: nitro.DefaultConfig(),
+	})
+}
+
+func TestStorePutGet(t *testing.T) {
+	s := newTestStore()
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := int64(-50); i < 50; i++ {
+		w.Put(i, fmt.Sprint("v", i))
+	}
+	w.Put(7, "replaced")
+	if !w.Delete(8) {
+		t.Errorf("expected delete to succeed")
+	}
+
+	snap, _ := s.NewSnapshot()
+	defer snap.Close()
+
+	if v, ok, err := snap.Get(7); !ok || err != nil || v != "replaced" {
+		t.Errorf("unexpected value %q %v %v", v, ok, err)
+	}
+
+	if _, ok, _ := snap.Get(8); ok {
+		t.Errorf("expected deleted key to be absent")
+	}
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+
+	count := 0
+	prev := int64(-51)
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		k, err := itr.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k <= prev {
+			t.Errorf("keys out of order %d <= %d", k, prev)
+		}
+		prev = k
+		count++
+	}
+
+	if count != 99 {
+		t.Errorf("expected 99 items, got %d", count)
+	}
+}
+
+func TestStoreRange(t *testing.T) {
+	s := newTestStore()
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := int64(0); i < 100; i++ {
+		w.Put(i, fmt.Sprint(i))
+	}
+
+	snap, _ := s.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+
+	itr.SetEnd(20)
+	var got []string
+	for itr.Seek(10); itr.Valid(); itr.Next() {
+		v, _ := itr.Value()
+		got = append(got, v)
+	}
+
+	if len(got) != 10 || got[0] != "10" || got[9] != "19" {
+		t.Errorf("unexpected range %v", got)
+	}
+}
+
+func TestStoreDedupValues(t *testing.T) {
+	cfg := nitro.DefaultConfig()
+	cfg.UseMemoryMgmt(mm.Malloc, mm.Free)
+	s := New(Options[int64, string]{
+		Keys:        Int64Codec{},
+		Values:      StringCodec{},
+		Config:      cfg,
+		DedupValues: true,
+	})
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := int64(0); i < 1000; i++ {
+		w.Put(i, fmt.Sprint("payload-", i%10))
+	}
+
+	sts := s.ValueStats()
+	if sts.Values != 10 || sts.References != 1000 || sts.SavedBytes != 990*9 {
+		t.Errorf("unexpected stats %+v", sts)
+	}
+
+	snap, _ := s.NewSnapshot()
+	if v, ok, err := snap.Get(123); !ok || err != nil || v != "payload-3" {
+		t.Errorf("unexpected value %q %v %v", v, ok, err)
+	}
+
+	for i := int64(0); i < 1000; i++ {
+		w.Delete(i)
+	}
+	snap.Close()
+
+	snap, _ = s.NewSnapshot()
+	snap.Close()
+	if !skiplist.MemoryMgmtSupported {
+		return
+	}
+
+	for i := 0; i < 100 && s.ValueStats().Values > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if sts := s.ValueStats(); sts.Values != 0 || sts.References != 0 {
+		t.Errorf("expected all values to be released, got %+v", sts)
+	}
+}
+
+func TestStoreCompressValues(t *testing.T) {
+	s := New(Options[int64, string]{
+		Keys:           Int64Codec{},
+		Values:         StringCodec{},
+		Config:         nitro.DefaultConfig(),
+		CompressValues: 64,
+	})
+	defer s.Close()
+
+	doc := strings.Repeat(`{"name":"nitro","kind":"document"},`, 50)
+	w := s.NewWriter()
+	for i := int64(0); i < 100; i++ {
+		w.Put(i, fmt.Sprint(i, doc))
+	}
+	w.Put(100, "small")
+
+	snap, _ := s.NewSnapshot()
+	defer snap.Close()
+
+	if v, ok, err := snap.Get(42); !ok || err != nil || v != fmt.Sprint(42, doc) {
+		t.Errorf("unexpected value of %d bytes %v %v", len(v), ok, err)
+	}
+
+	if v, ok, err := snap.Get(100); !ok || err != nil || v != "small" {
+		t.Errorf("unexpected value %q %v %v", v, ok, err)
+	}
+
+	sts := s.CompressionStats()
+	if sts.Values != 100 || sts.Incompressible != 0 || sts.Ratio() < 10 {
+		t.Errorf("unexpected stats %+v ratio %.2f", sts, sts.Ratio())
+	}
+
+	// A corrupt length must not be trusted for the allocation
+	corrupt := binary.AppendUvarint([]byte{valueLZ4}, 1<<40)
+	if _, err := decompressValue(append(corrupt, 0x10, 'a')); err != errBadItem {
+		t.Errorf("expected corrupt value to be rejected, got %v", err)
+	}
+}
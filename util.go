@@ -45,3 +45,28 @@ func (m *Nitro) partitionPivots(snap *Snapshot, nsplits int) []*Item {
 
 	return pivotItems
 }
+
+// rangePivots restricts partition pivots to the range [start, end). A nil
+// start or end leaves the range unbounded on that side.
+func (m *Nitro) rangePivots(pivots []*Item, start, end []byte) []*Item {
+	if start == nil && end == nil {
+		return pivots
+	}
+
+	inRange := []*Item{nil}
+	if start != nil {
+		inRange[0] = m.newItem(start, false)
+	}
+
+	for _, itm := range pivots[1 : len(pivots)-1] {
+		bs := itm.Bytes()
+		if (start == nil || m.keyCmp(bs, start) > 0) && (end == nil || m.keyCmp(bs, end) < 0) {
+			inRange = append(inRange, itm)
+		}
+	}
+
+	if end != nil {
+		return append(inRange, m.newItem(end, false))
+	}
+	return append(inRange, nil)
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// maxReportedItems bounds the items listed per kind of difference in a
+// BackupReport
+const maxReportedItems = 100
+
+// ErrKeyspaceBackup means a keyspace backup was passed to an operation on the
+// whole instance, e.g., it was verified against a snapshot of the instance
+var ErrKeyspaceBackup = fmt.Errorf("Operation is not supported for keyspace backups")
+
+// BackupReport lists the differences between a backup and a snapshot. Up to
+// 100 items are listed for every kind of difference.
+type BackupReport struct {
+	// Items in the backup
+	Items int64
+
+	// Items of the snapshot which are not in the backup
+	MissingCount int64
+	Missing      [][]byte
+	// Items of the backup which are not in the snapshot
+	ExtraCount int64
+	Extra      [][]byte
+	// Items of the backup which have the key of a snapshot item, but
+	// different contents
+	ModifiedCount int64
+	Modified      [][]byte
+}
+
+// OK reports whether the backup holds the items of the snapshot
+func (r *BackupReport) OK() bool {
+	return r.MissingCount == 0 && r.ExtraCount == 0 && r.ModifiedCount == 0
+}
+
+func (r *BackupReport) String() string {
+	return fmt.Sprintf("items = %d, missing = %d, extra = %d, modified = %d",
+		r.Items, r.MissingCount, r.ExtraCount, r.ModifiedCount)
+}
+
+func reportItem(items *[][]byte, count *int64, itm []byte) {
+	*count++
+	if len(*items) < maxReportedItems {
+		*items = append(*items, append([]byte(nil), itm...))
+	}
+}
+
+// VerifyBackup compares the data shards of a backup written by StoreToDisk
+// with a snapshot item by item, e.g., the snapshot the backup was taken
+// from. The delta shards are not compared, they hold the items written
+// while the backup was taken. The backup is streamed, it is not loaded into
+// memory.
+func VerifyBackup(dir string, snap *Snapshot) (*BackupReport, error) {
+	m := snap.db
+	datadir := filepath.Join(dir, "data")
+
+	hdr, err := readDumpHeader(dir)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Keyspace != "" {
+		return nil, ErrKeyspaceBackup
+	}
+	if hdr.MetadataSize != m.itemMetaSize {
+		return nil, ErrMetadataSizeMismatch
+	}
+
+	format, err := readDumpFormat(dir, m.dumpFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	bs, err := ioutil.ReadFile(filepath.Join(datadir, "files.json"))
+	if err == nil {
+		err = json.Unmarshal(bs, &files)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Every shard file is sorted, they are merged in key order
+	readers := make([]FileReader, len(files))
+	heads := make([]*Item, len(files))
+	defer func() {
+		for i, r := range readers {
+			if heads[i] != nil {
+				m.freeItem(heads[i])
+			}
+			if r != nil {
+				r.Close()
+			}
+		}
+	}()
+
+	for i, file := range files {
+		r := m.newFileReader(m.fileType, format)
+		if err := r.Open(filepath.Join(datadir, file)); err != nil {
+			return nil, err
+		}
+		readers[i] = r
+
+		if heads[i], err = r.ReadItem(); err != nil {
+			return nil, err
+		}
+	}
+
+	// next returns the shard with the smallest item or -1
+	next := func() int {
+		min := -1
+		for i, itm := range heads {
+			if itm != nil && (min < 0 || m.keyCmp(itm.Bytes(), heads[min].Bytes()) < 0) {
+				min = i
+			}
+		}
+		return min
+	}
+
+	advance := func(shard int) error {
+		m.freeItem(heads[shard])
+		var err error
+		heads[shard], err = readers[shard].ReadItem()
+		return err
+	}
+
+	r := &BackupReport{}
+	itr := snap.NewIterator()
+	if itr == nil {
+		snap.checkOpen()
+	}
+	defer itr.Close()
+
+	itr.SeekFirst()
+	for shard := next(); shard >= 0 || itr.Valid(); shard = next() {
+		var c int
+		switch {
+		case shard < 0:
+			c = 1
+		case !itr.Valid():
+			c = -1
+		default:
+			c = m.keyCmp(heads[shard].Bytes(), itr.Get())
+		}
+
+		if c <= 0 {
+			r.Items++
+		}
+
+		switch {
+		case c < 0:
+			reportItem(&r.Extra, &r.ExtraCount, heads[shard].Bytes())
+		case c > 0:
+			reportItem(&r.Missing, &r.MissingCount, itr.Get())
+		case !bytes.Equal(heads[shard].Bytes(), itr.Get()):
+			reportItem(&r.Modified, &r.ModifiedCount, heads[shard].Bytes())
+		}
+
+		if c <= 0 {
+			if err := advance(shard); err != nil {
+				return nil, err
+			}
+		}
+		if c >= 0 {
+			itr.Next()
+		}
+	}
+
+	if err := itr.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
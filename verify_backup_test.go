@@ -0,0 +1,60 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	// StoreToDisk closes the snapshot
+	snap.Open()
+	dir := t.TempDir()
+	if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := VerifyBackup(dir, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() || r.Items != 10000 {
+		t.Errorf("Expected backup to match, got %v", r)
+	}
+
+	w.Delete([]byte(fmt.Sprintf("key-%010d", 10)))
+	w.Delete([]byte(fmt.Sprintf("key-%010d", 20)))
+	w.Put([]byte("key-extra"))
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	if r, err = VerifyBackup(dir, snap2); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.OK() || r.ExtraCount != 2 || r.MissingCount != 1 || r.ModifiedCount != 0 {
+		t.Errorf("Unexpected report %v", r)
+	}
+
+	if string(r.Missing[0]) != "key-extra" || string(r.Extra[1]) != fmt.Sprintf("key-%010d", 20) {
+		t.Errorf("Unexpected items %q, %q", r.Missing, r.Extra)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elliotcourant/nitro/skiplist"
+)
+
+// SessionWatchdogCallback is called for a barrier session which has not
+// terminated within the watchdog timeout
+type SessionWatchdogCallback func(skiplist.StaleSession)
+
+// SetSessionWatchdog reports the barrier sessions of the item store which
+// have not terminated within timeout after they were closed, usually because
+// an iterator was not closed. Until such a session terminates, no deleted
+// item can be reclaimed. Every session is reported once. In debug mode, the
+// reports include the creation stacks of the iterators in the session.
+// Sessions are only used with UseMemoryMgmt.
+func (cfg *Config) SetSessionWatchdog(timeout time.Duration, fn SessionWatchdogCallback) {
+	cfg.watchdogTimeout = timeout
+	cfg.onStaleSession = fn
+}
+
+type sessionWatchdog struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (m *Nitro) startSessionWatchdog() {
+	m.watchdog.stop = make(chan struct{})
+	m.watchdog.wg.Add(1)
+	go m.sessionWatchdog()
+}
+
+func (m *Nitro) stopSessionWatchdog() {
+	if m.watchdog.stop != nil {
+		close(m.watchdog.stop)
+		m.watchdog.wg.Wait()
+	}
+}
+
+func (m *Nitro) sessionWatchdog() {
+	defer m.watchdog.wg.Done()
+	ticker := time.NewTicker(m.watchdogTimeout / 2)
+	defer ticker.Stop()
+
+	reported := make(map[uint64]bool)
+	for {
+		select {
+		case <-ticker.C:
+			stale := m.store.GetAccesBarrier().StaleSessions(m.watchdogTimeout)
+			current := make(map[uint64]bool, len(stale))
+			for _, ss := range stale {
+				current[ss.Seqno] = true
+				if !reported[ss.Seqno] {
+					m.onStaleSession(ss)
+				}
+			}
+			reported = current
+		case <-m.watchdog.stop:
+			return
+		}
+	}
+}
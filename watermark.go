@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// MemoryWatermarkJob is the name of the maintenance job of
+// SetMemoryWatermarks
+const MemoryWatermarkJob = "memory-watermarks"
+
+// MemoryWatermarkCallback is called with the MemoryInUse of an instance when
+// it crosses a memory watermark
+type MemoryWatermarkCallback func(inUse int64)
+
+// SetMemoryWatermarks checks the MemoryInUse of the instance against a low
+// and a high watermark every interval, e.g., to drop caches, spill to disk
+// or pause ingestion before a hard quota is reached. Once the memory usage
+// reaches high, the instance is under memory pressure until it falls to low
+// or below, so that a usage hovering around a single threshold does not
+// flap. A low watermark above high is lowered to high. The checks are a
+// maintenance job named MemoryWatermarkJob.
+func (cfg *Config) SetMemoryWatermarks(low, high int64, interval time.Duration) {
+	if low > high {
+		low = high
+	}
+	cfg.memoryLowWatermark = low
+	cfg.memoryHighWatermark = high
+	cfg.memoryWatermarkInterval = interval
+}
+
+// OnMemoryHighWatermark registers a callback invoked by the watermark job
+// when the memory usage of the instance reaches the high watermark
+func (cfg *Config) OnMemoryHighWatermark(fn MemoryWatermarkCallback) {
+	cfg.onMemoryHigh = fn
+}
+
+// OnMemoryLowWatermark registers a callback invoked by the watermark job
+// when the memory usage of the instance falls to the low watermark after it
+// has reached the high watermark
+func (cfg *Config) OnMemoryLowWatermark(fn MemoryWatermarkCallback) {
+	cfg.onMemoryLow = fn
+}
+
+func (m *Nitro) startWatermarkMonitor() {
+	m.AddJob(MemoryWatermarkJob, m.memoryWatermarkInterval, func(m *Nitro) error {
+		m.checkWatermarks()
+		return nil
+	})
+}
+
+func (m *Nitro) checkWatermarks() {
+	inUse := m.MemoryInUse()
+	if atomic.LoadInt32(&m.memoryPressure) == 0 {
+		if inUse >= m.memoryHighWatermark {
+			atomic.StoreInt32(&m.memoryPressure, 1)
+			if m.onMemoryHigh != nil {
+				m.onMemoryHigh(inUse)
+			}
+		}
+	} else if inUse <= m.memoryLowWatermark {
+		atomic.StoreInt32(&m.memoryPressure, 0)
+		if m.onMemoryLow != nil {
+			m.onMemoryLow(inUse)
+		}
+	}
+}
+
+// UnderMemoryPressure returns whether the memory usage of the instance has
+// reached the high watermark of SetMemoryWatermarks and not yet fallen to
+// the low watermark
+func (m *Nitro) UnderMemoryPressure() bool {
+	return atomic.LoadInt32(&m.memoryPressure) == 1
+}
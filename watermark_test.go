@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryWatermarks(t *testing.T) {
+	var high, low int32
+	conf := testConf
+	conf.SetMemoryWatermarks(64<<10, 256<<10, time.Millisecond)
+	conf.OnMemoryHighWatermark(func(inUse int64) {
+		if inUse < 256<<10 {
+			t.Errorf("Unexpected high watermark callback at %d", inUse)
+		}
+		atomic.AddInt32(&high, 1)
+	})
+	conf.OnMemoryLowWatermark(func(inUse int64) {
+		if inUse > 64<<10 {
+			t.Errorf("Unexpected low watermark callback at %d", inUse)
+		}
+		atomic.AddInt32(&low, 1)
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n := 0
+	for db.MemoryInUse() < 256<<10 {
+		for i := 0; i < 100; i++ {
+			w.Put([]byte(fmt.Sprintf("%0100d", n)))
+			n++
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !db.UnderMemoryPressure() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !db.UnderMemoryPressure() || atomic.LoadInt32(&high) != 1 {
+		t.Fatalf("Expected the high watermark to be reached")
+	}
+
+	// Usage between the watermarks keeps the pressure
+	for i := 0; i < n/2; i++ {
+		w.Delete([]byte(fmt.Sprintf("%0100d", i)))
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !db.UnderMemoryPressure() || atomic.LoadInt32(&low) != 0 {
+		t.Errorf("Expected the memory pressure to remain above the low watermark")
+	}
+
+	for i := n / 2; i < n; i++ {
+		w.Delete([]byte(fmt.Sprintf("%0100d", i)))
+	}
+	for db.UnderMemoryPressure() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	h, l := atomic.LoadInt32(&high), atomic.LoadInt32(&low)
+	if db.UnderMemoryPressure() || h != 1 || l != 1 {
+		t.Errorf("Expected the low watermark to be reached once, got %d high, %d low", h, l)
+	}
+}
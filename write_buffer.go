@@ -0,0 +1,288 @@
+package nitro
+
+import (
+	"sort"
+	"sync"
+)
+
+// writeBuffer is a write-behind buffer in front of the file block manager.
+// Written blocks are kept in memory and flushed by a background goroutine,
+// adjacent blocks of a shard are coalesced into a single sequential write.
+// Reads and deletes of blocks which are not flushed yet are served from the
+// buffer.
+type writeBuffer struct {
+	fbm    *fileBlockManager
+	size   int64
+	shards []writeBufferShard
+	pool   sync.Pool
+
+	flushch chan int
+	stopch  chan struct{}
+	wg      sync.WaitGroup
+
+	errLock sync.Mutex
+	err     error
+}
+
+type writeBufferShard struct {
+	// Serializes flushes and deletes of a shard
+	flushLock sync.Mutex
+
+	sync.Mutex
+	pending  map[int64][]byte
+	flushing map[int64][]byte
+	size     int64
+	queued   bool
+}
+
+func newWriteBuffer(fbm *fileBlockManager, size int) *writeBuffer {
+	wb := &writeBuffer{
+		fbm:     fbm,
+		size:    int64(size),
+		shards:  make([]writeBufferShard, len(fbm.wfds)),
+		flushch: make(chan int, len(fbm.wfds)),
+		stopch:  make(chan struct{}),
+	}
+
+	wb.pool.New = func() interface{} {
+		return make([]byte, fbm.blockSize)
+	}
+
+	for i := range wb.shards {
+		wb.shards[i].pending = make(map[int64][]byte)
+	}
+
+	wb.wg.Add(1)
+	go wb.flusher()
+
+	return wb
+}
+
+func (wb *writeBuffer) flusher() {
+	defer wb.wg.Done()
+	for {
+		select {
+		case shard := <-wb.flushch:
+			wb.flushShard(shard)
+		case <-wb.stopch:
+			return
+		}
+	}
+}
+
+func (wb *writeBuffer) setErr(err error) {
+	wb.errLock.Lock()
+	defer wb.errLock.Unlock()
+	if wb.err == nil {
+		wb.err = err
+	}
+}
+
+func (wb *writeBuffer) getErr() error {
+	wb.errLock.Lock()
+	defer wb.errLock.Unlock()
+	return wb.err
+}
+
+func (wb *writeBuffer) WriteBlock(bs []byte, shard int) (blockPtr, error) {
+	if err := wb.getErr(); err != nil {
+		return 0, err
+	}
+
+	shard = shard % len(wb.shards)
+	pos := wb.fbm.allocBlock(shard)
+	buf := wb.pool.Get().([]byte)
+	buf = buf[:copy(buf, bs)]
+
+	sh := &wb.shards[shard]
+	sh.Lock()
+	sh.pending[pos] = buf
+	sh.size += wb.fbm.blockSize
+	// Writers flush by themselves if the flusher cannot keep up
+	mustFlush := sh.size >= 2*wb.size
+	queue := !sh.queued && sh.size >= wb.size
+	if queue {
+		sh.queued = true
+	}
+	sh.Unlock()
+
+	if mustFlush {
+		if err := wb.flushShard(shard); err != nil {
+			return 0, err
+		}
+	} else if queue {
+		wb.flushch <- shard
+	}
+
+	return newBlockPtr(shard, pos), nil
+}
+
+func (wb *writeBuffer) ReadBlock(bptr blockPtr, buf []byte) error {
+	sh := &wb.shards[bptr.Shard()]
+	sh.Lock()
+	bs, ok := sh.pending[bptr.Offset()]
+	if !ok {
+		bs, ok = sh.flushing[bptr.Offset()]
+	}
+
+	if ok {
+		n := copy(buf, bs)
+		for ; n < len(buf); n++ {
+			buf[n] = 0
+		}
+	}
+	sh.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	return wb.fbm.ReadBlock(bptr, buf)
+}
+
+func (wb *writeBuffer) DeleteBlock(bptr blockPtr) error {
+	sh := &wb.shards[bptr.Shard()]
+	sh.flushLock.Lock()
+	defer sh.flushLock.Unlock()
+
+	sh.Lock()
+	if bs, ok := sh.pending[bptr.Offset()]; ok {
+		delete(sh.pending, bptr.Offset())
+		sh.size -= wb.fbm.blockSize
+		wb.pool.Put(bs[:cap(bs)])
+	}
+	sh.Unlock()
+
+	return wb.fbm.DeleteBlock(bptr)
+}
+
+// flushShard writes out the pending blocks of a shard
+func (wb *writeBuffer) flushShard(shard int) error {
+	sh := &wb.shards[shard]
+	sh.flushLock.Lock()
+	defer sh.flushLock.Unlock()
+
+	sh.Lock()
+	blocks := sh.pending
+	sh.queued = false
+	sh.flushing = blocks
+	sh.pending = make(map[int64][]byte)
+	sh.size = 0
+	sh.Unlock()
+
+	if len(blocks) == 0 {
+		sh.Lock()
+		sh.flushing = nil
+		sh.Unlock()
+		return nil
+	}
+
+	err := wb.writeBlocks(shard, blocks)
+
+	sh.Lock()
+	sh.flushing = nil
+	if err != nil {
+		// Keep the blocks readable, they are retried by the next flush
+		for pos, bs := range blocks {
+			sh.pending[pos] = bs
+			sh.size += wb.fbm.blockSize
+		}
+	}
+	sh.Unlock()
+
+	if err != nil {
+		wb.setErr(err)
+		return err
+	}
+
+	for _, bs := range blocks {
+		wb.pool.Put(bs[:cap(bs)])
+	}
+
+	return nil
+}
+
+// writeBlocks writes runs of adjacent blocks with a single write each
+func (wb *writeBuffer) writeBlocks(shard int, blocks map[int64][]byte) error {
+	bsize := wb.fbm.blockSize
+	maxRun := int(wb.size / bsize)
+	if maxRun < 1 {
+		maxRun = 1
+	}
+
+	offsets := make([]int64, 0, len(blocks))
+	for pos := range blocks {
+		offsets = append(offsets, pos)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	fd := wb.fbm.wfds[shard]
+	var iobuf, cbuf []byte
+	if wb.fbm.cipher != nil {
+		cbuf = make([]byte, bsize)
+	}
+
+	block := func(pos int64) []byte {
+		if cbuf != nil {
+			return wb.fbm.cipher.Seal(cbuf, blocks[pos], shard, pos)
+		}
+		return blocks[pos]
+	}
+
+	for i := 0; i < len(offsets); {
+		j := i + 1
+		for j < len(offsets) && j-i < maxRun && offsets[j] == offsets[j-1]+bsize {
+			j++
+		}
+
+		var data []byte
+		if j-i == 1 {
+			data = block(offsets[i])
+		} else {
+			if iobuf == nil {
+				iobuf = make([]byte, int64(maxRun)*bsize)
+			}
+
+			var n int
+			for k := i; k < j; k++ {
+				off := int(offsets[k] - offsets[i])
+				n = off + copy(iobuf[off:], block(offsets[k]))
+				// Blocks may be partially written
+				for z := n; z < off+int(bsize) && k < j-1; z++ {
+					iobuf[z] = 0
+				}
+			}
+			data = iobuf[:n]
+		}
+
+		if _, err := fd.WriteAt(data, offsets[i]); err != nil {
+			return err
+		}
+
+		i = j
+	}
+
+	return nil
+}
+
+// Sync flushes all buffered blocks and commits them to stable storage
+func (wb *writeBuffer) Sync() error {
+	for i := range wb.shards {
+		if err := wb.flushShard(i); err != nil {
+			return err
+		}
+	}
+
+	if err := wb.getErr(); err != nil {
+		return err
+	}
+
+	return wb.fbm.Sync()
+}
+
+// Close stops the flusher and flushes all buffered blocks
+func (wb *writeBuffer) Close() error {
+	close(wb.stopch)
+	wb.wg.Wait()
+	return wb.Sync()
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package xxhash implements the 64 bit xxHash (XXH64) hash function with a
+// seed of 0.
+//
+// Digests are compatible with the reference implementation, so that they can
+// be compared across processes and machines.
+package xxhash
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The primes are variables so that the seed arithmetic wraps around
+var (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// Size is the size of a digest in bytes
+const Size = 8
+
+const stripeSize = 32
+
+// Digest computes the hash of a stream of writes. The zero value is not
+// ready for use, use New.
+type Digest struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [stripeSize]byte
+	n              int // bytes buffered in mem
+}
+
+// New returns a Digest ready for writes
+func New() *Digest {
+	d := &Digest{}
+	d.Reset()
+	return d
+}
+
+// Reset discards the written data
+func (d *Digest) Reset() {
+	d.v1 = prime1 + prime2
+	d.v2 = prime2
+	d.v3 = 0
+	d.v4 = -prime1
+	d.total = 0
+	d.n = 0
+}
+
+// Size implements hash.Hash
+func (d *Digest) Size() int {
+	return Size
+}
+
+// BlockSize implements hash.Hash
+func (d *Digest) BlockSize() int {
+	return stripeSize
+}
+
+// Write adds b to the hashed data. It never fails.
+func (d *Digest) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+
+	if d.n+n < stripeSize {
+		d.n += copy(d.mem[d.n:], b)
+		return n, nil
+	}
+
+	if d.n > 0 {
+		c := copy(d.mem[d.n:], b)
+		d.stripe(d.mem[:])
+		b = b[c:]
+		d.n = 0
+	}
+
+	for ; len(b) >= stripeSize; b = b[stripeSize:] {
+		d.stripe(b)
+	}
+
+	d.n = copy(d.mem[:], b)
+	return n, nil
+}
+
+// WriteString adds s to the hashed data
+func (d *Digest) WriteString(s string) (int, error) {
+	return d.Write([]byte(s))
+}
+
+func (d *Digest) stripe(b []byte) {
+	d.v1 = round(d.v1, binary.LittleEndian.Uint64(b[0:8]))
+	d.v2 = round(d.v2, binary.LittleEndian.Uint64(b[8:16]))
+	d.v3 = round(d.v3, binary.LittleEndian.Uint64(b[16:24]))
+	d.v4 = round(d.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+// Sum64 returns the hash of the data written so far
+func (d *Digest) Sum64() uint64 {
+	var h uint64
+	if d.total >= stripeSize {
+		h = bits.RotateLeft64(d.v1, 1) + bits.RotateLeft64(d.v2, 7) +
+			bits.RotateLeft64(d.v3, 12) + bits.RotateLeft64(d.v4, 18)
+		h = mergeRound(h, d.v1)
+		h = mergeRound(h, d.v2)
+		h = mergeRound(h, d.v3)
+		h = mergeRound(h, d.v4)
+	} else {
+		h = prime5
+	}
+
+	h += d.total
+	return finalize(h, d.mem[:d.n])
+}
+
+// Sum appends the big endian hash to b
+func (d *Digest) Sum(b []byte) []byte {
+	var s [Size]byte
+	binary.BigEndian.PutUint64(s[:], d.Sum64())
+	return append(b, s[:]...)
+}
+
+// Sum64 returns the hash of b
+func Sum64(b []byte) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= stripeSize {
+		v1, v2, v3, v4 := prime1+prime2, prime2, uint64(0), -prime1
+		for ; len(b) >= stripeSize; b = b[stripeSize:] {
+			v1 = round(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = round(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = round(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = round(v4, binary.LittleEndian.Uint64(b[24:32]))
+		}
+
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = mergeRound(h, v1)
+		h = mergeRound(h, v2)
+		h = mergeRound(h, v3)
+		h = mergeRound(h, v4)
+	} else {
+		h = prime5
+	}
+
+	h += uint64(n)
+	return finalize(h, b)
+}
+
+// finalize mixes in the tail of the data, less than a stripe
+func finalize(h uint64, b []byte) uint64 {
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= round(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+	}
+
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime1
+		h = bits.RotateLeft64(h, 23)*prime2 + prime3
+		b = b[4:]
+	}
+
+	for _, c := range b {
+		h ^= uint64(c) * prime5
+		h = bits.RotateLeft64(h, 11) * prime1
+	}
+
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}
+
+func round(acc, input uint64) uint64 {
+	acc += input * prime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * prime1
+}
+
+func mergeRound(acc, val uint64) uint64 {
+	acc ^= round(0, val)
+	return acc*prime1 + prime4
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package xxhash
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSum64(t *testing.T) {
+	// Digests of the reference implementation
+	cases := []struct {
+		in   string
+		hash uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+	}
+
+	for _, c := range cases {
+		if h := Sum64([]byte(c.in)); h != c.hash {
+			t.Errorf("Sum64(%q) = %x, expected %x", c.in, h, c.hash)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, n := range []int{0, 1, 4, 8, 31, 32, 33, 64, 100, 1000} {
+		expected := Sum64(data[:n])
+		for _, chunk := range []int{1, 3, 7, 32, 50} {
+			d := New()
+			for b := data[:n]; len(b) > 0; {
+				c := chunk
+				if c > len(b) {
+					c = len(b)
+				}
+				d.Write(b[:c])
+				b = b[c:]
+			}
+
+			if h := d.Sum64(); h != expected {
+				t.Errorf("Digest of %d bytes in chunks of %d = %x, expected %x", n, chunk, h, expected)
+			}
+		}
+	}
+}